@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/crhym3/aegot/indexyaml"
+)
+
+var indexFile string
+
+// indexCommand runs tests, collecting composite indexes their datastore
+// queries need, and adds the missing ones to index.yaml.
+func indexCommand() {
+	tmp, err := ioutil.TempFile("", "aegot-index")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	goTest := []string{"go", "test"}
+	goTest = append(goTest, flags.Args()[1:]...)
+	err = execCmd(goTest, func(c *exec.Cmd) {
+		c.Env = appendToPathList(os.Environ(), "GOPATH", appengineDir)
+		c.Env = append(c.Env, indexyaml.LogEnv+"="+tmp.Name())
+	})
+	if err != nil {
+		// Indexes of queries that did run are still worth adding.
+		log.Printf("Tests failed: %v", err)
+	}
+
+	required, err := indexyaml.ReadLog(tmp.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	existing, err := readIndexes(indexFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	missing := missingIndexes(required, existing)
+	if len(missing) == 0 {
+		log.Printf("%s is up to date", indexFile)
+		return
+	}
+
+	content, err := ioutil.ReadFile(indexFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(indexFile, addIndexes(content, missing), 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Added %d index(es) to %s", len(missing), indexFile)
+}
+
+// addIndexes returns index.yaml content with missing index definitions
+// appended to it.
+func addIndexes(content []byte, missing []string) []byte {
+	var buf bytes.Buffer
+	buf.Write(content)
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	if !bytes.Contains(content, []byte("indexes:")) {
+		buf.WriteString("indexes:\n")
+	}
+	buf.WriteString("\n# Added by aet index\n")
+	buf.WriteString(strings.Join(missing, "\n"))
+	return buf.Bytes()
+}
+
+// readIndexes parses index definitions of index.yaml file at path.
+func readIndexes(path string) ([]*indexyaml.Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defs, err := indexyaml.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return defs, nil
+}
+
+// missingIndexes returns definitions of required indexes which none of
+// existing ones, nor a previous required index, can serve.
+func missingIndexes(required, existing []*indexyaml.Index) []string {
+	var missing []string
+	have := existing
+	for _, idx := range required {
+		found := false
+		for _, def := range have {
+			found = found || idx.SatisfiedBy(def)
+		}
+		if !found {
+			have = append(have, idx)
+			missing = append(missing, idx.String())
+		}
+	}
+	return missing
+}
+
+func init() {
+	flags.StringVar(&indexFile, "index", "index.yaml",
+		"index.yaml file \"aet index\" adds missing composite indexes to")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/crhym3/aegot/indexyaml"
+)
+
+func TestAddIndexes(t *testing.T) {
+	const (
+		def     = "- kind: Item\n  properties:\n  - name: N\n"
+		added   = "\n# Added by aet index\n" + def
+		defined = "indexes:\n\n- kind: Old\n  properties:\n  - name: X\n"
+	)
+	tests := []struct {
+		desc, content, want string
+	}{
+		{"no index.yaml", "", "indexes:\n" + added},
+		{"no indexes section", "# indexes\n", "# indexes\nindexes:\n" + added},
+		{"no indexes section nor newline", "# indexes", "# indexes\nindexes:\n" + added},
+		{"indexes section", defined, defined + added},
+		{"indexes section w/o newline", defined[:len(defined)-1], defined + added},
+	}
+	for _, tt := range tests {
+		got := string(addIndexes([]byte(tt.content), []string{def}))
+		if got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.desc, tt.want, got)
+		}
+		if _, err := indexyaml.Parse(strings.NewReader(got)); err != nil {
+			t.Errorf("%s: invalid index.yaml %q: %v", tt.desc, got, err)
+		}
+	}
+}
+
+func TestMissingIndexes(t *testing.T) {
+	item := func(eq int, props ...string) *indexyaml.Index {
+		idx := &indexyaml.Index{Kind: "Item", EqualityProps: eq}
+		for _, name := range props {
+			idx.Properties = append(idx.Properties, indexyaml.Property{Name: name})
+		}
+		return idx
+	}
+	existing := []*indexyaml.Index{item(0, "B", "A", "N")}
+	required := []*indexyaml.Index{
+		// equality properties in another order
+		item(2, "A", "B", "N"),
+		item(0, "N", "A"),
+		// the same one required twice
+		item(0, "N", "A"),
+	}
+	want := []string{item(0, "N", "A").String()}
+	if got := missingIndexes(required, existing); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected missing %q, got %q", want, got)
+	}
+}
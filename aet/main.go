@@ -12,8 +12,9 @@ import (
 var (
 	flags    = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	commands = map[string]func(){
-		"init": initSourcesCommand,
-		"test": runTestsCommand,
+		"init":  initSourcesCommand,
+		"test":  runTestsCommand,
+		"index": indexCommand,
 	}
 	// Expect appengine-go source files (repo) to be int appengineDir/src
 	appengineDir string
@@ -48,7 +49,7 @@ func init() {
 
 	flags.Usage = func() {
 		fmt.Fprintf(os.Stderr,
-			"Usage: %s [flags] {init|test} ./path/to/*_test.go\n", os.Args[0])
+			"Usage: %s [flags] {init|test|index} ./path/to/*_test.go\n", os.Args[0])
 		flags.PrintDefaults()
 	}
 }
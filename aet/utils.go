@@ -9,14 +9,18 @@ import (
 )
 
 func runCmd(args []string, f func(*exec.Cmd)) {
+	if err := execCmd(args, f); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func execCmd(args []string, f func(*exec.Cmd)) error {
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
 	if f != nil {
 		f(cmd)
 	}
-	if err := cmd.Run(); err != nil {
-		log.Fatal(err)
-	}
+	return cmd.Run()
 }
 
 func appendToPathList(env []string, key, val string) []string {
@@ -0,0 +1,207 @@
+// Package indexyaml parses and compares datastore composite index
+// definitions of index.yaml files. It's shared by testutils and aet tool.
+package indexyaml
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/crhym3/aegot/yaml"
+)
+
+// LogEnv is the name of environment variable "aet index" sets to the path of
+// a log tests append indexes their queries need to. See AppendLog.
+const LogEnv = "AEGOT_INDEX_LOG"
+
+// Index is a composite index definition.
+type Index struct {
+	Kind       string
+	Ancestor   bool
+	Properties []Property
+	// Number of leading Properties coming from equality filters of
+	// a query; their order in an index doesn't matter.
+	// It's not a part of index.yaml format and is 0 for parsed definitions.
+	EqualityProps int
+}
+
+// Property is a property of a composite index.
+type Property struct {
+	Name string
+	Desc bool
+}
+
+// String returns index definition in index.yaml format.
+func (idx *Index) String() string {
+	s := "- kind: " + idx.Kind + "\n"
+	if idx.Ancestor {
+		s += "  ancestor: yes\n"
+	}
+	if len(idx.Properties) > 0 {
+		s += "  properties:\n"
+	}
+	for _, p := range idx.Properties {
+		s += "  - name: " + p.Name + "\n"
+		if p.Desc {
+			s += "    direction: desc\n"
+		}
+	}
+	return s
+}
+
+// SatisfiedBy reports whether def can serve queries that need idx.
+func (idx *Index) SatisfiedBy(def *Index) bool {
+	if idx.Kind != def.Kind || idx.Ancestor != def.Ancestor ||
+		len(idx.Properties) != len(def.Properties) {
+		return false
+	}
+	eq := make(map[string]bool)
+	for _, p := range idx.Properties[:idx.EqualityProps] {
+		eq[p.Name] = true
+	}
+	for _, p := range def.Properties[:idx.EqualityProps] {
+		if !eq[p.Name] {
+			return false
+		}
+	}
+	for i := idx.EqualityProps; i < len(idx.Properties); i++ {
+		if idx.Properties[i] != def.Properties[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse parses composite index definitions in index.yaml format.
+func Parse(r io.Reader) ([]*Index, error) {
+	doc, err := yaml.Parse(r)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected indexes section")
+	}
+	for k := range m {
+		if k != "indexes" {
+			return nil, fmt.Errorf("unexpected %s", k)
+		}
+	}
+	list, ok := m["indexes"].([]interface{})
+	if !ok && m["indexes"] != nil {
+		return nil, fmt.Errorf("indexes must be a list")
+	}
+	defs := make([]*Index, len(list))
+	for i, v := range list {
+		if defs[i], err = parseIndex(v); err != nil {
+			return nil, fmt.Errorf("index #%d: %v", i+1, err)
+		}
+	}
+	return defs, nil
+}
+
+// parseIndex converts a decoded index definition.
+func parseIndex(v interface{}) (*Index, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a map, got %v", v)
+	}
+	idx := &Index{}
+	if idx.Kind, ok = m["kind"].(string); !ok || idx.Kind == "" {
+		return nil, fmt.Errorf("kind is required")
+	}
+	for k, v := range m {
+		switch k {
+		case "kind":
+		case "ancestor":
+			if idx.Ancestor, ok = v.(bool); !ok {
+				return nil, fmt.Errorf("ancestor must be yes or no")
+			}
+		case "properties":
+			props, ok := v.([]interface{})
+			if !ok && v != nil {
+				return nil, fmt.Errorf("properties must be a list")
+			}
+			for _, pv := range props {
+				p, err := parseProperty(pv)
+				if err != nil {
+					return nil, err
+				}
+				idx.Properties = append(idx.Properties, p)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %s", k)
+		}
+	}
+	return idx, nil
+}
+
+// parseProperty converts a decoded property of an index.
+func parseProperty(v interface{}) (Property, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return Property{}, fmt.Errorf("expected a property, got %v", v)
+	}
+	var p Property
+	if p.Name, ok = m["name"].(string); !ok || p.Name == "" {
+		return p, fmt.Errorf("property name is required")
+	}
+	for k, v := range m {
+		switch k {
+		case "name":
+		case "direction":
+			switch v {
+			case "asc", "ascending":
+			case "desc", "descending":
+				p.Desc = true
+			default:
+				return p, fmt.Errorf("invalid direction %v of %s", v, p.Name)
+			}
+		default:
+			return p, fmt.Errorf("unexpected %s in property %s", k, p.Name)
+		}
+	}
+	return p, nil
+}
+
+// AppendLog appends idx to a log of required indexes at path, creating
+// the file if it doesn't exist. Unlike index.yaml, the log keeps
+// EqualityProps of indexes.
+func AppendLog(path string, idx *Index) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// A single write so that concurrently running test binaries
+	// don't interleave their definitions.
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadLog reads indexes appended to a log with AppendLog.
+func ReadLog(path string) ([]*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var defs []*Index
+	dec := json.NewDecoder(f)
+	for {
+		idx := &Index{}
+		if err := dec.Decode(idx); err == io.EOF {
+			return defs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		defs = append(defs, idx)
+	}
+}
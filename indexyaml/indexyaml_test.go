@@ -0,0 +1,121 @@
+package indexyaml
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testIndexYAML = `indexes:
+
+# AUTOGENERATED
+- kind: Book
+  ancestor: yes
+  properties:
+  - name: author
+  - name: year
+    direction: desc
+
+- kind: Book
+  properties:
+  - name: title   # not the author
+  - name: author
+  - name: year
+`
+
+func TestParse(t *testing.T) {
+	defs, err := Parse(strings.NewReader(testIndexYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Index{
+		{Kind: "Book", Ancestor: true, Properties: []Property{{"author", false}, {"year", true}}},
+		{Kind: "Book", Properties: []Property{{"title", false}, {"author", false}, {"year", false}}},
+	}
+	if !reflect.DeepEqual(defs, want) {
+		t.Errorf("Expected %v, got %v", want, defs)
+	}
+	wantYAML := "- kind: Book\n  ancestor: yes\n  properties:\n  - name: author\n  - name: year\n    direction: desc\n"
+	if s := defs[0].String(); s != wantYAML {
+		t.Errorf("Expected:\n%s\ngot:\n%s", wantYAML, s)
+	}
+
+	// other ways to write the same definitions
+	flow := "indexes:\n- kind: Book\n  ancestor: true\n  properties: [{name: author}, {name: year, direction: descending}]\n" +
+		"- {kind: Book, ancestor: no, properties: [{name: title}, {name: author, direction: asc}, {name: year}]}\n"
+	if defs, err := Parse(strings.NewReader(flow)); err != nil || !reflect.DeepEqual(defs, want) {
+		t.Errorf("Expected %v, got %v (%v)", want, defs, err)
+	}
+	if defs, err := Parse(strings.NewReader("# no indexes yet\nindexes:\n")); err != nil || len(defs) != 0 {
+		t.Errorf("Expected no indexes, got %v (%v)", defs, err)
+	}
+
+	for _, bad := range []string{
+		"- name: author\n",
+		"indexes:\n- kind: Book\n  foo\n",
+		"indexes:\n- kind: Book\n  order: asc\n",
+		"indexes:\n- ancestor: yes\n",
+		"indexes:\n- kind: Book\n  ancestor: maybe\n",
+		"indexes:\n- kind: Book\n  properties:\n  - direction: asc\n",
+		"indexes:\n- kind: Book\n  properties:\n  - name: year\n    direction: up\n",
+		"indexes: Book\n",
+	} {
+		if _, err := Parse(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestSatisfiedBy(t *testing.T) {
+	idx := &Index{
+		Kind:          "Book",
+		Properties:    []Property{{"author", false}, {"title", false}, {"year", true}},
+		EqualityProps: 2,
+	}
+	tests := []struct {
+		def  *Index
+		want bool
+	}{
+		{&Index{Kind: "Book", Properties: []Property{{"author", false}, {"title", false}, {"year", true}}}, true},
+		// equality properties in any order
+		{&Index{Kind: "Book", Properties: []Property{{"title", false}, {"author", false}, {"year", true}}}, true},
+		{&Index{Kind: "Book", Properties: []Property{{"author", false}, {"year", true}, {"title", false}}}, false},
+		{&Index{Kind: "Book", Properties: []Property{{"author", false}, {"title", false}, {"year", false}}}, false},
+		{&Index{Kind: "Book", Ancestor: true, Properties: []Property{{"author", false}, {"title", false}, {"year", true}}}, false},
+		{&Index{Kind: "Author", Properties: []Property{{"author", false}, {"title", false}, {"year", true}}}, false},
+		{&Index{Kind: "Book", Properties: []Property{{"author", false}, {"title", false}}}, false},
+	}
+	for _, tt := range tests {
+		if got := idx.SatisfiedBy(tt.def); got != tt.want {
+			t.Errorf("SatisfiedBy(%v) = %v, expected %v", tt.def, got, tt.want)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "indexyaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	want := []*Index{
+		{Kind: "Book", Properties: []Property{{"author", false}, {"year", true}}, EqualityProps: 1},
+		{Kind: "Author", Ancestor: true, Properties: []Property{{"name", false}}},
+	}
+	for _, idx := range want {
+		if err := AppendLog(f.Name(), idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ReadLog(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
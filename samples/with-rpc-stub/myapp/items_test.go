@@ -2,6 +2,7 @@
 package myapp
 
 import (
+	"flag"
 	"testing"
 
 	"appengine"
@@ -11,6 +12,9 @@ import (
 	tu "github.com/crhym3/aegot/testutils"
 )
 
+// update makes AssertDatastoreGolden rewrite golden files.
+var update = flag.Bool("update", false, "rewrite golden files")
+
 func TestPutItem(t *testing.T) {
 	const (
 		itemId   = "some-id"
@@ -56,3 +60,62 @@ func TestPutItem(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestPutGetItem(t *testing.T) {
+	const itemId = "some-id"
+
+	_, unregister := tu.NewFakeDatastore()
+	defer unregister()
+
+	r, deleteContext := tu.NewTestRequest("PUT", "/"+itemId, nil)
+	defer deleteContext()
+	c := appengine.NewContext(r)
+
+	item := Item{Id: itemId, Name: "test"}
+	if err := item.put(c); err != nil {
+		t.Fatal(err)
+	}
+	fetched := &Item{Id: itemId}
+	if err := fetched.get(c); err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Name != item.Name {
+		t.Errorf("Expected %q, got %q", item.Name, fetched.Name)
+	}
+}
+
+func TestGetFixtureItem(t *testing.T) {
+	_, unregister := tu.NewFakeDatastore()
+	defer unregister()
+
+	r, deleteContext := tu.NewTestRequest("GET", "/existing-id", nil)
+	defer deleteContext()
+	c := appengine.NewContext(r)
+
+	if err := tu.LoadFixtures(c, "testdata/items.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	item := &Item{Id: "existing-id"}
+	if err := item.get(c); err != nil {
+		t.Fatal(err)
+	}
+	if item.Name != "Existing item" {
+		t.Errorf("Expected %q, got %q", "Existing item", item.Name)
+	}
+}
+
+func TestPutItemGolden(t *testing.T) {
+	_, unregister := tu.NewFakeDatastore()
+	defer unregister()
+
+	r, deleteContext := tu.NewTestRequest("PUT", "/some-id", nil)
+	defer deleteContext()
+
+	item := Item{Id: "some-id", Name: "test"}
+	if err := item.put(appengine.NewContext(r)); err != nil {
+		t.Fatal(err)
+	}
+	// Run "aet test ./myapp -update", or with AEGOT_UPDATE_GOLDEN=1,
+	// to rewrite testdata/after_put.golden
+	tu.AssertDatastoreGolden(t, "testdata/after_put.golden")
+}
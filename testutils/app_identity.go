@@ -0,0 +1,228 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	aei "appengine_internal"
+	pb "appengine_internal/app_identity"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// appIdentityService is the name of "app_identity" API service.
+	appIdentityService = "app_identity_service"
+	// defaultTokenExpiry is the lifetime of access tokens.
+	defaultTokenExpiry = time.Hour
+	// certCacheTime is how long clients may cache public certificates.
+	certCacheTime = 3600
+)
+
+var (
+	// appKey and appCert are generated once per test binary run,
+	// since generating an RSA key takes a while.
+	appKeyOnce sync.Once
+	appKey     *rsa.PrivateKey
+	appCertPEM string
+	appKeyName string
+)
+
+// FakeAppIdentity is an implementation of "app_identity_service" with a real
+// RSA key: SignForApp signs with it, and GetPublicCertificatesForApp returns
+// a self-signed certificate of its public key, so signatures can be verified
+// as in production. GetAccessToken issues random tokens which can be checked
+// with LookupToken.
+type FakeAppIdentity struct {
+	mu     sync.Mutex
+	expiry time.Duration
+	// allowed scopes; nil means any
+	scopes map[string]bool
+	tokens map[string]*accessToken
+}
+
+type accessToken struct {
+	token   string
+	scopes  []string
+	expires time.Time
+}
+
+// NewFakeAppIdentity creates an app identity service and registers it
+// as "app_identity_service" implementation. Access tokens expire in 1 hour
+// and can have any scopes, unless configured otherwise.
+//
+// Returns the service and a function that unregisters it. Here's an example:
+//
+// 		func TestSignedRequest(t *testing.T) {
+// 			_, unregister := NewFakeAppIdentity()
+// 			defer unregister()
+//
+// 			// test code that calls appengine.SignBytes and verifies
+// 			// the signature with appengine.PublicCertificates
+// 		}
+//
+func NewFakeAppIdentity() (*FakeAppIdentity, func()) {
+	appKeyOnce.Do(generateAppKey)
+	fa := &FakeAppIdentity{
+		expiry: defaultTokenExpiry,
+		tokens: make(map[string]*accessToken),
+	}
+	unregister := registerServiceOverrides(appIdentityService, map[string]RpcStubFunc{
+		"SignForApp":                  fa.signForApp,
+		"GetPublicCertificatesForApp": fa.getPublicCertificates,
+		"GetServiceAccountName":       fa.getServiceAccountName,
+		"GetAccessToken":              fa.getAccessToken,
+	})
+	return fa, unregister
+}
+
+// SetTokenExpiry changes the lifetime of access tokens issued from now on.
+func (fa *FakeAppIdentity) SetTokenExpiry(d time.Duration) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	fa.expiry = d
+}
+
+// AllowScopes limits scopes of access tokens. Requests for tokens with
+// other scopes fail with UNKNOWN_SCOPE error.
+func (fa *FakeAppIdentity) AllowScopes(scopes ...string) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	fa.scopes = make(map[string]bool)
+	for _, s := range scopes {
+		fa.scopes[s] = true
+	}
+}
+
+// LookupToken returns scopes of an access token issued by fa.
+// ok is false if the token is unknown or expired.
+func (fa *FakeAppIdentity) LookupToken(token string) (scopes []string, expires time.Time, ok bool) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	for _, t := range fa.tokens {
+		if t.token == token && time.Now().Before(t.expires) {
+			return append([]string(nil), t.scopes...), t.expires, true
+		}
+	}
+	return nil, time.Time{}, false
+}
+
+// generateAppKey creates appKey and a certificate for it.
+func generateAppKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: "testutils app identity"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	h := sha256.New()
+	h.Write(der)
+	appKey = key
+	appCertPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	appKeyName = fmt.Sprintf("%x", h.Sum(nil))[:40]
+}
+
+func (fa *FakeAppIdentity) signForApp(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.SignForAppRequest), out.(*pb.SignForAppResponse)
+	h := sha256.New()
+	h.Write(req.BytesToSign)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, appKey, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return appIdentityError(pb.AppIdentityServiceError_UNKNOWN_ERROR, err.Error())
+	}
+	resp.KeyName = proto.String(appKeyName)
+	resp.SignatureBytes = sig
+	return nil
+}
+
+func (fa *FakeAppIdentity) getPublicCertificates(in, out proto.Message, _ *RpcCallOptions) error {
+	resp := out.(*pb.GetPublicCertificateForAppResponse)
+	resp.PublicCertificateList = []*pb.PublicCertificate{{
+		KeyName:            proto.String(appKeyName),
+		X509CertificatePem: proto.String(appCertPEM),
+	}}
+	resp.MaxClientCacheTimeInSecond = proto.Int64(certCacheTime)
+	return nil
+}
+
+func (fa *FakeAppIdentity) getServiceAccountName(in, out proto.Message, _ *RpcCallOptions) error {
+	resp := out.(*pb.GetServiceAccountNameResponse)
+	resp.ServiceAccountName = proto.String(serviceAccountName())
+	return nil
+}
+
+func (fa *FakeAppIdentity) getAccessToken(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.GetAccessTokenRequest), out.(*pb.GetAccessTokenResponse)
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	scopes := append([]string(nil), req.Scope...)
+	if len(scopes) == 0 {
+		return appIdentityError(pb.AppIdentityServiceError_UNKNOWN_SCOPE, "no scopes")
+	}
+	for _, s := range scopes {
+		if fa.scopes != nil && !fa.scopes[s] {
+			return appIdentityError(pb.AppIdentityServiceError_UNKNOWN_SCOPE, s)
+		}
+	}
+	sort.Strings(scopes)
+	// Like in production, a token is reused until it expires.
+	id := strings.Join(scopes, " ")
+	t := fa.tokens[id]
+	if t == nil || !time.Now().Before(t.expires) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return appIdentityError(pb.AppIdentityServiceError_UNKNOWN_ERROR, err.Error())
+		}
+		t = &accessToken{
+			token:   fmt.Sprintf("ya29.test-%x", b),
+			scopes:  scopes,
+			expires: time.Now().Add(fa.expiry),
+		}
+		fa.tokens[id] = t
+	}
+	resp.AccessToken = proto.String(t.token)
+	resp.ExpirationTime = proto.Int64(t.expires.Unix())
+	return nil
+}
+
+// serviceAccountName returns the service account of the app.
+func serviceAccountName() string {
+	id := appID()
+	if i := strings.Index(id, ":"); i >= 0 {
+		// domain apps, e.g. example.com:app
+		id = id[i+1:] + "." + id[:i]
+	}
+	return id + "@appspot.gserviceaccount.com"
+}
+
+// appIdentityError creates an API error with the given code.
+func appIdentityError(code pb.AppIdentityServiceError_ErrorCode, detail string) error {
+	return &aei.APIError{
+		Service: appIdentityService,
+		Code:    int32(code),
+		Detail:  detail,
+	}
+}
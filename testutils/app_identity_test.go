@@ -0,0 +1,122 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"reflect"
+	"testing"
+	"time"
+
+	aei "appengine_internal"
+	pb "appengine_internal/app_identity"
+)
+
+func TestAppIdentitySign(t *testing.T) {
+	_, unregister := NewFakeAppIdentity()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	sig := &pb.SignForAppResponse{}
+	if err := c.Call(appIdentityService, "SignForApp", &pb.SignForAppRequest{BytesToSign: []byte("hello")}, sig, nil); err != nil {
+		t.Fatal(err)
+	}
+	certs := &pb.GetPublicCertificateForAppResponse{}
+	if err := c.Call(appIdentityService, "GetPublicCertificatesForApp", &pb.GetPublicCertificateForAppRequest{}, certs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(certs.PublicCertificateList) != 1 || certs.GetMaxClientCacheTimeInSecond() != certCacheTime {
+		t.Fatalf("Expected 1 certificate, got %v", certs)
+	}
+	pc := certs.PublicCertificateList[0]
+	if pc.GetKeyName() != sig.GetKeyName() {
+		t.Errorf("Expected the signing key %q, got %q", sig.GetKeyName(), pc.GetKeyName())
+	}
+	block, _ := pem.Decode([]byte(pc.GetX509CertificatePem()))
+	if block == nil {
+		t.Fatalf("Invalid PEM certificate %q", pc.GetX509CertificatePem())
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	h.Write([]byte("hello"))
+	if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, h.Sum(nil), sig.SignatureBytes); err != nil {
+		t.Errorf("Signature verification failed: %v", err)
+	}
+
+	sa := &pb.GetServiceAccountNameResponse{}
+	if err := c.Call(appIdentityService, "GetServiceAccountName", &pb.GetServiceAccountNameRequest{}, sa, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := appID() + "@appspot.gserviceaccount.com"; sa.GetServiceAccountName() != want {
+		t.Errorf("Expected service account %s, got %s", want, sa.GetServiceAccountName())
+	}
+}
+
+func TestAppIdentityAccessToken(t *testing.T) {
+	fa, unregister := NewFakeAppIdentity()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	getToken := func(scopes ...string) (*pb.GetAccessTokenResponse, pb.AppIdentityServiceError_ErrorCode) {
+		resp := &pb.GetAccessTokenResponse{}
+		err := c.Call(appIdentityService, "GetAccessToken", &pb.GetAccessTokenRequest{Scope: scopes}, resp, nil)
+		if err == nil {
+			return resp, pb.AppIdentityServiceError_SUCCESS
+		}
+		apiErr, ok := err.(*aei.APIError)
+		if !ok || apiErr.Service != appIdentityService {
+			t.Fatalf("Expected an app identity API error, got %#v", err)
+		}
+		return resp, pb.AppIdentityServiceError_ErrorCode(apiErr.Code)
+	}
+
+	fa.AllowScopes("a", "b")
+	first, code := getToken("b", "a")
+	if code != pb.AppIdentityServiceError_SUCCESS {
+		t.Fatalf("Expected a token, got %v", code)
+	}
+	if exp := time.Unix(first.GetExpirationTime(), 0).Sub(time.Now()); exp < 59*time.Minute || exp > time.Hour {
+		t.Errorf("Expected a token to expire in 1h, got %v", exp)
+	}
+	scopes, _, ok := fa.LookupToken(first.GetAccessToken())
+	if !ok || !reflect.DeepEqual(scopes, []string{"a", "b"}) {
+		t.Errorf("Expected a token of scopes a and b, got %v (%v)", scopes, ok)
+	}
+	// the same scopes in any order get the same token
+	if second, _ := getToken("a", "b"); second.GetAccessToken() != first.GetAccessToken() {
+		t.Errorf("Expected token %s to be reused, got %s", first.GetAccessToken(), second.GetAccessToken())
+	}
+	if other, _ := getToken("a"); other.GetAccessToken() == first.GetAccessToken() {
+		t.Error("Expected a new token for other scopes")
+	}
+	if _, code := getToken("a", "c"); code != pb.AppIdentityServiceError_UNKNOWN_SCOPE {
+		t.Errorf("Expected UNKNOWN_SCOPE for a scope not allowed, got %v", code)
+	}
+	if _, code := getToken(); code != pb.AppIdentityServiceError_UNKNOWN_SCOPE {
+		t.Errorf("Expected UNKNOWN_SCOPE without scopes, got %v", code)
+	}
+	if _, _, ok := fa.LookupToken("ya29.unknown"); ok {
+		t.Error("Expected an unknown token not to be found")
+	}
+
+	// expired tokens are replaced
+	fa.SetTokenExpiry(-time.Second)
+	expired, _ := getToken("b")
+	if _, _, ok := fa.LookupToken(expired.GetAccessToken()); ok {
+		t.Error("Expected an expired token not to be found")
+	}
+	fa.SetTokenExpiry(time.Minute)
+	if fresh, _ := getToken("b"); fresh.GetAccessToken() == expired.GetAccessToken() {
+		t.Error("Expected a new token after the old one expired")
+	}
+}
@@ -0,0 +1,424 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+
+	aei "appengine_internal"
+	pb "appengine_internal/blobstore"
+	dspb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// blobInfoKind is the kind of datastore entities with blob metadata.
+	blobInfoKind = "__BlobInfo__"
+	// blobUploadPath is the URL path prefix of upload URLs.
+	blobUploadPath = "/_ah/upload/"
+	// maxBlobFetchSize is the most data FetchData returns at once.
+	maxBlobFetchSize = (1 << 20) - (1 << 15)
+	// blobCreationFormat is the format of X-AppEngine-Upload-Creation header.
+	blobCreationFormat = "2006-01-02 15:04:05.000000"
+)
+
+// FakeBlobstore is an implementation of "blobstore" service which keeps blobs
+// in memory. Like in production, blob metadata is stored as __BlobInfo__
+// entities, so that blobstore.Stat works, in the datastore created by
+// NewFakeDatastore. Blobs can't be created without one.
+//
+// Uploads to URLs created with blobstore.UploadURL are simulated with
+// UploadRequest. Cloud Storage buckets of upload URLs are ignored: files are
+// always stored as blobs.
+type FakeBlobstore struct {
+	mu    sync.Mutex
+	blobs map[appengine.BlobKey][]byte
+	// upload URLs by session ID
+	uploads map[string]*uploadSession
+}
+
+// uploadSession is an upload URL created with CreateUploadURL.
+type uploadSession struct {
+	successPath     string
+	maxBytes        int64
+	maxBytesPerBlob int64
+}
+
+// blobInfo is metadata of a blob, stored as __BlobInfo__ entity.
+type blobInfo struct {
+	key         appengine.BlobKey
+	contentType string
+	filename    string
+	size        int64
+	// hex encoded MD5 of the contents
+	md5     string
+	created time.Time
+	// Files API handle of blobs created with "file" service
+	creationHandle string
+}
+
+// currentBlobstore is the blobstore created by the last NewFakeBlobstore call
+// and not unregistered yet; guarded by currentMu.
+var currentBlobstore *FakeBlobstore
+
+// NewFakeBlobstore creates an empty blobstore and registers it as "blobstore"
+// service implementation.
+//
+// Returns the blobstore and a function that unregisters it. Here's an example:
+//
+// 		func TestAvatar(t *testing.T) {
+// 			_, unregisterDatastore := NewFakeDatastore()
+// 			defer unregisterDatastore()
+// 			bs, unregister := NewFakeBlobstore()
+// 			defer unregister()
+// 			key, _ := bs.CreateBlob("image/png", "avatar.png", png)
+//
+// 			// test code that serves the blob with blobstore.Send
+// 		}
+//
+func NewFakeBlobstore() (*FakeBlobstore, func()) {
+	bs := &FakeBlobstore{
+		blobs:   make(map[appengine.BlobKey][]byte),
+		uploads: make(map[string]*uploadSession),
+	}
+	unregister := registerServiceOverrides("blobstore", map[string]RpcStubFunc{
+		"CreateUploadURL": bs.createUploadURL,
+		"FetchData":       bs.fetchData,
+		"DeleteBlob":      bs.deleteBlob,
+	})
+	currentMu.Lock()
+	currentBlobstore = bs
+	currentMu.Unlock()
+	return bs, func() {
+		unregister()
+		currentMu.Lock()
+		if currentBlobstore == bs {
+			currentBlobstore = nil
+		}
+		currentMu.Unlock()
+	}
+}
+
+// Blob returns contents of a blob. ok is false if there's no such blob.
+func (bs *FakeBlobstore) Blob(key appengine.BlobKey) (data []byte, ok bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	data, ok = bs.blobs[key]
+	return data, ok
+}
+
+// CreateBlob stores data as a new blob, as if it were uploaded by a user,
+// and returns its key.
+func (bs *FakeBlobstore) CreateBlob(contentType, filename string, data []byte) (appengine.BlobKey, error) {
+	bi := newBlobInfo(contentType, filename, data)
+	if err := bs.store(bi, data); err != nil {
+		return "", err
+	}
+	return bi.key, nil
+}
+
+// UploadRequest simulates an upload to a URL created with blobstore.UploadURL.
+// r is a multipart/form-data POST to the upload URL, like a browser sends it.
+// File parts of r are stored as blobs, and the returned request is the one
+// App Engine sends to the success path: a POST with file parts replaced by
+// blob references, which blobstore.ParseUpload understands, and the other
+// form fields and headers of r. Like in production, an upload URL can only be
+// used once.
+//
+// Returns the request, with an associated appengine.Context, and a function
+// that removes the context, like NewTestRequest. Here's an example:
+//
+// 		var body bytes.Buffer
+// 		mw := multipart.NewWriter(&body)
+// 		fw, _ := mw.CreateFormFile("photo", "cat.jpg")
+// 		fw.Write(jpeg)
+// 		mw.WriteField("caption", "My cat")
+// 		mw.Close()
+// 		up, _ := http.NewRequest("POST", uploadURL.String(), &body)
+// 		up.Header.Set("Content-Type", mw.FormDataContentType())
+//
+// 		r, deleteContext, err := UploadRequest(up)
+// 		if err != nil {
+// 			t.Fatal(err)
+// 		}
+// 		defer deleteContext()
+// 		w := httptest.NewRecorder()
+// 		http.DefaultServeMux.ServeHTTP(w, r)
+//
+// It returns an error if there's no blobstore created by NewFakeBlobstore,
+// r is not an upload to one of its URLs, or the upload is larger than
+// the limits of the URL.
+func UploadRequest(r *http.Request) (*http.Request, func(), error) {
+	currentMu.Lock()
+	bs := currentBlobstore
+	currentMu.Unlock()
+	if bs == nil {
+		return nil, nil, errors.New("UploadRequest: no blobstore, call NewFakeBlobstore first")
+	}
+	if !strings.HasPrefix(r.URL.Path, blobUploadPath) {
+		return nil, nil, fmt.Errorf("UploadRequest: %s is not an upload URL", r.URL)
+	}
+	id := strings.TrimPrefix(r.URL.Path, blobUploadPath)
+	bs.mu.Lock()
+	s := bs.uploads[id]
+	delete(bs.uploads, id)
+	bs.mu.Unlock()
+	if s == nil {
+		return nil, nil, fmt.Errorf("UploadRequest: unknown or used upload URL %s", r.URL)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, fmt.Errorf("UploadRequest: %v", err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	var (
+		infos []*blobInfo
+		blobs [][]byte
+		total int64
+	)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("UploadRequest: %v", err)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, nil, fmt.Errorf("UploadRequest: %v", err)
+		}
+		disp := part.Header.Get("Content-Disposition")
+		_, params, err := mime.ParseMediaType(disp)
+		if err != nil {
+			return nil, nil, fmt.Errorf("UploadRequest: %v", err)
+		}
+		filename, isFile := params["filename"]
+		if !isFile {
+			// ParseUpload needs a content type of every part
+			h := make(textproto.MIMEHeader)
+			for k, v := range part.Header {
+				h[k] = v
+			}
+			if h.Get("Content-Type") == "" {
+				h.Set("Content-Type", "text/plain")
+			}
+			w, _ := mw.CreatePart(h)
+			w.Write(data)
+			continue
+		}
+		if filename == "" {
+			// no file selected
+			continue
+		}
+		size := int64(len(data))
+		if s.maxBytesPerBlob > 0 && size > s.maxBytesPerBlob {
+			return nil, nil, fmt.Errorf("UploadRequest: %s is larger than %d bytes", filename, s.maxBytesPerBlob)
+		}
+		total += size
+
+		ctype := part.Header.Get("Content-Type")
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		bi := newBlobInfo(ctype, filename, data)
+		w, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {fmt.Sprintf("message/external-body; blob-key=%q; access-type=%q", bi.key, "X-AppEngine-BlobKey")},
+			"Content-Disposition": {disp},
+		})
+		fmt.Fprintf(w, "Content-Type: %s\r\n", bi.contentType)
+		fmt.Fprintf(w, "Content-Length: %d\r\n", bi.size)
+		fmt.Fprintf(w, "Content-MD5: %s\r\n", base64.URLEncoding.EncodeToString([]byte(bi.md5)))
+		fmt.Fprintf(w, "X-AppEngine-Upload-Creation: %s\r\n", bi.created.Format(blobCreationFormat))
+		fmt.Fprintf(w, "Content-Disposition: %s\r\n\r\n", disp)
+		infos = append(infos, bi)
+		blobs = append(blobs, data)
+	}
+	if s.maxBytes > 0 && total > s.maxBytes {
+		return nil, nil, fmt.Errorf("UploadRequest: upload is larger than %d bytes", s.maxBytes)
+	}
+	mw.Close()
+
+	req, err := http.NewRequest("POST", s.successPath, &body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("UploadRequest: %v", err)
+	}
+	for k, v := range r.Header {
+		if k != "Content-Type" && k != "Content-Length" {
+			req.Header[k] = v
+		}
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Host = r.Host
+	for i, bi := range infos {
+		if err := bs.store(bi, blobs[i]); err != nil {
+			return nil, nil, fmt.Errorf("UploadRequest: %v", err)
+		}
+	}
+	CreateTestContext(req)
+	return req, func() {
+		DeleteTestContext(req)
+	}, nil
+}
+
+func (bs *FakeBlobstore) createUploadURL(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.CreateUploadURLRequest), out.(*pb.CreateUploadURLResponse)
+	id := randomString(24)
+	bs.mu.Lock()
+	bs.uploads[id] = &uploadSession{
+		successPath:     req.GetSuccessPath(),
+		maxBytes:        req.GetMaxUploadSizeBytes(),
+		maxBytesPerBlob: req.GetMaxUploadSizePerBlobBytes(),
+	}
+	bs.mu.Unlock()
+	resp.Url = proto.String("http://localhost" + blobUploadPath + id)
+	return nil
+}
+
+func (bs *FakeBlobstore) fetchData(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.FetchDataRequest), out.(*pb.FetchDataResponse)
+	start, end := req.GetStartIndex(), req.GetEndIndex()
+	if start < 0 || end < start {
+		return blobstoreError(pb.BlobstoreServiceError_DATA_INDEX_OUT_OF_RANGE)
+	}
+	if end-start+1 > maxBlobFetchSize {
+		return blobstoreError(pb.BlobstoreServiceError_BLOB_FETCH_SIZE_TOO_LARGE)
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	data, ok := bs.blobs[appengine.BlobKey(req.GetBlobKey())]
+	if !ok {
+		return blobstoreError(pb.BlobstoreServiceError_BLOB_NOT_FOUND)
+	}
+	n := int64(len(data))
+	if start > n {
+		start = n
+	}
+	if end >= n {
+		end = n - 1
+	}
+	resp.Data = append([]byte{}, data[start:end+1]...)
+	return nil
+}
+
+func (bs *FakeBlobstore) deleteBlob(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.DeleteBlobRequest)
+	bs.mu.Lock()
+	for _, k := range req.BlobKey {
+		delete(bs.blobs, appengine.BlobKey(k))
+	}
+	bs.mu.Unlock()
+
+	currentMu.Lock()
+	ds := currentDatastore
+	currentMu.Unlock()
+	if ds != nil {
+		app := fullAppID()
+		for _, k := range req.BlobKey {
+			ds.storeInternal(blobInfoKey(app, appengine.BlobKey(k)), nil)
+		}
+	}
+	return nil
+}
+
+// store saves data of a blob and its info entity.
+func (bs *FakeBlobstore) store(bi *blobInfo, data []byte) error {
+	currentMu.Lock()
+	ds := currentDatastore
+	currentMu.Unlock()
+	if ds == nil {
+		return errors.New("no datastore for blob info, call NewFakeDatastore first")
+	}
+	e := bi.entity(fullAppID())
+	ds.storeInternal(e.Key, e)
+	bs.mu.Lock()
+	bs.blobs[bi.key] = data
+	bs.mu.Unlock()
+	return nil
+}
+
+// newBlobInfo returns info of a new blob with a random key.
+func newBlobInfo(contentType, filename string, data []byte) *blobInfo {
+	h := md5.New()
+	h.Write(data)
+	return &blobInfo{
+		key:         appengine.BlobKey(randomString(24)),
+		contentType: contentType,
+		filename:    filename,
+		size:        int64(len(data)),
+		md5:         fmt.Sprintf("%x", h.Sum(nil)),
+		// ParseUpload gets microseconds
+		created: time.Unix(0, time.Now().UnixNano()/1e3*1e3).UTC(),
+	}
+}
+
+// entity returns __BlobInfo__ entity of bi in app.
+func (bi *blobInfo) entity(app string) *dspb.EntityProto {
+	prop := func(name string, v *dspb.PropertyValue) *dspb.Property {
+		return &dspb.Property{Name: proto.String(name), Value: v, Multiple: proto.Bool(false)}
+	}
+	str := func(s string) *dspb.PropertyValue {
+		return &dspb.PropertyValue{StringValue: proto.String(s)}
+	}
+	created := prop("creation", &dspb.PropertyValue{Int64Value: proto.Int64(bi.created.UnixNano() / 1e3)})
+	created.Meaning = dspb.Property_GD_WHEN.Enum()
+	e := &dspb.EntityProto{
+		Key: blobInfoKey(app, bi.key),
+		Property: []*dspb.Property{
+			prop("content_type", str(bi.contentType)),
+			created,
+			prop("filename", str(bi.filename)),
+			prop("md5_hash", str(bi.md5)),
+			prop("size", &dspb.PropertyValue{Int64Value: proto.Int64(bi.size)}),
+		},
+	}
+	if bi.creationHandle != "" {
+		e.Property = append(e.Property, prop("creation_handle", str(bi.creationHandle)))
+	}
+	return e
+}
+
+// blobInfoKey returns the key of __BlobInfo__ entity of a blob. Blob infos
+// are always in the default namespace.
+func blobInfoKey(app string, key appengine.BlobKey) *dspb.Reference {
+	return &dspb.Reference{
+		App: proto.String(app),
+		Path: &dspb.Path{Element: []*dspb.Path_Element{{
+			Type: proto.String(blobInfoKind),
+			Name: proto.String(string(key)),
+		}}},
+	}
+}
+
+// randomString returns n random bytes encoded with URL safe base64.
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// blobstoreError creates an API error with the given code.
+func blobstoreError(code pb.BlobstoreServiceError_ErrorCode) error {
+	return &aei.APIError{Service: "blobstore", Code: int32(code)}
+}
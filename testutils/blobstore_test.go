@@ -0,0 +1,233 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	"appengine"
+
+	aei "appengine_internal"
+	basepb "appengine_internal/base"
+	pb "appengine_internal/blobstore"
+	dspb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// testUploadURL creates an upload URL with a limit of bytes per blob.
+func testUploadURL(t *testing.T, c appengine.Context, successPath string, maxPerBlob int64) string {
+	req := &pb.CreateUploadURLRequest{SuccessPath: proto.String(successPath)}
+	if maxPerBlob > 0 {
+		req.MaxUploadSizePerBlobBytes = proto.Int64(maxPerBlob)
+	}
+	resp := &pb.CreateUploadURLResponse{}
+	if err := c.Call("blobstore", "CreateUploadURL", req, resp, nil); err != nil {
+		t.Fatal(err)
+	}
+	return resp.GetUrl()
+}
+
+// testUpload creates a browser upload of a file cat.jpg to url.
+func testUpload(t *testing.T, url, data string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("photo", "cat.jpg")
+	fw.Write([]byte(data))
+	pw, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="doc"; filename="a.txt"`},
+		"Content-Type":        {"text/plain"},
+	})
+	pw.Write([]byte("hello"))
+	// no file selected
+	mw.CreateFormFile("empty", "")
+	mw.WriteField("caption", "My cat")
+	mw.Close()
+	r, err := http.NewRequest("POST", url, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Cookie", "session=1")
+	return r
+}
+
+// blobInfoEntity returns __BlobInfo__ entity of key, or nil.
+func blobInfoEntity(t *testing.T, c appengine.Context, key appengine.BlobKey) *dspb.EntityProto {
+	resp := &dspb.GetResponse{}
+	req := &dspb.GetRequest{Key: []*dspb.Reference{blobInfoKey(fullAppID(), key)}}
+	if err := c.Call("datastore_v3", "Get", req, resp, nil); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Entity[0].Entity
+}
+
+func TestUploadRequest(t *testing.T) {
+	_, unregisterDatastore := NewFakeDatastore()
+	defer unregisterDatastore()
+	bs, unregister := NewFakeBlobstore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	url := testUploadURL(t, c, "/done?x=1", 0)
+	if !strings.HasPrefix(url, "http://localhost"+blobUploadPath) {
+		t.Errorf("Unexpected upload URL %s", url)
+	}
+	up := testUpload(t, url, "meow")
+	r, deleteUploadContext, err := UploadRequest(up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteUploadContext()
+	if r.Method != "POST" || r.URL.String() != "/done?x=1" || r.Header.Get("Cookie") != "session=1" {
+		t.Errorf("Unexpected request %s %s %v", r.Method, r.URL, r.Header)
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, ctype, data string
+	}{
+		{"photo", "application/octet-stream", "meow"},
+		{"doc", "text/plain", "hello"},
+		{"caption", "", "My cat"},
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for _, tt := range tests {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if p.FormName() != tt.name {
+			t.Errorf("Expected part %s, got %s", tt.name, p.FormName())
+		}
+		body, _ := ioutil.ReadAll(p)
+		ctype, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if tt.ctype == "" {
+			if ctype != "text/plain" || string(body) != tt.data {
+				t.Errorf("%s: expected a text/plain field %q, got %s %q", tt.name, tt.data, ctype, body)
+			}
+			continue
+		}
+		key := appengine.BlobKey(params["blob-key"])
+		if ctype != "message/external-body" || key == "" {
+			t.Errorf("%s: expected a blob reference, got %s", tt.name, p.Header.Get("Content-Type"))
+			continue
+		}
+		if data, ok := bs.Blob(key); !ok || string(data) != tt.data {
+			t.Errorf("%s: expected blob %q, got %q (%v)", tt.name, tt.data, data, ok)
+		}
+		// the part has headers of the blob
+		blob, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(body))).ReadMIMEHeader()
+		if err != nil || blob.Get("Content-Type") != tt.ctype || blob.Get("Content-Length") != strconv.Itoa(len(tt.data)) {
+			t.Errorf("%s: unexpected blob headers %v (%v)", tt.name, blob, err)
+		}
+		e := blobInfoEntity(t, c, key)
+		if e == nil {
+			t.Errorf("%s: expected a blob info entity", tt.name)
+			continue
+		}
+		props := make(map[string]*dspb.PropertyValue)
+		for _, p := range e.Property {
+			props[p.GetName()] = p.Value
+		}
+		if props["content_type"].GetStringValue() != tt.ctype || props["size"].GetInt64Value() != int64(len(tt.data)) {
+			t.Errorf("%s: unexpected blob info %v", tt.name, e)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("Expected no more parts, got %v", err)
+	}
+
+	// upload URLs can only be used once
+	if _, _, err := UploadRequest(testUpload(t, url, "meow")); err == nil {
+		t.Error("Expected an error reusing an upload URL")
+	}
+	small := testUploadURL(t, c, "/done", 3)
+	if _, _, err := UploadRequest(testUpload(t, small, "meow")); err == nil {
+		t.Error("Expected an error uploading a blob over the limit")
+	}
+	if _, _, err := UploadRequest(testUpload(t, "http://localhost/other", "meow")); err == nil {
+		t.Error("Expected an error uploading to a URL which is not an upload URL")
+	}
+	unused := testUploadURL(t, c, "/done", 0)
+	unregister()
+	if _, _, err := UploadRequest(testUpload(t, unused, "meow")); err == nil {
+		t.Error("Expected an error without a blobstore")
+	}
+}
+
+func TestBlobstoreFetchData(t *testing.T) {
+	_, unregisterDatastore := NewFakeDatastore()
+	defer unregisterDatastore()
+	bs, unregister := NewFakeBlobstore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	key, err := bs.CreateBlob("text/plain", "a.txt", []byte("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		start, end int64
+		code       pb.BlobstoreServiceError_ErrorCode
+		want       string
+	}{
+		{0, 3, 0, "0123"},
+		{8, 100, 0, "89"},
+		{9, 9, 0, "9"},
+		{10, 20, 0, ""},
+		{5, 4, pb.BlobstoreServiceError_DATA_INDEX_OUT_OF_RANGE, ""},
+		{-1, 4, pb.BlobstoreServiceError_DATA_INDEX_OUT_OF_RANGE, ""},
+		{0, maxBlobFetchSize, pb.BlobstoreServiceError_BLOB_FETCH_SIZE_TOO_LARGE, ""},
+	}
+	fetch := func(key appengine.BlobKey, start, end int64) (string, pb.BlobstoreServiceError_ErrorCode) {
+		resp := &pb.FetchDataResponse{}
+		err := c.Call("blobstore", "FetchData", &pb.FetchDataRequest{
+			BlobKey:    proto.String(string(key)),
+			StartIndex: proto.Int64(start),
+			EndIndex:   proto.Int64(end),
+		}, resp, nil)
+		if err == nil {
+			return string(resp.Data), 0
+		}
+		apiErr, ok := err.(*aei.APIError)
+		if !ok || apiErr.Service != "blobstore" {
+			t.Fatalf("Expected a blobstore API error, got %#v", err)
+		}
+		return "", pb.BlobstoreServiceError_ErrorCode(apiErr.Code)
+	}
+	for _, tt := range tests {
+		if got, code := fetch(key, tt.start, tt.end); got != tt.want || code != tt.code {
+			t.Errorf("FetchData(%d, %d): expected %q %v, got %q %v", tt.start, tt.end, tt.want, tt.code, got, code)
+		}
+	}
+
+	if err := c.Call("blobstore", "DeleteBlob", &pb.DeleteBlobRequest{BlobKey: []string{string(key)}},
+		&basepb.VoidProto{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bs.Blob(key); ok {
+		t.Error("Expected the blob to be deleted")
+	}
+	if e := blobInfoEntity(t, c, key); e != nil {
+		t.Errorf("Expected blob info to be deleted, got %v", e)
+	}
+	if _, code := fetch(key, 0, 1); code != pb.BlobstoreServiceError_BLOB_NOT_FOUND {
+		t.Errorf("Expected BLOB_NOT_FOUND for a deleted blob, got %v", code)
+	}
+}
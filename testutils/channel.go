@@ -0,0 +1,232 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	aei "appengine_internal"
+	pb "appengine_internal/channel"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// channelPresencePath is the URL path prefix of presence requests.
+	channelPresencePath = "/_ah/channel/"
+	// maxChannelClientIdLen is the longest client ID.
+	maxChannelClientIdLen = 64
+	// maxChannelMessageLen is the largest message, in bytes.
+	maxChannelMessageLen = 32767
+	// defaultChannelDuration is the lifetime of tokens, in minutes, unless
+	// another one is requested. It can't be more than maxChannelDuration.
+	defaultChannelDuration = 2 * 60
+	maxChannelDuration     = 24 * 60
+)
+
+// FakeChannel is an implementation of "channel" service which keeps sent
+// messages in memory, per client ID.
+//
+// Tokens are deterministic: the n-th token created by a FakeChannel is
+// "channel-<n>-<client ID>". Clients connect and disconnect with Connect and
+// Disconnect, which send presence requests to the app.
+type FakeChannel struct {
+	mu sync.Mutex
+	// number of tokens created
+	created  int
+	tokens   map[string]*channelToken
+	messages map[string][]string
+	// connected clients
+	connected map[string]bool
+}
+
+type channelToken struct {
+	clientId string
+	expires  time.Time
+}
+
+// NewFakeChannel creates a channel service and registers it as "channel"
+// service implementation. Like the channel package does in production, it is
+// also registered as "xmpp" service.
+//
+// Returns the service and a function that unregisters it. Here's an example:
+//
+// 		func TestChat(t *testing.T) {
+// 			fc, unregister := NewFakeChannel()
+// 			defer unregister()
+//
+// 			// test code that creates a channel for "bob"
+//
+// 			fc.Connect(t, "bob")
+//
+// 			// test code that posts a message to the chat room
+//
+// 			if msgs := fc.Messages("bob"); len(msgs) != 1 {
+// 				t.Errorf("Expected 1 message to bob, got %q", msgs)
+// 			}
+// 		}
+//
+func NewFakeChannel() (*FakeChannel, func()) {
+	fc := &FakeChannel{
+		tokens:    make(map[string]*channelToken),
+		messages:  make(map[string][]string),
+		connected: make(map[string]bool),
+	}
+	methods := map[string]RpcStubFunc{
+		"CreateChannel":      fc.createChannel,
+		"SendChannelMessage": fc.sendChannelMessage,
+	}
+	unregister := registerServiceOverrides("channel", methods)
+	unregisterXmpp := registerServiceOverrides("xmpp", methods)
+	return fc, func() {
+		unregister()
+		unregisterXmpp()
+	}
+}
+
+// ClientID returns the client a token was created for. ok is false if
+// the token is unknown or expired.
+func (fc *FakeChannel) ClientID(token string) (clientID string, ok bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	t := fc.tokens[token]
+	if t == nil || !time.Now().Before(t.expires) {
+		return "", false
+	}
+	return t.clientId, true
+}
+
+// Messages returns messages sent to a client so far, in the order they
+// were sent. Messages are kept even if the client is not connected.
+func (fc *FakeChannel) Messages(clientID string) []string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return append([]string(nil), fc.messages[clientID]...)
+}
+
+// Reset forgets messages sent to all clients.
+func (fc *FakeChannel) Reset() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.messages = make(map[string][]string)
+}
+
+// Connected reports whether a client is connected.
+func (fc *FakeChannel) Connected(clientID string) bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.connected[clientID]
+}
+
+// Connect connects a client to its channel, as if it opened a socket with
+// a token created for it, and sends the presence request App Engine sends
+// in production: a POST to /_ah/channel/connected/ with the client ID in
+// "from" form value. The request has an appengine.Context created with
+// CreateTestContext and is sent to http.DefaultServeMux.
+//
+// It's a fatal test error if the client has no valid token or is already
+// connected. Returns the recorded response of the app.
+func (fc *FakeChannel) Connect(t *testing.T, clientID string) *httptest.ResponseRecorder {
+	fc.mu.Lock()
+	valid := false
+	for _, tok := range fc.tokens {
+		if tok.clientId == clientID && time.Now().Before(tok.expires) {
+			valid = true
+		}
+	}
+	connected := fc.connected[clientID]
+	if valid && !connected {
+		fc.connected[clientID] = true
+	}
+	fc.mu.Unlock()
+	switch {
+	case !valid:
+		t.Fatalf("Connect: no valid token for client %q", clientID)
+	case connected:
+		t.Fatalf("Connect: client %q is already connected", clientID)
+	}
+	return sendChannelPresence("connected", clientID)
+}
+
+// Disconnect disconnects a client, and sends a presence request to
+// /_ah/channel/disconnected/ like Connect does. It's a fatal test error
+// if the client is not connected.
+func (fc *FakeChannel) Disconnect(t *testing.T, clientID string) *httptest.ResponseRecorder {
+	fc.mu.Lock()
+	connected := fc.connected[clientID]
+	delete(fc.connected, clientID)
+	fc.mu.Unlock()
+	if !connected {
+		t.Fatalf("Disconnect: client %q is not connected", clientID)
+	}
+	return sendChannelPresence("disconnected", clientID)
+}
+
+// sendChannelPresence posts a presence request of clientID to
+// http.DefaultServeMux.
+func sendChannelPresence(presence, clientID string) *httptest.ResponseRecorder {
+	body := url.Values{"from": {clientID}}.Encode()
+	req, err := http.NewRequest("POST", channelPresencePath+presence+"/", strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	CreateTestContext(req)
+	defer DeleteTestContext(req)
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	return w
+}
+
+func (fc *FakeChannel) createChannel(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.CreateChannelRequest), out.(*pb.CreateChannelResponse)
+	clientID := req.GetApplicationKey()
+	if clientID == "" || len(clientID) > maxChannelClientIdLen {
+		return channelError(pb.ChannelServiceError_INVALID_CHANNEL_KEY)
+	}
+	minutes := int32(defaultChannelDuration)
+	if req.DurationMinutes != nil {
+		minutes = req.GetDurationMinutes()
+	}
+	if minutes < 1 || minutes > maxChannelDuration {
+		return channelError(pb.ChannelServiceError_INVALID_CHANNEL_TOKEN_DURATION)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.created++
+	token := fmt.Sprintf("channel-%d-%s", fc.created, clientID)
+	fc.tokens[token] = &channelToken{
+		clientId: clientID,
+		expires:  time.Now().Add(time.Duration(minutes) * time.Minute),
+	}
+	resp.Token = proto.String(token)
+	resp.DurationMinutes = proto.Int32(minutes)
+	return nil
+}
+
+func (fc *FakeChannel) sendChannelMessage(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.SendMessageRequest)
+	clientID := req.GetApplicationKey()
+	if clientID == "" || len(clientID) > maxChannelClientIdLen {
+		return channelError(pb.ChannelServiceError_INVALID_CHANNEL_KEY)
+	}
+	if len(req.GetMessage()) > maxChannelMessageLen {
+		return channelError(pb.ChannelServiceError_BAD_MESSAGE)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.messages[clientID] = append(fc.messages[clientID], req.GetMessage())
+	return nil
+}
+
+// channelError creates an API error with the given code.
+func channelError(code pb.ChannelServiceError_ErrorCode) error {
+	return &aei.APIError{Service: "channel", Code: int32(code)}
+}
@@ -0,0 +1,148 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"appengine"
+
+	aei "appengine_internal"
+	basepb "appengine_internal/base"
+	pb "appengine_internal/channel"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// channelPresence records presence requests, "+" for connected and "-" for
+// disconnected clients.
+var channelPresence []string
+
+func init() {
+	http.HandleFunc(channelPresencePath+"connected/", func(w http.ResponseWriter, r *http.Request) {
+		from := r.FormValue("from")
+		if r.Method != "POST" {
+			http.Error(w, "not a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		channelPresence = append(channelPresence, "+"+from)
+		c := appengine.NewContext(r)
+		req := &pb.SendMessageRequest{ApplicationKey: proto.String(from), Message: proto.String("welcome")}
+		if err := c.Call("channel", "SendChannelMessage", req, &basepb.VoidProto{}, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	http.HandleFunc(channelPresencePath+"disconnected/", func(w http.ResponseWriter, r *http.Request) {
+		channelPresence = append(channelPresence, "-"+r.FormValue("from"))
+		http.Error(w, "gone", http.StatusGone)
+	})
+}
+
+// channelErrorCode returns channel service error code of err, or OK if err
+// is nil.
+func channelErrorCode(t *testing.T, err error) pb.ChannelServiceError_ErrorCode {
+	if err == nil {
+		return pb.ChannelServiceError_OK
+	}
+	apiErr, ok := err.(*aei.APIError)
+	if !ok || apiErr.Service != "channel" {
+		t.Fatalf("Expected a channel API error, got %#v", err)
+	}
+	return pb.ChannelServiceError_ErrorCode(apiErr.Code)
+}
+
+func TestCreateChannel(t *testing.T) {
+	fc, unregister := NewFakeChannel()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	tests := []struct {
+		service, clientID string
+		minutes           int32
+		code              pb.ChannelServiceError_ErrorCode
+		token             string
+		duration          int32
+	}{
+		{"channel", "bob", 0, pb.ChannelServiceError_OK, "channel-1-bob", defaultChannelDuration},
+		{"xmpp", "amy", 5, pb.ChannelServiceError_OK, "channel-2-amy", 5},
+		{"channel", "bob", maxChannelDuration, pb.ChannelServiceError_OK, "channel-3-bob", maxChannelDuration},
+		{"channel", "x", maxChannelDuration + 1, pb.ChannelServiceError_INVALID_CHANNEL_TOKEN_DURATION, "", 0},
+		{"channel", "x", -1, pb.ChannelServiceError_INVALID_CHANNEL_TOKEN_DURATION, "", 0},
+		{"channel", "", 0, pb.ChannelServiceError_INVALID_CHANNEL_KEY, "", 0},
+		{"channel", strings.Repeat("x", maxChannelClientIdLen+1), 0, pb.ChannelServiceError_INVALID_CHANNEL_KEY, "", 0},
+	}
+	for _, tt := range tests {
+		req := &pb.CreateChannelRequest{ApplicationKey: proto.String(tt.clientID)}
+		if tt.minutes != 0 {
+			req.DurationMinutes = proto.Int32(tt.minutes)
+		}
+		resp := &pb.CreateChannelResponse{}
+		code := channelErrorCode(t, c.Call(tt.service, "CreateChannel", req, resp, nil))
+		if code != tt.code || resp.GetToken() != tt.token || resp.GetDurationMinutes() != tt.duration {
+			t.Errorf("%s %q %d: expected %q %d %v, got %q %d %v", tt.service, tt.clientID, tt.minutes,
+				tt.token, tt.duration, tt.code, resp.GetToken(), resp.GetDurationMinutes(), code)
+		}
+	}
+	if id, ok := fc.ClientID("channel-2-amy"); id != "amy" || !ok {
+		t.Errorf("Expected client amy, got %q (%v)", id, ok)
+	}
+	if _, ok := fc.ClientID("channel-9-amy"); ok {
+		t.Error("Expected an unknown token not to be found")
+	}
+}
+
+func TestChannelPresence(t *testing.T) {
+	fc, unregister := NewFakeChannel()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	channelPresence = nil
+
+	send := func(clientID, msg string) pb.ChannelServiceError_ErrorCode {
+		req := &pb.SendMessageRequest{ApplicationKey: proto.String(clientID), Message: proto.String(msg)}
+		return channelErrorCode(t, c.Call("channel", "SendChannelMessage", req, &basepb.VoidProto{}, nil))
+	}
+	if err := c.Call("channel", "CreateChannel", &pb.CreateChannelRequest{ApplicationKey: proto.String("bob")},
+		&pb.CreateChannelResponse{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages are kept before a client connects
+	send("amy", "yo")
+	if w := fc.Connect(t, "bob"); w.Code != http.StatusOK || !fc.Connected("bob") {
+		t.Errorf("Expected bob to connect, got %d %s", w.Code, w.Body)
+	}
+	send("bob", "hi")
+	if code := send("bob", strings.Repeat("x", maxChannelMessageLen+1)); code != pb.ChannelServiceError_BAD_MESSAGE {
+		t.Errorf("Expected BAD_MESSAGE for a long message, got %v", code)
+	}
+	if code := send("", "hi"); code != pb.ChannelServiceError_INVALID_CHANNEL_KEY {
+		t.Errorf("Expected INVALID_CHANNEL_KEY without a client ID, got %v", code)
+	}
+	if msgs := fc.Messages("bob"); !reflect.DeepEqual(msgs, []string{"welcome", "hi"}) {
+		t.Errorf("Expected messages to bob [welcome hi], got %q", msgs)
+	}
+	if msgs := fc.Messages("amy"); !reflect.DeepEqual(msgs, []string{"yo"}) || fc.Connected("amy") {
+		t.Errorf("Expected messages to amy [yo], got %q", msgs)
+	}
+
+	// the response of the app is returned as is
+	if w := fc.Disconnect(t, "bob"); w.Code != http.StatusGone || fc.Connected("bob") {
+		t.Errorf("Expected bob to disconnect, got %d", w.Code)
+	}
+	if w := fc.Connect(t, "bob"); w.Code != http.StatusOK {
+		t.Errorf("Expected bob to reconnect, got %d %s", w.Code, w.Body)
+	}
+	if want := []string{"+bob", "-bob", "+bob"}; !reflect.DeepEqual(channelPresence, want) {
+		t.Errorf("Expected presence requests %v, got %v", want, channelPresence)
+	}
+
+	fc.Reset()
+	if msgs := fc.Messages("bob"); len(msgs) != 0 {
+		t.Errorf("Expected no messages after Reset, got %q", msgs)
+	}
+}
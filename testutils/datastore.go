@@ -0,0 +1,599 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+
+	aei "appengine_internal"
+	basepb "appengine_internal/base"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/crhym3/aegot/indexyaml"
+)
+
+// defaultBatchSize is the number of results RunQuery and Next return
+// when the request does not specify a count.
+const defaultBatchSize = 20
+
+// FakeDatastore is an in-memory implementation of "datastore_v3" service.
+// Entities are kept in a map keyed by their pb.Reference so that e.g.
+// datastore.Put() followed by datastore.Get() round-trips without
+// dev_appserver.
+type FakeDatastore struct {
+	mu       sync.Mutex
+	entities map[string]*pb.EntityProto
+	// entities as seen by global (non-ancestor) queries
+	indexed map[string]*pb.EntityProto
+	// writes not yet visible to global queries, keyed by entity group
+	pending map[string][]*mutation
+	// nil means strong consistency
+	consistency *ConsistencyPolicy
+	rand        *rand.Rand
+	// last allocated ID; IDs are unique across all kinds
+	lastId int64
+	// in-flight queries, keyed by pb.Cursor handle
+	queries    map[uint64]*queryRun
+	lastCursor uint64
+	// entity group versions, keyed by root entity key
+	versions map[string]int64
+	// in-flight transactions, keyed by pb.Transaction handle
+	txns    map[uint64]*transaction
+	lastTxn uint64
+	// number of Commit calls so far
+	commits int
+	// commit attempts that must fail with a concurrency error
+	contention map[int]bool
+	// composite indexes required by queries so far, in index.yaml format
+	usedIndexes map[string]bool
+	// indexes from index.yaml passed to RequireIndexes
+	definedIndexes []*indexyaml.Index
+	requireIndexes bool
+}
+
+// NewFakeDatastore creates an empty datastore and registers it as
+// "datastore_v3" service implementation.
+//
+// Returns the datastore and a function that unregisters it. Here's an example:
+//
+// 		func TestSomething(t *testing.T) {
+// 			_, unregister := NewFakeDatastore()
+// 			defer unregister()
+//
+// 			// test code that calls datastore.Put, datastore.Get, etc.
+// 		}
+//
+func NewFakeDatastore() (*FakeDatastore, func()) {
+	ds := &FakeDatastore{
+		entities:    make(map[string]*pb.EntityProto),
+		indexed:     make(map[string]*pb.EntityProto),
+		pending:     make(map[string][]*mutation),
+		queries:     make(map[uint64]*queryRun),
+		versions:    make(map[string]int64),
+		txns:        make(map[uint64]*transaction),
+		contention:  make(map[int]bool),
+		usedIndexes: make(map[string]bool),
+	}
+	unregister := registerServiceOverrides("datastore_v3", map[string]RpcStubFunc{
+		"Get":              ds.get,
+		"Put":              ds.put,
+		"Delete":           ds.delete,
+		"AllocateIds":      ds.allocateIds,
+		"RunQuery":         ds.runQuery,
+		"Next":             ds.next,
+		"DeleteCursor":     ds.deleteCursor,
+		"BeginTransaction": ds.beginTransaction,
+		"Commit":           ds.commit,
+		"Rollback":         ds.rollback,
+	})
+	unsetCurrent := setCurrentDatastore(ds)
+	return ds, func() {
+		unregister()
+		unsetCurrent()
+	}
+}
+
+func (ds *FakeDatastore) get(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.GetRequest), out.(*pb.GetResponse)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if len(req.GetKey()) > maxGetBatchSize {
+		return datastoreError(pb.Error_BAD_REQUEST,
+			"cannot get more than %d keys in a single call", maxGetBatchSize)
+	}
+	for _, key := range req.GetKey() {
+		if err := checkKey(key, false); err != nil {
+			return err
+		}
+	}
+	if req.Transaction != nil {
+		tx, err := ds.transaction(req.Transaction)
+		if err != nil {
+			return err
+		}
+		if err := tx.enlist(ds, req.GetKey()...); err != nil {
+			return err
+		}
+	}
+	for _, key := range req.GetKey() {
+		ds.applyGroup(entityGroupString(key))
+		re := &pb.GetResponse_Entity{}
+		if e, ok := ds.entities[keyString(key)]; ok {
+			re.Entity = proto.Clone(e).(*pb.EntityProto)
+		}
+		resp.Entity = append(resp.Entity, re)
+	}
+	return nil
+}
+
+func (ds *FakeDatastore) put(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.PutRequest), out.(*pb.PutResponse)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if err := checkBatchSize(len(req.GetEntity())); err != nil {
+		return err
+	}
+	for _, e := range req.GetEntity() {
+		if err := checkKey(e.GetKey(), true); err != nil {
+			return err
+		}
+		if err := checkEntity(e); err != nil {
+			return err
+		}
+	}
+	// explicit IDs of the batch are reserved before allocating any
+	for _, e := range req.GetEntity() {
+		ds.reserveId(e.GetKey())
+	}
+	entities := make([]*pb.EntityProto, len(req.GetEntity()))
+	keys := make([]*pb.Reference, len(entities))
+	for i, e := range req.GetEntity() {
+		e = proto.Clone(e).(*pb.EntityProto)
+		elems := e.Key.Path.Element
+		if last := elems[len(elems)-1]; last.Id == nil && last.Name == nil {
+			ds.lastId++
+			last.Id = proto.Int64(ds.lastId)
+		}
+		e.EntityGroup = &pb.Path{Element: []*pb.Path_Element{
+			proto.Clone(elems[0]).(*pb.Path_Element),
+		}}
+		entities[i], keys[i] = e, e.Key
+	}
+	if req.Transaction != nil {
+		tx, err := ds.transaction(req.Transaction)
+		if err != nil {
+			return err
+		}
+		if err := tx.enlist(ds, keys...); err != nil {
+			return err
+		}
+		for _, e := range entities {
+			tx.mutations = append(tx.mutations, &mutation{key: e.Key, entity: e})
+		}
+	} else {
+		for _, e := range entities {
+			ds.store(e.Key, e)
+		}
+		ds.settle(keys...)
+	}
+	for _, key := range keys {
+		resp.Key = append(resp.Key, proto.Clone(key).(*pb.Reference))
+	}
+	return nil
+}
+
+func (ds *FakeDatastore) delete(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.DeleteRequest)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if err := checkBatchSize(len(req.GetKey())); err != nil {
+		return err
+	}
+	for _, key := range req.GetKey() {
+		if err := checkKey(key, false); err != nil {
+			return err
+		}
+	}
+	if req.Transaction != nil {
+		tx, err := ds.transaction(req.Transaction)
+		if err != nil {
+			return err
+		}
+		if err := tx.enlist(ds, req.GetKey()...); err != nil {
+			return err
+		}
+		for _, key := range req.GetKey() {
+			tx.mutations = append(tx.mutations, &mutation{key: key})
+		}
+		return nil
+	}
+	for _, key := range req.GetKey() {
+		ds.store(key, nil)
+	}
+	ds.settle(req.GetKey()...)
+	return nil
+}
+
+// store writes e under key, or deletes the entity if e is nil, and bumps
+// the version of key's entity group. The write is not visible to global
+// queries until the entity group is applied, see settle.
+func (ds *FakeDatastore) store(key *pb.Reference, e *pb.EntityProto) {
+	setEntity(ds.entities, key, e)
+	group := entityGroupString(key)
+	ds.versions[group]++
+	ds.pending[group] = append(ds.pending[group], &mutation{key: key, entity: e})
+}
+
+// storeInternal writes e, or deletes the entity with key if e is nil, on
+// behalf of other services, e.g. __BlobInfo__ entities of blobstore. Unlike
+// Put and Delete, it allows reserved kinds.
+func (ds *FakeDatastore) storeInternal(key *pb.Reference, e *pb.EntityProto) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.reserveId(key)
+	if e != nil {
+		e = proto.Clone(e).(*pb.EntityProto)
+		e.EntityGroup = &pb.Path{Element: []*pb.Path_Element{
+			proto.Clone(key.Path.Element[0]).(*pb.Path_Element),
+		}}
+	}
+	ds.store(key, e)
+	ds.settle(key)
+}
+
+// reserveId moves the ID allocator past the ID key ends with, if any, so
+// that incomplete keys put later don't get the same ID, like dev_appserver
+// does.
+func (ds *FakeDatastore) reserveId(key *pb.Reference) {
+	elems := key.GetPath().GetElement()
+	if id := elems[len(elems)-1].GetId(); id > ds.lastId {
+		ds.lastId = id
+	}
+}
+
+// setEntity writes e under key in m, or deletes the key if e is nil.
+func setEntity(m map[string]*pb.EntityProto, key *pb.Reference, e *pb.EntityProto) {
+	if e != nil {
+		m[keyString(key)] = e
+	} else {
+		delete(m, keyString(key))
+	}
+}
+
+func (ds *FakeDatastore) allocateIds(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.AllocateIdsRequest), out.(*pb.AllocateIdsResponse)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	switch {
+	case req.Size != nil:
+		if req.GetSize() < 1 {
+			return datastoreError(pb.Error_BAD_REQUEST,
+				"Invalid size %d", req.GetSize())
+		}
+		resp.Start = proto.Int64(ds.lastId + 1)
+		ds.lastId += req.GetSize()
+	case req.Max != nil:
+		if req.GetMax() <= ds.lastId {
+			// IDs up to max are already taken: an empty 0-0 range
+			resp.Start, resp.End = proto.Int64(0), proto.Int64(0)
+			return nil
+		}
+		resp.Start = proto.Int64(ds.lastId + 1)
+		ds.lastId = req.GetMax()
+	default:
+		return datastoreError(pb.Error_BAD_REQUEST, "Either size or max is required")
+	}
+	resp.End = proto.Int64(ds.lastId)
+	return nil
+}
+
+func (ds *FakeDatastore) runQuery(in, out proto.Message, _ *RpcCallOptions) error {
+	q, res := in.(*pb.Query), out.(*pb.QueryResult)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if q.Ancestor != nil {
+		if err := checkKey(q.Ancestor, false); err != nil {
+			return err
+		}
+	}
+	if q.Transaction != nil {
+		if q.Ancestor == nil {
+			return datastoreError(pb.Error_BAD_REQUEST,
+				"Only ancestor queries are allowed inside transactions.")
+		}
+		tx, err := ds.transaction(q.Transaction)
+		if err != nil {
+			return err
+		}
+		if err := tx.enlist(ds, q.Ancestor); err != nil {
+			return err
+		}
+	}
+	cq, err := compileQuery(q)
+	if err != nil {
+		return err
+	}
+	source, isMetadata := ds.metadataEntities(q)
+	if !isMetadata {
+		if err := ds.checkIndex(cq); err != nil {
+			return err
+		}
+		// Ancestor queries are strongly consistent while global queries see
+		// only writes applied so far.
+		source = ds.indexed
+		if q.Ancestor != nil {
+			ds.applyGroup(entityGroupString(q.Ancestor))
+			source = ds.entities
+		}
+	}
+	rows, err := cq.eval(sortEntities(source))
+	if err != nil {
+		return err
+	}
+	ds.lastCursor++
+	run := &queryRun{
+		cursor: ds.lastCursor,
+		app:    q.GetApp(),
+		cq:     cq,
+		rows:   rows,
+		limit:  -1,
+		start:  q.CompiledCursor,
+	}
+	if q.Limit != nil {
+		run.limit = q.GetLimit()
+	}
+	ds.queries[run.cursor] = run
+
+	count := int32(defaultBatchSize)
+	if q.Count != nil {
+		count = q.GetCount()
+	}
+	run.fill(res, q.GetOffset(), count, q.GetCompile())
+	return nil
+}
+
+func (ds *FakeDatastore) next(in, out proto.Message, _ *RpcCallOptions) error {
+	req, res := in.(*pb.NextRequest), out.(*pb.QueryResult)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	run, ok := ds.queries[req.GetCursor().GetCursor()]
+	if !ok {
+		return datastoreError(pb.Error_BAD_REQUEST, "Cursor %d not found",
+			req.GetCursor().GetCursor())
+	}
+	count := int32(defaultBatchSize)
+	if req.Count != nil {
+		count = req.GetCount()
+	}
+	run.fill(res, req.GetOffset(), count, req.GetCompile())
+	return nil
+}
+
+func (ds *FakeDatastore) deleteCursor(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.Cursor)
+	ds.mu.Lock()
+	delete(ds.queries, req.GetCursor())
+	ds.mu.Unlock()
+	if v, ok := out.(*basepb.VoidProto); ok {
+		v.Reset()
+	}
+	return nil
+}
+
+// sortEntities returns all entities of m in key order.
+func sortEntities(m map[string]*pb.EntityProto) []*pb.EntityProto {
+	list := make([]*pb.EntityProto, 0, len(m))
+	for _, e := range m {
+		list = append(list, e)
+	}
+	sort.Sort(entitiesByKey(list))
+	return list
+}
+
+// queryRun is the state of a query between RunQuery and subsequent Next
+// calls.
+type queryRun struct {
+	cursor uint64
+	app    string
+	cq     *compiledQuery
+	rows   []*queryRow
+	// index of the next row in rows
+	pos int
+	// number of results left to return; negative means unlimited
+	limit int32
+	// last row returned or skipped so far
+	last *queryRow
+	// start cursor of the query, if any
+	start *pb.CompiledCursor
+}
+
+// fill skips offset rows and then copies at most count of the remaining
+// ones into res. If compile is true, res will also contain a compiled cursor
+// positioned after the last row consumed so far.
+func (run *queryRun) fill(res *pb.QueryResult, offset, count int32, compile bool) {
+	skipped := int32(0)
+	// offset rows don't count against the limit
+	for skipped < offset && run.pos < len(run.rows) && run.limit != 0 {
+		run.skip()
+		skipped++
+	}
+	if skipped > 0 {
+		res.SkippedResults = proto.Int32(skipped)
+	}
+	for count > 0 && run.pos < len(run.rows) && run.limit != 0 {
+		res.Result = append(res.Result, run.cq.result(run.consume()))
+		count--
+	}
+	res.Cursor = &pb.Cursor{Cursor: proto.Uint64(run.cursor), App: proto.String(run.app)}
+	res.MoreResults = proto.Bool(run.pos < len(run.rows) && run.limit != 0)
+	res.KeysOnly = proto.Bool(run.cq.q.GetKeysOnly())
+	if len(run.cq.q.GetPropertyName()) > 0 {
+		res.IndexOnly = proto.Bool(true)
+	}
+	if compile {
+		switch {
+		case run.last != nil:
+			res.CompiledCursor = encodeCursorRow(run.last)
+		case run.start != nil:
+			res.CompiledCursor = run.start
+		default:
+			res.CompiledCursor = &pb.CompiledCursor{}
+		}
+	}
+}
+
+// consume advances the query to the next row and returns it.
+func (run *queryRun) consume() *queryRow {
+	run.skip()
+	if run.limit > 0 {
+		run.limit--
+	}
+	return run.last
+}
+
+// skip advances the query to the next row w/o returning it.
+func (run *queryRun) skip() {
+	run.last = run.rows[run.pos]
+	run.pos++
+}
+
+// matchesQuery reports whether e satisfies kind, namespace and ancestor
+// constraints of q.
+func matchesQuery(e *pb.EntityProto, q *pb.Query) bool {
+	key := e.GetKey()
+	if key.GetApp() != q.GetApp() || key.GetNameSpace() != q.GetNameSpace() {
+		return false
+	}
+	elems := key.GetPath().GetElement()
+	if q.Kind != nil && elems[len(elems)-1].GetType() != q.GetKind() {
+		return false
+	}
+	if q.Ancestor != nil && !hasAncestor(key, q.Ancestor) {
+		return false
+	}
+	return true
+}
+
+// hasAncestor reports whether ancestor path is a prefix of key path.
+// A key is considered its own ancestor.
+func hasAncestor(key, ancestor *pb.Reference) bool {
+	if key.GetNameSpace() != ancestor.GetNameSpace() {
+		return false
+	}
+	kp, ap := key.GetPath().GetElement(), ancestor.GetPath().GetElement()
+	if len(ap) > len(kp) {
+		return false
+	}
+	for i, a := range ap {
+		if compareElements(kp[i], a) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkKey returns an error if key is invalid. Incomplete keys, i.e. those
+// with neither ID nor name in the last path element, are allowed only if
+// allowIncomplete is true.
+func checkKey(key *pb.Reference, allowIncomplete bool) error {
+	elems := key.GetPath().GetElement()
+	if len(elems) == 0 {
+		return datastoreError(pb.Error_BAD_REQUEST, "Key path is empty")
+	}
+	for i, el := range elems {
+		if el.GetType() == "" {
+			return datastoreError(pb.Error_BAD_REQUEST, "Key path element must have a kind")
+		}
+		if el.Id != nil && el.Name != nil {
+			return datastoreError(pb.Error_BAD_REQUEST,
+				"Key path element must not have both ID and name")
+		}
+		complete := el.GetId() != 0 || el.GetName() != ""
+		if !complete && (i < len(elems)-1 || !allowIncomplete) {
+			return datastoreError(pb.Error_BAD_REQUEST, "Key path element must have ID or name")
+		}
+	}
+	return nil
+}
+
+// compareKeys orders keys the way datastore does: by namespace and then by
+// path, element by element. Ancestors go before their descendants.
+func compareKeys(a, b *pb.Reference) int {
+	if c := compareStrings(a.GetNameSpace(), b.GetNameSpace()); c != 0 {
+		return c
+	}
+	ap, bp := a.GetPath().GetElement(), b.GetPath().GetElement()
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		if c := compareElements(ap[i], bp[i]); c != 0 {
+			return c
+		}
+	}
+	return len(ap) - len(bp)
+}
+
+// compareElements orders path elements by kind and then by ID or name.
+// Numeric IDs go before names.
+func compareElements(a, b *pb.Path_Element) int {
+	if c := compareStrings(a.GetType(), b.GetType()); c != 0 {
+		return c
+	}
+	switch {
+	case a.Name == nil && b.Name != nil:
+		return -1
+	case a.Name != nil && b.Name == nil:
+		return 1
+	case a.Name != nil:
+		return compareStrings(a.GetName(), b.GetName())
+	case a.GetId() < b.GetId():
+		return -1
+	case a.GetId() > b.GetId():
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// entitiesByKey implements sort.Interface, ordering entities by key.
+type entitiesByKey []*pb.EntityProto
+
+func (s entitiesByKey) Len() int           { return len(s) }
+func (s entitiesByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s entitiesByKey) Less(i, j int) bool { return compareKeys(s[i].Key, s[j].Key) < 0 }
+
+// keyString encodes key into a string that uniquely identifies it.
+func keyString(key *pb.Reference) string {
+	s := key.GetApp() + "\x00" + key.GetNameSpace()
+	for _, el := range key.GetPath().GetElement() {
+		s += "\x00" + el.GetType() + "\x00"
+		if el.Name != nil {
+			s += "n" + el.GetName()
+		} else {
+			s += "i" + strconv.FormatInt(el.GetId(), 10)
+		}
+	}
+	return s
+}
+
+// datastoreError creates an error in the form production "datastore_v3"
+// service returns it.
+func datastoreError(code pb.Error_ErrorCode, format string, args ...interface{}) error {
+	return &aei.APIError{
+		Service: "datastore_v3",
+		Code:    int32(code),
+		Detail:  fmt.Sprintf(format, args...),
+	}
+}
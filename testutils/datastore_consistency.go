@@ -0,0 +1,91 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"math/rand"
+
+	pb "appengine_internal/datastore"
+)
+
+// ConsistencyPolicy emulates eventual consistency of the High Replication
+// Datastore, similar to dev_appserver's --datastore_consistency_policy.
+//
+// Writes are always visible to Get and ancestor queries, which are strongly
+// consistent. Non-ancestor (global) queries, though, see a write only after
+// it has been applied. Each write applies all pending writes of its entity
+// group with the given Probability; otherwise they stay pending until the
+// group is read with Get or an ancestor query, or ApplyPendingWrites is
+// called.
+type ConsistencyPolicy struct {
+	// Probability of a write being applied right away, 0 to 1.
+	// Zero means writes are never applied on their own.
+	Probability float64
+	// Seed of the random number generator. Tests using the same seed
+	// and making the same sequence of writes see the same results.
+	Seed int64
+}
+
+// SetConsistencyPolicy makes ds eventually consistent according to p.
+// A nil policy restores strong consistency, which is the default,
+// applying all pending writes.
+//
+// Here's how to make sure a handler doesn't rely on global queries
+// seeing its own writes:
+//
+// 		ds, unregister := NewFakeDatastore()
+// 		defer unregister()
+// 		ds.SetConsistencyPolicy(&ConsistencyPolicy{Probability: 0})
+//
+func (ds *FakeDatastore) SetConsistencyPolicy(p *ConsistencyPolicy) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.consistency = p
+	if p == nil {
+		ds.rand = nil
+		ds.applyAll()
+		return
+	}
+	ds.rand = rand.New(rand.NewSource(p.Seed))
+}
+
+// ApplyPendingWrites makes all writes visible to global queries,
+// as if enough time has passed since they were made.
+func (ds *FakeDatastore) ApplyPendingWrites() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.applyAll()
+}
+
+// settle is called after each write RPC with the keys it modified.
+// It decides whether pending writes of their entity groups become visible
+// to global queries.
+func (ds *FakeDatastore) settle(keys ...*pb.Reference) {
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		group := entityGroupString(key)
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+		if ds.consistency == nil || ds.rand.Float64() < ds.consistency.Probability {
+			ds.applyGroup(group)
+		}
+	}
+}
+
+// applyGroup makes pending writes of an entity group visible to global
+// queries.
+func (ds *FakeDatastore) applyGroup(group string) {
+	for _, m := range ds.pending[group] {
+		setEntity(ds.indexed, m.key, m.entity)
+	}
+	delete(ds.pending, group)
+}
+
+func (ds *FakeDatastore) applyAll() {
+	for group := range ds.pending {
+		ds.applyGroup(group)
+	}
+}
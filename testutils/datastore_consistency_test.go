@@ -0,0 +1,89 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"appengine"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// globalNames returns key names of Item entities a global query sees.
+func globalNames(t *testing.T, c appengine.Context) []string {
+	es, _ := testGetAll(t, c, &pb.Query{Kind: proto.String("Item")})
+	return keyNames(es)
+}
+
+func TestConsistencyPolicy(t *testing.T) {
+	ds, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	ds.SetConsistencyPolicy(&ConsistencyPolicy{Probability: 0})
+
+	parent := testKey("Parent", "p", 0, nil)
+	// b goes after root Items in key order
+	a, b := testKey("Item", "a", 0, nil), testKey("Item", "b", 0, parent)
+	testPut(t, c, testEntity(a), testEntity(b))
+	if names := globalNames(t, c); len(names) != 0 {
+		t.Errorf("Expected a global query not to see fresh writes, got %v", names)
+	}
+	es, _ := testGetAll(t, c, &pb.Query{Kind: proto.String("Item"), Ancestor: parent})
+	if names := keyNames(es); !reflect.DeepEqual(names, []string{"b"}) {
+		t.Errorf("Expected an ancestor query to see b, got %v", names)
+	}
+	if es := testGet(t, c, nil, a); es[0] == nil {
+		t.Error("Expected Get to see a")
+	}
+	// reading entity groups applies their writes
+	if names := globalNames(t, c); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("Expected a global query to see a and b once read, got %v", names)
+	}
+
+	// deletes are pending too
+	c.Call("datastore_v3", "Delete", &pb.DeleteRequest{Key: []*pb.Reference{a}}, &pb.DeleteResponse{}, nil)
+	testPut(t, c, testEntity(testKey("Item", "c", 0, nil)))
+	if names := globalNames(t, c); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("Expected a global query to see a and b, got %v", names)
+	}
+	ds.ApplyPendingWrites()
+	if names := globalNames(t, c); !reflect.DeepEqual(names, []string{"c", "b"}) {
+		t.Errorf("Expected a global query to see c and b after ApplyPendingWrites, got %v", names)
+	}
+
+	testPut(t, c, testEntity(testKey("Item", "d", 0, nil)))
+	ds.SetConsistencyPolicy(nil)
+	if names := globalNames(t, c); !reflect.DeepEqual(names, []string{"c", "d", "b"}) {
+		t.Errorf("Expected strong consistency to apply pending writes, got %v", names)
+	}
+}
+
+func TestConsistencyPolicySeed(t *testing.T) {
+	// visible returns names of entities a global query sees after putting
+	// them one by one with probability 0.5.
+	visible := func(seed int64) []string {
+		ds, unregister := NewFakeDatastore()
+		defer unregister()
+		c, deleteContext := newTestContext(t)
+		defer deleteContext()
+		ds.SetConsistencyPolicy(&ConsistencyPolicy{Probability: 0.5, Seed: seed})
+		for i := 0; i < 20; i++ {
+			testPut(t, c, testEntity(testKey("Item", fmt.Sprintf("%02d", i), 0, nil)))
+		}
+		return globalNames(t, c)
+	}
+	first := visible(42)
+	if len(first) == 0 || len(first) == 20 {
+		t.Errorf("Expected some entities to be visible, got %v", first)
+	}
+	for i := 0; i < 3; i++ {
+		if names := visible(42); !reflect.DeepEqual(names, first) {
+			t.Errorf("Expected the same seed to see %v, got %v", first, names)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "appengine_internal/datastore"
+	"github.com/crhym3/aegot/yaml"
+)
+
+// UpdateGoldenEnv is the name of environment variable which makes
+// AssertDatastoreGolden rewrite golden files instead of comparing,
+// e.g. AEGOT_UPDATE_GOLDEN=1 go test.
+const UpdateGoldenEnv = "AEGOT_UPDATE_GOLDEN"
+
+var (
+	currentMu sync.Mutex
+	// datastore created by the last NewFakeDatastore call
+	// and not unregistered yet
+	currentDatastore *FakeDatastore
+)
+
+// Dump returns all entities of ds in a stable text form: entities are sorted
+// by namespace and key, properties by name. The output is in the format
+// LoadFixtures reads, so a dump can also be used as fixtures. Entities
+// of reserved kinds, e.g. blob infos, are omitted.
+func (ds *FakeDatastore) Dump() string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	var buf bytes.Buffer
+	for _, e := range sortEntities(ds.entities) {
+		// entities of other services, e.g. __BlobInfo__, can't be fixtures
+		if isReservedName(entityKind(e)) {
+			continue
+		}
+		dumpEntity(&buf, e)
+	}
+	return buf.String()
+}
+
+// AssertDatastoreGolden compares Dump of the datastore created by
+// NewFakeDatastore with the contents of a golden file at path, and fails
+// the test if they differ. When tests are run with UpdateGoldenEnv set,
+// or with -update flag, the file is rewritten instead.
+//
+// This package doesn't define -update flag, so that it doesn't collide with
+// flags of other packages. The caller's test package has to declare it for
+// "go test -update" to work:
+//
+// 		var update = flag.Bool("update", false, "rewrite golden files")
+//
+// 		func TestPutItem(t *testing.T) {
+// 			_, unregister := NewFakeDatastore()
+// 			defer unregister()
+//
+// 			// test code that calls datastore.Put
+//
+// 			AssertDatastoreGolden(t, "testdata/after_put.golden")
+// 		}
+//
+func AssertDatastoreGolden(t *testing.T, path string) {
+	currentMu.Lock()
+	ds := currentDatastore
+	currentMu.Unlock()
+	if ds == nil {
+		t.Fatal("AssertDatastoreGolden: no datastore, call NewFakeDatastore first")
+	}
+	got := ds.Dump()
+
+	if flagOrEnv("update", UpdateGoldenEnv) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run tests with %s=1 to create it)", err, UpdateGoldenEnv)
+	}
+	if string(want) != got {
+		t.Errorf("Datastore differs from %s (-want +got):\n%s", path,
+			diffLines(string(want), got))
+	}
+}
+
+// setCurrentDatastore makes ds the datastore AssertDatastoreGolden checks.
+// Returns a function that resets it, unless another datastore has been set
+// since.
+func setCurrentDatastore(ds *FakeDatastore) func() {
+	currentMu.Lock()
+	currentDatastore = ds
+	currentMu.Unlock()
+	return func() {
+		currentMu.Lock()
+		if currentDatastore == ds {
+			currentDatastore = nil
+		}
+		currentMu.Unlock()
+	}
+}
+
+// dumpEntity writes e to buf in fixtures format.
+func dumpEntity(buf *bytes.Buffer, e *pb.EntityProto) {
+	ns := e.GetKey().GetNameSpace()
+	fmt.Fprintf(buf, "- key: %s\n", dumpKeyPath(e.GetKey().GetPath().GetElement()))
+	if ns != "" {
+		fmt.Fprintf(buf, "  namespace: %s\n", dumpString(ns))
+	}
+
+	values := make(map[string][]string)
+	multiple := make(map[string]bool)
+	var names, noindex []string
+	addProps := func(props []*pb.Property, indexed bool) {
+		for _, p := range props {
+			name := p.GetName()
+			if _, ok := values[name]; !ok {
+				names = append(names, name)
+				// blobs and texts are never indexed
+				m := p.GetMeaning()
+				if !indexed && m != pb.Property_BLOB && m != pb.Property_TEXT {
+					noindex = append(noindex, dumpString(name))
+				}
+			}
+			values[name] = append(values[name], dumpValue(p, ns))
+			multiple[name] = multiple[name] || p.GetMultiple()
+		}
+	}
+	addProps(e.GetProperty(), true)
+	addProps(e.GetRawProperty(), false)
+	sort.Strings(names)
+	sort.Strings(noindex)
+
+	if len(noindex) > 0 {
+		fmt.Fprintf(buf, "  noindex: [%s]\n", strings.Join(noindex, ", "))
+	}
+	if len(names) > 0 {
+		buf.WriteString("  properties:\n")
+	}
+	for _, name := range names {
+		v := strings.Join(values[name], ", ")
+		if multiple[name] || len(values[name]) > 1 {
+			v = "[" + v + "]"
+		}
+		fmt.Fprintf(buf, "    %s: %s\n", dumpString(name), v)
+	}
+}
+
+// dumpKeyPath formats path elements as a fixtures key path.
+func dumpKeyPath(elems []*pb.Path_Element) string {
+	parts := make([]string, 0, 2*len(elems))
+	for _, el := range elems {
+		parts = append(parts, dumpString(el.GetType()))
+		if el.Name != nil {
+			parts = append(parts, dumpString(el.GetName()))
+		} else {
+			parts = append(parts, strconv.FormatInt(el.GetId(), 10))
+		}
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// dumpValue formats value of p in fixtures format. ns is the namespace of
+// the entity p belongs to.
+func dumpValue(p *pb.Property, ns string) string {
+	v := p.GetValue()
+	switch {
+	case v.Int64Value != nil:
+		if p.GetMeaning() == pb.Property_GD_WHEN {
+			t := time.Unix(0, v.GetInt64Value()*1e3).UTC()
+			return fmt.Sprintf("{time: %q}", t.Format(time.RFC3339Nano))
+		}
+		return strconv.FormatInt(v.GetInt64Value(), 10)
+	case v.BooleanValue != nil:
+		return strconv.FormatBool(v.GetBooleanValue())
+	case v.StringValue != nil:
+		s := v.GetStringValue()
+		switch p.GetMeaning() {
+		case pb.Property_BLOB:
+			return "{blob: " + base64.StdEncoding.EncodeToString([]byte(s)) + "}"
+		case pb.Property_BYTESTRING:
+			return "{bytestring: " + base64.StdEncoding.EncodeToString([]byte(s)) + "}"
+		case pb.Property_TEXT:
+			return "{text: " + strconv.Quote(s) + "}"
+		case pb.Property_BLOBKEY:
+			return "{blobkey: " + strconv.Quote(s) + "}"
+		}
+		return strconv.Quote(s)
+	case v.DoubleValue != nil:
+		return dumpFloat(v.GetDoubleValue())
+	case v.Pointvalue != nil:
+		return fmt.Sprintf("{geo: [%s, %s]}",
+			dumpFloat(v.Pointvalue.GetX()), dumpFloat(v.Pointvalue.GetY()))
+	case v.Uservalue != nil:
+		return "{user: " + strconv.Quote(v.Uservalue.GetEmail()) + "}"
+	case v.Referencevalue != nil:
+		key := valueKey(v.Referencevalue)
+		s := "{key: " + dumpKeyPath(key.GetPath().GetElement())
+		if key.GetNameSpace() != ns {
+			s += ", namespace: " + dumpString(key.GetNameSpace())
+		}
+		return s + "}"
+	}
+	return "null"
+}
+
+// dumpString returns s as is if it reads back as the same string in YAML,
+// e.g. a kind or a property name, or quoted otherwise.
+func dumpString(s string) string {
+	for i, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' ||
+			i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '.')) {
+			return strconv.Quote(s)
+		}
+	}
+	if yaml.Scalar(s) != s {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// dumpFloat formats f so that it is read back as a float, not an integer.
+func dumpFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !math.IsInf(f, 0) && !math.IsNaN(f) && !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// diffLines returns a line by line diff of a and b. Lines only in a are
+// prefixed with "-", lines only in b with "+".
+func diffLines(a, b string) string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	// lcs[i][j] is the length of the longest common subsequence
+	// of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			switch {
+			case x[i] == y[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var buf bytes.Buffer
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			buf.WriteString("  " + x[i] + "\n")
+			i++
+			j++
+		case j == len(y) || i < len(x) && lcs[i+1][j] >= lcs[i][j+1]:
+			buf.WriteString("- " + x[i] + "\n")
+			i++
+		default:
+			buf.WriteString("+ " + y[j] + "\n")
+			j++
+		}
+	}
+	return buf.String()
+}
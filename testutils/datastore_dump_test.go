@@ -0,0 +1,47 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAssertDatastoreGolden(t *testing.T) {
+	ds, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	testPut(t, c,
+		testEntity(testKey("Item", "b", 0, nil), testIntProp("N", 2)),
+		testEntity(testKey("Item", "a", 0, nil), testStringProp("Name", "x")))
+
+	dir, err := ioutil.TempDir("", "aegot-golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testdata", "items.golden")
+
+	os.Setenv(UpdateGoldenEnv, "1")
+	AssertDatastoreGolden(t, path)
+	os.Setenv(UpdateGoldenEnv, "")
+	golden, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected a golden file to be written: %v", err)
+	}
+	if dump := ds.Dump(); string(golden) != dump {
+		t.Errorf("Expected golden file to be the dump:\n%s\ngot:\n%s", dump, golden)
+	}
+	AssertDatastoreGolden(t, path)
+}
+
+func TestDiffLines(t *testing.T) {
+	want := "  a\n- b\n  c\n+ d\n"
+	if d := diffLines("a\nb\nc\n", "a\nc\nd\n"); d != want {
+		t.Errorf("Expected diff:\n%s\ngot:\n%s", want, d)
+	}
+}
@@ -0,0 +1,153 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	pb "appengine_internal/datastore"
+	"github.com/crhym3/aegot/indexyaml"
+)
+
+// IndexLogEnv is the name of environment variable "aet index" uses to
+// collect composite indexes required by tests. If set, every composite index
+// a query needs is appended to the file it names.
+const IndexLogEnv = indexyaml.LogEnv
+
+// requiredIndex returns composite index a query needs in production,
+// or nil if built-in indexes are enough.
+func requiredIndex(cq *compiledQuery) *indexyaml.Index {
+	q := cq.q
+	if q.Kind == nil {
+		return nil
+	}
+	var eqProps []string
+	for _, f := range q.GetFilter() {
+		name := f.GetProperty()[0].GetName()
+		if name != keyProperty && !isInequality(f.GetOp()) && !containsString(eqProps, name) {
+			eqProps = append(eqProps, name)
+		}
+	}
+	sort.Strings(eqProps)
+	// Orders on properties with equality filters have no effect, and
+	// a trailing ascending key order is implied by every index.
+	var orders []*pb.Query_Order
+	for _, o := range cq.orders {
+		if !containsString(eqProps, o.GetProperty()) {
+			orders = append(orders, o)
+		}
+	}
+	if n := len(orders); n > 0 && orders[n-1].GetProperty() == keyProperty &&
+		orders[n-1].GetDirection() == pb.Query_Order_ASCENDING {
+		orders = orders[:n-1]
+	}
+
+	switch {
+	case len(eqProps) == 0 && len(orders) == 0 && len(q.GetPropertyName()) == 0:
+		// kind or kind + ancestor only
+		return nil
+	case len(orders) == 0 && len(q.GetPropertyName()) == 0:
+		// equality filters only, with or without an ancestor, served by
+		// merge join
+		return nil
+	case q.Ancestor == nil && len(eqProps) == 0 && len(orders) == 1 &&
+		(len(q.GetPropertyName()) == 0 ||
+			len(q.GetPropertyName()) == 1 && q.GetPropertyName()[0] == orders[0].GetProperty()):
+		// single property index
+		return nil
+	case q.Ancestor == nil && len(eqProps) == 0 && len(orders) == 0 &&
+		len(q.GetPropertyName()) == 1:
+		// projection of a single property
+		return nil
+	}
+
+	idx := &indexyaml.Index{
+		Kind:          q.GetKind(),
+		Ancestor:      q.Ancestor != nil,
+		EqualityProps: len(eqProps),
+	}
+	for _, name := range eqProps {
+		idx.Properties = append(idx.Properties, indexyaml.Property{Name: name})
+	}
+	for _, o := range orders {
+		idx.Properties = append(idx.Properties, indexyaml.Property{
+			Name: o.GetProperty(),
+			Desc: o.GetDirection() == pb.Query_Order_DESCENDING,
+		})
+	}
+	for _, name := range q.GetPropertyName() {
+		found := false
+		for _, p := range idx.Properties {
+			found = found || p.Name == name
+		}
+		if !found {
+			idx.Properties = append(idx.Properties, indexyaml.Property{Name: name})
+		}
+	}
+	return idx
+}
+
+// RequireIndexes makes queries fail with NEED_INDEX error, as they would in
+// production, if they need a composite index not defined in index.yaml file
+// at path.
+func (ds *FakeDatastore) RequireIndexes(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defs, err := indexyaml.Parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	ds.mu.Lock()
+	ds.definedIndexes = defs
+	ds.requireIndexes = true
+	ds.mu.Unlock()
+	return nil
+}
+
+// RequiredIndexes returns suggested index.yaml content with all composite
+// indexes queries run so far would need in production.
+func (ds *FakeDatastore) RequiredIndexes() string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	defs := make([]string, 0, len(ds.usedIndexes))
+	for s := range ds.usedIndexes {
+		defs = append(defs, s)
+	}
+	sort.Strings(defs)
+	return "indexes:\n\n" + strings.Join(defs, "\n")
+}
+
+// checkIndex records composite index cq needs, if any, and fails if
+// the index is missing from index.yaml passed to RequireIndexes.
+func (ds *FakeDatastore) checkIndex(cq *compiledQuery) error {
+	idx := requiredIndex(cq)
+	if idx == nil {
+		return nil
+	}
+	def := idx.String()
+	if !ds.usedIndexes[def] {
+		if path := os.Getenv(IndexLogEnv); path != "" {
+			if err := indexyaml.AppendLog(path, idx); err != nil {
+				return fmt.Errorf("%s: %v", IndexLogEnv, err)
+			}
+		}
+		ds.usedIndexes[def] = true
+	}
+	if !ds.requireIndexes {
+		return nil
+	}
+	for _, d := range ds.definedIndexes {
+		if idx.SatisfiedBy(d) {
+			return nil
+		}
+	}
+	return datastoreError(pb.Error_NEED_INDEX,
+		"no matching index found.\nThe suggested index for this query is:\n%s", def)
+}
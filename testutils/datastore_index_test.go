@@ -0,0 +1,151 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"strings"
+	"testing"
+
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+func TestRequiredIndex(t *testing.T) {
+	const (
+		eq  = pb.Query_Filter_EQUAL
+		gt  = pb.Query_Filter_GREATER_THAN
+		asc = pb.Query_Order_ASCENDING
+		dsc = pb.Query_Order_DESCENDING
+	)
+	parent := testKey("Parent", "p", 0, nil)
+	tests := []struct {
+		desc string
+		q    *pb.Query
+		// index.yaml definition, or "" if built-in indexes are enough
+		want string
+	}{
+		{"kindless", &pb.Query{Ancestor: parent}, ""},
+		{"kind only", &pb.Query{Kind: proto.String("Item")}, ""},
+		{"ancestor only", &pb.Query{Kind: proto.String("Item"), Ancestor: parent}, ""},
+		{"equality only", &pb.Query{
+			Kind:   proto.String("Item"),
+			Filter: []*pb.Query_Filter{queryFilter(eq, testStringProp("Tag", "x")), queryFilter(eq, testIntProp("N", 1))},
+		}, ""},
+		{"equality only with ancestor", &pb.Query{
+			Kind:     proto.String("Item"),
+			Ancestor: parent,
+			Filter:   []*pb.Query_Filter{queryFilter(eq, testStringProp("Tag", "x")), queryFilter(eq, testIntProp("N", 1))},
+		}, ""},
+		{"single sort order", &pb.Query{
+			Kind:  proto.String("Item"),
+			Order: []*pb.Query_Order{queryOrder("N", dsc)},
+		}, ""},
+		{"single sort order and key", &pb.Query{
+			Kind:  proto.String("Item"),
+			Order: []*pb.Query_Order{queryOrder("N", dsc), queryOrder(keyProperty, asc)},
+		}, ""},
+		{"single sort order with ancestor", &pb.Query{
+			Kind:     proto.String("Item"),
+			Ancestor: parent,
+			Order:    []*pb.Query_Order{queryOrder("N", dsc)},
+		}, "- kind: Item\n  ancestor: yes\n  properties:\n  - name: N\n    direction: desc\n"},
+		{"inequality only", &pb.Query{
+			Kind:   proto.String("Item"),
+			Filter: []*pb.Query_Filter{queryFilter(gt, testIntProp("N", 1))},
+		}, ""},
+		{"inequality and sort orders", &pb.Query{
+			Kind:   proto.String("Item"),
+			Filter: []*pb.Query_Filter{queryFilter(gt, testIntProp("N", 1))},
+			Order:  []*pb.Query_Order{queryOrder("N", asc), queryOrder("Tag", dsc)},
+		}, "- kind: Item\n  properties:\n  - name: N\n  - name: Tag\n    direction: desc\n"},
+		{"equality and sort order", &pb.Query{
+			Kind:   proto.String("Item"),
+			Filter: []*pb.Query_Filter{queryFilter(eq, testStringProp("Tag", "x"))},
+			Order:  []*pb.Query_Order{queryOrder("Tag", asc), queryOrder("N", asc)},
+		}, "- kind: Item\n  properties:\n  - name: Tag\n  - name: N\n"},
+		{"projection of a property", &pb.Query{
+			Kind:         proto.String("Item"),
+			PropertyName: []string{"N"},
+		}, ""},
+		{"projection of a sorted property", &pb.Query{
+			Kind:         proto.String("Item"),
+			PropertyName: []string{"N"},
+			Order:        []*pb.Query_Order{queryOrder("N", dsc)},
+		}, ""},
+		{"projection of two properties", &pb.Query{
+			Kind:         proto.String("Item"),
+			PropertyName: []string{"N", "Tag"},
+		}, "- kind: Item\n  properties:\n  - name: N\n  - name: Tag\n"},
+		{"projection and equality", &pb.Query{
+			Kind:         proto.String("Item"),
+			Filter:       []*pb.Query_Filter{queryFilter(eq, testStringProp("Tag", "x"))},
+			PropertyName: []string{"N"},
+		}, "- kind: Item\n  properties:\n  - name: Tag\n  - name: N\n"},
+	}
+	for _, tt := range tests {
+		cq, err := compileQuery(tt.q)
+		if err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+			continue
+		}
+		got := ""
+		if idx := requiredIndex(cq); idx != nil {
+			got = idx.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected index %q, got %q", tt.desc, tt.want, got)
+		}
+	}
+}
+
+func TestRequireIndexes(t *testing.T) {
+	ds, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	seedQueryEntities(t, c)
+
+	if err := ds.RequireIndexes("testdata/missing.yaml"); err == nil {
+		t.Error("Expected an error for a missing index.yaml")
+	}
+	if err := ds.RequireIndexes("testdata/index.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	run := func(q *pb.Query) error {
+		q.App = proto.String(fullAppID())
+		return c.Call("datastore_v3", "RunQuery", q, &pb.QueryResult{}, nil)
+	}
+	tag := queryFilter(pb.Query_Filter_EQUAL, testStringProp("Tag", "x"))
+	defined := &pb.Query{
+		Kind:   proto.String("Item"),
+		Filter: []*pb.Query_Filter{tag},
+		Order:  []*pb.Query_Order{queryOrder("N", pb.Query_Order_ASCENDING)},
+	}
+	if err := run(defined); err != nil {
+		t.Errorf("Expected a query served by index.yaml to run, got %v", err)
+	}
+	builtin := &pb.Query{
+		Kind:     proto.String("Item"),
+		Ancestor: testKey("Parent", "p", 0, nil),
+		Filter:   []*pb.Query_Filter{tag},
+	}
+	if err := run(builtin); err != nil {
+		t.Errorf("Expected a query served by built-in indexes to run, got %v", err)
+	}
+	missing := &pb.Query{
+		Kind:   proto.String("Item"),
+		Filter: []*pb.Query_Filter{tag},
+		Order:  []*pb.Query_Order{queryOrder("N", pb.Query_Order_DESCENDING)},
+	}
+	err := run(missing)
+	want := "- kind: Item\n  properties:\n  - name: Tag\n  - name: N\n    direction: desc\n"
+	if code := datastoreErrorCode(t, err); code != pb.Error_NEED_INDEX || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected NEED_INDEX suggesting %q, got %v", want, err)
+	}
+
+	all := "indexes:\n\n- kind: Item\n  properties:\n  - name: Tag\n  - name: N\n\n" + want
+	if got := ds.RequiredIndexes(); got != all {
+		t.Errorf("Expected required indexes %q, got %q", all, got)
+	}
+}
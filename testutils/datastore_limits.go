@@ -0,0 +1,77 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"strings"
+
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Production datastore limits.
+const (
+	maxEntitySize          = 1 << 20
+	maxIndexedStringLength = 500
+	maxWriteBatchSize      = 500
+	maxGetBatchSize        = 1000
+	maxIndexEntries        = 20000
+)
+
+// checkBatchSize fails if a write RPC contains too many entities or keys.
+func checkBatchSize(n int) error {
+	if n > maxWriteBatchSize {
+		return datastoreError(pb.Error_BAD_REQUEST,
+			"cannot write more than %d entities in a single call", maxWriteBatchSize)
+	}
+	return nil
+}
+
+// checkEntity fails if e would be rejected by production datastore
+// because it is too large or uses reserved names.
+func checkEntity(e *pb.EntityProto) error {
+	for _, el := range e.GetKey().GetPath().GetElement() {
+		if isReservedName(el.GetType()) {
+			return datastoreError(pb.Error_BAD_REQUEST,
+				"The kind \"%s\" is reserved.", el.GetType())
+		}
+	}
+	if size := proto.Size(e); size > maxEntitySize {
+		return datastoreError(pb.Error_BAD_REQUEST,
+			"entity is too big: %d bytes, maximum is %d", size, maxEntitySize)
+	}
+	entries := 0
+	for _, p := range e.GetProperty() {
+		if isReservedName(p.GetName()) {
+			return datastoreError(pb.Error_BAD_REQUEST,
+				"The property \"%s\" is reserved.", p.GetName())
+		}
+		if v := p.GetValue(); v.StringValue != nil && len(v.GetStringValue()) > maxIndexedStringLength {
+			return datastoreError(pb.Error_BAD_REQUEST,
+				"Property %s is too long. Maximum length is %d.",
+				p.GetName(), maxIndexedStringLength)
+		}
+		// Each indexed value has an entry in both ascending and descending
+		// built-in index.
+		entries += 2
+	}
+	for _, p := range e.GetRawProperty() {
+		if isReservedName(p.GetName()) {
+			return datastoreError(pb.Error_BAD_REQUEST,
+				"The property \"%s\" is reserved.", p.GetName())
+		}
+	}
+	if entries > maxIndexEntries {
+		return datastoreError(pb.Error_BAD_REQUEST,
+			"Too many indexed properties: %d index entries, maximum is %d",
+			entries, maxIndexEntries)
+	}
+	return nil
+}
+
+// isReservedName reports whether name matches __.*__, which datastore
+// reserves for kinds and properties of its own.
+func isReservedName(name string) bool {
+	return len(name) >= 4 && strings.HasPrefix(name, "__") && strings.HasSuffix(name, "__")
+}
@@ -0,0 +1,132 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"strings"
+	"testing"
+
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// sizedEntity returns an entity of exactly size bytes, encoded.
+func sizedEntity(t *testing.T, size int) *pb.EntityProto {
+	newEntity := func(n int) *pb.EntityProto {
+		p := testStringProp("Body", strings.Repeat("x", n))
+		p.Meaning = pb.Property_TEXT.Enum()
+		e := testEntity(testKey("Item", "big", 0, nil))
+		e.RawProperty = []*pb.Property{p}
+		return e
+	}
+	n := size
+	e := newEntity(n)
+	for proto.Size(e) > size {
+		n -= proto.Size(e) - size
+		e = newEntity(n)
+	}
+	if proto.Size(e) != size {
+		t.Fatalf("Couldn't make an entity of %d bytes", size)
+	}
+	return e
+}
+
+// indexedEntity returns an entity with n indexed properties.
+func indexedEntity(n int) *pb.EntityProto {
+	e := testEntity(testKey("Item", "indexed", 0, nil))
+	for i := 0; i < n; i++ {
+		p := testIntProp("N", int64(i))
+		p.Multiple = proto.Bool(true)
+		e.Property = append(e.Property, p)
+	}
+	return e
+}
+
+func TestEntityLimits(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	raw := func(e *pb.EntityProto) *pb.EntityProto {
+		e.RawProperty, e.Property = e.Property, nil
+		return e
+	}
+	tests := []struct {
+		desc string
+		e    *pb.EntityProto
+		code pb.Error_ErrorCode
+	}{
+		{"entity of 1MB", sizedEntity(t, maxEntitySize), 0},
+		{"entity over 1MB", sizedEntity(t, maxEntitySize+1), pb.Error_BAD_REQUEST},
+		{"indexed string of 500 bytes", testEntity(testKey("Item", "s", 0, nil),
+			testStringProp("S", strings.Repeat("x", maxIndexedStringLength))), 0},
+		{"indexed string over 500 bytes", testEntity(testKey("Item", "s", 0, nil),
+			testStringProp("S", strings.Repeat("x", maxIndexedStringLength+1))), pb.Error_BAD_REQUEST},
+		{"unindexed string over 500 bytes", raw(testEntity(testKey("Item", "s", 0, nil),
+			testStringProp("S", strings.Repeat("x", maxIndexedStringLength+1)))), 0},
+		{"most index entries", indexedEntity(maxIndexEntries / 2), 0},
+		{"too many index entries", indexedEntity(maxIndexEntries/2 + 1), pb.Error_BAD_REQUEST},
+		{"reserved kind", testEntity(testKey("__foo__", "a", 0, nil)), pb.Error_BAD_REQUEST},
+		{"reserved parent kind", testEntity(testKey("Item", "a", 0, testKey("__foo__", "p", 0, nil))),
+			pb.Error_BAD_REQUEST},
+		{"kind of underscores", testEntity(testKey("__", "a", 0, nil)), 0},
+		{"kind with underscores", testEntity(testKey("__foo", "a", 0, nil)), 0},
+		{"reserved property", testEntity(testKey("Item", "a", 0, nil), testIntProp("__foo__", 1)),
+			pb.Error_BAD_REQUEST},
+		{"reserved unindexed property", raw(testEntity(testKey("Item", "a", 0, nil), testIntProp("__foo__", 1))),
+			pb.Error_BAD_REQUEST},
+	}
+	for _, tt := range tests {
+		err := c.Call("datastore_v3", "Put", &pb.PutRequest{Entity: []*pb.EntityProto{tt.e}}, &pb.PutResponse{}, nil)
+		if code := datastoreErrorCode(t, err); code != tt.code {
+			t.Errorf("%s: expected %v, got %v", tt.desc, tt.code, err)
+		}
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	entities := func(n int) []*pb.EntityProto {
+		es := make([]*pb.EntityProto, n)
+		for i := range es {
+			es[i] = testEntity(testKey("Item", "", int64(i+1), nil))
+		}
+		return es
+	}
+	keys := func(n int) []*pb.Reference {
+		ks := make([]*pb.Reference, n)
+		for i := range ks {
+			ks[i] = testKey("Item", "", int64(i+1), nil)
+		}
+		return ks
+	}
+	tests := []struct {
+		method   string
+		in       proto.Message
+		out      proto.Message
+		code     pb.Error_ErrorCode
+		keyCount int
+	}{
+		{"Put", &pb.PutRequest{Entity: entities(maxWriteBatchSize)}, &pb.PutResponse{}, 0, maxWriteBatchSize},
+		{"Put", &pb.PutRequest{Entity: entities(maxWriteBatchSize + 1)}, &pb.PutResponse{},
+			pb.Error_BAD_REQUEST, maxWriteBatchSize + 1},
+		{"Delete", &pb.DeleteRequest{Key: keys(maxWriteBatchSize)}, &pb.DeleteResponse{}, 0, maxWriteBatchSize},
+		{"Delete", &pb.DeleteRequest{Key: keys(maxWriteBatchSize + 1)}, &pb.DeleteResponse{},
+			pb.Error_BAD_REQUEST, maxWriteBatchSize + 1},
+		{"Get", &pb.GetRequest{Key: keys(maxGetBatchSize)}, &pb.GetResponse{}, 0, maxGetBatchSize},
+		{"Get", &pb.GetRequest{Key: keys(maxGetBatchSize + 1)}, &pb.GetResponse{},
+			pb.Error_BAD_REQUEST, maxGetBatchSize + 1},
+	}
+	for _, tt := range tests {
+		err := c.Call("datastore_v3", tt.method, tt.in, tt.out, nil)
+		if code := datastoreErrorCode(t, err); code != tt.code {
+			t.Errorf("%s of %d: expected %v, got %v", tt.method, tt.keyCount, tt.code, err)
+		}
+	}
+}
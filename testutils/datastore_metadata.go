@@ -0,0 +1,222 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"sort"
+	"time"
+
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Special kinds answered from datastore contents.
+const (
+	namespaceKind   = "__namespace__"
+	kindKind        = "__kind__"
+	propertyKind    = "__property__"
+	statTotalKind   = "__Stat_Total__"
+	statKindKind    = "__Stat_Kind__"
+	statNsTotalKind = "__Stat_Ns_Total__"
+	statNsKindKind  = "__Stat_Ns_Kind__"
+)
+
+// statTotalName is the key name of __Stat_Total__ entity.
+const statTotalName = "total_entity_usage"
+
+// metadataEntities returns entities of a metadata or statistics kind q
+// queries, built from entities visible to global queries. ok is false if
+// q is a regular query.
+//
+// Metadata entities are:
+//
+// 		__namespace__: key ID 1 for the default namespace, key name otherwise
+// 		__kind__: key name is the kind, in the query namespace
+// 		__property__: key [__kind__, kind, __property__, name];
+// 			property_representation lists value types, e.g. "STRING", "INT64"
+//
+// Statistics are __Stat_Total__ ("total_entity_usage" key name) and
+// __Stat_Kind__ (kind name as key name) in the default namespace, which count
+// entities of all namespaces, and __Stat_Ns_Total__ and __Stat_Ns_Kind__
+// with the same keys, which count entities of the query namespace. Index
+// sizes are not tracked, so bytes is equal to entity_bytes.
+func (ds *FakeDatastore) metadataEntities(q *pb.Query) (entities map[string]*pb.EntityProto, ok bool) {
+	app, ns := q.GetApp(), q.GetNameSpace()
+	newKey := func(path ...interface{}) *pb.Reference {
+		key := &pb.Reference{App: q.App, NameSpace: q.NameSpace, Path: &pb.Path{}}
+		for i := 0; i < len(path); i += 2 {
+			el := &pb.Path_Element{Type: proto.String(path[i].(string))}
+			switch id := path[i+1].(type) {
+			case int64:
+				el.Id = proto.Int64(id)
+			case string:
+				el.Name = proto.String(id)
+			}
+			key.Path.Element = append(key.Path.Element, el)
+		}
+		return key
+	}
+	entities = make(map[string]*pb.EntityProto)
+	add := func(e *pb.EntityProto) {
+		if e.EntityGroup == nil {
+			e.EntityGroup = &pb.Path{Element: e.Key.Path.Element[:1]}
+		}
+		entities[keyString(e.Key)] = e
+	}
+
+	switch q.GetKind() {
+	case namespaceKind:
+		seen := make(map[string]bool)
+		for _, e := range ds.indexed {
+			name := e.GetKey().GetNameSpace()
+			if e.GetKey().GetApp() != app || seen[name] {
+				continue
+			}
+			seen[name] = true
+			if name == "" {
+				add(&pb.EntityProto{Key: newKey(namespaceKind, int64(1))})
+			} else {
+				add(&pb.EntityProto{Key: newKey(namespaceKind, name)})
+			}
+		}
+
+	case kindKind:
+		for _, e := range ds.indexed {
+			if e.GetKey().GetApp() == app && e.GetKey().GetNameSpace() == ns {
+				add(&pb.EntityProto{Key: newKey(kindKind, entityKind(e))})
+			}
+		}
+
+	case propertyKind:
+		// representations by keyString of __property__ key
+		reprs := make(map[string][]string)
+		for _, e := range ds.indexed {
+			if e.GetKey().GetApp() != app || e.GetKey().GetNameSpace() != ns {
+				continue
+			}
+			for _, p := range e.GetProperty() {
+				key := newKey(kindKind, entityKind(e), propertyKind, p.GetName())
+				ks := keyString(key)
+				if _, ok := entities[ks]; !ok {
+					add(&pb.EntityProto{Key: key})
+				}
+				if r := valueRepresentation(p.GetValue()); !containsString(reprs[ks], r) {
+					reprs[ks] = append(reprs[ks], r)
+				}
+			}
+		}
+		for ks, e := range entities {
+			sort.Strings(reprs[ks])
+			for _, r := range reprs[ks] {
+				e.Property = append(e.Property, &pb.Property{
+					Name:     proto.String("property_representation"),
+					Value:    &pb.PropertyValue{StringValue: proto.String(r)},
+					Multiple: proto.Bool(true),
+				})
+			}
+		}
+
+	case statTotalKind, statKindKind, statNsTotalKind, statNsKindKind:
+		perNs := q.GetKind() == statNsTotalKind || q.GetKind() == statNsKindKind
+		if !perNs && ns != "" {
+			// global statistics live in the default namespace only
+			break
+		}
+		total := &entityStat{}
+		kinds := make(map[string]*entityStat)
+		for _, e := range ds.indexed {
+			if e.GetKey().GetApp() != app || perNs && e.GetKey().GetNameSpace() != ns {
+				continue
+			}
+			kind := entityKind(e)
+			if kinds[kind] == nil {
+				kinds[kind] = &entityStat{}
+			}
+			size := int64(proto.Size(e))
+			kinds[kind].add(size)
+			total.add(size)
+		}
+		if total.count == 0 {
+			break
+		}
+		now := time.Now()
+		if q.GetKind() == statTotalKind || q.GetKind() == statNsTotalKind {
+			add(total.entity(newKey(q.GetKind(), statTotalName), now))
+			break
+		}
+		for kind, st := range kinds {
+			e := st.entity(newKey(q.GetKind(), kind), now)
+			e.Property = append(e.Property, &pb.Property{
+				Name:     proto.String("kind_name"),
+				Value:    &pb.PropertyValue{StringValue: proto.String(kind)},
+				Multiple: proto.Bool(false),
+			})
+			add(e)
+		}
+
+	default:
+		return nil, false
+	}
+	return entities, true
+}
+
+// entityStat accumulates statistics of a set of entities.
+type entityStat struct {
+	count, bytes int64
+}
+
+func (st *entityStat) add(size int64) {
+	st.count++
+	st.bytes += size
+}
+
+// entity returns statistics entity with the given key, as of time t.
+func (st *entityStat) entity(key *pb.Reference, t time.Time) *pb.EntityProto {
+	prop := func(name string, v int64) *pb.Property {
+		return &pb.Property{
+			Name:     proto.String(name),
+			Value:    &pb.PropertyValue{Int64Value: proto.Int64(v)},
+			Multiple: proto.Bool(false),
+		}
+	}
+	ts := prop("timestamp", t.UnixNano()/1e3)
+	ts.Meaning = pb.Property_GD_WHEN.Enum()
+	return &pb.EntityProto{
+		Key: key,
+		Property: []*pb.Property{
+			prop("bytes", st.bytes),
+			prop("count", st.count),
+			prop("entity_bytes", st.bytes),
+			ts,
+		},
+	}
+}
+
+// entityKind returns the kind of e.
+func entityKind(e *pb.EntityProto) string {
+	elems := e.GetKey().GetPath().GetElement()
+	return elems[len(elems)-1].GetType()
+}
+
+// valueRepresentation returns the name of v's type as reported in
+// property_representation of __property__ entities.
+func valueRepresentation(v *pb.PropertyValue) string {
+	switch {
+	case v.Int64Value != nil:
+		return "INT64"
+	case v.BooleanValue != nil:
+		return "BOOLEAN"
+	case v.StringValue != nil:
+		return "STRING"
+	case v.DoubleValue != nil:
+		return "DOUBLE"
+	case v.Pointvalue != nil:
+		return "POINT"
+	case v.Uservalue != nil:
+		return "USER"
+	case v.Referencevalue != nil:
+		return "REFERENCE"
+	}
+	return "NULL"
+}
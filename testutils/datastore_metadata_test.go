@@ -0,0 +1,163 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"appengine"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// keyPath formats key path as e.g. "__kind__:Item/__property__:N".
+func keyPath(key *pb.Reference) string {
+	var elems []string
+	for _, el := range key.GetPath().GetElement() {
+		if el.Name != nil {
+			elems = append(elems, el.GetType()+":"+el.GetName())
+		} else {
+			elems = append(elems, fmt.Sprintf("%s:%d", el.GetType(), el.GetId()))
+		}
+	}
+	return strings.Join(elems, "/")
+}
+
+// propValues returns values of e's properties by name, formatted.
+func propValues(e *pb.EntityProto) map[string][]string {
+	m := make(map[string][]string)
+	for _, p := range e.GetProperty() {
+		v := p.GetValue()
+		var s string
+		switch {
+		case v.StringValue != nil:
+			s = v.GetStringValue()
+		case v.Int64Value != nil:
+			s = fmt.Sprint(v.GetInt64Value())
+		}
+		m[p.GetName()] = append(m[p.GetName()], s)
+	}
+	return m
+}
+
+// metadataQuery runs a query of kind in namespace ns and returns the
+// results.
+func metadataQuery(t *testing.T, c appengine.Context, ns, kind string, ancestor *pb.Reference) []*pb.EntityProto {
+	q := &pb.Query{Kind: proto.String(kind), Ancestor: ancestor}
+	if ns != "" {
+		q.NameSpace = proto.String(ns)
+	}
+	es, _ := testGetAll(t, c, q)
+	return es
+}
+
+func TestMetadataQueries(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	double := testIntProp("N", 0)
+	double.Value = &pb.PropertyValue{DoubleValue: proto.Float64(2.5)}
+	flag := testIntProp("Flag", 0)
+	flag.Value = &pb.PropertyValue{BooleanValue: proto.Bool(true)}
+	other := testKey("Item", "c", 0, nil)
+	other.NameSpace = proto.String("ns")
+	testPut(t, c,
+		testEntity(testKey("Item", "a", 0, nil), testIntProp("N", 1), testStringProp("Tag", "x")),
+		testEntity(testKey("Item", "b", 0, nil), double, flag),
+		testEntity(testKey("List", "l", 0, nil), testStringProp("Name", "l")),
+		testEntity(other, testIntProp("N", 3)))
+
+	itemKind := testKey(kindKind, "Item", 0, nil)
+	tests := []struct {
+		ns, kind string
+		ancestor *pb.Reference
+		// key paths and property_representation values of each result
+		keys  []string
+		reprs [][]string
+	}{
+		{"", namespaceKind, nil, []string{"__namespace__:1", "__namespace__:ns"}, nil},
+		{"ns", namespaceKind, nil, []string{"__namespace__:1", "__namespace__:ns"}, nil},
+		{"", kindKind, nil, []string{"__kind__:Item", "__kind__:List"}, nil},
+		{"ns", kindKind, nil, []string{"__kind__:Item"}, nil},
+		{"", propertyKind, nil, []string{
+			"__kind__:Item/__property__:Flag",
+			"__kind__:Item/__property__:N",
+			"__kind__:Item/__property__:Tag",
+			"__kind__:List/__property__:Name",
+		}, [][]string{{"BOOLEAN"}, {"DOUBLE", "INT64"}, {"STRING"}, {"STRING"}}},
+		{"", propertyKind, itemKind, []string{
+			"__kind__:Item/__property__:Flag",
+			"__kind__:Item/__property__:N",
+			"__kind__:Item/__property__:Tag",
+		}, [][]string{{"BOOLEAN"}, {"DOUBLE", "INT64"}, {"STRING"}}},
+		{"ns", propertyKind, nil, []string{"__kind__:Item/__property__:N"}, [][]string{{"INT64"}}},
+	}
+	for _, tt := range tests {
+		es := metadataQuery(t, c, tt.ns, tt.kind, tt.ancestor)
+		var keys []string
+		var reprs [][]string
+		for _, e := range es {
+			keys = append(keys, keyPath(e.Key))
+			if r := propValues(e)["property_representation"]; r != nil {
+				reprs = append(reprs, r)
+			}
+			if e.Key.GetNameSpace() != tt.ns {
+				t.Errorf("%s in %q: expected keys in the query namespace, got %v", tt.kind, tt.ns, e.Key)
+			}
+		}
+		if !reflect.DeepEqual(keys, tt.keys) || !reflect.DeepEqual(reprs, tt.reprs) {
+			t.Errorf("%s in %q under %v: expected %v %v, got %v %v", tt.kind, tt.ns, tt.ancestor,
+				tt.keys, tt.reprs, keys, reprs)
+		}
+	}
+}
+
+func TestStatisticsQueries(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	other := testKey("Item", "c", 0, nil)
+	other.NameSpace = proto.String("ns")
+	testPut(t, c,
+		testEntity(testKey("Item", "a", 0, nil), testIntProp("N", 1)),
+		testEntity(testKey("Item", "b", 0, nil), testIntProp("N", 2)),
+		testEntity(testKey("List", "l", 0, nil)),
+		testEntity(other, testIntProp("N", 3)))
+
+	tests := []struct {
+		ns, kind string
+		// key path, count and kind_name of each result
+		stats []string
+	}{
+		{"", statTotalKind, []string{"__Stat_Total__:total_entity_usage 4 []"}},
+		{"", statKindKind, []string{"__Stat_Kind__:Item 3 [Item]", "__Stat_Kind__:List 1 [List]"}},
+		// global statistics are in the default namespace only
+		{"ns", statTotalKind, nil},
+		{"", statNsTotalKind, []string{"__Stat_Ns_Total__:total_entity_usage 3 []"}},
+		{"ns", statNsTotalKind, []string{"__Stat_Ns_Total__:total_entity_usage 1 []"}},
+		{"", statNsKindKind, []string{"__Stat_Ns_Kind__:Item 2 [Item]", "__Stat_Ns_Kind__:List 1 [List]"}},
+		{"ns", statNsKindKind, []string{"__Stat_Ns_Kind__:Item 1 [Item]"}},
+		{"empty", statNsTotalKind, nil},
+	}
+	for _, tt := range tests {
+		var stats []string
+		for _, e := range metadataQuery(t, c, tt.ns, tt.kind, nil) {
+			v := propValues(e)
+			stats = append(stats, fmt.Sprintf("%s %s %v", keyPath(e.Key), v["count"][0], v["kind_name"]))
+			if v["bytes"][0] == "0" || v["bytes"][0] != v["entity_bytes"][0] || len(v["timestamp"]) != 1 {
+				t.Errorf("%s in %q: unexpected statistics %v", tt.kind, tt.ns, v)
+			}
+		}
+		if !reflect.DeepEqual(stats, tt.stats) {
+			t.Errorf("%s in %q: expected %v, got %v", tt.kind, tt.ns, tt.stats, stats)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"sort"
+
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// keyProperty is the name of the pseudo-property queries use to filter
+// and sort by entity keys.
+const keyProperty = "__key__"
+
+// queryRow is a single query result. Non-projection queries produce one row
+// per entity while projection queries produce one row per combination of
+// projected property values.
+type queryRow struct {
+	entity *pb.EntityProto
+	// values of sort order and projected properties
+	values map[string]*pb.PropertyValue
+}
+
+// compiledQuery is a validated pb.Query ready to be evaluated.
+type compiledQuery struct {
+	q *pb.Query
+	// effective sort orders, w/o the implicit key order
+	orders []*pb.Query_Order
+	// name of the property inequality filters apply to, if any
+	ineqProp string
+	// true if orders contain __key__
+	keyOrdered bool
+}
+
+// compileQuery validates q the way production does and returns
+// a compiled version of it.
+func compileQuery(q *pb.Query) (*compiledQuery, error) {
+	cq := &compiledQuery{q: q, orders: q.GetOrder()}
+	for _, f := range q.GetFilter() {
+		if len(f.GetProperty()) == 0 {
+			return nil, datastoreError(pb.Error_BAD_REQUEST, "Filter has no property")
+		}
+		name := f.GetProperty()[0].GetName()
+		if q.Kind == nil && name != keyProperty {
+			return nil, datastoreError(pb.Error_BAD_REQUEST,
+				"kind is required for non-__key__ filters")
+		}
+		if !isInequality(f.GetOp()) {
+			continue
+		}
+		if cq.ineqProp != "" && cq.ineqProp != name {
+			return nil, datastoreError(pb.Error_BAD_REQUEST,
+				"Only one inequality filter per query is supported. "+
+					"Encountered both %s and %s", cq.ineqProp, name)
+		}
+		cq.ineqProp = name
+	}
+	for _, o := range cq.orders {
+		if q.Kind == nil && (o.GetProperty() != keyProperty ||
+			o.GetDirection() != pb.Query_Order_ASCENDING) {
+			return nil, datastoreError(pb.Error_BAD_REQUEST,
+				"kind is required for all orders except __key__ ascending")
+		}
+		if o.GetProperty() == keyProperty {
+			cq.keyOrdered = true
+		}
+	}
+	if cq.ineqProp != "" {
+		if len(cq.orders) == 0 {
+			cq.orders = []*pb.Query_Order{{Property: proto.String(cq.ineqProp)}}
+		} else if cq.orders[0].GetProperty() != cq.ineqProp {
+			return nil, datastoreError(pb.Error_BAD_REQUEST,
+				"The first sort property must be the same as the property to "+
+					"which the inequality filter is applied. In your query the "+
+					"first sort property is %s but the inequality filter is on %s",
+				cq.orders[0].GetProperty(), cq.ineqProp)
+		}
+	}
+	if len(q.GetPropertyName()) > 0 {
+		if q.GetKeysOnly() {
+			return nil, datastoreError(pb.Error_BAD_REQUEST,
+				"projection and keys_only cannot both be set")
+		}
+		for _, f := range q.GetFilter() {
+			name := f.GetProperty()[0].GetName()
+			if f.GetOp() == pb.Query_Filter_EQUAL && containsString(q.GetPropertyName(), name) {
+				return nil, datastoreError(pb.Error_BAD_REQUEST,
+					"cannot use projection on a property with an equality filter")
+			}
+		}
+	}
+	for _, name := range q.GetGroupByPropertyName() {
+		if !containsString(q.GetPropertyName(), name) {
+			return nil, datastoreError(pb.Error_BAD_REQUEST,
+				"cannot group by property %s which is not projected", name)
+		}
+	}
+	return cq, nil
+}
+
+// eval returns rows produced by entities (which must be sorted by key)
+// in the query order. Start and end cursors are applied but offset and
+// limit are not.
+func (cq *compiledQuery) eval(entities []*pb.EntityProto) ([]*queryRow, error) {
+	var rows []*queryRow
+	for _, e := range entities {
+		if !matchesQuery(e, cq.q) || !cq.matchesFilters(e) {
+			continue
+		}
+		rows = append(rows, cq.entityRows(e)...)
+	}
+	sort.Stable(&rowSorter{rows, cq})
+	// Index rows are unique, so repeated values of a multi-valued
+	// property yield a single row.
+	unique := rows[:0]
+	for i, r := range rows {
+		if i == 0 || cq.compareRows(rows[i-1], r) != 0 ||
+			compareKeys(rows[i-1].entity.GetKey(), r.entity.GetKey()) != 0 {
+			unique = append(unique, r)
+		}
+	}
+	rows = unique
+
+	if groupBy := cq.q.GetGroupByPropertyName(); len(groupBy) > 0 {
+		seen := make(map[string]bool)
+		distinct := rows[:0]
+		for _, r := range rows {
+			var id string
+			for _, name := range groupBy {
+				id += proto.CompactTextString(r.values[name]) + "\x00"
+			}
+			if !seen[id] {
+				seen[id] = true
+				distinct = append(distinct, r)
+			}
+		}
+		rows = distinct
+	}
+
+	if cc := cq.q.CompiledCursor; cc != nil && cc.Position != nil {
+		start, err := decodeCursorRow(cc)
+		if err != nil {
+			return nil, err
+		}
+		i := 0
+		for i < len(rows) && cq.compareRows(rows[i], start) <= 0 {
+			i++
+		}
+		rows = rows[i:]
+	}
+	if cc := cq.q.EndCompiledCursor; cc != nil {
+		if cc.Position == nil {
+			return nil, nil
+		}
+		end, err := decodeCursorRow(cc)
+		if err != nil {
+			return nil, err
+		}
+		i := 0
+		for i < len(rows) && cq.compareRows(rows[i], end) <= 0 {
+			i++
+		}
+		rows = rows[:i]
+	}
+	return rows, nil
+}
+
+// matchesFilters reports whether e satisfies all filters of the query.
+// Equality filters must each be satisfied by some value of a property,
+// while all inequality filters must be satisfied by the same value.
+func (cq *compiledQuery) matchesFilters(e *pb.EntityProto) bool {
+	for _, f := range cq.q.GetFilter() {
+		vals := propertyValues(e, f.GetProperty()[0].GetName())
+		switch f.GetOp() {
+		case pb.Query_Filter_EQUAL, pb.Query_Filter_IN:
+			if !anyValueEquals(vals, f.GetProperty()) {
+				return false
+			}
+		case pb.Query_Filter_EXISTS:
+			if len(vals) == 0 {
+				return false
+			}
+		}
+	}
+	if cq.ineqProp != "" && len(cq.ineqValues(e)) == 0 {
+		return false
+	}
+	return true
+}
+
+// ineqValues returns values of the inequality filter property of e that
+// satisfy all inequality filters.
+func (cq *compiledQuery) ineqValues(e *pb.EntityProto) []*pb.PropertyValue {
+	var res []*pb.PropertyValue
+	for _, v := range propertyValues(e, cq.ineqProp) {
+		ok := true
+		for _, f := range cq.q.GetFilter() {
+			if isInequality(f.GetOp()) && !applyInequality(f.GetOp(), v, f.GetProperty()[0].GetValue()) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// entityRows creates query rows from a single matching entity.
+// It returns nil if e lacks any of sort order or projected properties.
+func (cq *compiledQuery) entityRows(e *pb.EntityProto) []*queryRow {
+	rows := []*queryRow{{entity: e, values: make(map[string]*pb.PropertyValue)}}
+	for _, name := range cq.q.GetPropertyName() {
+		vals := cq.candidateValues(e, name)
+		if len(vals) == 0 {
+			return nil
+		}
+		product := make([]*queryRow, 0, len(rows)*len(vals))
+		for _, r := range rows {
+			for _, v := range vals {
+				nr := &queryRow{entity: e, values: make(map[string]*pb.PropertyValue)}
+				for k, rv := range r.values {
+					nr.values[k] = rv
+				}
+				nr.values[name] = v
+				product = append(product, nr)
+			}
+		}
+		rows = product
+	}
+	for _, o := range cq.orders {
+		name := o.GetProperty()
+		if _, ok := rows[0].values[name]; ok {
+			continue
+		}
+		vals := cq.candidateValues(e, name)
+		if len(vals) == 0 {
+			return nil
+		}
+		// Multi-valued properties sort by the smallest value in ascending
+		// order and by the largest one in descending order.
+		v := vals[0]
+		for _, cand := range vals[1:] {
+			c := compareValues(cand, v)
+			if (o.GetDirection() == pb.Query_Order_DESCENDING) == (c > 0) && c != 0 {
+				v = cand
+			}
+		}
+		for _, r := range rows {
+			r.values[name] = v
+		}
+	}
+	return rows
+}
+
+// candidateValues returns values of property name of e that can appear
+// in a query row.
+func (cq *compiledQuery) candidateValues(e *pb.EntityProto, name string) []*pb.PropertyValue {
+	if name == cq.ineqProp {
+		return cq.ineqValues(e)
+	}
+	return propertyValues(e, name)
+}
+
+// compareRows orders rows by sort orders, then by key and then by projected
+// values.
+func (cq *compiledQuery) compareRows(a, b *queryRow) int {
+	for _, o := range cq.orders {
+		c := compareValues(a.values[o.GetProperty()], b.values[o.GetProperty()])
+		if o.GetDirection() == pb.Query_Order_DESCENDING {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	if !cq.keyOrdered {
+		if c := compareKeys(a.entity.GetKey(), b.entity.GetKey()); c != 0 {
+			return c
+		}
+	}
+	for _, name := range cq.q.GetPropertyName() {
+		if c := compareValues(a.values[name], b.values[name]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// result converts r into an entity returned to the client.
+func (cq *compiledQuery) result(r *queryRow) *pb.EntityProto {
+	e := r.entity
+	switch {
+	case len(cq.q.GetPropertyName()) > 0:
+		res := &pb.EntityProto{Key: e.Key, EntityGroup: e.EntityGroup}
+		for _, name := range cq.q.GetPropertyName() {
+			res.Property = append(res.Property, &pb.Property{
+				Name:     proto.String(name),
+				Value:    r.values[name],
+				Meaning:  pb.Property_INDEX_VALUE.Enum(),
+				Multiple: proto.Bool(false),
+			})
+		}
+		e = res
+	case cq.q.GetKeysOnly():
+		e = &pb.EntityProto{Key: e.Key, EntityGroup: e.EntityGroup}
+	}
+	return proto.Clone(e).(*pb.EntityProto)
+}
+
+// rowSorter implements sort.Interface, ordering rows of a query.
+type rowSorter struct {
+	rows []*queryRow
+	cq   *compiledQuery
+}
+
+func (s *rowSorter) Len() int           { return len(s.rows) }
+func (s *rowSorter) Swap(i, j int)      { s.rows[i], s.rows[j] = s.rows[j], s.rows[i] }
+func (s *rowSorter) Less(i, j int) bool { return s.cq.compareRows(s.rows[i], s.rows[j]) < 0 }
+
+// encodeCursorRow creates a compiled cursor positioned right after r.
+// The position is opaque to clients, same as in production.
+func encodeCursorRow(r *queryRow) *pb.CompiledCursor {
+	pos := &pb.EntityProto{Key: r.entity.Key, EntityGroup: &pb.Path{}}
+	names := make([]string, 0, len(r.values))
+	for name := range r.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pos.Property = append(pos.Property, &pb.Property{
+			Name:     proto.String(name),
+			Value:    r.values[name],
+			Multiple: proto.Bool(false),
+		})
+	}
+	b, err := proto.Marshal(pos)
+	if err != nil {
+		panic(err)
+	}
+	return &pb.CompiledCursor{Position: &pb.CompiledCursor_Position{
+		StartKey:       proto.String(string(b)),
+		StartInclusive: proto.Bool(false),
+	}}
+}
+
+// decodeCursorRow is the opposite of encodeCursorRow.
+func decodeCursorRow(cc *pb.CompiledCursor) (*queryRow, error) {
+	pos := &pb.EntityProto{}
+	if err := proto.Unmarshal([]byte(cc.GetPosition().GetStartKey()), pos); err != nil {
+		return nil, datastoreError(pb.Error_BAD_REQUEST, "Invalid cursor: %v", err)
+	}
+	r := &queryRow{entity: pos, values: make(map[string]*pb.PropertyValue)}
+	for _, p := range pos.Property {
+		r.values[p.GetName()] = p.Value
+	}
+	return r, nil
+}
+
+// propertyValues returns all indexed values of property name of e.
+func propertyValues(e *pb.EntityProto, name string) []*pb.PropertyValue {
+	if name == keyProperty {
+		return []*pb.PropertyValue{keyValue(e.GetKey())}
+	}
+	var vals []*pb.PropertyValue
+	for _, p := range e.GetProperty() {
+		if p.GetName() == name {
+			vals = append(vals, p.GetValue())
+		}
+	}
+	return vals
+}
+
+func anyValueEquals(vals []*pb.PropertyValue, props []*pb.Property) bool {
+	for _, v := range vals {
+		for _, p := range props {
+			if compareValues(v, p.GetValue()) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isInequality(op pb.Query_Filter_Operator) bool {
+	switch op {
+	case pb.Query_Filter_LESS_THAN, pb.Query_Filter_LESS_THAN_OR_EQUAL,
+		pb.Query_Filter_GREATER_THAN, pb.Query_Filter_GREATER_THAN_OR_EQUAL:
+		return true
+	}
+	return false
+}
+
+// applyInequality reports whether "v op arg" holds.
+func applyInequality(op pb.Query_Filter_Operator, v, arg *pb.PropertyValue) bool {
+	c := compareValues(v, arg)
+	switch op {
+	case pb.Query_Filter_LESS_THAN:
+		return c < 0
+	case pb.Query_Filter_LESS_THAN_OR_EQUAL:
+		return c <= 0
+	case pb.Query_Filter_GREATER_THAN:
+		return c > 0
+	case pb.Query_Filter_GREATER_THAN_OR_EQUAL:
+		return c >= 0
+	}
+	return false
+}
+
+// keyValue converts key into a property value.
+func keyValue(key *pb.Reference) *pb.PropertyValue {
+	rv := &pb.PropertyValue_ReferenceValue{
+		App:       key.App,
+		NameSpace: key.NameSpace,
+	}
+	for _, el := range key.GetPath().GetElement() {
+		rv.Pathelement = append(rv.Pathelement, &pb.PropertyValue_ReferenceValue_PathElement{
+			Type: el.Type,
+			Id:   el.Id,
+			Name: el.Name,
+		})
+	}
+	return &pb.PropertyValue{Referencevalue: rv}
+}
+
+// valueKey converts a reference property value into a key.
+func valueKey(v *pb.PropertyValue_ReferenceValue) *pb.Reference {
+	key := &pb.Reference{App: v.App, NameSpace: v.NameSpace, Path: &pb.Path{}}
+	for _, el := range v.GetPathelement() {
+		key.Path.Element = append(key.Path.Element, &pb.Path_Element{
+			Type: el.Type,
+			Id:   el.Id,
+			Name: el.Name,
+		})
+	}
+	return key
+}
+
+// valueTypeRank returns the position of v's type in datastore ordering:
+// null < integers and dates < booleans < strings < doubles < points
+// < users < keys.
+func valueTypeRank(v *pb.PropertyValue) int {
+	switch {
+	case v == nil:
+		return 0
+	case v.Int64Value != nil:
+		return 1
+	case v.BooleanValue != nil:
+		return 2
+	case v.StringValue != nil:
+		return 3
+	case v.DoubleValue != nil:
+		return 4
+	case v.Pointvalue != nil:
+		return 5
+	case v.Uservalue != nil:
+		return 6
+	case v.Referencevalue != nil:
+		return 7
+	}
+	return 0
+}
+
+// compareValues orders property values the way datastore indexes do.
+func compareValues(a, b *pb.PropertyValue) int {
+	ra, rb := valueTypeRank(a), valueTypeRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch ra {
+	case 1:
+		x, y := a.GetInt64Value(), b.GetInt64Value()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case 2:
+		x, y := a.GetBooleanValue(), b.GetBooleanValue()
+		switch {
+		case x == y:
+			return 0
+		case y:
+			return -1
+		}
+		return 1
+	case 3:
+		return compareStrings(a.GetStringValue(), b.GetStringValue())
+	case 4:
+		return compareFloats(a.GetDoubleValue(), b.GetDoubleValue())
+	case 5:
+		pa, pbv := a.GetPointvalue(), b.GetPointvalue()
+		if c := compareFloats(pa.GetX(), pbv.GetX()); c != 0 {
+			return c
+		}
+		return compareFloats(pa.GetY(), pbv.GetY())
+	case 6:
+		ua, ub := a.GetUservalue(), b.GetUservalue()
+		if c := compareStrings(ua.GetEmail(), ub.GetEmail()); c != 0 {
+			return c
+		}
+		return compareStrings(ua.GetAuthDomain(), ub.GetAuthDomain())
+	case 7:
+		ka, kb := valueKey(a.GetReferencevalue()), valueKey(b.GetReferencevalue())
+		if c := compareStrings(ka.GetApp(), kb.GetApp()); c != 0 {
+			return c
+		}
+		return compareKeys(ka, kb)
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
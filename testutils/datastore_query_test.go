@@ -0,0 +1,215 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"reflect"
+	"testing"
+
+	"appengine"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// seedQueryEntities puts Items a-g with N from 10 down to 4 and Tag x, y,
+// x, ... Items a-e are root entities and also have Tag z, while f and g
+// are in Parent p entity group.
+func seedQueryEntities(t *testing.T, c appengine.Context) {
+	parent := testKey("Parent", "p", 0, nil)
+	var es []*pb.EntityProto
+	for i, name := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		var key *pb.Reference
+		if i < 5 {
+			key = testKey("Item", name, 0, nil)
+		} else {
+			key = testKey("Item", name, 0, parent)
+		}
+		tag := []string{"x", "y"}[i%2]
+		e := testEntity(key, testIntProp("N", int64(10-i)), testStringProp("Tag", tag))
+		if i < 5 {
+			e.Property = append(e.Property, testStringProp("Tag", "z"))
+		}
+		for _, p := range e.Property[1:] {
+			p.Multiple = proto.Bool(i < 5)
+		}
+		es = append(es, e)
+	}
+	testPut(t, c, es...)
+}
+
+func queryFilter(op pb.Query_Filter_Operator, p *pb.Property) *pb.Query_Filter {
+	return &pb.Query_Filter{Op: op.Enum(), Property: []*pb.Property{p}}
+}
+
+func queryOrder(name string, dir pb.Query_Order_Direction) *pb.Query_Order {
+	return &pb.Query_Order{Property: proto.String(name), Direction: dir.Enum()}
+}
+
+func TestQueryFiltersAndOrders(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	seedQueryEntities(t, c)
+
+	const (
+		eq  = pb.Query_Filter_EQUAL
+		lt  = pb.Query_Filter_LESS_THAN
+		gt  = pb.Query_Filter_GREATER_THAN
+		gte = pb.Query_Filter_GREATER_THAN_OR_EQUAL
+		asc = pb.Query_Order_ASCENDING
+		dsc = pb.Query_Order_DESCENDING
+	)
+	parent := testKey("Parent", "p", 0, nil)
+	tests := []struct {
+		name     string
+		filters  []*pb.Query_Filter
+		orders   []*pb.Query_Order
+		ancestor *pb.Reference
+		want     []string
+	}{
+		{"key order", nil, nil, nil,
+			[]string{"a", "b", "c", "d", "e", "f", "g"}},
+		{"inequality sorts by its property", []*pb.Query_Filter{queryFilter(gt, testIntProp("N", 7))}, nil, nil,
+			[]string{"c", "b", "a"}},
+		{"descending order", []*pb.Query_Filter{queryFilter(gte, testIntProp("N", 6))}, []*pb.Query_Order{queryOrder("N", dsc)}, nil,
+			[]string{"a", "b", "c", "d", "e"}},
+		{"equality and order", []*pb.Query_Filter{queryFilter(eq, testStringProp("Tag", "y"))}, []*pb.Query_Order{queryOrder("N", dsc)}, nil,
+			[]string{"b", "d", "f"}},
+		{"any of multiple values", []*pb.Query_Filter{queryFilter(eq, testStringProp("Tag", "z"))}, nil, nil,
+			[]string{"a", "b", "c", "d", "e"}},
+		{"equality and inequality", []*pb.Query_Filter{
+			queryFilter(eq, testStringProp("Tag", "x")),
+			queryFilter(lt, testIntProp("N", 9)),
+		}, nil, nil,
+			[]string{"g", "e", "c"}},
+		{"ancestor", nil, nil, parent,
+			[]string{"f", "g"}},
+		{"ancestor and filter", []*pb.Query_Filter{queryFilter(eq, testStringProp("Tag", "y"))}, nil, parent,
+			[]string{"f"}},
+		{"ancestor and order", nil, []*pb.Query_Order{queryOrder("N", asc)}, parent,
+			[]string{"g", "f"}},
+		{"no matches", []*pb.Query_Filter{queryFilter(eq, testStringProp("Tag", "w"))}, nil, nil,
+			[]string{}},
+	}
+	for _, tt := range tests {
+		q := &pb.Query{Kind: proto.String("Item"), Filter: tt.filters, Order: tt.orders, Ancestor: tt.ancestor}
+		es, _ := testGetAll(t, c, q)
+		if got := keyNames(es); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestQueryInvalid(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	tests := []struct {
+		name string
+		q    *pb.Query
+	}{
+		{"first order must be the inequality property", &pb.Query{
+			Kind:   proto.String("Item"),
+			Filter: []*pb.Query_Filter{queryFilter(pb.Query_Filter_GREATER_THAN, testIntProp("N", 7))},
+			Order:  []*pb.Query_Order{queryOrder("Tag", pb.Query_Order_ASCENDING)},
+		}},
+		{"inequalities on two properties", &pb.Query{
+			Kind: proto.String("Item"),
+			Filter: []*pb.Query_Filter{
+				queryFilter(pb.Query_Filter_GREATER_THAN, testIntProp("N", 7)),
+				queryFilter(pb.Query_Filter_LESS_THAN, testStringProp("Tag", "y")),
+			},
+		}},
+		{"kindless query with a property filter", &pb.Query{
+			Filter: []*pb.Query_Filter{queryFilter(pb.Query_Filter_EQUAL, testIntProp("N", 7))},
+		}},
+	}
+	for _, tt := range tests {
+		tt.q.App = proto.String(fullAppID())
+		if err := c.Call("datastore_v3", "RunQuery", tt.q, &pb.QueryResult{}, nil); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestQueryProjectionAndDistinct(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	seedQueryEntities(t, c)
+
+	// rows of Key name/Tag value
+	rows := func(es []*pb.EntityProto) []string {
+		var s []string
+		for i, e := range es {
+			if len(e.Property) != 1 || e.Property[0].GetMeaning() != pb.Property_INDEX_VALUE {
+				t.Errorf("Expected only index value of Tag, got %v", e.Property)
+				continue
+			}
+			s = append(s, keyNames(es)[i]+"/"+e.Property[0].GetValue().GetStringValue())
+		}
+		return s
+	}
+
+	es, res := testGetAll(t, c, &pb.Query{
+		Kind:         proto.String("Item"),
+		PropertyName: []string{"Tag"},
+		Filter:       []*pb.Query_Filter{queryFilter(pb.Query_Filter_GREATER_THAN_OR_EQUAL, testIntProp("N", 9))},
+	})
+	want := []string{"b/y", "b/z", "a/x", "a/z"}
+	if got := rows(es); !reflect.DeepEqual(got, want) {
+		t.Errorf("Projection: expected %v, got %v", want, got)
+	}
+	if !res.GetIndexOnly() {
+		t.Errorf("Expected an index only result")
+	}
+
+	es, _ = testGetAll(t, c, &pb.Query{
+		Kind:                proto.String("Item"),
+		PropertyName:        []string{"Tag"},
+		GroupByPropertyName: []string{"Tag"},
+		Order:               []*pb.Query_Order{queryOrder("Tag", pb.Query_Order_ASCENDING)},
+	})
+	want = []string{"a/x", "b/y", "a/z"}
+	if got := rows(es); !reflect.DeepEqual(got, want) {
+		t.Errorf("Distinct: expected %v, got %v", want, got)
+	}
+}
+
+func TestQueryCursors(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	seedQueryEntities(t, c)
+
+	byN := []*pb.Query_Order{queryOrder("N", pb.Query_Order_ASCENDING)}
+	es, res := testGetAll(t, c, &pb.Query{Kind: proto.String("Item"), Order: byN, Limit: proto.Int32(2)})
+	if got, want := keyNames(es), []string{"g", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("First page: expected %v, got %v", want, got)
+	}
+	start := res.CompiledCursor
+
+	es, res = testGetAll(t, c, &pb.Query{Kind: proto.String("Item"), Order: byN, Limit: proto.Int32(2),
+		CompiledCursor: start})
+	if got, want := keyNames(es), []string{"e", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Second page: expected %v, got %v", want, got)
+	}
+	end := res.CompiledCursor
+
+	es, _ = testGetAll(t, c, &pb.Query{Kind: proto.String("Item"), Order: byN, Offset: proto.Int32(1),
+		CompiledCursor: start})
+	if got, want := keyNames(es), []string{"d", "c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Cursor and offset: expected %v, got %v", want, got)
+	}
+
+	es, _ = testGetAll(t, c, &pb.Query{Kind: proto.String("Item"), Order: byN, EndCompiledCursor: end})
+	if got, want := keyNames(es), []string{"g", "f", "e", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("End cursor: expected %v, got %v", want, got)
+	}
+}
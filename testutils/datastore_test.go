@@ -0,0 +1,283 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"reflect"
+	"testing"
+
+	"appengine"
+	aei "appengine_internal"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// newTestContext creates a context for calling fakes from tests.
+func newTestContext(t *testing.T) (appengine.Context, func()) {
+	r, deleteContext := NewTestRequest("GET", "/", nil)
+	return appengine.NewContext(r), deleteContext
+}
+
+// testKey creates a key of the test app with a name or an ID.
+func testKey(kind, name string, id int64, parent *pb.Reference) *pb.Reference {
+	key := &pb.Reference{App: proto.String(fullAppID()), Path: &pb.Path{}}
+	if parent != nil {
+		key = proto.Clone(parent).(*pb.Reference)
+	}
+	el := &pb.Path_Element{Type: proto.String(kind)}
+	if name != "" {
+		el.Name = proto.String(name)
+	} else if id != 0 {
+		el.Id = proto.Int64(id)
+	}
+	key.Path.Element = append(key.Path.Element, el)
+	return key
+}
+
+func testEntity(key *pb.Reference, props ...*pb.Property) *pb.EntityProto {
+	return &pb.EntityProto{Key: key, EntityGroup: &pb.Path{}, Property: props}
+}
+
+func testStringProp(name, v string) *pb.Property {
+	return &pb.Property{
+		Name:     proto.String(name),
+		Multiple: proto.Bool(false),
+		Value:    &pb.PropertyValue{StringValue: proto.String(v)},
+	}
+}
+
+func testIntProp(name string, v int64) *pb.Property {
+	return &pb.Property{
+		Name:     proto.String(name),
+		Multiple: proto.Bool(false),
+		Value:    &pb.PropertyValue{Int64Value: proto.Int64(v)},
+	}
+}
+
+func testPut(t *testing.T, c appengine.Context, es ...*pb.EntityProto) []*pb.Reference {
+	res := &pb.PutResponse{}
+	if err := c.Call("datastore_v3", "Put", &pb.PutRequest{Entity: es}, res, nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	return res.Key
+}
+
+// testGet gets entities of keys, in transaction tx if it's not nil.
+// Missing entities are nil.
+func testGet(t *testing.T, c appengine.Context, tx *pb.Transaction, keys ...*pb.Reference) []*pb.EntityProto {
+	res := &pb.GetResponse{}
+	if err := c.Call("datastore_v3", "Get", &pb.GetRequest{Key: keys, Transaction: tx}, res, nil); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	es := make([]*pb.EntityProto, len(res.Entity))
+	for i, re := range res.Entity {
+		es[i] = re.Entity
+	}
+	return es
+}
+
+// datastoreErrorCode returns datastore error code of err, or 0 if err is
+// nil.
+func datastoreErrorCode(t *testing.T, err error) pb.Error_ErrorCode {
+	if err == nil {
+		return 0
+	}
+	apiErr, ok := err.(*aei.APIError)
+	if !ok || apiErr.Service != "datastore_v3" {
+		t.Fatalf("Expected a datastore API error, got %#v", err)
+	}
+	return pb.Error_ErrorCode(apiErr.Code)
+}
+
+// testGetAll runs q and fetches all batches like datastore.Query.GetAll
+// does: offset and limit left after a batch are passed to the next one.
+// Returns the results and the last batch.
+func testGetAll(t *testing.T, c appengine.Context, q *pb.Query) ([]*pb.EntityProto, *pb.QueryResult) {
+	q.App = proto.String(fullAppID())
+	q.Compile = proto.Bool(true)
+	res := &pb.QueryResult{}
+	if err := c.Call("datastore_v3", "RunQuery", q, res, nil); err != nil {
+		t.Fatalf("RunQuery: %v", err)
+	}
+	offset, limit := q.GetOffset(), int32(-1)
+	if q.Limit != nil {
+		limit = q.GetLimit()
+	}
+	var results []*pb.EntityProto
+	for {
+		results = append(results, res.Result...)
+		offset -= res.GetSkippedResults()
+		if limit >= 0 {
+			limit -= int32(len(res.Result))
+		}
+		if !res.GetMoreResults() || limit == 0 {
+			return results, res
+		}
+		req := &pb.NextRequest{
+			Cursor:  res.Cursor,
+			Offset:  proto.Int32(offset),
+			Compile: proto.Bool(true),
+		}
+		if q.Count != nil {
+			req.Count = q.Count
+		}
+		res = &pb.QueryResult{}
+		if err := c.Call("datastore_v3", "Next", req, res, nil); err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+	}
+}
+
+// keyNames returns the last key name of each entity.
+func keyNames(es []*pb.EntityProto) []string {
+	names := make([]string, len(es))
+	for i, e := range es {
+		el := e.GetKey().GetPath().GetElement()
+		names[i] = el[len(el)-1].GetName()
+	}
+	return names
+}
+
+func TestDatastorePutGetDelete(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	keys := testPut(t, c,
+		testEntity(testKey("Item", "a", 0, nil), testStringProp("Name", "x")),
+		testEntity(testKey("Item", "", 0, nil), testStringProp("Name", "y")))
+	if id := keys[1].GetPath().GetElement()[0].GetId(); id == 0 {
+		t.Errorf("Expected an allocated ID, got %v", keys[1])
+	}
+
+	get := func() *pb.GetResponse {
+		res := &pb.GetResponse{}
+		req := &pb.GetRequest{Key: []*pb.Reference{keys[0], testKey("Item", "missing", 0, nil)}}
+		if err := c.Call("datastore_v3", "Get", req, res, nil); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		return res
+	}
+	res := get()
+	if v := res.Entity[0].GetEntity().GetProperty()[0].GetValue().GetStringValue(); v != "x" {
+		t.Errorf("Expected Name x, got %q", v)
+	}
+	if res.Entity[1].Entity != nil {
+		t.Errorf("Expected no entity for a missing key, got %v", res.Entity[1])
+	}
+
+	if err := c.Call("datastore_v3", "Delete", &pb.DeleteRequest{Key: keys[:1]}, &pb.DeleteResponse{}, nil); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if res := get(); res.Entity[0].Entity != nil {
+		t.Errorf("Expected a deleted entity to be gone, got %v", res.Entity[0])
+	}
+}
+
+func TestDatastoreExplicitIds(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	testPut(t, c, testEntity(testKey("Item", "", 1, nil), testStringProp("Name", "first")))
+	// an incomplete key goes before an explicit ID in the same batch
+	keys := testPut(t, c,
+		testEntity(testKey("Item", "", 0, nil), testStringProp("Name", "second")),
+		testEntity(testKey("Item", "", 3, nil), testStringProp("Name", "third")))
+	if id := keys[0].GetPath().GetElement()[0].GetId(); id == 1 || id == 3 {
+		t.Errorf("Expected an ID other than explicit ones, got %d", id)
+	}
+
+	q := &pb.Query{Kind: proto.String("Item")}
+	es, _ := testGetAll(t, c, q)
+	var names []string
+	for _, e := range es {
+		names = append(names, e.GetProperty()[0].GetValue().GetStringValue())
+	}
+	if want := []string{"first", "third", "second"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected entities %v, got %v", want, names)
+	}
+}
+
+func TestDatastoreOffsetLimit(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		testPut(t, c, testEntity(testKey("Item", name, 0, nil)))
+	}
+
+	// expected results are those of dev_appserver for GetAll with
+	// Offset and Limit: offset rows don't count against the limit
+	tests := []struct {
+		offset, limit, count int32
+		want                 []string
+	}{
+		{0, 3, 0, []string{"a", "b", "c"}},
+		{1, 3, 0, []string{"b", "c", "d"}},
+		{1, 3, 1, []string{"b", "c", "d"}},
+		{2, -1, 2, []string{"c", "d", "e"}},
+		{3, 5, 0, []string{"d", "e"}},
+		{4, 3, 1, []string{"e"}},
+		{5, 3, 0, []string{}},
+		{1, 0, 0, []string{}},
+	}
+	for _, tt := range tests {
+		q := &pb.Query{Kind: proto.String("Item"), Offset: proto.Int32(tt.offset)}
+		if tt.limit >= 0 {
+			q.Limit = proto.Int32(tt.limit)
+		}
+		if tt.count > 0 {
+			q.Count = proto.Int32(tt.count)
+		}
+		es, _ := testGetAll(t, c, q)
+		if got := keyNames(es); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Offset(%d).Limit(%d), batches of %d: expected %v, got %v",
+				tt.offset, tt.limit, tt.count, tt.want, got)
+		}
+	}
+}
+
+func TestDatastoreAllocateIds(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	allocate := func(req *pb.AllocateIdsRequest) (int64, int64) {
+		req.ModelKey = testKey("Item", "", 0, nil)
+		res := &pb.AllocateIdsResponse{}
+		if err := c.Call("datastore_v3", "AllocateIds", req, res, nil); err != nil {
+			t.Fatalf("AllocateIds(%v): %v", req, err)
+		}
+		return res.GetStart(), res.GetEnd()
+	}
+	tests := []struct {
+		req        *pb.AllocateIdsRequest
+		start, end int64
+	}{
+		{&pb.AllocateIdsRequest{Size: proto.Int64(10)}, 1, 10},
+		{&pb.AllocateIdsRequest{Max: proto.Int64(20)}, 11, 20},
+		// nothing left below max
+		{&pb.AllocateIdsRequest{Max: proto.Int64(15)}, 0, 0},
+		{&pb.AllocateIdsRequest{Max: proto.Int64(20)}, 0, 0},
+		{&pb.AllocateIdsRequest{Size: proto.Int64(1)}, 21, 21},
+	}
+	for _, tt := range tests {
+		if start, end := allocate(tt.req); start != tt.start || end != tt.end {
+			t.Errorf("AllocateIds(%v): expected %d-%d, got %d-%d", tt.req, tt.start, tt.end, start, end)
+		}
+	}
+
+	err := c.Call("datastore_v3", "AllocateIds", &pb.AllocateIdsRequest{
+		ModelKey: testKey("Item", "", 0, nil),
+		Size:     proto.Int64(0),
+	}, &pb.AllocateIdsResponse{}, nil)
+	if err == nil {
+		t.Errorf("Expected an error for size 0")
+	}
+}
@@ -0,0 +1,147 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// maxGroupsPerTransaction is the maximum number of entity groups
+// a cross-group (XG) transaction can operate on.
+const maxGroupsPerTransaction = 5
+
+// transaction is the state of a datastore transaction between
+// BeginTransaction and Commit or Rollback calls.
+type transaction struct {
+	xg bool
+	// entity groups the transaction operates on; values are entity group
+	// versions at the time of the first access.
+	groups map[string]int64
+	// puts and deletes to apply on commit, in the order they were made
+	mutations []*mutation
+}
+
+// mutation is a write applied at a later point, e.g. on transaction commit.
+// A nil entity means delete.
+type mutation struct {
+	key    *pb.Reference
+	entity *pb.EntityProto
+}
+
+// ForceContention makes commit attempts with the given numbers fail with
+// CONCURRENT_TRANSACTION error, as if another request modified the same
+// entity group. Attempts are counted from 1 across all Commit calls made
+// to ds.
+//
+// For instance, ForceContention(1, 2) makes datastore.RunInTransaction
+// call its function three times and succeed on the last attempt,
+// while ForceContention(1, 2, 3) makes it give up and return
+// datastore.ErrConcurrentTransaction.
+func (ds *FakeDatastore) ForceContention(attempts ...int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, n := range attempts {
+		ds.contention[n] = true
+	}
+}
+
+func (ds *FakeDatastore) beginTransaction(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.BeginTransactionRequest), out.(*pb.Transaction)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.lastTxn++
+	ds.txns[ds.lastTxn] = &transaction{
+		xg:     req.GetAllowMultipleEg(),
+		groups: make(map[string]int64),
+	}
+	resp.Handle = proto.Uint64(ds.lastTxn)
+	resp.App = proto.String(req.GetApp())
+	return nil
+}
+
+func (ds *FakeDatastore) commit(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.Transaction)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	tx, err := ds.transaction(req)
+	if err != nil {
+		return err
+	}
+	delete(ds.txns, req.GetHandle())
+
+	ds.commits++
+	if ds.contention[ds.commits] {
+		return datastoreError(pb.Error_CONCURRENT_TRANSACTION,
+			"too much contention on these datastore entities. please try again.")
+	}
+	for group, version := range tx.groups {
+		if ds.versions[group] != version {
+			return datastoreError(pb.Error_CONCURRENT_TRANSACTION,
+				"too much contention on these datastore entities. please try again.")
+		}
+	}
+	keys := make([]*pb.Reference, len(tx.mutations))
+	for i, m := range tx.mutations {
+		ds.store(m.key, m.entity)
+		keys[i] = m.key
+	}
+	ds.settle(keys...)
+	return nil
+}
+
+func (ds *FakeDatastore) rollback(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.Transaction)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, err := ds.transaction(req); err != nil {
+		return err
+	}
+	delete(ds.txns, req.GetHandle())
+	return nil
+}
+
+// transaction returns in-flight transaction identified by t.
+func (ds *FakeDatastore) transaction(t *pb.Transaction) (*transaction, error) {
+	tx, ok := ds.txns[t.GetHandle()]
+	if !ok {
+		return nil, datastoreError(pb.Error_BAD_REQUEST,
+			"transaction has expired or is invalid")
+	}
+	return tx, nil
+}
+
+// enlist adds entity groups of keys to the transaction, remembering their
+// current versions. It fails if the transaction would span more entity
+// groups than allowed.
+func (tx *transaction) enlist(ds *FakeDatastore, keys ...*pb.Reference) error {
+	for _, key := range keys {
+		group := entityGroupString(key)
+		if _, ok := tx.groups[group]; ok {
+			continue
+		}
+		switch {
+		case !tx.xg && len(tx.groups) > 0:
+			return datastoreError(pb.Error_BAD_REQUEST,
+				"cross-group transaction need to be explicitly specified, "+
+					"see TransactionOptions.XG")
+		case len(tx.groups) >= maxGroupsPerTransaction:
+			return datastoreError(pb.Error_BAD_REQUEST,
+				"operating on too many entity groups in a single transaction.")
+		}
+		tx.groups[group] = ds.versions[group]
+	}
+	return nil
+}
+
+// entityGroupString returns keyString of the root entity of key's
+// entity group.
+func entityGroupString(key *pb.Reference) string {
+	root := &pb.Reference{
+		App:       key.App,
+		NameSpace: key.NameSpace,
+		Path:      &pb.Path{Element: key.GetPath().GetElement()[:1]},
+	}
+	return keyString(root)
+}
@@ -0,0 +1,208 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"testing"
+
+	"appengine"
+	basepb "appengine_internal/base"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// testBegin starts a transaction, a cross-group one if xg is true.
+func testBegin(t *testing.T, c appengine.Context, xg bool) *pb.Transaction {
+	tx := &pb.Transaction{}
+	req := &pb.BeginTransactionRequest{App: proto.String(fullAppID()), AllowMultipleEg: proto.Bool(xg)}
+	if err := c.Call("datastore_v3", "BeginTransaction", req, tx, nil); err != nil {
+		t.Fatalf("BeginTransaction: %v", err)
+	}
+	return tx
+}
+
+// txnCall makes a call of method with tx, returning the error code.
+func txnCall(t *testing.T, c appengine.Context, method string, tx *pb.Transaction) pb.Error_ErrorCode {
+	var out proto.Message = &basepb.VoidProto{}
+	if method == "Commit" {
+		out = &pb.CommitResponse{}
+	}
+	return datastoreErrorCode(t, c.Call("datastore_v3", method, tx, out, nil))
+}
+
+// txnPut puts es in tx, returning the error code.
+func txnPut(t *testing.T, c appengine.Context, tx *pb.Transaction, es ...*pb.EntityProto) pb.Error_ErrorCode {
+	err := c.Call("datastore_v3", "Put", &pb.PutRequest{Entity: es, Transaction: tx}, &pb.PutResponse{}, nil)
+	return datastoreErrorCode(t, err)
+}
+
+// txnGet gets keys in tx, returning the error code.
+func txnGet(t *testing.T, c appengine.Context, tx *pb.Transaction, keys ...*pb.Reference) pb.Error_ErrorCode {
+	err := c.Call("datastore_v3", "Get", &pb.GetRequest{Key: keys, Transaction: tx}, &pb.GetResponse{}, nil)
+	return datastoreErrorCode(t, err)
+}
+
+// intValue returns value of the first property of e, or -1 if e is nil.
+func intValue(e *pb.EntityProto) int64 {
+	if e == nil {
+		return -1
+	}
+	return e.Property[0].GetValue().GetInt64Value()
+}
+
+func TestTransactionCommitRollback(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	a := testKey("Item", "a", 0, nil)
+	b := testKey("Item", "b", 0, a)
+	testPut(t, c, testEntity(a, testIntProp("N", 1)))
+
+	tx := testBegin(t, c, false)
+	if code := txnPut(t, c, tx, testEntity(a, testIntProp("N", 2)), testEntity(b, testIntProp("N", 1))); code != 0 {
+		t.Fatalf("Put: %v", code)
+	}
+	if es := testGet(t, c, nil, a, b); intValue(es[0]) != 1 || es[1] != nil {
+		t.Errorf("Expected no changes before commit, got %v", es)
+	}
+	if code := txnCall(t, c, "Commit", tx); code != 0 {
+		t.Fatalf("Commit: %v", code)
+	}
+	if es := testGet(t, c, nil, a, b); intValue(es[0]) != 2 || intValue(es[1]) != 1 {
+		t.Errorf("Expected changes after commit, got %v", es)
+	}
+
+	rb := testBegin(t, c, false)
+	txnPut(t, c, rb, testEntity(a, testIntProp("N", 3)))
+	err := c.Call("datastore_v3", "Delete", &pb.DeleteRequest{Key: []*pb.Reference{b}, Transaction: rb},
+		&pb.DeleteResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if code := txnCall(t, c, "Rollback", rb); code != 0 {
+		t.Fatalf("Rollback: %v", code)
+	}
+	if es := testGet(t, c, nil, a, b); intValue(es[0]) != 2 || intValue(es[1]) != 1 {
+		t.Errorf("Expected no changes after rollback, got %v", es)
+	}
+
+	// handles can't be reused once committed or rolled back
+	for _, h := range []*pb.Transaction{tx, rb} {
+		for _, method := range []string{"Commit", "Rollback"} {
+			if code := txnCall(t, c, method, h); code != pb.Error_BAD_REQUEST {
+				t.Errorf("%s of transaction %d: expected BAD_REQUEST, got %v", method, h.GetHandle(), code)
+			}
+		}
+		if code := txnPut(t, c, h, testEntity(a, testIntProp("N", 4))); code != pb.Error_BAD_REQUEST {
+			t.Errorf("Put in transaction %d: expected BAD_REQUEST, got %v", h.GetHandle(), code)
+		}
+		if code := txnGet(t, c, h, a); code != pb.Error_BAD_REQUEST {
+			t.Errorf("Get in transaction %d: expected BAD_REQUEST, got %v", h.GetHandle(), code)
+		}
+	}
+	if es := testGet(t, c, nil, a); intValue(es[0]) != 2 {
+		t.Errorf("Expected N 2, got %v", es[0])
+	}
+}
+
+func TestTransactionConflict(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	a, other := testKey("Item", "a", 0, nil), testKey("Item", "other", 0, nil)
+
+	tests := []struct {
+		desc string
+		// key written outside of the transaction after it reads a
+		write *pb.Reference
+		code  pb.Error_ErrorCode
+		// N of a afterwards
+		want int64
+	}{
+		{"same entity", a, pb.Error_CONCURRENT_TRANSACTION, 100},
+		{"same entity group", testKey("Item", "child", 0, a), pb.Error_CONCURRENT_TRANSACTION, 100},
+		{"other entity group", other, 0, 2},
+	}
+	for i, tt := range tests {
+		tx := testBegin(t, c, false)
+		if code := txnGet(t, c, tx, a); code != 0 {
+			t.Fatalf("%s: Get: %v", tt.desc, code)
+		}
+		txnPut(t, c, tx, testEntity(a, testIntProp("N", int64(i))))
+		testPut(t, c, testEntity(tt.write, testIntProp("N", 100)))
+		if code := txnCall(t, c, "Commit", tx); code != tt.code {
+			t.Errorf("%s: expected %v, got %v", tt.desc, tt.code, code)
+		}
+		if es := testGet(t, c, nil, a); intValue(es[0]) != tt.want {
+			t.Errorf("%s: expected N %d, got %v", tt.desc, tt.want, es[0])
+		}
+	}
+}
+
+func TestTransactionGroups(t *testing.T) {
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	roots := make([]*pb.Reference, maxGroupsPerTransaction+1)
+	for i := range roots {
+		roots[i] = testKey("Item", "", int64(i+1), nil)
+	}
+
+	tx := testBegin(t, c, false)
+	// a child is in the group of its root
+	if code := txnGet(t, c, tx, roots[0], testKey("Item", "child", 0, roots[0])); code != 0 {
+		t.Errorf("Expected one entity group to be allowed, got %v", code)
+	}
+	if code := txnGet(t, c, tx, roots[1]); code != pb.Error_BAD_REQUEST {
+		t.Errorf("Expected BAD_REQUEST for two entity groups w/o XG, got %v", code)
+	}
+	txnCall(t, c, "Rollback", tx)
+
+	xg := testBegin(t, c, true)
+	if code := txnGet(t, c, xg, roots[:maxGroupsPerTransaction]...); code != 0 {
+		t.Errorf("Expected %d entity groups to be allowed, got %v", maxGroupsPerTransaction, code)
+	}
+	if code := txnPut(t, c, xg, testEntity(roots[maxGroupsPerTransaction], testIntProp("N", 1))); code != pb.Error_BAD_REQUEST {
+		t.Errorf("Expected BAD_REQUEST for %d entity groups, got %v", maxGroupsPerTransaction+1, code)
+	}
+	if code := txnCall(t, c, "Commit", xg); code != 0 {
+		t.Errorf("Commit: %v", code)
+	}
+}
+
+func TestForceContention(t *testing.T) {
+	ds, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	a := testKey("Item", "a", 0, nil)
+
+	ds.ForceContention(1, 2, 4)
+	want := []pb.Error_ErrorCode{
+		pb.Error_CONCURRENT_TRANSACTION,
+		pb.Error_CONCURRENT_TRANSACTION,
+		0,
+		pb.Error_CONCURRENT_TRANSACTION,
+		0,
+	}
+	for i, code := range want {
+		tx := testBegin(t, c, false)
+		txnPut(t, c, tx, testEntity(a, testIntProp("N", int64(i+1))))
+		if got := txnCall(t, c, "Commit", tx); got != code {
+			t.Errorf("Commit attempt %d: expected %v, got %v", i+1, code, got)
+		}
+		if i == 2 {
+			if es := testGet(t, c, nil, a); intValue(es[0]) != 3 {
+				t.Errorf("Expected only attempt 3 to be applied, got %v", es[0])
+			}
+		}
+	}
+	if es := testGet(t, c, nil, a); intValue(es[0]) != 5 {
+		t.Errorf("Expected N 5 after the last attempt, got %v", es[0])
+	}
+}
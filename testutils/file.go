@@ -0,0 +1,378 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"strings"
+	"sync"
+
+	"appengine"
+
+	aei "appengine_internal"
+	dspb "appengine_internal/datastore"
+	pb "appengine_internal/files"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// blobstoreFileDir is the directory of blobstore files.
+	blobstoreFileDir = "/blobstore/"
+	// creationHandlePrefix starts names of files which are not finalized.
+	creationHandlePrefix = "writable:"
+	// blobFileIndexKind is the kind of entities which map creation handles
+	// of finalized files to blob keys.
+	blobFileIndexKind = "__BlobFileIndex__"
+	// maxFileAppendSize is the most data a single Append can write.
+	maxFileAppendSize = 1 << 20
+)
+
+// FakeFileService is an implementation of "file" service, the Files API,
+// for blobstore files. Files are created with a /blobstore/writable:<handle>
+// name, appended to and finalized into blobs of the blobstore created by
+// NewFakeBlobstore. Finalized files can then be read with their
+// /blobstore/<blob key> names, or with blobstore API.
+//
+// Like in production, a file is finalized only while it is opened with
+// an exclusive lock, which no other open can get at the same time, and it
+// can't be appended to afterwards.
+type FakeFileService struct {
+	mu sync.Mutex
+	// files created with Create, by name
+	files map[string]*writableFile
+	// open files by name; a file can be opened several times unless
+	// it has an exclusive lock
+	opened map[string]*openedFile
+}
+
+// writableFile is a file created with Create.
+type writableFile struct {
+	contentType  string
+	uploadedName string
+	data         []byte
+	// the last sequence key of Append
+	sequenceKey string
+	// blob of a finalized file
+	blobKey appengine.BlobKey
+}
+
+type openedFile struct {
+	mode      pb.OpenRequest_OpenMode
+	exclusive bool
+	count     int
+}
+
+// NewFakeFileService creates a file service with no files and registers it
+// as "file" service implementation. Finalizing files requires a blobstore
+// created by NewFakeBlobstore, and in turn a datastore.
+//
+// Returns the service and a function that unregisters it. Here's an example:
+//
+// 		func TestExport(t *testing.T) {
+// 			_, unregisterDatastore := NewFakeDatastore()
+// 			defer unregisterDatastore()
+// 			bs, unregisterBlobstore := NewFakeBlobstore()
+// 			defer unregisterBlobstore()
+// 			fs, unregister := NewFakeFileService()
+// 			defer unregister()
+//
+// 			// test code that writes a file and finalizes it
+//
+// 			key, _ := fs.BlobKey(filename)
+// 			if data, _ := bs.Blob(key); string(data) != want {
+// 				t.Errorf("Exported %q, want %q", data, want)
+// 			}
+// 		}
+//
+func NewFakeFileService() (*FakeFileService, func()) {
+	fs := &FakeFileService{
+		files:  make(map[string]*writableFile),
+		opened: make(map[string]*openedFile),
+	}
+	return fs, registerServiceOverrides("file", map[string]RpcStubFunc{
+		"Create":          fs.create,
+		"Open":            fs.open,
+		"Append":          fs.append,
+		"Close":           fs.close,
+		"Read":            fs.read,
+		"Stat":            fs.stat,
+		"GetCapabilities": fs.getCapabilities,
+	})
+}
+
+// BlobKey returns the key of the blob a file was finalized into. ok is false
+// if there's no file with the name, or it's not finalized.
+func (fs *FakeFileService) BlobKey(filename string) (key appengine.BlobKey, ok bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if f := fs.files[filename]; f != nil && f.blobKey != "" {
+		return f.blobKey, true
+	}
+	return "", false
+}
+
+func (fs *FakeFileService) create(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.CreateRequest), out.(*pb.CreateResponse)
+	if req.GetFilesystem() != "blobstore" {
+		return fileError(pb.FileServiceErrors_UNSUPPORTED_FILE_SYSTEM, req.GetFilesystem())
+	}
+	if req.GetContentType() != pb.FileContentType_RAW {
+		return fileError(pb.FileServiceErrors_UNSUPPORTED_CONTENT_TYPE, req.GetContentType().String())
+	}
+	if req.Filename != nil {
+		return fileError(pb.FileServiceErrors_FILE_NAME_SPECIFIED, req.GetFilename())
+	}
+	f := &writableFile{contentType: "application/octet-stream"}
+	for _, p := range req.GetParameters() {
+		switch p.GetName() {
+		case "content_type":
+			f.contentType = p.GetValue()
+		case "file_name":
+			f.uploadedName = p.GetValue()
+		default:
+			return fileError(pb.FileServiceErrors_INVALID_PARAMETER, p.GetName())
+		}
+	}
+	name := blobstoreFileDir + creationHandlePrefix + randomString(24)
+	fs.mu.Lock()
+	fs.files[name] = f
+	fs.mu.Unlock()
+	resp.Filename = proto.String(name)
+	return nil
+}
+
+func (fs *FakeFileService) open(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.OpenRequest)
+	name, mode := req.GetFilename(), req.GetOpenMode()
+	if req.GetContentType() != pb.FileContentType_RAW {
+		return fileError(pb.FileServiceErrors_WRONG_CONTENT_TYPE, req.GetContentType().String())
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, key, err := fs.lookup(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case mode == pb.OpenRequest_APPEND && f == nil:
+		return fileError(pb.FileServiceErrors_READ_ONLY, name)
+	case mode == pb.OpenRequest_APPEND && key != "":
+		return fileError(pb.FileServiceErrors_FINALIZATION_ERROR, name+" is finalized")
+	case mode == pb.OpenRequest_READ && key == "":
+		return fileError(pb.FileServiceErrors_FINALIZATION_ERROR, name+" is not finalized")
+	}
+	if o := fs.opened[name]; o != nil {
+		if o.exclusive || req.GetExclusiveLock() {
+			return fileError(pb.FileServiceErrors_EXCLUSIVE_LOCK_FAILED, name)
+		}
+		if o.mode != mode {
+			return fileError(pb.FileServiceErrors_WRONG_OPEN_MODE, name)
+		}
+		o.count++
+		return nil
+	}
+	fs.opened[name] = &openedFile{mode: mode, exclusive: req.GetExclusiveLock(), count: 1}
+	return nil
+}
+
+func (fs *FakeFileService) append(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.AppendRequest)
+	name := req.GetFilename()
+	if len(req.Data) > maxFileAppendSize {
+		return fileError(pb.FileServiceErrors_REQUEST_TOO_LARGE, name)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkOpen(name, pb.OpenRequest_APPEND); err != nil {
+		return err
+	}
+	f := fs.files[name]
+	if req.SequenceKey != nil {
+		if req.GetSequenceKey() <= f.sequenceKey {
+			return fileError(pb.FileServiceErrors_SEQUENCE_KEY_OUT_OF_ORDER, req.GetSequenceKey())
+		}
+		f.sequenceKey = req.GetSequenceKey()
+	}
+	f.data = append(f.data, req.Data...)
+	return nil
+}
+
+func (fs *FakeFileService) close(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.CloseRequest)
+	name := req.GetFilename()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	o := fs.opened[name]
+	if o == nil {
+		return fileError(pb.FileServiceErrors_FILE_NOT_OPENED, name)
+	}
+	if req.GetFinalize() {
+		if o.mode != pb.OpenRequest_APPEND {
+			return fileError(pb.FileServiceErrors_WRONG_OPEN_MODE, name)
+		}
+		if !o.exclusive {
+			return fileError(pb.FileServiceErrors_EXCLUSIVE_LOCK_REQUIRED, name)
+		}
+		if err := fs.finalize(name); err != nil {
+			return err
+		}
+	}
+	if o.count--; o.count == 0 {
+		delete(fs.opened, name)
+	}
+	return nil
+}
+
+func (fs *FakeFileService) read(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.ReadRequest), out.(*pb.ReadResponse)
+	name := req.GetFilename()
+	if req.GetPos() < 0 || req.GetMaxBytes() < 0 {
+		return fileError(pb.FileServiceErrors_OUT_OF_BOUNDS, name)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkOpen(name, pb.OpenRequest_READ); err != nil {
+		return err
+	}
+	_, key, err := fs.lookup(name)
+	if err != nil {
+		return err
+	}
+	data := blobData(key)
+	size := int64(len(data))
+	pos, n := req.GetPos(), req.GetMaxBytes()
+	if pos > size {
+		pos = size
+	}
+	// clamped first, as pos+n may overflow
+	if n > size-pos {
+		n = size - pos
+	}
+	end := pos + n
+	resp.Data = append([]byte{}, data[pos:end]...)
+	return nil
+}
+
+func (fs *FakeFileService) stat(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.StatRequest), out.(*pb.StatResponse)
+	if req.FileGlob != nil {
+		return fileError(pb.FileServiceErrors_GLOBS_NOT_SUPPORTED, req.GetFileGlob())
+	}
+	name := req.GetFilename()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, key, err := fs.lookup(name)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if key != "" {
+		size = int64(len(blobData(key)))
+	} else {
+		size = int64(len(f.data))
+	}
+	resp.Stat = []*pb.FileStat{{
+		Filename:    proto.String(name),
+		ContentType: pb.FileContentType_RAW.Enum(),
+		Finalized:   proto.Bool(key != ""),
+		Length:      proto.Int64(size),
+	}}
+	return nil
+}
+
+func (fs *FakeFileService) getCapabilities(in, out proto.Message, _ *RpcCallOptions) error {
+	resp := out.(*pb.GetCapabilitiesResponse)
+	resp.Filesystem = []string{"blobstore"}
+	resp.ShuffleAvailable = proto.Bool(false)
+	return nil
+}
+
+// lookup finds a file by name. f is the file created with Create, or nil
+// if name is /blobstore/<blob key>. key is the blob of a finalized file.
+func (fs *FakeFileService) lookup(name string) (f *writableFile, key appengine.BlobKey, err error) {
+	if !strings.HasPrefix(name, blobstoreFileDir) {
+		return nil, "", fileError(pb.FileServiceErrors_INVALID_FILE_NAME, name)
+	}
+	ticket := strings.TrimPrefix(name, blobstoreFileDir)
+	if strings.HasPrefix(ticket, creationHandlePrefix) {
+		if f = fs.files[name]; f == nil {
+			return nil, "", fileError(pb.FileServiceErrors_EXISTENCE_ERROR, name)
+		}
+		return f, f.blobKey, nil
+	}
+	key = appengine.BlobKey(ticket)
+	if blobData(key) == nil {
+		return nil, "", fileError(pb.FileServiceErrors_EXISTENCE_ERROR, name)
+	}
+	return nil, key, nil
+}
+
+// checkOpen fails unless name is open in the given mode.
+func (fs *FakeFileService) checkOpen(name string, mode pb.OpenRequest_OpenMode) error {
+	o := fs.opened[name]
+	if o == nil {
+		return fileError(pb.FileServiceErrors_FILE_NOT_OPENED, name)
+	}
+	if o.mode != mode {
+		return fileError(pb.FileServiceErrors_WRONG_OPEN_MODE, name)
+	}
+	return nil
+}
+
+// finalize stores contents of a file as a blob. Like in production,
+// the blob info records the creation handle of the file, and
+// a __BlobFileIndex__ entity maps the handle to the blob key.
+func (fs *FakeFileService) finalize(name string) error {
+	currentMu.Lock()
+	bs, ds := currentBlobstore, currentDatastore
+	currentMu.Unlock()
+	if bs == nil {
+		return fileError(pb.FileServiceErrors_FINALIZATION_ERROR,
+			"no blobstore, call NewFakeBlobstore first")
+	}
+	f := fs.files[name]
+	handle := strings.TrimPrefix(name, blobstoreFileDir)
+	bi := newBlobInfo(f.contentType, f.uploadedName, f.data)
+	bi.creationHandle = handle
+	if err := bs.store(bi, f.data); err != nil {
+		return fileError(pb.FileServiceErrors_FINALIZATION_ERROR, err.Error())
+	}
+	key := &dspb.Reference{
+		App: proto.String(fullAppID()),
+		Path: &dspb.Path{Element: []*dspb.Path_Element{{
+			Type: proto.String(blobFileIndexKind),
+			Name: proto.String(handle),
+		}}},
+	}
+	ds.storeInternal(key, &dspb.EntityProto{
+		Key: key,
+		RawProperty: []*dspb.Property{{
+			Name:     proto.String("blob_key"),
+			Value:    &dspb.PropertyValue{StringValue: proto.String(string(bi.key))},
+			Multiple: proto.Bool(false),
+		}},
+	})
+	f.blobKey = bi.key
+	return nil
+}
+
+// blobData returns contents of a blob of the blobstore created by
+// NewFakeBlobstore, or nil if there's no such blob.
+func blobData(key appengine.BlobKey) []byte {
+	currentMu.Lock()
+	bs := currentBlobstore
+	currentMu.Unlock()
+	if bs == nil {
+		return nil
+	}
+	data, ok := bs.Blob(key)
+	if ok && data == nil {
+		data = []byte{}
+	}
+	return data
+}
+
+// fileError creates an API error with the given code.
+func fileError(code pb.FileServiceErrors_ErrorCode, detail string) error {
+	return &aei.APIError{Service: "file", Code: int32(code), Detail: detail}
+}
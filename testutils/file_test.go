@@ -0,0 +1,152 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"math"
+	"testing"
+
+	"appengine"
+
+	aei "appengine_internal"
+	pb "appengine_internal/files"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// fileErrorCode returns file service error code of err, or 0 if err is nil.
+func fileErrorCode(t *testing.T, err error) pb.FileServiceErrors_ErrorCode {
+	if err == nil {
+		return 0
+	}
+	apiErr, ok := err.(*aei.APIError)
+	if !ok || apiErr.Service != "file" {
+		t.Fatalf("Expected a file API error, got %#v", err)
+	}
+	return pb.FileServiceErrors_ErrorCode(apiErr.Code)
+}
+
+type testFiles struct {
+	t *testing.T
+	c appengine.Context
+}
+
+func (f *testFiles) call(method string, in, out proto.Message) pb.FileServiceErrors_ErrorCode {
+	return fileErrorCode(f.t, f.c.Call("file", method, in, out, nil))
+}
+
+func (f *testFiles) open(name string, mode pb.OpenRequest_OpenMode, exclusive bool) pb.FileServiceErrors_ErrorCode {
+	return f.call("Open", &pb.OpenRequest{
+		Filename:      proto.String(name),
+		ContentType:   pb.FileContentType_RAW.Enum(),
+		OpenMode:      mode.Enum(),
+		ExclusiveLock: proto.Bool(exclusive),
+	}, &pb.OpenResponse{})
+}
+
+func (f *testFiles) append(name, data, seq string) pb.FileServiceErrors_ErrorCode {
+	req := &pb.AppendRequest{Filename: proto.String(name), Data: []byte(data)}
+	if seq != "" {
+		req.SequenceKey = proto.String(seq)
+	}
+	return f.call("Append", req, &pb.AppendResponse{})
+}
+
+func (f *testFiles) close(name string, finalize bool) pb.FileServiceErrors_ErrorCode {
+	return f.call("Close", &pb.CloseRequest{Filename: proto.String(name), Finalize: proto.Bool(finalize)},
+		&pb.CloseResponse{})
+}
+
+func TestFileService(t *testing.T) {
+	_, unregisterDatastore := NewFakeDatastore()
+	defer unregisterDatastore()
+	bs, unregisterBlobstore := NewFakeBlobstore()
+	defer unregisterBlobstore()
+	fs, unregister := NewFakeFileService()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	f := &testFiles{t, c}
+
+	cr := &pb.CreateResponse{}
+	code := f.call("Create", &pb.CreateRequest{
+		Filesystem:  proto.String("blobstore"),
+		ContentType: pb.FileContentType_RAW.Enum(),
+		Parameters: []*pb.CreateRequest_Parameter{
+			{Name: proto.String("content_type"), Value: proto.String("text/csv")},
+			{Name: proto.String("file_name"), Value: proto.String("export.csv")},
+		},
+	}, cr)
+	if code != 0 {
+		t.Fatalf("Create: %v", code)
+	}
+	name := cr.GetFilename()
+
+	const (
+		readMode   = pb.OpenRequest_READ
+		appendMode = pb.OpenRequest_APPEND
+	)
+	steps := []struct {
+		desc string
+		code pb.FileServiceErrors_ErrorCode
+		got  pb.FileServiceErrors_ErrorCode
+	}{
+		{"append to a file not opened", pb.FileServiceErrors_FILE_NOT_OPENED, f.append(name, "x", "")},
+		{"read a file not finalized", pb.FileServiceErrors_FINALIZATION_ERROR, f.open(name, readMode, false)},
+		{"open for append", 0, f.open(name, appendMode, false)},
+		{"exclusive lock of an opened file", pb.FileServiceErrors_EXCLUSIVE_LOCK_FAILED, f.open(name, appendMode, true)},
+		{"append", 0, f.append(name, "a,b\n", "1")},
+		{"repeated sequence key", pb.FileServiceErrors_SEQUENCE_KEY_OUT_OF_ORDER, f.append(name, "a,b\n", "1")},
+		{"append next sequence key", 0, f.append(name, "c,d\n", "2")},
+		{"finalize without an exclusive lock", pb.FileServiceErrors_EXCLUSIVE_LOCK_REQUIRED, f.close(name, true)},
+		{"close", 0, f.close(name, false)},
+		{"close a closed file", pb.FileServiceErrors_FILE_NOT_OPENED, f.close(name, false)},
+		{"open with an exclusive lock", 0, f.open(name, appendMode, true)},
+		{"any other open", pb.FileServiceErrors_EXCLUSIVE_LOCK_FAILED, f.open(name, appendMode, false)},
+		{"finalize", 0, f.close(name, true)},
+		{"append to a finalized file", pb.FileServiceErrors_FINALIZATION_ERROR, f.open(name, appendMode, true)},
+	}
+	for _, s := range steps {
+		if s.got != s.code {
+			t.Errorf("%s: expected %v, got %v", s.desc, s.code, s.got)
+		}
+	}
+
+	key, ok := fs.BlobKey(name)
+	if !ok {
+		t.Fatalf("Expected %s to be finalized", name)
+	}
+	if data, _ := bs.Blob(key); string(data) != "a,b\nc,d\n" {
+		t.Errorf("Expected blob a,b\\nc,d\\n, got %q", data)
+	}
+
+	blobName := blobstoreFileDir + string(key)
+	if code := f.open(blobName, readMode, false); code != 0 {
+		t.Fatalf("Open %s: %v", blobName, code)
+	}
+	tests := []struct {
+		pos, maxBytes int64
+		want          string
+	}{
+		{0, 3, "a,b"},
+		{2, 100, "b\nc,d\n"},
+		{4, math.MaxInt64, "c,d\n"},
+		{8, 1, ""},
+		{100, 1, ""},
+	}
+	for _, tt := range tests {
+		resp := &pb.ReadResponse{}
+		req := &pb.ReadRequest{Filename: proto.String(blobName), Pos: proto.Int64(tt.pos), MaxBytes: proto.Int64(tt.maxBytes)}
+		if code := f.call("Read", req, resp); code != 0 || string(resp.Data) != tt.want {
+			t.Errorf("Read(%d, %d): expected %q, got %q (%v)", tt.pos, tt.maxBytes, tt.want, resp.Data, code)
+		}
+	}
+
+	st := &pb.StatResponse{}
+	if code := f.call("Stat", &pb.StatRequest{Filename: proto.String(name)}, st); code != 0 {
+		t.Fatalf("Stat: %v", code)
+	}
+	if len(st.Stat) != 1 || st.Stat[0].GetLength() != 8 || !st.Stat[0].GetFinalized() {
+		t.Errorf("Expected a finalized file of 8 bytes, got %v", st)
+	}
+}
@@ -0,0 +1,357 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/crhym3/aegot/yaml"
+)
+
+// LoadFixtures puts entities described in a JSON or YAML file at path into
+// the datastore, using context c. Files with .json extension are parsed as
+// JSON, anything else as YAML. It is usually combined with NewFakeDatastore:
+//
+// 		func TestListItems(t *testing.T) {
+// 			_, unregister := NewFakeDatastore()
+// 			defer unregister()
+// 			r, deleteContext := NewTestRequest("GET", "/items", nil)
+// 			defer deleteContext()
+// 			if err := LoadFixtures(appengine.NewContext(r), "testdata/items.yaml"); err != nil {
+// 				t.Fatal(err)
+// 			}
+// 			// ...
+// 		}
+//
+// A fixtures file is a list of entities. Each entity has a key path of
+// alternating kinds and IDs (integer IDs or string names; the last ID can
+// be omitted to have one allocated), an optional namespace, properties,
+// and names of properties that shouldn't be indexed:
+//
+// 		- key: [List, 1, Item, some-id]
+// 		  namespace: ns
+// 		  noindex: [Description]
+// 		  properties:
+// 		    Name: Some item
+// 		    Price: 9.99
+// 		    Count: 3
+// 		    Tags: [a, b]          # multi-valued property
+// 		    Description: Whatever
+// 		    Created: {time: "2013-06-01T12:00:00Z"}
+// 		    Location: {geo: [51.5, -0.12]}
+// 		    List: {key: [List, 1]}
+// 		    Photo: {blob: aGVsbG8=}   # base64
+// 		    Body: {text: Long text}
+// 		    Image: {blobkey: some-blob-key}
+// 		    Hash: {bytestring: aGVsbG8=}  # base64, indexed
+// 		    Author: {user: someone@example.com}
+//
+// Strings, integers, floats, booleans and nulls are stored as such;
+// typed values are written as single-key maps. Key values default to the
+// namespace of the entity, which can be overridden with a "namespace" key,
+// e.g. {key: [User, 1], namespace: other}.
+func LoadFixtures(c appengine.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var entities []*pb.EntityProto
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		entities, err = readFixtures(f, c.FullyQualifiedAppID(), parseFixturesJSON)
+	} else {
+		entities, err = readFixtures(f, c.FullyQualifiedAppID(), yaml.Parse)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for len(entities) > 0 {
+		n := len(entities)
+		if n > maxWriteBatchSize {
+			n = maxWriteBatchSize
+		}
+		req := &pb.PutRequest{Entity: entities[:n]}
+		if err := c.Call("datastore_v3", "Put", req, &pb.PutResponse{}, nil); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		entities = entities[n:]
+	}
+	return nil
+}
+
+// readFixtures decodes entities of app from r using parse function.
+func readFixtures(r io.Reader, app string, parse func(io.Reader) (interface{}, error)) ([]*pb.EntityProto, error) {
+	doc, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, nil
+	}
+	list, ok := doc.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of entities")
+	}
+	entities := make([]*pb.EntityProto, len(list))
+	for i, item := range list {
+		if entities[i], err = fixtureEntity(item, app); err != nil {
+			return nil, fmt.Errorf("entity #%d: %v", i+1, err)
+		}
+	}
+	return entities, nil
+}
+
+// parseFixturesJSON parses JSON document into the same types yaml.Parse
+// returns.
+func parseFixturesJSON(r io.Reader) (interface{}, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return jsonNumbers(doc), nil
+}
+
+// jsonNumbers replaces json.Number values in v with int64 or float64.
+func jsonNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = jsonNumbers(v[k])
+		}
+	}
+	return v
+}
+
+// fixtureEntity converts a decoded fixture into an entity.
+func fixtureEntity(v interface{}, app string) (*pb.EntityProto, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a map, got %v", v)
+	}
+	for k := range m {
+		switch k {
+		case "key", "namespace", "noindex", "properties":
+		default:
+			return nil, fmt.Errorf("unknown field %q", k)
+		}
+	}
+	ns, ok := m["namespace"].(string)
+	if !ok && m["namespace"] != nil {
+		return nil, fmt.Errorf("namespace must be a string")
+	}
+	key, err := fixtureKey(m["key"], app, ns, true)
+	if err != nil {
+		return nil, err
+	}
+	noindex := make(map[string]bool)
+	if list, ok := m["noindex"].([]interface{}); ok {
+		for _, name := range list {
+			noindex[fmt.Sprint(name)] = true
+		}
+	} else if m["noindex"] != nil {
+		return nil, fmt.Errorf("noindex must be a list of property names")
+	}
+	props, ok := m["properties"].(map[string]interface{})
+	if !ok && m["properties"] != nil {
+		return nil, fmt.Errorf("properties must be a map")
+	}
+
+	e := &pb.EntityProto{Key: key, EntityGroup: &pb.Path{}}
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values, multiple := props[name].([]interface{})
+		if !multiple {
+			values = []interface{}{props[name]}
+		}
+		for _, val := range values {
+			p, raw, err := fixtureProperty(val, app, ns)
+			if err != nil {
+				return nil, fmt.Errorf("property %s: %v", name, err)
+			}
+			p.Name = proto.String(name)
+			p.Multiple = proto.Bool(multiple)
+			if raw || noindex[name] {
+				e.RawProperty = append(e.RawProperty, p)
+			} else {
+				e.Property = append(e.Property, p)
+			}
+		}
+	}
+	return e, nil
+}
+
+// fixtureKey converts a key path, e.g. [Parent, 1, Child, name], into a key.
+// If allowIncomplete is true, the last ID may be omitted.
+func fixtureKey(v interface{}, app, ns string, allowIncomplete bool) (*pb.Reference, error) {
+	path, ok := v.([]interface{})
+	if !ok || len(path) == 0 {
+		return nil, fmt.Errorf("key must be a list of kinds and IDs, got %v", v)
+	}
+	if len(path)%2 != 0 && !allowIncomplete {
+		return nil, fmt.Errorf("incomplete key %v", v)
+	}
+	key := &pb.Reference{App: proto.String(app), Path: &pb.Path{}}
+	if ns != "" {
+		key.NameSpace = proto.String(ns)
+	}
+	for i := 0; i < len(path); i += 2 {
+		kind, ok := path[i].(string)
+		if !ok || kind == "" {
+			return nil, fmt.Errorf("invalid kind %v in key %v", path[i], v)
+		}
+		el := &pb.Path_Element{Type: proto.String(kind)}
+		if i+1 < len(path) {
+			switch id := path[i+1].(type) {
+			case int64:
+				el.Id = proto.Int64(id)
+			case string:
+				el.Name = proto.String(id)
+			default:
+				return nil, fmt.Errorf("invalid ID %v in key %v", path[i+1], v)
+			}
+		}
+		key.Path.Element = append(key.Path.Element, el)
+	}
+	return key, nil
+}
+
+// fixtureProperty converts a property value. Returned raw is true for
+// values which are never indexed.
+func fixtureProperty(v interface{}, app, ns string) (p *pb.Property, raw bool, err error) {
+	p = &pb.Property{Value: &pb.PropertyValue{}}
+	switch v := v.(type) {
+	case nil:
+	case bool:
+		p.Value.BooleanValue = proto.Bool(v)
+	case int64:
+		p.Value.Int64Value = proto.Int64(v)
+	case float64:
+		p.Value.DoubleValue = proto.Float64(v)
+	case string:
+		p.Value.StringValue = proto.String(v)
+	case map[string]interface{}:
+		raw, err = fixtureTypedProperty(p, v, app, ns)
+	default:
+		err = fmt.Errorf("unsupported value %v", v)
+	}
+	return p, raw, err
+}
+
+// fixtureTypedProperty sets p to a typed value, e.g. {time: "..."}.
+func fixtureTypedProperty(p *pb.Property, m map[string]interface{}, app, ns string) (raw bool, err error) {
+	if s, ok := m["namespace"].(string); ok {
+		ns = s
+		delete(m, "namespace")
+	}
+	if len(m) != 1 {
+		return false, fmt.Errorf("typed value must have a single type key, got %v", m)
+	}
+	for typ, v := range m {
+		s, isString := v.(string)
+		switch typ {
+		case "time":
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return false, err
+			}
+			p.Meaning = pb.Property_GD_WHEN.Enum()
+			p.Value.Int64Value = proto.Int64(t.UnixNano() / 1e3)
+		case "geo":
+			ll, ok := v.([]interface{})
+			if !ok || len(ll) != 2 {
+				return false, fmt.Errorf("geo must be [lat, lng], got %v", v)
+			}
+			lat, ok1 := fixtureFloat(ll[0])
+			lng, ok2 := fixtureFloat(ll[1])
+			if !ok1 || !ok2 {
+				return false, fmt.Errorf("geo must be [lat, lng], got %v", v)
+			}
+			p.Meaning = pb.Property_GEORSS_POINT.Enum()
+			p.Value.Pointvalue = &pb.PropertyValue_PointValue{X: proto.Float64(lat), Y: proto.Float64(lng)}
+		case "key":
+			key, err := fixtureKey(v, app, ns, false)
+			if err != nil {
+				return false, err
+			}
+			p.Value = keyValue(key)
+		case "blob":
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil || !isString {
+				return false, fmt.Errorf("blob must be base64 encoded string")
+			}
+			p.Meaning = pb.Property_BLOB.Enum()
+			p.Value.StringValue = proto.String(string(b))
+			return true, nil
+		case "text":
+			if !isString {
+				return false, fmt.Errorf("text must be a string")
+			}
+			p.Meaning = pb.Property_TEXT.Enum()
+			p.Value.StringValue = proto.String(s)
+			return true, nil
+		case "blobkey":
+			if !isString {
+				return false, fmt.Errorf("blobkey must be a string")
+			}
+			p.Meaning = pb.Property_BLOBKEY.Enum()
+			p.Value.StringValue = proto.String(s)
+		case "bytestring":
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil || !isString {
+				return false, fmt.Errorf("bytestring must be base64 encoded string")
+			}
+			p.Meaning = pb.Property_BYTESTRING.Enum()
+			p.Value.StringValue = proto.String(string(b))
+		case "user":
+			if !isString {
+				return false, fmt.Errorf("user must be an email")
+			}
+			p.Value.Uservalue = &pb.PropertyValue_UserValue{
+				Email:      proto.String(s),
+				AuthDomain: proto.String("gmail.com"),
+			}
+		default:
+			return false, fmt.Errorf("unknown value type %q", typ)
+		}
+	}
+	return false, nil
+}
+
+func fixtureFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,143 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"strings"
+	"testing"
+
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/crhym3/aegot/yaml"
+)
+
+// ydoc joins lines of a YAML document.
+func ydoc(lines ...string) string {
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// fixtureProp creates a property the way fixtures are loaded.
+func fixtureProp(name string, meaning *pb.Property_Meaning, v *pb.PropertyValue) *pb.Property {
+	return &pb.Property{Name: proto.String(name), Meaning: meaning, Multiple: proto.Bool(false), Value: v}
+}
+
+func TestLoadFixtures(t *testing.T) {
+	list := testKey("List", "", 1, nil)
+	milk := testKey("Item", "milk", 0, list)
+	tags := func(v string) *pb.Property {
+		p := testStringProp("Tags", v)
+		p.Multiple = proto.Bool(true)
+		return p
+	}
+	want := &pb.EntityProto{
+		Key:         milk,
+		EntityGroup: &pb.Path{Element: list.Path.Element},
+		Property: []*pb.Property{
+			fixtureProp("Author", nil, &pb.PropertyValue{Uservalue: &pb.PropertyValue_UserValue{
+				Email:      proto.String("someone@example.com"),
+				AuthDomain: proto.String("gmail.com"),
+			}}),
+			testIntProp("Count", 2),
+			fixtureProp("Created", pb.Property_GD_WHEN.Enum(), &pb.PropertyValue{Int64Value: proto.Int64(1370088000e6)}),
+			fixtureProp("Done", nil, &pb.PropertyValue{BooleanValue: proto.Bool(false)}),
+			fixtureProp("Hash", pb.Property_BYTESTRING.Enum(), &pb.PropertyValue{StringValue: proto.String("hello")}),
+			fixtureProp("Image", pb.Property_BLOBKEY.Enum(), &pb.PropertyValue{StringValue: proto.String("some-blob-key")}),
+			fixtureProp("List", nil, keyValue(list)),
+			fixtureProp("Location", pb.Property_GEORSS_POINT.Enum(), &pb.PropertyValue{
+				Pointvalue: &pb.PropertyValue_PointValue{X: proto.Float64(51.5), Y: proto.Float64(-0.12)},
+			}),
+			fixtureProp("Missing", nil, &pb.PropertyValue{}),
+			fixtureProp("Price", nil, &pb.PropertyValue{DoubleValue: proto.Float64(1.5)}),
+			tags("dairy"),
+			tags("fresh"),
+		},
+		RawProperty: []*pb.Property{
+			fixtureProp("Body", pb.Property_TEXT.Enum(), &pb.PropertyValue{StringValue: proto.String("Long text")}),
+			testStringProp("Note", "Whole milk"),
+			fixtureProp("Photo", pb.Property_BLOB.Enum(), &pb.PropertyValue{StringValue: proto.String("hello")}),
+		},
+	}
+
+	for _, path := range []string{"testdata/fixtures.yaml", "testdata/fixtures.json"} {
+		_, unregister := NewFakeDatastore()
+		c, deleteContext := newTestContext(t)
+		if err := LoadFixtures(c, path); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+
+		es := testGet(t, c, nil, list, milk)
+		if es[0] == nil || es[0].Property[0].GetValue().GetStringValue() != "Groceries" {
+			t.Errorf("%s: expected list Groceries, got %v", path, es[0])
+		}
+		if !proto.Equal(es[1], want) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", path, proto.MarshalTextString(want), proto.MarshalTextString(es[1]))
+		}
+
+		q := &pb.Query{Kind: proto.String("Item"), NameSpace: proto.String("ns")}
+		es, _ = testGetAll(t, c, q)
+		if len(es) != 1 {
+			t.Errorf("%s: expected 1 item in namespace ns, got %v", path, es)
+		} else {
+			e := es[0]
+			if e.Key.GetNameSpace() != "ns" || e.Key.Path.Element[0].GetId() == 0 {
+				t.Errorf("%s: expected an allocated ID in namespace ns, got %v", path, e.Key)
+			}
+			refs := make(map[string]*pb.PropertyValue_ReferenceValue)
+			for _, p := range e.Property {
+				refs[p.GetName()] = p.Value.Referencevalue
+			}
+			if ns := refs["Ref"].GetNameSpace(); ns != "ns" {
+				t.Errorf("%s: expected a key in namespace of the entity, got %q", path, ns)
+			}
+			if ns := refs["Other"].GetNameSpace(); ns != "" {
+				t.Errorf("%s: expected a key in the default namespace, got %q", path, ns)
+			}
+		}
+		deleteContext()
+		unregister()
+	}
+}
+
+func TestLoadFixturesErrors(t *testing.T) {
+	entity := func(value string) string {
+		return ydoc("- key: [Item, a]", "  properties:", "    P: "+value)
+	}
+	tests := []struct {
+		in, err string
+	}{
+		{"key: [Item, a]\n", "expected a list of entities"},
+		{"- kay: [Item, a]\n", `entity #1: unknown field "kay"`},
+		{"- key: Item\n", "entity #1: key must be a list of kinds and IDs"},
+		{ydoc("- key: [Item, a]", "- key: [Item, 1.5]"), "entity #2: invalid ID 1.5"},
+		{"- key: [1, a]\n", "entity #1: invalid kind 1"},
+		{"- key: [Item, a]\n  namespace: 1\n", "entity #1: namespace must be a string"},
+		{"- key: [Item, a]\n  noindex: P\n", "entity #1: noindex must be a list"},
+		{entity("{time: yesterday}"), `entity #1: property P: parsing time "yesterday"`},
+		{entity("{geo: [51.5]}"), "entity #1: property P: geo must be [lat, lng]"},
+		{entity("{geo: [a, b]}"), "entity #1: property P: geo must be [lat, lng]"},
+		{entity("{key: [Item]}"), "entity #1: property P: incomplete key"},
+		{entity("{blob: '!!'}"), "entity #1: property P: blob must be base64 encoded string"},
+		{entity("{bytestring: 1}"), "entity #1: property P: bytestring must be base64 encoded string"},
+		{entity("{text: 1}"), "entity #1: property P: text must be a string"},
+		{entity("{blobkey: [a]}"), "entity #1: property P: blobkey must be a string"},
+		{entity("{user: 1}"), "entity #1: property P: user must be an email"},
+		{entity("{colour: red}"), `entity #1: property P: unknown value type "colour"`},
+		{entity("{text: a, blob: b}"), "entity #1: property P: typed value must have a single type key"},
+		{entity("[[a]]"), "entity #1: property P: unsupported value [a]"},
+	}
+	for _, tt := range tests {
+		_, err := readFixtures(strings.NewReader(tt.in), fullAppID(), yaml.Parse)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%q: expected error %q, got %v", tt.in, tt.err, err)
+		}
+	}
+
+	_, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	if err := LoadFixtures(c, "testdata/missing.yaml"); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
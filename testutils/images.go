@@ -0,0 +1,337 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"strings"
+	"sync"
+
+	"appengine"
+
+	aei "appengine_internal"
+	pb "appengine_internal/image"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// imageServingPath is the URL path prefix of image serving URLs.
+	imageServingPath = "/_ah/img/"
+	// maxImageTransforms is the most transforms a request can have.
+	maxImageTransforms = 10
+	// maxResizeDimension is the largest width or height of Resize.
+	maxResizeDimension = 4000
+	// defaultJPEGQuality is used when output quality is not specified.
+	defaultJPEGQuality = 85
+)
+
+// FakeImages is an implementation of "images" service which transforms
+// images with Go image packages. PNG, JPEG and GIF images can be decoded,
+// and encoded as PNG or JPEG. Resize, crop, rotate and flip transforms are
+// applied like in production, other transforms are ignored.
+//
+// Images can also be read from the blobstore created by NewFakeBlobstore,
+// and serving URLs are created for its blobs: a URL is the same every time
+// it is requested for a blob, and BlobKey resolves it back to the blob.
+type FakeImages struct {
+	mu sync.Mutex
+	// blobs with serving URLs
+	served map[appengine.BlobKey]bool
+}
+
+// NewFakeImages creates an images service and registers it as "images"
+// service implementation.
+//
+// Returns the service and a function that unregisters it. Here's an example:
+//
+// 		func TestThumbnail(t *testing.T) {
+// 			_, unregister := NewFakeImages()
+// 			defer unregister()
+//
+// 			// test code that creates a thumbnail
+//
+// 			cfg, format, err := image.DecodeConfig(bytes.NewReader(thumb))
+// 			if err != nil || format != "jpeg" || cfg.Width != 32 {
+// 				t.Errorf("Expected 32px wide JPEG, got %s %+v, %v", format, cfg, err)
+// 			}
+// 		}
+//
+func NewFakeImages() (*FakeImages, func()) {
+	fi := &FakeImages{served: make(map[appengine.BlobKey]bool)}
+	return fi, registerServiceOverrides("images", map[string]RpcStubFunc{
+		"Transform":     fi.transform,
+		"GetUrlBase":    fi.getUrlBase,
+		"DeleteUrlBase": fi.deleteUrlBase,
+	})
+}
+
+// BlobKey returns the blob a serving URL was created for. The URL may have
+// options, e.g. "=s32". ok is false if the URL is unknown or was deleted.
+func (fi *FakeImages) BlobKey(servingURL string) (key appengine.BlobKey, ok bool) {
+	u, err := url.Parse(servingURL)
+	if err != nil || !strings.HasPrefix(u.Path, imageServingPath) {
+		return "", false
+	}
+	key = appengine.BlobKey(strings.TrimPrefix(u.Path, imageServingPath))
+	if i := strings.Index(string(key), "="); i >= 0 {
+		key = key[:i]
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return key, fi.served[key]
+}
+
+func (fi *FakeImages) transform(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.ImagesTransformRequest), out.(*pb.ImagesTransformResponse)
+	if len(req.GetTransform()) > maxImageTransforms {
+		return imagesError(pb.ImagesServiceError_BAD_TRANSFORM_DATA)
+	}
+	m, err := decodeImageData(req.GetImage())
+	if err != nil {
+		return err
+	}
+	for _, t := range req.GetTransform() {
+		if m, err = transformImage(m, t); err != nil {
+			return err
+		}
+	}
+	data, err := encodeImage(m, req.GetOutput())
+	if err != nil {
+		return err
+	}
+	b := m.Bounds()
+	resp.Image = &pb.ImageData{
+		Content: data,
+		Width:   proto.Int32(int32(b.Dx())),
+		Height:  proto.Int32(int32(b.Dy())),
+	}
+	return nil
+}
+
+func (fi *FakeImages) getUrlBase(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.ImagesGetUrlBaseRequest), out.(*pb.ImagesGetUrlBaseResponse)
+	key := appengine.BlobKey(req.GetBlobKey())
+	data := blobData(key)
+	if data == nil {
+		return imagesError(pb.ImagesServiceError_INVALID_BLOB_KEY)
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return imagesError(pb.ImagesServiceError_NOT_IMAGE)
+	}
+	fi.mu.Lock()
+	fi.served[key] = true
+	fi.mu.Unlock()
+	scheme := "http"
+	if req.GetCreateSecureUrl() {
+		scheme = "https"
+	}
+	resp.Url = proto.String(scheme + "://localhost" + imageServingPath + string(key))
+	return nil
+}
+
+func (fi *FakeImages) deleteUrlBase(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.ImagesDeleteUrlBaseRequest)
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	delete(fi.served, appengine.BlobKey(req.GetBlobKey()))
+	return nil
+}
+
+// decodeImageData decodes image contents, or a blob if d has a blob key.
+func decodeImageData(d *pb.ImageData) (image.Image, error) {
+	data := d.Content
+	if d.BlobKey != nil {
+		if data = blobData(appengine.BlobKey(d.GetBlobKey())); data == nil {
+			return nil, imagesError(pb.ImagesServiceError_INVALID_BLOB_KEY)
+		}
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return nil, imagesError(pb.ImagesServiceError_NOT_IMAGE)
+	}
+	m, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, imagesError(pb.ImagesServiceError_BAD_IMAGE_DATA)
+	}
+	return m, nil
+}
+
+// transformImage applies t to m. Like in production, a transform with
+// several operations resizes, rotates, flips and then crops the image.
+func transformImage(m image.Image, t *pb.Transform) (image.Image, error) {
+	if t.Width != nil || t.Height != nil {
+		var err error
+		if m, err = resizeImage(m, t); err != nil {
+			return nil, err
+		}
+	}
+	if t.GetRotate() != 0 {
+		if t.GetRotate()%90 != 0 {
+			return nil, imagesError(pb.ImagesServiceError_BAD_TRANSFORM_DATA)
+		}
+		m = rotateImage(m, int((t.GetRotate()%360+360)%360))
+	}
+	if t.GetHorizontalFlip() {
+		w := m.Bounds().Dx()
+		m = remapImage(m, w, m.Bounds().Dy(), func(x, y int) (int, int) { return w - 1 - x, y })
+	}
+	if t.GetVerticalFlip() {
+		h := m.Bounds().Dy()
+		m = remapImage(m, m.Bounds().Dx(), h, func(x, y int) (int, int) { return x, h - 1 - y })
+	}
+	if t.CropLeftX != nil || t.CropTopY != nil || t.CropRightX != nil || t.CropBottomY != nil {
+		left, top := float64(t.GetCropLeftX()), float64(t.GetCropTopY())
+		right, bottom := 1.0, 1.0
+		if t.CropRightX != nil {
+			right = float64(t.GetCropRightX())
+		}
+		if t.CropBottomY != nil {
+			bottom = float64(t.GetCropBottomY())
+		}
+		if left < 0 || top < 0 || right > 1 || bottom > 1 || left >= right || top >= bottom {
+			return nil, imagesError(pb.ImagesServiceError_BAD_TRANSFORM_DATA)
+		}
+		b := m.Bounds()
+		x0, y0 := int(left*float64(b.Dx())), int(top*float64(b.Dy()))
+		x1, y1 := int(right*float64(b.Dx())), int(bottom*float64(b.Dy()))
+		m = cropImage(m, x0, y0, maxInt(x1-x0, 1), maxInt(y1-y0, 1))
+	}
+	return m, nil
+}
+
+// resizeImage scales m to the width and height of t, keeping the aspect
+// ratio unless stretching is allowed. With crop to fit, the image is scaled
+// to cover the requested size, and then cropped at the offsets of t.
+func resizeImage(m image.Image, t *pb.Transform) (image.Image, error) {
+	reqW, reqH := int(t.GetWidth()), int(t.GetHeight())
+	if reqW < 0 || reqH < 0 || reqW > maxResizeDimension || reqH > maxResizeDimension || reqW+reqH == 0 {
+		return nil, imagesError(pb.ImagesServiceError_BAD_TRANSFORM_DATA)
+	}
+	if (t.GetCropToFit() || t.GetAllowStretch()) && (reqW == 0 || reqH == 0) {
+		return nil, imagesError(pb.ImagesServiceError_BAD_TRANSFORM_DATA)
+	}
+	b := m.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	rw, rh := float64(reqW)/w, float64(reqH)/h
+	var newW, newH int
+	switch {
+	case t.GetCropToFit():
+		r := rh
+		if rw > rh {
+			r = rw
+		}
+		newW, newH = int(r*w), int(r*h)
+	case t.GetAllowStretch():
+		newW, newH = reqW, reqH
+	case reqW == 0 || (rw > rh && reqH != 0):
+		newW, newH = int(rh*w), reqH
+	default:
+		newW, newH = reqW, int(rw*h)
+	}
+	newW, newH = maxInt(newW, 1), maxInt(newH, 1)
+	srcW, srcH := b.Dx(), b.Dy()
+	m = remapImage(m, newW, newH, func(x, y int) (int, int) {
+		// nearest pixel to the center of the scaled one
+		return (2*x + 1) * srcW / (2 * newW), (2*y + 1) * srcH / (2 * newH)
+	})
+	if t.GetCropToFit() {
+		reqW, reqH = minInt(reqW, newW), minInt(reqH, newH)
+		offX, offY := 0.5, 0.5
+		if t.CropOffsetX != nil {
+			offX = float64(t.GetCropOffsetX())
+		}
+		if t.CropOffsetY != nil {
+			offY = float64(t.GetCropOffsetY())
+		}
+		m = cropImage(m, int(float64(newW-reqW)*offX), int(float64(newH-reqH)*offY), reqW, reqH)
+	}
+	return m, nil
+}
+
+// rotateImage rotates m clockwise by degrees, a multiple of 90.
+func rotateImage(m image.Image, degrees int) image.Image {
+	w, h := m.Bounds().Dx(), m.Bounds().Dy()
+	switch degrees {
+	case 90:
+		return remapImage(m, h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+	case 180:
+		return remapImage(m, w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+	case 270:
+		return remapImage(m, h, w, func(x, y int) (int, int) { return w - 1 - y, x })
+	}
+	return m
+}
+
+// cropImage returns a w by h part of m with top left corner at x0, y0.
+func cropImage(m image.Image, x0, y0, w, h int) image.Image {
+	return remapImage(m, w, h, func(x, y int) (int, int) { return x0 + x, y0 + y })
+}
+
+// remapImage creates a w by h image whose pixel at x, y is the pixel of m
+// at src(x, y). Coordinates are relative to the top left corner of m.
+func remapImage(m image.Image, w, h int, src func(x, y int) (int, int)) *image.NRGBA {
+	b := m.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx, sy := src(x, y)
+			dst.Set(x, y, color.NRGBAModel.Convert(m.At(b.Min.X+sx, b.Min.Y+sy)))
+		}
+	}
+	return dst
+}
+
+// encodeImage encodes m in the format of out.
+func encodeImage(m image.Image, out *pb.OutputSettings) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch out.GetMimeType() {
+	case pb.OutputSettings_PNG:
+		err = png.Encode(&buf, m)
+	case pb.OutputSettings_JPEG:
+		q := defaultJPEGQuality
+		if out.Quality != nil {
+			q = int(out.GetQuality())
+		}
+		if q < 1 || q > 100 {
+			return nil, imagesError(pb.ImagesServiceError_BAD_TRANSFORM_DATA)
+		}
+		err = jpeg.Encode(&buf, m, &jpeg.Options{Quality: q})
+	default:
+		// there's no WEBP encoder in Go
+		return nil, &aei.APIError{
+			Service: "images",
+			Code:    int32(pb.ImagesServiceError_UNSPECIFIED_ERROR),
+			Detail:  out.GetMimeType().String() + " output is not supported",
+		}
+	}
+	if err != nil {
+		return nil, imagesError(pb.ImagesServiceError_UNSPECIFIED_ERROR)
+	}
+	return buf.Bytes(), nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// imagesError creates an API error with the given code.
+func imagesError(code pb.ImagesServiceError_ErrorCode) error {
+	return &aei.APIError{Service: "images", Code: int32(code)}
+}
@@ -0,0 +1,280 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"appengine"
+
+	aei "appengine_internal"
+	pb "appengine_internal/image"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+var (
+	red   = color.NRGBA{255, 0, 0, 255}
+	blue  = color.NRGBA{0, 0, 255, 255}
+	green = color.NRGBA{0, 255, 0, 255}
+	white = color.NRGBA{255, 255, 255, 255}
+)
+
+// testImage returns a 40x20 image with red, blue, green and white quarters,
+// clockwise from the top left one.
+func testImage() image.Image {
+	m := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := [2][2]color.NRGBA{{red, blue}, {green, white}}[y/10][x/20]
+			m.Set(x, y, c)
+		}
+	}
+	return m
+}
+
+// colorName returns the name of one of the test image colors c is.
+func colorName(c color.Color) string {
+	names := map[color.NRGBA]string{red: "red", blue: "blue", green: "green", white: "white"}
+	if name, ok := names[color.NRGBAModel.Convert(c).(color.NRGBA)]; ok {
+		return name
+	}
+	return "other"
+}
+
+// imagesErrorCode returns images service error code of err, or 0 if err
+// is nil.
+func imagesErrorCode(t *testing.T, err error) pb.ImagesServiceError_ErrorCode {
+	if err == nil {
+		return 0
+	}
+	apiErr, ok := err.(*aei.APIError)
+	if !ok || apiErr.Service != "images" {
+		t.Fatalf("Expected an images API error, got %#v", err)
+	}
+	return pb.ImagesServiceError_ErrorCode(apiErr.Code)
+}
+
+// testTransform transforms img and returns the result decoded.
+func testTransform(t *testing.T, c appengine.Context, img *pb.ImageData, out *pb.OutputSettings,
+	transforms ...*pb.Transform) (image.Image, string, pb.ImagesServiceError_ErrorCode) {
+
+	resp := &pb.ImagesTransformResponse{}
+	req := &pb.ImagesTransformRequest{Image: img, Transform: transforms, Output: out}
+	if code := imagesErrorCode(t, c.Call("images", "Transform", req, resp, nil)); code != 0 {
+		return nil, "", code
+	}
+	m, format, err := image.Decode(bytes.NewReader(resp.Image.Content))
+	if err != nil {
+		t.Fatalf("Invalid image of %v: %v", transforms, err)
+	}
+	if b := m.Bounds(); int32(b.Dx()) != resp.Image.GetWidth() || int32(b.Dy()) != resp.Image.GetHeight() {
+		t.Errorf("Expected size %dx%d in the response, got %dx%d", b.Dx(), b.Dy(),
+			resp.Image.GetWidth(), resp.Image.GetHeight())
+	}
+	return m, format, 0
+}
+
+func TestImagesTransform(t *testing.T) {
+	_, unregister := NewFakeImages()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	img := &pb.ImageData{Content: buf.Bytes()}
+	out := &pb.OutputSettings{MimeType: pb.OutputSettings_PNG.Enum()}
+	tests := []struct {
+		desc       string
+		transforms []*pb.Transform
+		code       pb.ImagesServiceError_ErrorCode
+		w, h       int
+		// colors of the top left, top right and bottom left corners
+		corners [3]string
+	}{
+		{"no transforms", nil, 0, 40, 20, [3]string{"red", "blue", "green"}},
+		{"resize by width", []*pb.Transform{{Width: proto.Int32(10)}}, 0,
+			10, 5, [3]string{"red", "blue", "green"}},
+		{"resize by height", []*pb.Transform{{Height: proto.Int32(10)}}, 0,
+			20, 10, [3]string{"red", "blue", "green"}},
+		// the aspect ratio is kept
+		{"resize into a box", []*pb.Transform{{Width: proto.Int32(10), Height: proto.Int32(10)}}, 0,
+			10, 5, [3]string{"red", "blue", "green"}},
+		{"stretch", []*pb.Transform{{Width: proto.Int32(10), Height: proto.Int32(10), AllowStretch: proto.Bool(true)}}, 0,
+			10, 10, [3]string{"red", "blue", "green"}},
+		// scaled to 20x10 and cropped in the center
+		{"crop to fit", []*pb.Transform{{Width: proto.Int32(10), Height: proto.Int32(10), CropToFit: proto.Bool(true)}}, 0,
+			10, 10, [3]string{"red", "blue", "green"}},
+		{"crop to fit on the left", []*pb.Transform{{Width: proto.Int32(10), Height: proto.Int32(10),
+			CropToFit: proto.Bool(true), CropOffsetX: proto.Float32(0)}}, 0,
+			10, 10, [3]string{"red", "red", "green"}},
+		{"crop to fit on the right", []*pb.Transform{{Width: proto.Int32(10), Height: proto.Int32(10),
+			CropToFit: proto.Bool(true), CropOffsetX: proto.Float32(1)}}, 0,
+			10, 10, [3]string{"blue", "blue", "white"}},
+		{"rotate clockwise", []*pb.Transform{{Rotate: proto.Int32(90)}}, 0,
+			20, 40, [3]string{"green", "red", "white"}},
+		{"rotate counterclockwise", []*pb.Transform{{Rotate: proto.Int32(-90)}}, 0,
+			20, 40, [3]string{"blue", "white", "red"}},
+		{"rotate upside down", []*pb.Transform{{Rotate: proto.Int32(180)}}, 0,
+			40, 20, [3]string{"white", "green", "blue"}},
+		{"flip horizontally", []*pb.Transform{{HorizontalFlip: proto.Bool(true)}}, 0,
+			40, 20, [3]string{"blue", "red", "white"}},
+		{"flip vertically", []*pb.Transform{{VerticalFlip: proto.Bool(true)}}, 0,
+			40, 20, [3]string{"green", "white", "red"}},
+		{"crop the top right quarter", []*pb.Transform{{CropLeftX: proto.Float32(0.5), CropBottomY: proto.Float32(0.5)}}, 0,
+			20, 10, [3]string{"blue", "blue", "blue"}},
+		{"crop the bottom half", []*pb.Transform{{CropTopY: proto.Float32(0.5)}}, 0,
+			40, 10, [3]string{"green", "white", "green"}},
+		// resize, rotate and then crop, no matter the order of fields
+		{"several operations", []*pb.Transform{{Width: proto.Int32(20), Rotate: proto.Int32(90), CropTopY: proto.Float32(0.5)}}, 0,
+			10, 10, [3]string{"white", "blue", "white"}},
+		{"several transforms", []*pb.Transform{{Width: proto.Int32(20)}, {HorizontalFlip: proto.Bool(true)}}, 0,
+			20, 10, [3]string{"blue", "red", "white"}},
+		{"crop right of left", []*pb.Transform{{CropLeftX: proto.Float32(0.5), CropRightX: proto.Float32(0.4)}},
+			pb.ImagesServiceError_BAD_TRANSFORM_DATA, 0, 0, [3]string{}},
+		{"rotate by 45 degrees", []*pb.Transform{{Rotate: proto.Int32(45)}},
+			pb.ImagesServiceError_BAD_TRANSFORM_DATA, 0, 0, [3]string{}},
+		{"resize too large", []*pb.Transform{{Width: proto.Int32(maxResizeDimension + 1)}},
+			pb.ImagesServiceError_BAD_TRANSFORM_DATA, 0, 0, [3]string{}},
+		{"crop to fit without a height", []*pb.Transform{{Width: proto.Int32(10), CropToFit: proto.Bool(true)}},
+			pb.ImagesServiceError_BAD_TRANSFORM_DATA, 0, 0, [3]string{}},
+		{"too many transforms", make([]*pb.Transform, maxImageTransforms+1),
+			pb.ImagesServiceError_BAD_TRANSFORM_DATA, 0, 0, [3]string{}},
+	}
+	for _, tt := range tests {
+		m, _, code := testTransform(t, c, img, out, tt.transforms...)
+		if code != tt.code {
+			t.Errorf("%s: expected error %v, got %v", tt.desc, tt.code, code)
+			continue
+		}
+		if code != 0 {
+			continue
+		}
+		b := m.Bounds()
+		corners := [3]string{
+			colorName(m.At(b.Min.X, b.Min.Y)),
+			colorName(m.At(b.Max.X-1, b.Min.Y)),
+			colorName(m.At(b.Min.X, b.Max.Y-1)),
+		}
+		if b.Dx() != tt.w || b.Dy() != tt.h || corners != tt.corners {
+			t.Errorf("%s: expected %dx%d %v, got %dx%d %v", tt.desc, tt.w, tt.h, tt.corners, b.Dx(), b.Dy(), corners)
+		}
+	}
+}
+
+func TestImagesEncoding(t *testing.T) {
+	_, unregister := NewFakeImages()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	var pngBuf, gifBuf bytes.Buffer
+	png.Encode(&pngBuf, testImage())
+	gif.Encode(&gifBuf, testImage(), nil)
+	jpegOut := func(quality int32) *pb.OutputSettings {
+		return &pb.OutputSettings{MimeType: pb.OutputSettings_JPEG.Enum(), Quality: proto.Int32(quality)}
+	}
+	tests := []struct {
+		desc   string
+		data   []byte
+		out    *pb.OutputSettings
+		code   pb.ImagesServiceError_ErrorCode
+		format string
+	}{
+		{"PNG to JPEG", pngBuf.Bytes(), &pb.OutputSettings{MimeType: pb.OutputSettings_JPEG.Enum()}, 0, "jpeg"},
+		{"GIF to PNG", gifBuf.Bytes(), &pb.OutputSettings{MimeType: pb.OutputSettings_PNG.Enum()}, 0, "png"},
+		{"JPEG quality", pngBuf.Bytes(), jpegOut(1), 0, "jpeg"},
+		{"JPEG quality too high", pngBuf.Bytes(), jpegOut(101), pb.ImagesServiceError_BAD_TRANSFORM_DATA, ""},
+		{"WEBP", pngBuf.Bytes(), &pb.OutputSettings{MimeType: pb.OutputSettings_WEBP.Enum()},
+			pb.ImagesServiceError_UNSPECIFIED_ERROR, ""},
+		{"not an image", []byte("hello"), nil, pb.ImagesServiceError_NOT_IMAGE, ""},
+		{"truncated image", pngBuf.Bytes()[:50], nil, pb.ImagesServiceError_BAD_IMAGE_DATA, ""},
+	}
+	for _, tt := range tests {
+		m, format, code := testTransform(t, c, &pb.ImageData{Content: tt.data}, tt.out)
+		if code != tt.code || format != tt.format {
+			t.Errorf("%s: expected %q %v, got %q %v", tt.desc, tt.format, tt.code, format, code)
+			continue
+		}
+		if m != nil && (m.Bounds().Dx() != 40 || m.Bounds().Dy() != 20) {
+			t.Errorf("%s: expected a 40x20 image, got %v", tt.desc, m.Bounds())
+		}
+	}
+}
+
+func TestImagesServingURL(t *testing.T) {
+	_, unregisterDatastore := NewFakeDatastore()
+	defer unregisterDatastore()
+	bs, unregisterBlobstore := NewFakeBlobstore()
+	defer unregisterBlobstore()
+	fi, unregister := NewFakeImages()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	var buf bytes.Buffer
+	png.Encode(&buf, testImage())
+	key, err := bs.CreateBlob("image/png", "a.png", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := bs.CreateBlob("text/plain", "a.txt", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &pb.OutputSettings{MimeType: pb.OutputSettings_PNG.Enum()}
+	flip := &pb.Transform{VerticalFlip: proto.Bool(true)}
+	if m, _, code := testTransform(t, c, &pb.ImageData{BlobKey: proto.String(string(key))}, out, flip); code != 0 ||
+		colorName(m.At(0, 0)) != "green" {
+		t.Errorf("Expected a flipped image of a blob, got %v", code)
+	}
+	if _, _, code := testTransform(t, c, &pb.ImageData{BlobKey: proto.String("nope")}, out); code != pb.ImagesServiceError_INVALID_BLOB_KEY {
+		t.Errorf("Expected INVALID_BLOB_KEY, got %v", code)
+	}
+
+	getURL := func(key appengine.BlobKey, secure bool) (string, pb.ImagesServiceError_ErrorCode) {
+		resp := &pb.ImagesGetUrlBaseResponse{}
+		err := c.Call("images", "GetUrlBase", &pb.ImagesGetUrlBaseRequest{
+			BlobKey:         proto.String(string(key)),
+			CreateSecureUrl: proto.Bool(secure),
+		}, resp, nil)
+		return resp.GetUrl(), imagesErrorCode(t, err)
+	}
+	u, code := getURL(key, false)
+	if code != 0 || u != "http://localhost"+imageServingPath+string(key) {
+		t.Errorf("Unexpected serving URL %q (%v)", u, code)
+	}
+	if secure, _ := getURL(key, true); secure != "https"+u[len("http"):] {
+		t.Errorf("Expected a secure URL of %s, got %s", u, secure)
+	}
+	if k, ok := fi.BlobKey(u + "=s32-c"); !ok || k != key {
+		t.Errorf("Expected %s for a URL with options, got %s (%v)", key, k, ok)
+	}
+	if _, code := getURL(text, false); code != pb.ImagesServiceError_NOT_IMAGE {
+		t.Errorf("Expected NOT_IMAGE for a text blob, got %v", code)
+	}
+	if _, code := getURL("nope", false); code != pb.ImagesServiceError_INVALID_BLOB_KEY {
+		t.Errorf("Expected INVALID_BLOB_KEY, got %v", code)
+	}
+
+	err = c.Call("images", "DeleteUrlBase", &pb.ImagesDeleteUrlBaseRequest{BlobKey: proto.String(string(key))},
+		&pb.ImagesDeleteUrlBaseResponse{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fi.BlobKey(u); ok {
+		t.Error("Expected a deleted serving URL to be unknown")
+	}
+	if _, ok := fi.BlobKey("http://localhost/other"); ok {
+		t.Error("Expected a URL which is not a serving URL to be unknown")
+	}
+}
@@ -0,0 +1,237 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strings"
+	"sync"
+
+	aei "appengine_internal"
+	pb "appengine_internal/mail"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+var (
+	// headers the mail service accepts, in canonical form
+	allowedMailHeaders = map[string]bool{
+		"In-Reply-To":      true,
+		"List-Id":          true,
+		"List-Unsubscribe": true,
+		"On-Behalf-Of":     true,
+		"References":       true,
+		"Resent-Date":      true,
+		"Resent-From":      true,
+		"Resent-To":        true,
+	}
+	// attachment extensions the mail service rejects
+	blockedAttachmentExts = map[string]bool{
+		"ade": true, "adp": true, "bat": true, "chm": true, "cmd": true,
+		"com": true, "cpl": true, "exe": true, "hta": true, "ins": true,
+		"isp": true, "jse": true, "lib": true, "mde": true, "msc": true,
+		"msp": true, "mst": true, "pif": true, "scr": true, "sct": true,
+		"shb": true, "sys": true, "vb": true, "vbe": true, "vbs": true,
+		"vxd": true, "wsc": true, "wsf": true, "wsh": true,
+	}
+)
+
+// SentMessage is an email sent with appengine/mail package.
+type SentMessage struct {
+	Sender      string
+	ReplyTo     string
+	To, Cc, Bcc []string
+	Subject     string
+	Body        string
+	HTMLBody    string
+	Attachments []MailAttachment
+	Headers     mail.Header
+	// true for messages sent with mail.SendToAdmins
+	ToAdmins bool
+}
+
+// MailAttachment is an email attachment.
+type MailAttachment struct {
+	Name      string
+	Data      []byte
+	ContentID string
+}
+
+// FakeMail is an implementation of "mail" service which keeps sent messages
+// in memory.
+//
+// Like in production, senders must be either <anything>@<app ID>.appspotmail.com
+// or addresses allowed with AllowSender, e.g. app admins or the signed in user.
+// Other messages are rejected with UNAUTHORIZED_SENDER error.
+type FakeMail struct {
+	mu      sync.Mutex
+	outbox  []*SentMessage
+	senders map[string]bool
+}
+
+// currentMail is the mail service created by the last NewFakeMail call
+// and not unregistered yet; guarded by currentMu.
+var currentMail *FakeMail
+
+// NewFakeMail creates an empty outbox and registers it as "mail" service
+// implementation.
+//
+// Returns the mail service and a function that unregisters it.
+// Here's an example:
+//
+// 		func TestInvite(t *testing.T) {
+// 			_, unregister := NewFakeMail()
+// 			defer unregister()
+//
+// 			// test code that calls mail.Send
+//
+// 			sent := SentMail()
+// 			if len(sent) != 1 || sent[0].To[0] != "friend@example.com" {
+// 				t.Errorf("Expected an invite to friend@example.com, got %+v", sent)
+// 			}
+// 		}
+//
+func NewFakeMail() (*FakeMail, func()) {
+	fm := &FakeMail{senders: make(map[string]bool)}
+	unregister := registerServiceOverrides("mail", map[string]RpcStubFunc{
+		"Send":         fm.send,
+		"SendToAdmins": fm.sendToAdmins,
+	})
+	currentMu.Lock()
+	currentMail = fm
+	currentMu.Unlock()
+	return fm, func() {
+		unregister()
+		currentMu.Lock()
+		if currentMail == fm {
+			currentMail = nil
+		}
+		currentMu.Unlock()
+	}
+}
+
+// SentMail returns messages sent through the mail service created by
+// NewFakeMail, in the order they were sent. It returns nil if there's no
+// such service.
+func SentMail() []*SentMessage {
+	currentMu.Lock()
+	fm := currentMail
+	currentMu.Unlock()
+	if fm == nil {
+		return nil
+	}
+	return fm.Sent()
+}
+
+// Sent returns messages sent so far, in the order they were sent.
+func (fm *FakeMail) Sent() []*SentMessage {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	return append([]*SentMessage(nil), fm.outbox...)
+}
+
+// Reset empties the outbox.
+func (fm *FakeMail) Reset() {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.outbox = nil
+}
+
+// AllowSender authorizes addr to send messages, in addition to
+// the app's appspotmail.com addresses.
+func (fm *FakeMail) AllowSender(addr string) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.senders[strings.ToLower(addr)] = true
+}
+
+func (fm *FakeMail) send(in, out proto.Message, _ *RpcCallOptions) error {
+	return fm.store(in.(*pb.MailMessage), false)
+}
+
+func (fm *FakeMail) sendToAdmins(in, out proto.Message, _ *RpcCallOptions) error {
+	return fm.store(in.(*pb.MailMessage), true)
+}
+
+// store validates msg and adds it to the outbox.
+func (fm *FakeMail) store(msg *pb.MailMessage, toAdmins bool) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if code, detail := fm.validate(msg, toAdmins); code != pb.MailServiceError_OK {
+		return &aei.APIError{Service: "mail", Code: int32(code), Detail: detail}
+	}
+	m := &SentMessage{
+		Sender:   msg.GetSender(),
+		ReplyTo:  msg.GetReplyTo(),
+		To:       msg.To,
+		Cc:       msg.Cc,
+		Bcc:      msg.Bcc,
+		Subject:  msg.GetSubject(),
+		Body:     msg.GetTextBody(),
+		HTMLBody: msg.GetHtmlBody(),
+		Headers:  make(mail.Header),
+		ToAdmins: toAdmins,
+	}
+	for _, a := range msg.GetAttachment() {
+		m.Attachments = append(m.Attachments, MailAttachment{
+			Name:      a.GetFileName(),
+			Data:      a.Data,
+			ContentID: a.GetContentID(),
+		})
+	}
+	for _, h := range msg.GetHeader() {
+		name := textproto.CanonicalMIMEHeaderKey(h.GetName())
+		m.Headers[name] = append(m.Headers[name], h.GetValue())
+	}
+	fm.outbox = append(fm.outbox, m)
+	return nil
+}
+
+// validate checks msg the way production mail service does.
+func (fm *FakeMail) validate(msg *pb.MailMessage, toAdmins bool) (pb.MailServiceError_ErrorCode, string) {
+	sender, err := mail.ParseAddress(msg.GetSender())
+	if err != nil {
+		return pb.MailServiceError_BAD_REQUEST, "invalid sender: " + err.Error()
+	}
+	if !fm.senders[strings.ToLower(sender.Address)] && !isAppMailAddress(sender.Address) {
+		return pb.MailServiceError_UNAUTHORIZED_SENDER, "unauthorized sender " + sender.Address
+	}
+	for _, list := range [][]string{msg.To, msg.Cc, msg.Bcc} {
+		for _, addr := range list {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				return pb.MailServiceError_BAD_REQUEST, "invalid recipient " + addr
+			}
+		}
+	}
+	if !toAdmins && len(msg.To)+len(msg.Cc)+len(msg.Bcc) == 0 {
+		return pb.MailServiceError_BAD_REQUEST, "no recipients"
+	}
+	if msg.TextBody == nil && msg.HtmlBody == nil {
+		return pb.MailServiceError_BAD_REQUEST, "no body"
+	}
+	for _, a := range msg.GetAttachment() {
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(a.GetFileName()), "."))
+		if ext == "" || blockedAttachmentExts[ext] {
+			return pb.MailServiceError_INVALID_ATTACHMENT_TYPE, "invalid attachment " + a.GetFileName()
+		}
+	}
+	for _, h := range msg.GetHeader() {
+		if !allowedMailHeaders[textproto.CanonicalMIMEHeaderKey(h.GetName())] {
+			return pb.MailServiceError_INVALID_HEADER_NAME, "header not allowed: " + h.GetName()
+		}
+	}
+	return pb.MailServiceError_OK, ""
+}
+
+// isAppMailAddress reports whether addr belongs to the app's
+// appspotmail.com domain.
+func isAppMailAddress(addr string) bool {
+	id := appID()
+	// the display part of a domain app ID, e.g. "app" for "example.com:app"
+	if i := strings.LastIndex(id, ":"); i >= 0 {
+		id = id[i+1:]
+	}
+	return strings.HasSuffix(strings.ToLower(addr), "@"+strings.ToLower(id)+".appspotmail.com")
+}
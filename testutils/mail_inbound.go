@@ -0,0 +1,155 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"time"
+	"unicode/utf8"
+)
+
+// inboundMailPath is the URL path prefix of incoming mail requests.
+const inboundMailPath = "/_ah/mail/"
+
+// NewInboundMailRequest creates a request App Engine sends to the app when
+// an email is received, i.e. a POST to /_ah/mail/<to address> with an RFC 2822
+// message body, and an appengine.Context associated with the request.
+// The message is multipart/mixed if there are attachments, and plain text
+// otherwise. Non-ASCII text is encoded as in messages sent by mail clients.
+// It panics if to or from is not a valid address.
+//
+// Returns the request and a function that removes associated context,
+// like NewTestRequest:
+//
+// 		r, deleteContext := NewInboundMailRequest("support@myapp.appspotmail.com",
+// 			"Joe <joe@example.com>", "Help", "It's broken", MailAttachment{
+// 				Name: "screenshot.png",
+// 				Data: png,
+// 			})
+// 		defer deleteContext()
+// 		w := httptest.NewRecorder()
+// 		http.DefaultServeMux.ServeHTTP(w, r)
+//
+func NewInboundMailRequest(to, from, subject, body string, attachments ...MailAttachment) (*http.Request, func()) {
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		panic(fmt.Sprintf("NewInboundMailRequest: to %q: %v", to, err))
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		panic(fmt.Sprintf("NewInboundMailRequest: from %q: %v", from, err))
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", encodeMailHeader(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%d@mail.example.com>\r\n", time.Now().UnixNano())
+	msg.WriteString("MIME-Version: 1.0\r\n")
+
+	if len(attachments) == 0 {
+		writeMailPart(&msg, textMailHeader(body), mailText(body))
+	} else {
+		var parts bytes.Buffer
+		mw := multipart.NewWriter(&parts)
+		writeMailPart(&msg, textproto.MIMEHeader{
+			"Content-Type": {"multipart/mixed; boundary=" + mw.Boundary()},
+		}, nil)
+		w, _ := mw.CreatePart(textMailHeader(body))
+		w.Write(mailText(body))
+		for _, a := range attachments {
+			ctype := mime.TypeByExtension(path.Ext(a.Name))
+			if ctype == "" {
+				ctype = "application/octet-stream"
+			}
+			h := textproto.MIMEHeader{
+				"Content-Type":              {fmt.Sprintf("%s; name=%q", ctype, a.Name)},
+				"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", a.Name)},
+				"Content-Transfer-Encoding": {"base64"},
+			}
+			if a.ContentID != "" {
+				h.Set("Content-ID", a.ContentID)
+			}
+			w, _ := mw.CreatePart(h)
+			w.Write(base64Lines(a.Data))
+		}
+		mw.Close()
+		msg.Write(parts.Bytes())
+	}
+
+	req, err := http.NewRequest("POST", inboundMailPath+toAddr.Address, &msg)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+	CreateTestContext(req)
+	return req, func() {
+		DeleteTestContext(req)
+	}
+}
+
+// writeMailPart writes MIME headers h, a blank line and body to buf.
+func writeMailPart(buf *bytes.Buffer, h textproto.MIMEHeader, body []byte) {
+	for k, vs := range h {
+		for _, v := range vs {
+			fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+}
+
+// textMailHeader returns headers of a plain text part with body.
+func textMailHeader(body string) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}}
+	if !isASCII(body) {
+		h.Set("Content-Transfer-Encoding", "base64")
+	}
+	return h
+}
+
+// mailText returns body encoded according to textMailHeader.
+func mailText(body string) []byte {
+	if !isASCII(body) {
+		return base64Lines([]byte(body))
+	}
+	return []byte(body)
+}
+
+// encodeMailHeader encodes non-ASCII header values as RFC 2047 words.
+func encodeMailHeader(s string) string {
+	if isASCII(s) {
+		return s
+	}
+	return "=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte(s)) + "?="
+}
+
+// base64Lines encodes b in base64 lines of 76 characters.
+func base64Lines(b []byte) []byte {
+	s := base64.StdEncoding.EncodeToString(b)
+	var buf bytes.Buffer
+	for len(s) > 76 {
+		buf.WriteString(s[:76] + "\r\n")
+		s = s[76:]
+	}
+	buf.WriteString(s + "\r\n")
+	return buf.Bytes()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// readMailPart returns body of a MIME part with header h, decoding base64.
+func readMailPart(t *testing.T, h textproto.MIMEHeader, r io.Reader) string {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("Content-Transfer-Encoding") == "base64" {
+		if b, err = base64.StdEncoding.DecodeString(strings.Replace(string(b), "\r\n", "", -1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return string(b)
+}
+
+func TestNewInboundMailRequest(t *testing.T) {
+	png := strings.Repeat("\x89PNG", 40)
+	r, deleteContext := NewInboundMailRequest("Support <support@app.appspotmail.com>",
+		"joe@example.com", "Ünïcode", "héllo\nworld",
+		MailAttachment{Name: "a.png", Data: []byte(png)},
+		MailAttachment{Name: "b", Data: []byte("x"), ContentID: "<c1>"})
+	defer deleteContext()
+
+	if r.Method != "POST" || r.URL.Path != "/_ah/mail/support@app.appspotmail.com" ||
+		r.Header.Get("Content-Type") != "message/rfc822" {
+		t.Errorf("Unexpected request %s %s %v", r.Method, r.URL.Path, r.Header)
+	}
+	msg, err := mail.ReadMessage(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := msg.Header.Get("From"); from != "joe@example.com" {
+		t.Errorf("Expected From joe@example.com, got %q", from)
+	}
+	if want := "=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte("Ünïcode")) + "?="; msg.Header.Get("Subject") != want {
+		t.Errorf("Expected Subject %q, got %q", want, msg.Header.Get("Subject"))
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Invalid Date: %v", err)
+	}
+	ctype, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || ctype != "multipart/mixed" {
+		t.Fatalf("Expected multipart/mixed message, got %q (%v)", msg.Header.Get("Content-Type"), err)
+	}
+
+	tests := []struct {
+		ctype, filename, contentID, body string
+	}{
+		{"text/plain", "", "", "héllo\nworld"},
+		{"image/png", "a.png", "", png},
+		{"application/octet-stream", "b", "<c1>", "x"},
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for i, tt := range tests {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Part %d: %v", i, err)
+		}
+		ctype, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		filename := ""
+		if d := p.Header.Get("Content-Disposition"); d != "" {
+			_, params, _ := mime.ParseMediaType(d)
+			filename = params["filename"]
+		}
+		body := readMailPart(t, p.Header, p)
+		if ctype != tt.ctype || filename != tt.filename || p.Header.Get("Content-ID") != tt.contentID || body != tt.body {
+			t.Errorf("Part %d: expected %s %q %q %q, got %s %q %q %q", i,
+				tt.ctype, tt.filename, tt.contentID, tt.body, ctype, filename, p.Header.Get("Content-ID"), body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("Expected 3 parts, got error %v", err)
+	}
+}
+
+func TestNewInboundMailRequestPlain(t *testing.T) {
+	r, deleteContext := NewInboundMailRequest("a@app.appspotmail.com", "Joe <joe@example.com>", "Hi", "plain")
+	defer deleteContext()
+	msg, err := mail.ReadMessage(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := textproto.MIMEHeader(msg.Header)
+	if h.Get("Subject") != "Hi" || h.Get("Content-Type") != "text/plain; charset=UTF-8" ||
+		h.Get("Content-Transfer-Encoding") != "" {
+		t.Errorf("Unexpected headers %v", msg.Header)
+	}
+	if body := readMailPart(t, h, msg.Body); body != "plain" {
+		t.Errorf("Expected body plain, got %q", body)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for an invalid address")
+		}
+	}()
+	NewInboundMailRequest("nope", "joe@example.com", "Hi", "plain")
+}
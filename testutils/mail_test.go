@@ -0,0 +1,126 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"reflect"
+	"testing"
+
+	aei "appengine_internal"
+	pb "appengine_internal/mail"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// testMailMessage returns a valid message sent from the app's address.
+func testMailMessage() *pb.MailMessage {
+	return &pb.MailMessage{
+		Sender:   proto.String("Bot <noreply@" + appID() + ".appspotmail.com>"),
+		To:       []string{"a@example.com"},
+		Subject:  proto.String("hi"),
+		TextBody: proto.String("body"),
+		HtmlBody: proto.String("<b>body</b>"),
+		Attachment: []*pb.MailAttachment{
+			{FileName: proto.String("a.txt"), Data: []byte("data")},
+		},
+		Header: []*pb.MailHeader{
+			{Name: proto.String("list-id"), Value: proto.String("news")},
+		},
+	}
+}
+
+func TestMail(t *testing.T) {
+	fm, unregister := NewFakeMail()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	fm.AllowSender("Admin@Example.com")
+
+	tests := []struct {
+		desc   string
+		method string
+		change func(m *pb.MailMessage)
+		code   pb.MailServiceError_ErrorCode
+	}{
+		{"valid message", "Send", func(m *pb.MailMessage) {}, pb.MailServiceError_OK},
+		{"unauthorized sender", "Send", func(m *pb.MailMessage) {
+			m.Sender = proto.String("me@example.com")
+		}, pb.MailServiceError_UNAUTHORIZED_SENDER},
+		{"allowed sender", "Send", func(m *pb.MailMessage) {
+			m.Sender = proto.String("Admin <admin@example.com>")
+		}, pb.MailServiceError_OK},
+		{"invalid sender", "Send", func(m *pb.MailMessage) {
+			m.Sender = proto.String("<nope")
+		}, pb.MailServiceError_BAD_REQUEST},
+		{"invalid recipient", "Send", func(m *pb.MailMessage) {
+			m.Cc = []string{"nope"}
+		}, pb.MailServiceError_BAD_REQUEST},
+		{"no recipients", "Send", func(m *pb.MailMessage) {
+			m.To = nil
+		}, pb.MailServiceError_BAD_REQUEST},
+		{"no recipients to admins", "SendToAdmins", func(m *pb.MailMessage) {
+			m.To = nil
+		}, pb.MailServiceError_OK},
+		{"no body", "Send", func(m *pb.MailMessage) {
+			m.TextBody, m.HtmlBody = nil, nil
+		}, pb.MailServiceError_BAD_REQUEST},
+		{"blocked attachment", "Send", func(m *pb.MailMessage) {
+			m.Attachment[0].FileName = proto.String("a.EXE")
+		}, pb.MailServiceError_INVALID_ATTACHMENT_TYPE},
+		{"attachment without an extension", "Send", func(m *pb.MailMessage) {
+			m.Attachment[0].FileName = proto.String("readme")
+		}, pb.MailServiceError_INVALID_ATTACHMENT_TYPE},
+		{"header not allowed", "Send", func(m *pb.MailMessage) {
+			m.Header[0].Name = proto.String("X-Foo")
+		}, pb.MailServiceError_INVALID_HEADER_NAME},
+	}
+	sent := 0
+	for _, tt := range tests {
+		m := testMailMessage()
+		tt.change(m)
+		err := c.Call("mail", tt.method, m, &pb.MailMessage{}, nil)
+		var code pb.MailServiceError_ErrorCode
+		if err != nil {
+			apiErr, ok := err.(*aei.APIError)
+			if !ok || apiErr.Service != "mail" {
+				t.Fatalf("%s: expected a mail API error, got %#v", tt.desc, err)
+			}
+			code = pb.MailServiceError_ErrorCode(apiErr.Code)
+		}
+		if code != tt.code {
+			t.Errorf("%s: expected %v, got %v", tt.desc, tt.code, err)
+		}
+		if code == pb.MailServiceError_OK {
+			sent++
+		}
+	}
+
+	msgs := SentMail()
+	if len(msgs) != sent {
+		t.Fatalf("Expected %d sent messages, got %d", sent, len(msgs))
+	}
+	want := &SentMessage{
+		Sender:      "Bot <noreply@" + appID() + ".appspotmail.com>",
+		To:          []string{"a@example.com"},
+		Subject:     "hi",
+		Body:        "body",
+		HTMLBody:    "<b>body</b>",
+		Attachments: []MailAttachment{{Name: "a.txt", Data: []byte("data")}},
+		Headers:     map[string][]string{"List-Id": {"news"}},
+	}
+	if !reflect.DeepEqual(msgs[0], want) {
+		t.Errorf("Expected %+v, got %+v", want, msgs[0])
+	}
+	if !msgs[2].ToAdmins || msgs[1].ToAdmins {
+		t.Errorf("Expected only the last message sent to admins, got %+v", msgs)
+	}
+
+	fm.Reset()
+	if msgs := fm.Sent(); len(msgs) != 0 {
+		t.Errorf("Expected no messages after Reset, got %d", len(msgs))
+	}
+	unregister()
+	if msgs := SentMail(); msgs != nil {
+		t.Errorf("Expected no messages without a mail service, got %v", msgs)
+	}
+}
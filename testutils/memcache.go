@@ -0,0 +1,378 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+
+	aei "appengine_internal"
+	pb "appengine_internal/memcache"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// maxMemcacheValueSize is the largest value memcache accepts.
+	maxMemcacheValueSize = 1000000
+	// maxRelativeExpiration is the largest expiration time interpreted
+	// as a number of seconds from now rather than a Unix timestamp.
+	maxRelativeExpiration = 30 * 24 * 60 * 60
+)
+
+// FakeMemcache is an in-memory implementation of "memcache" service.
+// It supports all Get, Set (including Add, Replace and CompareAndSwap),
+// Delete, Increment, FlushAll and Stats calls made by appengine/memcache,
+// and thus its Gob and JSON codecs too.
+type FakeMemcache struct {
+	mu sync.Mutex
+	// items keyed by namespace and key; values are elements of lru
+	items map[string]*list.Element
+	// most recently used items go first
+	lru *list.List
+	// keys deleted with a non-zero delete_time, which can't be added
+	// until the time they map to
+	locked map[string]time.Time
+	// total size of all items and maximum size; zero max means no limit
+	bytes, maxBytes int
+	lastCas         uint64
+	// shift of the fake clock relative to time.Now
+	offset                 time.Duration
+	hits, misses, byteHits uint64
+}
+
+// memcacheItem is a cached value.
+type memcacheItem struct {
+	id      string
+	key     []byte
+	value   []byte
+	flags   uint32
+	cas     uint64
+	expires time.Time // zero means never
+	access  time.Time
+}
+
+func (it *memcacheItem) size() int {
+	return len(it.key) + len(it.value)
+}
+
+// NewFakeMemcache creates an empty memcache with no memory limit and
+// registers it as "memcache" service implementation.
+//
+// Returns the memcache and a function that unregisters it. Here's an example:
+//
+// 		func TestSomething(t *testing.T) {
+// 			_, unregister := NewFakeMemcache()
+// 			defer unregister()
+//
+// 			// test code that calls memcache.Get, memcache.Gob.Set, etc.
+// 		}
+//
+func NewFakeMemcache() (*FakeMemcache, func()) {
+	mc := &FakeMemcache{
+		items:  make(map[string]*list.Element),
+		lru:    list.New(),
+		locked: make(map[string]time.Time),
+	}
+	unregister := registerServiceOverrides("memcache", map[string]RpcStubFunc{
+		"Get":            mc.get,
+		"Set":            mc.set,
+		"Delete":         mc.delete,
+		"Increment":      mc.increment,
+		"BatchIncrement": mc.batchIncrement,
+		"FlushAll":       mc.flushAll,
+		"Stats":          mc.stats,
+	})
+	return mc, unregister
+}
+
+// SetMaxBytes limits the total size of keys and values the memcache holds.
+// When the limit is exceeded, least recently used items are evicted.
+// Zero means no limit.
+func (mc *FakeMemcache) SetMaxBytes(n int) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.maxBytes = n
+	mc.evict()
+}
+
+// AdvanceTime moves the memcache clock forward by d, so that items can be
+// expired without waiting.
+func (mc *FakeMemcache) AdvanceTime(d time.Duration) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.offset += d
+}
+
+func (mc *FakeMemcache) now() time.Time {
+	return time.Now().Add(mc.offset)
+}
+
+func (mc *FakeMemcache) get(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.MemcacheGetRequest), out.(*pb.MemcacheGetResponse)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, key := range req.GetKey() {
+		it := mc.lookup(req.GetNameSpace(), key)
+		if it == nil {
+			mc.misses++
+			continue
+		}
+		mc.hits++
+		mc.byteHits += uint64(it.size())
+		ri := &pb.MemcacheGetResponse_Item{
+			Key:   it.key,
+			Value: it.value,
+			Flags: proto.Uint32(it.flags),
+		}
+		if req.GetForCas() {
+			ri.CasId = proto.Uint64(it.cas)
+		}
+		resp.Item = append(resp.Item, ri)
+	}
+	return nil
+}
+
+func (mc *FakeMemcache) set(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.MemcacheSetRequest), out.(*pb.MemcacheSetResponse)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, ri := range req.GetItem() {
+		resp.SetStatus = append(resp.SetStatus, mc.setItem(req.GetNameSpace(), ri))
+	}
+	mc.evict()
+	return nil
+}
+
+func (mc *FakeMemcache) setItem(ns string, ri *pb.MemcacheSetRequest_Item) pb.MemcacheSetResponse_SetStatusCode {
+	if len(ri.Value) > maxMemcacheValueSize {
+		return pb.MemcacheSetResponse_ERROR
+	}
+	now := mc.now()
+	existing := mc.lookup(ns, ri.Key)
+	switch ri.GetSetPolicy() {
+	case pb.MemcacheSetRequest_ADD:
+		if t, ok := mc.locked[memcacheId(ns, ri.Key)]; existing != nil || ok && now.Before(t) {
+			return pb.MemcacheSetResponse_NOT_STORED
+		}
+	case pb.MemcacheSetRequest_REPLACE:
+		if existing == nil {
+			return pb.MemcacheSetResponse_NOT_STORED
+		}
+	case pb.MemcacheSetRequest_CAS:
+		if existing == nil {
+			return pb.MemcacheSetResponse_NOT_STORED
+		}
+		if ri.CasId == nil || existing.cas != ri.GetCasId() {
+			return pb.MemcacheSetResponse_EXISTS
+		}
+	}
+	it := &memcacheItem{
+		id:     memcacheId(ns, ri.Key),
+		key:    append([]byte(nil), ri.Key...),
+		value:  append([]byte(nil), ri.Value...),
+		flags:  ri.GetFlags(),
+		access: now,
+	}
+	switch exp := ri.GetExpirationTime(); {
+	case exp == 0:
+	case exp <= maxRelativeExpiration:
+		it.expires = now.Add(time.Duration(exp) * time.Second)
+	default:
+		it.expires = time.Unix(int64(exp), 0)
+	}
+	mc.store(it)
+	return pb.MemcacheSetResponse_STORED
+}
+
+func (mc *FakeMemcache) delete(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.MemcacheDeleteRequest), out.(*pb.MemcacheDeleteResponse)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, ri := range req.GetItem() {
+		it := mc.lookup(req.GetNameSpace(), ri.Key)
+		if it == nil {
+			resp.DeleteStatus = append(resp.DeleteStatus, pb.MemcacheDeleteResponse_NOT_FOUND)
+			continue
+		}
+		mc.remove(it.id)
+		// delete_time keeps the key from being added for some time
+		switch t := ri.GetDeleteTime(); {
+		case t == 0:
+		case t <= maxRelativeExpiration:
+			mc.locked[it.id] = mc.now().Add(time.Duration(t) * time.Second)
+		default:
+			mc.locked[it.id] = time.Unix(int64(t), 0)
+		}
+		resp.DeleteStatus = append(resp.DeleteStatus, pb.MemcacheDeleteResponse_DELETED)
+	}
+	return nil
+}
+
+func (mc *FakeMemcache) increment(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.MemcacheIncrementRequest), out.(*pb.MemcacheIncrementResponse)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if !mc.incrementItem(req.GetNameSpace(), req, resp) {
+		return &aei.APIError{
+			Service: "memcache",
+			Code:    int32(pb.MemcacheServiceError_INVALID_VALUE),
+			Detail:  "cannot increment or decrement non-numeric value",
+		}
+	}
+	mc.evict()
+	return nil
+}
+
+func (mc *FakeMemcache) batchIncrement(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.MemcacheBatchIncrementRequest), out.(*pb.MemcacheBatchIncrementResponse)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, ri := range req.GetItem() {
+		r := &pb.MemcacheIncrementResponse{}
+		if !mc.incrementItem(req.GetNameSpace(), ri, r) {
+			r.IncrementStatus = pb.MemcacheIncrementResponse_ERROR.Enum()
+		}
+		resp.Item = append(resp.Item, r)
+	}
+	mc.evict()
+	return nil
+}
+
+// incrementItem applies req to an item in namespace ns (unless req has its
+// own namespace) and fills in resp. It returns false if the item value isn't
+// a decimal number.
+func (mc *FakeMemcache) incrementItem(ns string, req *pb.MemcacheIncrementRequest, resp *pb.MemcacheIncrementResponse) bool {
+	if req.NameSpace != nil {
+		ns = req.GetNameSpace()
+	}
+	it := mc.lookup(ns, req.Key)
+	if it == nil {
+		if req.InitialValue == nil {
+			// a miss
+			resp.IncrementStatus = pb.MemcacheIncrementResponse_NOT_CHANGED.Enum()
+			return true
+		}
+		it = &memcacheItem{
+			id:    memcacheId(ns, req.Key),
+			key:   append([]byte(nil), req.Key...),
+			value: []byte(strconv.FormatUint(req.GetInitialValue(), 10)),
+			flags: req.GetInitialFlags(),
+		}
+	}
+	v, err := strconv.ParseUint(string(it.value), 10, 64)
+	if err != nil {
+		return false
+	}
+	if req.GetDirection() == pb.MemcacheIncrementRequest_DECREMENT {
+		if req.GetDelta() > v {
+			v = 0
+		} else {
+			v -= req.GetDelta()
+		}
+	} else {
+		// wraps around at 2^64, like memcached
+		v += req.GetDelta()
+	}
+	updated := *it
+	updated.value = []byte(strconv.FormatUint(v, 10))
+	updated.access = mc.now()
+	mc.store(&updated)
+	resp.NewValue = proto.Uint64(v)
+	resp.IncrementStatus = pb.MemcacheIncrementResponse_OK.Enum()
+	return true
+}
+
+func (mc *FakeMemcache) flushAll(in, out proto.Message, _ *RpcCallOptions) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.items = make(map[string]*list.Element)
+	mc.lru.Init()
+	mc.locked = make(map[string]time.Time)
+	mc.bytes = 0
+	return nil
+}
+
+func (mc *FakeMemcache) stats(in, out proto.Message, _ *RpcCallOptions) error {
+	resp := out.(*pb.MemcacheStatsResponse)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.expire()
+	var age uint32
+	if el := mc.lru.Back(); el != nil {
+		age = uint32(mc.now().Sub(el.Value.(*memcacheItem).access) / time.Second)
+	}
+	resp.Stats = &pb.MergedNamespaceStats{
+		Hits:          proto.Uint64(mc.hits),
+		Misses:        proto.Uint64(mc.misses),
+		ByteHits:      proto.Uint64(mc.byteHits),
+		Items:         proto.Uint64(uint64(mc.lru.Len())),
+		Bytes:         proto.Uint64(uint64(mc.bytes)),
+		OldestItemAge: proto.Uint32(age),
+	}
+	return nil
+}
+
+// lookup returns a live item and marks it as recently used, or returns nil.
+func (mc *FakeMemcache) lookup(ns string, key []byte) *memcacheItem {
+	el, ok := mc.items[memcacheId(ns, key)]
+	if !ok {
+		return nil
+	}
+	it := el.Value.(*memcacheItem)
+	now := mc.now()
+	if !it.expires.IsZero() && !now.Before(it.expires) {
+		mc.remove(it.id)
+		return nil
+	}
+	it.access = now
+	mc.lru.MoveToFront(el)
+	return it
+}
+
+// store adds or replaces an item, assigning it a new CAS ID.
+func (mc *FakeMemcache) store(it *memcacheItem) {
+	mc.remove(it.id)
+	delete(mc.locked, it.id)
+	mc.lastCas++
+	it.cas = mc.lastCas
+	mc.items[it.id] = mc.lru.PushFront(it)
+	mc.bytes += it.size()
+}
+
+func (mc *FakeMemcache) remove(id string) {
+	if el, ok := mc.items[id]; ok {
+		mc.bytes -= el.Value.(*memcacheItem).size()
+		mc.lru.Remove(el)
+		delete(mc.items, id)
+	}
+}
+
+// expire removes all expired items.
+func (mc *FakeMemcache) expire() {
+	now := mc.now()
+	for id, el := range mc.items {
+		it := el.Value.(*memcacheItem)
+		if !it.expires.IsZero() && !now.Before(it.expires) {
+			mc.remove(id)
+		}
+	}
+}
+
+// evict removes least recently used items until memory limit is met.
+func (mc *FakeMemcache) evict() {
+	if mc.maxBytes <= 0 || mc.bytes <= mc.maxBytes {
+		return
+	}
+	mc.expire()
+	for mc.bytes > mc.maxBytes {
+		mc.remove(mc.lru.Back().Value.(*memcacheItem).id)
+	}
+}
+
+// memcacheId returns a unique ID of key in namespace ns.
+func memcacheId(ns string, key []byte) string {
+	return ns + "\x00" + string(key)
+}
@@ -0,0 +1,321 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"testing"
+	"time"
+
+	"appengine"
+
+	aei "appengine_internal"
+	pb "appengine_internal/memcache"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+type testMemcache struct {
+	t *testing.T
+	c appengine.Context
+}
+
+func (m *testMemcache) call(method string, in, out proto.Message) error {
+	return m.c.Call("memcache", method, in, out, nil)
+}
+
+func (m *testMemcache) set(key, value string, policy pb.MemcacheSetRequest_SetPolicy, exp uint32, cas uint64) pb.MemcacheSetResponse_SetStatusCode {
+	item := &pb.MemcacheSetRequest_Item{
+		Key:            []byte(key),
+		Value:          []byte(value),
+		SetPolicy:      policy.Enum(),
+		ExpirationTime: proto.Uint32(exp),
+	}
+	if cas != 0 {
+		item.CasId = proto.Uint64(cas)
+	}
+	resp := &pb.MemcacheSetResponse{}
+	if err := m.call("Set", &pb.MemcacheSetRequest{Item: []*pb.MemcacheSetRequest_Item{item}}, resp); err != nil {
+		m.t.Fatalf("Set %s: %v", key, err)
+	}
+	return resp.SetStatus[0]
+}
+
+// get returns an item of key, or nil on a cache miss.
+func (m *testMemcache) get(key string) *pb.MemcacheGetResponse_Item {
+	resp := &pb.MemcacheGetResponse{}
+	req := &pb.MemcacheGetRequest{Key: [][]byte{[]byte(key)}, ForCas: proto.Bool(true)}
+	if err := m.call("Get", req, resp); err != nil {
+		m.t.Fatalf("Get %s: %v", key, err)
+	}
+	if len(resp.Item) == 0 {
+		return nil
+	}
+	return resp.Item[0]
+}
+
+func (m *testMemcache) value(key string) string {
+	if it := m.get(key); it != nil {
+		return string(it.Value)
+	}
+	return "<miss>"
+}
+
+func TestMemcacheSet(t *testing.T) {
+	_, unregister := NewFakeMemcache()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	m := &testMemcache{t, c}
+
+	const (
+		set     = pb.MemcacheSetRequest_SET
+		add     = pb.MemcacheSetRequest_ADD
+		replace = pb.MemcacheSetRequest_REPLACE
+		cas     = pb.MemcacheSetRequest_CAS
+	)
+	const (
+		stored    = pb.MemcacheSetResponse_STORED
+		notStored = pb.MemcacheSetResponse_NOT_STORED
+		exists    = pb.MemcacheSetResponse_EXISTS
+	)
+	tests := []struct {
+		desc   string
+		key    string
+		policy pb.MemcacheSetRequest_SetPolicy
+		value  string
+		status pb.MemcacheSetResponse_SetStatusCode
+		want   string
+	}{
+		{"add a new key", "a", add, "1", stored, "1"},
+		{"add an existing key", "a", add, "2", notStored, "1"},
+		{"replace a missing key", "b", replace, "1", notStored, "<miss>"},
+		{"replace an existing key", "a", replace, "3", stored, "3"},
+		{"set", "b", set, "4", stored, "4"},
+		{"compare and swap without a CAS ID", "a", cas, "5", exists, "3"},
+		{"compare and swap a missing key", "c", cas, "5", notStored, "<miss>"},
+	}
+	for _, tt := range tests {
+		if s := m.set(tt.key, tt.value, tt.policy, 0, 0); s != tt.status {
+			t.Errorf("%s: expected %v, got %v", tt.desc, tt.status, s)
+		}
+		if got := m.value(tt.key); got != tt.want {
+			t.Errorf("%s: expected value %q, got %q", tt.desc, tt.want, got)
+		}
+	}
+
+	first := m.get("a").GetCasId()
+	if s := m.set("a", "6", cas, 0, first); s != stored {
+		t.Errorf("Expected compare and swap to store the value, got %v", s)
+	}
+	// the value has changed since it was read
+	if s := m.set("a", "7", cas, 0, first); s != exists {
+		t.Errorf("Expected EXISTS with a stale CAS ID, got %v", s)
+	}
+	if got := m.value("a"); got != "6" {
+		t.Errorf("Expected value 6, got %q", got)
+	}
+
+	big := make([]byte, maxMemcacheValueSize+1)
+	if s := m.set("big", string(big), set, 0, 0); s != pb.MemcacheSetResponse_ERROR {
+		t.Errorf("Expected ERROR for a value of %d bytes, got %v", len(big), s)
+	}
+}
+
+func TestMemcacheExpiration(t *testing.T) {
+	mc, unregister := NewFakeMemcache()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	m := &testMemcache{t, c}
+
+	m.set("relative", "x", pb.MemcacheSetRequest_SET, 10, 0)
+	m.set("absolute", "x", pb.MemcacheSetRequest_SET, uint32(time.Now().Add(time.Hour).Unix()), 0)
+	m.set("never", "x", pb.MemcacheSetRequest_SET, 0, 0)
+
+	mc.AdvanceTime(9 * time.Second)
+	if m.get("relative") == nil {
+		t.Error("Expected an item to live for 10s")
+	}
+	mc.AdvanceTime(time.Second)
+	if m.get("relative") != nil {
+		t.Error("Expected an item to expire after 10s")
+	}
+	if m.get("absolute") == nil {
+		t.Error("Expected an item to live for an hour")
+	}
+	mc.AdvanceTime(time.Hour)
+	if m.get("absolute") != nil {
+		t.Error("Expected an item to expire after an hour")
+	}
+	if m.get("never") == nil {
+		t.Error("Expected an item without expiration to stay")
+	}
+
+	// a key deleted with a delete time can't be added until then
+	req := &pb.MemcacheDeleteRequest{Item: []*pb.MemcacheDeleteRequest_Item{
+		{Key: []byte("never"), DeleteTime: proto.Uint32(5)},
+		{Key: []byte("missing")},
+	}}
+	resp := &pb.MemcacheDeleteResponse{}
+	if err := m.call("Delete", req, resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.DeleteStatus) != 2 || resp.DeleteStatus[0] != pb.MemcacheDeleteResponse_DELETED ||
+		resp.DeleteStatus[1] != pb.MemcacheDeleteResponse_NOT_FOUND {
+		t.Errorf("Expected DELETED and NOT_FOUND, got %v", resp.DeleteStatus)
+	}
+	if s := m.set("never", "y", pb.MemcacheSetRequest_ADD, 0, 0); s != pb.MemcacheSetResponse_NOT_STORED {
+		t.Errorf("Expected add of a locked key to fail, got %v", s)
+	}
+	mc.AdvanceTime(5 * time.Second)
+	if s := m.set("never", "y", pb.MemcacheSetRequest_ADD, 0, 0); s != pb.MemcacheSetResponse_STORED {
+		t.Errorf("Expected add to succeed after the delete time, got %v", s)
+	}
+}
+
+func TestMemcacheIncrement(t *testing.T) {
+	_, unregister := NewFakeMemcache()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	m := &testMemcache{t, c}
+
+	m.set("n", "10", pb.MemcacheSetRequest_SET, 0, 0)
+	m.set("s", "ten", pb.MemcacheSetRequest_SET, 0, 0)
+	m.set("max", "18446744073709551615", pb.MemcacheSetRequest_SET, 0, 0)
+
+	const (
+		inc = pb.MemcacheIncrementRequest_INCREMENT
+		dec = pb.MemcacheIncrementRequest_DECREMENT
+	)
+	tests := []struct {
+		key       string
+		dir       pb.MemcacheIncrementRequest_Direction
+		delta     uint64
+		initial   *uint64
+		status    pb.MemcacheIncrementResponse_IncrementStatusCode
+		want      uint64
+		wantValue string
+	}{
+		{"n", inc, 5, nil, pb.MemcacheIncrementResponse_OK, 15, "15"},
+		{"n", dec, 3, nil, pb.MemcacheIncrementResponse_OK, 12, "12"},
+		// decrements stop at zero
+		{"n", dec, 100, nil, pb.MemcacheIncrementResponse_OK, 0, "0"},
+		// increments wrap around
+		{"max", inc, 2, nil, pb.MemcacheIncrementResponse_OK, 1, "1"},
+		{"missing", inc, 1, nil, pb.MemcacheIncrementResponse_NOT_CHANGED, 0, "<miss>"},
+		{"new", inc, 1, proto.Uint64(41), pb.MemcacheIncrementResponse_OK, 42, "42"},
+		{"s", inc, 1, nil, pb.MemcacheIncrementResponse_ERROR, 0, "ten"},
+	}
+	for _, tt := range tests {
+		req := &pb.MemcacheBatchIncrementRequest{Item: []*pb.MemcacheIncrementRequest{{
+			Key:          []byte(tt.key),
+			Delta:        proto.Uint64(tt.delta),
+			Direction:    tt.dir.Enum(),
+			InitialValue: tt.initial,
+		}}}
+		resp := &pb.MemcacheBatchIncrementResponse{}
+		if err := m.call("BatchIncrement", req, resp); err != nil {
+			t.Fatal(err)
+		}
+		r := resp.Item[0]
+		if r.GetIncrementStatus() != tt.status || r.GetNewValue() != tt.want {
+			t.Errorf("%v %s by %d: expected %v %d, got %v %d", tt.dir, tt.key, tt.delta,
+				tt.status, tt.want, r.GetIncrementStatus(), r.GetNewValue())
+		}
+		if got := m.value(tt.key); got != tt.wantValue {
+			t.Errorf("%v %s by %d: expected value %q, got %q", tt.dir, tt.key, tt.delta, tt.wantValue, got)
+		}
+	}
+
+	err := m.call("Increment", &pb.MemcacheIncrementRequest{Key: []byte("s"), Delta: proto.Uint64(1)},
+		&pb.MemcacheIncrementResponse{})
+	if apiErr, ok := err.(*aei.APIError); !ok || apiErr.Code != int32(pb.MemcacheServiceError_INVALID_VALUE) {
+		t.Errorf("Expected INVALID_VALUE for a non-numeric value, got %v", err)
+	}
+}
+
+func TestMemcacheEviction(t *testing.T) {
+	mc, unregister := NewFakeMemcache()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	m := &testMemcache{t, c}
+
+	// each item is 2+4 bytes, two of them fit
+	mc.SetMaxBytes(14)
+	m.set("k1", "1234", pb.MemcacheSetRequest_SET, 0, 0)
+	m.set("k2", "1234", pb.MemcacheSetRequest_SET, 0, 0)
+	// k1 is used more recently than k2 now
+	m.get("k1")
+	m.set("k3", "1234", pb.MemcacheSetRequest_SET, 0, 0)
+	cached := []struct {
+		key  string
+		want bool
+	}{{"k1", true}, {"k2", false}, {"k3", true}}
+	for _, tt := range cached {
+		if got := m.get(tt.key) != nil; got != tt.want {
+			t.Errorf("Expected %s cached: %v, got %v", tt.key, tt.want, got)
+		}
+	}
+
+	// lowering the limit evicts right away
+	mc.SetMaxBytes(6)
+	if m.get("k1") != nil || m.get("k3") == nil {
+		t.Errorf("Expected only the most recent k3 to stay")
+	}
+
+	resp := &pb.MemcacheStatsResponse{}
+	if err := m.call("Stats", &pb.MemcacheStatsRequest{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	st := resp.GetStats()
+	if st.GetItems() != 1 || st.GetBytes() != 6 || st.GetHits() != 4 || st.GetMisses() != 2 {
+		t.Errorf("Expected 1 item of 6 bytes, 4 hits and 2 misses, got %v", st)
+	}
+
+	if err := m.call("FlushAll", &pb.MemcacheFlushRequest{}, &pb.MemcacheFlushResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if m.get("k3") != nil {
+		t.Error("Expected no items after FlushAll")
+	}
+}
+
+func TestMemcacheNamespaces(t *testing.T) {
+	_, unregister := NewFakeMemcache()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	set := func(ns, value string) {
+		req := &pb.MemcacheSetRequest{NameSpace: proto.String(ns), Item: []*pb.MemcacheSetRequest_Item{
+			{Key: []byte("k"), Value: []byte(value)},
+		}}
+		if err := c.Call("memcache", "Set", req, &pb.MemcacheSetResponse{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(ns string) string {
+		resp := &pb.MemcacheGetResponse{}
+		req := &pb.MemcacheGetRequest{NameSpace: proto.String(ns), Key: [][]byte{[]byte("k")}}
+		if err := c.Call("memcache", "Get", req, resp, nil); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Item) == 0 {
+			return "<miss>"
+		}
+		return string(resp.Item[0].Value)
+	}
+	set("", "default")
+	set("ns", "other")
+	if got := get(""); got != "default" {
+		t.Errorf("Expected default, got %q", got)
+	}
+	if got := get("ns"); got != "other" {
+		t.Errorf("Expected other, got %q", got)
+	}
+	if got := get("none"); got != "<miss>" {
+		t.Errorf("Expected a miss, got %q", got)
+	}
+}
@@ -0,0 +1,155 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	aei "appengine_internal"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// corpusFileExt is the extension of entity files in a corpus.
+const corpusFileExt = ".entity"
+
+// RecordEntityCorpus saves a sample entity of every distinct shape found
+// in ds to dir, so that CheckEntityCorpus can later verify that entities
+// stored by previous versions of an app still load into current structs.
+//
+// Entities are stored as text pb.EntityProto, exactly as datastore.Put sent
+// them, in dir/<kind>/<shape>.entity files. The shape of an entity is a set
+// of its property names and value types; entities of the same shape are
+// saved once. Entities of reserved kinds, e.g. blob infos, are skipped.
+// Existing files are never removed, so that the corpus, when checked in,
+// accumulates shapes of all struct versions.
+func (ds *FakeDatastore) RecordEntityCorpus(dir string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, e := range sortEntities(ds.entities) {
+		if isReservedName(entityKind(e)) {
+			continue
+		}
+		kindDir := filepath.Join(dir, url.QueryEscape(entityKind(e)))
+		path := filepath.Join(kindDir, entityShape(e)+corpusFileExt)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(kindDir, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(proto.MarshalTextString(e)), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckEntityCorpus loads every entity recorded by RecordEntityCorpus in dir
+// into a struct of the type structs maps its kind to, using datastore.Get.
+// Kinds missing from structs are skipped.
+//
+// It returns an error listing all entities which failed to load, e.g. with
+// *datastore.ErrFieldMismatch because a field was removed or its type
+// changed:
+//
+// 		err := CheckEntityCorpus(c, "testdata/corpus", map[string]interface{}{
+// 			"Item": Item{},
+// 		})
+// 		if err != nil {
+// 			t.Error(err)
+// 		}
+//
+func CheckEntityCorpus(c appengine.Context, dir string, structs map[string]interface{}) error {
+	kinds := make([]string, 0, len(structs))
+	for kind := range structs {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	var errs []string
+	for _, kind := range kinds {
+		typ := reflect.TypeOf(structs[kind])
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		files, err := filepath.Glob(filepath.Join(dir, url.QueryEscape(kind), "*"+corpusFileExt))
+		if err != nil {
+			return err
+		}
+		for _, path := range files {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			e := &pb.EntityProto{}
+			if err := proto.UnmarshalText(string(b), e); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			cc := &corpusContext{Context: c, entity: e}
+			key := datastore.NewKey(c, kind, "", 1, nil)
+			if err := datastore.Get(cc, key, reflect.New(typ).Interface()); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", path, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d incompatible entities in %s:\n%s",
+			len(errs), dir, strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// corpusContext serves "datastore_v3.Get" calls with a corpus entity and
+// passes all other calls to the embedded context.
+type corpusContext struct {
+	appengine.Context
+	entity *pb.EntityProto
+}
+
+func (c *corpusContext) Call(service, method string, in, out aei.ProtoMessage, opts *aei.CallOptions) error {
+	if service != "datastore_v3" || method != "Get" {
+		return c.Context.Call(service, method, in, out, opts)
+	}
+	resp := out.(*pb.GetResponse)
+	resp.Entity = []*pb.GetResponse_Entity{{Entity: c.entity}}
+	return nil
+}
+
+// entityShape returns a short hash of names, types and indexing of e's
+// properties.
+func entityShape(e *pb.EntityProto) string {
+	var props []string
+	describe := func(list []*pb.Property, indexed bool) {
+		for _, p := range list {
+			props = append(props, fmt.Sprintf("%s\x00%v\x00%v\x00%s\x00%v",
+				p.GetName(), indexed, p.GetMeaning(),
+				valueRepresentation(p.GetValue()), p.GetMultiple()))
+		}
+	}
+	describe(e.GetProperty(), true)
+	describe(e.GetRawProperty(), false)
+	sort.Strings(props)
+	// Repeated values of a multi-valued property make the same shape.
+	unique := props[:0]
+	for i, p := range props {
+		if i == 0 || props[i-1] != p {
+			unique = append(unique, p)
+		}
+	}
+	h := sha1.New()
+	h.Write([]byte(strings.Join(unique, "\n")))
+	return fmt.Sprintf("%x", h.Sum(nil))[:12]
+}
@@ -0,0 +1,114 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"appengine/datastore"
+
+	pb "appengine_internal/datastore"
+)
+
+// corpusItem is the current struct of Item entities.
+type corpusItem struct {
+	Name  string
+	Count int64
+}
+
+// renamedItem has Name of corpusItem renamed to Title.
+type renamedItem struct {
+	Title string
+	Count int64
+}
+
+// retypedItem has Count of corpusItem changed to a string.
+type retypedItem struct {
+	Name  string
+	Count string
+}
+
+func TestEntityCorpus(t *testing.T) {
+	ds, unregister := NewFakeDatastore()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	dir, err := ioutil.TempDir("", "aegot-corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testPut(t, c,
+		testEntity(testKey("Item", "a", 0, nil), testStringProp("Name", "a"), testIntProp("Count", 1)),
+		// same shape as a
+		testEntity(testKey("Item", "b", 0, nil), testStringProp("Name", "b"), testIntProp("Count", 2)),
+		testEntity(testKey("Item", "c", 0, nil), testStringProp("Name", "c")))
+	// e.g. a blob info
+	reserved := testKey("__foo__", "x", 0, nil)
+	ds.storeInternal(reserved, testEntity(reserved, testStringProp("Name", "x")))
+	if err := ds.RecordEntityCorpus(dir); err != nil {
+		t.Fatalf("RecordEntityCorpus: %v", err)
+	}
+	kinds, _ := filepath.Glob(filepath.Join(dir, "*"))
+	files, _ := filepath.Glob(filepath.Join(dir, "Item", "*"+corpusFileExt))
+	if len(kinds) != 1 || len(files) != 2 {
+		t.Fatalf("Expected 2 Item shapes, got %v", files)
+	}
+
+	// files of shapes which are gone are kept
+	del := &pb.DeleteRequest{Key: []*pb.Reference{
+		testKey("Item", "a", 0, nil), testKey("Item", "b", 0, nil), testKey("Item", "c", 0, nil),
+	}}
+	if err := c.Call("datastore_v3", "Delete", del, &pb.DeleteResponse{}, nil); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	testPut(t, c, testEntity(testKey("Item", "d", 0, nil), testIntProp("Count", 4)))
+	if err := ds.RecordEntityCorpus(dir); err != nil {
+		t.Fatalf("RecordEntityCorpus: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "Item", "*"+corpusFileExt)); len(files) != 3 {
+		t.Errorf("Expected 3 Item shapes, got %v", files)
+	}
+
+	tests := []struct {
+		v interface{}
+		// fields failing to load, with a prefix of the reason
+		mismatches map[string]string
+	}{
+		{corpusItem{}, nil},
+		{&corpusItem{}, nil},
+		{renamedItem{}, map[string]string{"Name": "no such struct field"}},
+		{retypedItem{}, map[string]string{"Count": "type mismatch"}},
+	}
+	for _, tt := range tests {
+		err := CheckEntityCorpus(c, dir, map[string]interface{}{"Item": tt.v, "Other": corpusItem{}})
+		if tt.mismatches == nil {
+			if err != nil {
+				t.Errorf("%T: expected corpus to load, got %v", tt.v, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%T: expected an error", tt.v)
+			continue
+		}
+		typ := reflect.TypeOf(tt.v)
+		for field, reason := range tt.mismatches {
+			mismatch := &datastore.ErrFieldMismatch{StructType: typ, FieldName: field, Reason: reason}
+			if !strings.Contains(err.Error(), mismatch.Error()) {
+				t.Errorf("%T: expected %q, got %v", tt.v, mismatch, err)
+			}
+		}
+		if !strings.Contains(err.Error(), filepath.Join(dir, "Item")) {
+			t.Errorf("%T: expected entity files to be listed, got %v", tt.v, err)
+		}
+	}
+}
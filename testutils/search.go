@@ -0,0 +1,549 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "appengine_internal/search"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// maxSearchNameLen is the longest index name and document ID.
+	maxSearchNameLen = 100
+	// defaultListDocumentsLimit is used when ListDocuments has no limit.
+	defaultListDocumentsLimit = 100
+	// defaultScorerLimit is how many matches are scored and sorted.
+	defaultScorerLimit = 1000
+	// searchDocIdLen is the number of random bytes in allocated doc IDs.
+	searchDocIdLen = 12
+)
+
+// searchFieldName is a valid document field name.
+var searchFieldName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// FakeSearch is an in-memory implementation of "search" service. Documents
+// are indexed by field type: TEXT and HTML fields are tokenized, ATOM fields
+// are matched as a whole and NUMBER and DATE fields support comparisons.
+//
+// Queries are parsed like in production, see parseSearchQuery for the
+// supported syntax; a malformed query fails with INVALID_REQUEST, unless
+// it is searched in RELAXED parsing mode. Results are ordered by document
+// rank, or by match score and sort expressions when they are requested.
+type FakeSearch struct {
+	mu      sync.Mutex
+	indexes map[searchIndexKey]*searchIndex
+}
+
+type searchIndexKey struct {
+	namespace, name string
+}
+
+type searchIndex struct {
+	docs map[string]*pb.Document
+	// field types of all documents ever indexed
+	schema map[string]map[pb.FieldValue_ContentType]bool
+}
+
+// NewFakeSearch creates a search service and registers it as "search"
+// service implementation.
+//
+// Returns the service and a function that unregisters it. Here's an example:
+//
+// 		func TestFindBooks(t *testing.T) {
+// 			_, unregister := NewFakeSearch()
+// 			defer unregister()
+//
+// 			// test code that puts documents into "books" index
+//
+// 			index, _ := search.Open("books")
+// 			it := index.Search(c, `author:"Jules Verne" AND year < 1870`, nil)
+// 			// check the results
+// 		}
+//
+func NewFakeSearch() (*FakeSearch, func()) {
+	fs := &FakeSearch{indexes: make(map[searchIndexKey]*searchIndex)}
+	return fs, registerServiceOverrides("search", map[string]RpcStubFunc{
+		"IndexDocument":  fs.indexDocument,
+		"DeleteDocument": fs.deleteDocument,
+		"ListDocuments":  fs.listDocuments,
+		"ListIndexes":    fs.listIndexes,
+		"Search":         fs.search,
+	})
+}
+
+// DocIds returns sorted IDs of the documents in an index of the default
+// namespace.
+func (fs *FakeSearch) DocIds(index string) []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	idx := fs.indexes[searchIndexKey{"", index}]
+	if idx == nil {
+		return nil
+	}
+	return idx.sortedIds()
+}
+
+func (fs *FakeSearch) indexDocument(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.IndexDocumentRequest), out.(*pb.IndexDocumentResponse)
+	spec := req.GetParams().GetIndexSpec()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, d := range req.GetParams().GetDocument() {
+		id, err := fs.index(spec, d)
+		resp.Status = append(resp.Status, searchStatus(err))
+		resp.DocId = append(resp.DocId, id)
+	}
+	return nil
+}
+
+// index validates d and puts it into the index of spec, replacing
+// a document with the same ID. Returns ID of the document.
+func (fs *FakeSearch) index(spec *pb.IndexSpec, d *pb.Document) (string, error) {
+	if !validSearchName(spec.GetName()) {
+		return "", searchErrorf("Invalid index name %q", spec.GetName())
+	}
+	d = proto.Clone(d).(*pb.Document)
+	if d.Id == nil {
+		d.Id = proto.String(randomString(searchDocIdLen))
+	} else if !validSearchName(d.GetId()) {
+		return "", searchErrorf("Invalid document ID %q", d.GetId())
+	}
+	for _, f := range d.GetField() {
+		if err := validateSearchField(f); err != nil {
+			return "", err
+		}
+	}
+	key := searchIndexKey{spec.GetNamespace(), spec.GetName()}
+	idx := fs.indexes[key]
+	if idx == nil {
+		idx = &searchIndex{
+			docs:   make(map[string]*pb.Document),
+			schema: make(map[string]map[pb.FieldValue_ContentType]bool),
+		}
+		fs.indexes[key] = idx
+	}
+	for _, f := range d.GetField() {
+		if idx.schema[f.GetName()] == nil {
+			idx.schema[f.GetName()] = make(map[pb.FieldValue_ContentType]bool)
+		}
+		idx.schema[f.GetName()][f.GetValue().GetType()] = true
+	}
+	idx.docs[d.GetId()] = d
+	return d.GetId(), nil
+}
+
+func (fs *FakeSearch) deleteDocument(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.DeleteDocumentRequest), out.(*pb.DeleteDocumentResponse)
+	spec := req.GetParams().GetIndexSpec()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	idx := fs.indexes[searchIndexKey{spec.GetNamespace(), spec.GetName()}]
+	for _, id := range req.GetParams().GetDocId() {
+		// deleting a missing document is not an error
+		if idx != nil {
+			delete(idx.docs, id)
+		}
+		resp.Status = append(resp.Status, searchStatus(nil))
+	}
+	return nil
+}
+
+func (fs *FakeSearch) listDocuments(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.ListDocumentsRequest), out.(*pb.ListDocumentsResponse)
+	params := req.GetParams()
+	spec := params.GetIndexSpec()
+	resp.Status = searchStatus(nil)
+	limit := defaultListDocumentsLimit
+	if params.Limit != nil {
+		limit = int(params.GetLimit())
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	idx := fs.indexes[searchIndexKey{spec.GetNamespace(), spec.GetName()}]
+	if idx == nil {
+		return nil
+	}
+	for _, id := range idx.sortedIds() {
+		if len(resp.Document) >= limit {
+			break
+		}
+		if params.StartDocId != nil {
+			start := params.GetStartDocId()
+			if id < start || (id == start && !params.GetIncludeStartDoc()) {
+				continue
+			}
+		}
+		d := proto.Clone(idx.docs[id]).(*pb.Document)
+		if params.GetKeysOnly() {
+			d = &pb.Document{Id: d.Id}
+		}
+		resp.Document = append(resp.Document, d)
+	}
+	return nil
+}
+
+func (fs *FakeSearch) listIndexes(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.ListIndexesRequest), out.(*pb.ListIndexesResponse)
+	params := req.GetParams()
+	resp.Status = searchStatus(nil)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var names []string
+	for key := range fs.indexes {
+		if key.namespace != params.GetNamespace() ||
+			!strings.HasPrefix(key.name, params.GetIndexNamePrefix()) {
+			continue
+		}
+		if params.StartIndexName != nil {
+			start := params.GetStartIndexName()
+			if key.name < start || (key.name == start && !params.GetIncludeStartIndex()) {
+				continue
+			}
+		}
+		names = append(names, key.name)
+	}
+	sort.Strings(names)
+	if off := int(params.GetOffset()); off < len(names) {
+		names = names[off:]
+	} else {
+		names = nil
+	}
+	if limit := int(params.GetLimit()); len(names) > limit {
+		names = names[:limit]
+	}
+	for _, name := range names {
+		idx := fs.indexes[searchIndexKey{params.GetNamespace(), name}]
+		md := &pb.IndexMetadata{
+			IndexSpec: &pb.IndexSpec{Name: proto.String(name)},
+			Storage:   &pb.IndexMetadata_Storage{AmountUsed: proto.Int64(idx.size())},
+		}
+		if params.Namespace != nil {
+			md.IndexSpec.Namespace = proto.String(params.GetNamespace())
+		}
+		if params.GetFetchSchema() {
+			md.Field = idx.fieldTypes()
+		}
+		resp.IndexMetadata = append(resp.IndexMetadata, md)
+	}
+	return nil
+}
+
+func (fs *FakeSearch) search(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.SearchRequest), out.(*pb.SearchResponse)
+	params := req.GetParams()
+	resp.MatchedCount = proto.Int64(0)
+	results, err := fs.searchResults(params)
+	if err != nil {
+		resp.Status = searchStatus(err)
+		return nil
+	}
+	resp.Status = searchStatus(nil)
+	resp.MatchedCount = proto.Int64(int64(len(results)))
+
+	offset := int(params.GetOffset())
+	if params.Cursor != nil {
+		n, err := decodeSearchCursor(params.GetCursor(), params.GetQuery())
+		if err != nil {
+			resp.Status = searchStatus(err)
+			return nil
+		}
+		offset += n
+	}
+	if offset > len(results) {
+		offset = len(results)
+	}
+	end := offset + int(params.GetLimit())
+	if end > len(results) {
+		end = len(results)
+	}
+	for i, r := range results[offset:end] {
+		if params.GetCursorType() == pb.SearchParams_PER_RESULT {
+			r.Cursor = proto.String(encodeSearchCursor(offset+i+1, params.GetQuery()))
+		}
+		resp.Result = append(resp.Result, r)
+	}
+	if params.GetCursorType() == pb.SearchParams_SINGLE && end < len(results) {
+		resp.Cursor = proto.String(encodeSearchCursor(end, params.GetQuery()))
+	}
+	return nil
+}
+
+// searchResults returns all results of a search, in order.
+func (fs *FakeSearch) searchResults(params *pb.SearchParams) ([]*pb.SearchResult, error) {
+	query := params.GetQuery()
+	q, err := parseSearchQuery(query)
+	if err != nil {
+		if params.GetParsingMode() != pb.SearchParams_RELAXED {
+			return nil, searchErrorf("Failed to parse search request %q; %v", query, err)
+		}
+		q = relaxedSearchQuery(query)
+	}
+	sorts := make([]*searchExpr, len(params.GetSortSpec()))
+	for i, s := range params.GetSortSpec() {
+		if sorts[i], err = parseSearchExpr(s.GetSortExpression()); err != nil {
+			return nil, searchErrorf("Failed to parse sort expression %q; %v", s.GetSortExpression(), err)
+		}
+	}
+	fieldSpec := params.GetFieldSpec()
+	exprs := make([]*searchExpr, len(fieldSpec.GetExpression()))
+	for i, e := range fieldSpec.GetExpression() {
+		if exprs[i], err = parseSearchExpr(e.GetExpression()); err != nil {
+			return nil, searchErrorf("Failed to parse field expression %q; %v", e.GetExpression(), err)
+		}
+	}
+
+	spec := params.GetIndexSpec()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	idx := fs.indexes[searchIndexKey{spec.GetNamespace(), spec.GetName()}]
+	if idx == nil {
+		return nil, nil
+	}
+	var hits []*searchHit
+	for _, d := range idx.docs {
+		if ok, n := q.match(d); ok {
+			hits = append(hits, &searchHit{doc: d, score: float64(n)})
+		}
+	}
+	// documents are returned in rank order, unless sorted or scored
+	sort.Sort(hitsByRank(hits))
+	scored := params.ScorerSpec != nil
+	if scored || len(sorts) > 0 {
+		limit := defaultScorerLimit
+		if scored && params.ScorerSpec.Limit != nil {
+			limit = int(params.ScorerSpec.GetLimit())
+		}
+		if limit > len(hits) {
+			limit = len(hits)
+		}
+		hs := &hitSorter{hits: hits[:limit], specs: params.GetSortSpec(), scored: scored}
+		for _, h := range hs.hits {
+			for _, e := range sorts {
+				h.keys = append(h.keys, e.eval(h))
+			}
+		}
+		sort.Sort(hs)
+	}
+
+	results := make([]*pb.SearchResult, len(hits))
+	for i, h := range hits {
+		r := &pb.SearchResult{Document: resultDocument(h.doc, params)}
+		for j, e := range exprs {
+			if f := e.eval(h).field(fieldSpec.GetExpression()[j].GetName()); f != nil {
+				r.Expression = append(r.Expression, f)
+			}
+		}
+		if scored {
+			r.Score = []float64{h.score}
+		}
+		results[i] = r
+	}
+	return results, nil
+}
+
+// resultDocument copies d with the fields a search asked for.
+func resultDocument(d *pb.Document, params *pb.SearchParams) *pb.Document {
+	if params.GetKeysOnly() {
+		return &pb.Document{Id: d.Id}
+	}
+	d = proto.Clone(d).(*pb.Document)
+	names := params.GetFieldSpec().GetName()
+	if len(names) == 0 {
+		return d
+	}
+	var fields []*pb.Field
+	for _, f := range d.Field {
+		for _, name := range names {
+			if f.GetName() == name {
+				fields = append(fields, f)
+				break
+			}
+		}
+	}
+	d.Field = fields
+	return d
+}
+
+// searchHit is a document matching a search.
+type searchHit struct {
+	doc   *pb.Document
+	score float64
+	// values of sort expressions
+	keys []searchValue
+}
+
+type hitsByRank []*searchHit
+
+func (s hitsByRank) Len() int      { return len(s) }
+func (s hitsByRank) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s hitsByRank) Less(i, j int) bool {
+	if a, b := s[i].doc.GetOrderId(), s[j].doc.GetOrderId(); a != b {
+		return a > b
+	}
+	return s[i].doc.GetId() < s[j].doc.GetId()
+}
+
+// hitSorter orders hits by sort expressions, then by score and rank.
+type hitSorter struct {
+	hits   []*searchHit
+	specs  []*pb.SortSpec
+	scored bool
+}
+
+func (s *hitSorter) Len() int      { return len(s.hits) }
+func (s *hitSorter) Swap(i, j int) { s.hits[i], s.hits[j] = s.hits[j], s.hits[i] }
+func (s *hitSorter) Less(i, j int) bool {
+	a, b := s.hits[i], s.hits[j]
+	for k, spec := range s.specs {
+		va, vb := a.keys[k].orDefault(spec), b.keys[k].orDefault(spec)
+		// documents w/o a value are last in either direction
+		if va.missing || vb.missing {
+			if va.missing != vb.missing {
+				return vb.missing
+			}
+			continue
+		}
+		if c := va.compare(vb); c != 0 {
+			return (c > 0) == spec.GetSortDescending()
+		}
+	}
+	if s.scored && a.score != b.score {
+		return a.score > b.score
+	}
+	return hitsByRank(s.hits).Less(i, j)
+}
+
+func (idx *searchIndex) sortedIds() []string {
+	ids := make([]string, 0, len(idx.docs))
+	for id := range idx.docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// size returns the storage used by documents of idx.
+func (idx *searchIndex) size() int64 {
+	var n int64
+	for _, d := range idx.docs {
+		n += int64(proto.Size(d))
+	}
+	return n
+}
+
+// fieldTypes returns the schema of idx, sorted by field name.
+func (idx *searchIndex) fieldTypes() []*pb.FieldTypes {
+	names := make([]string, 0, len(idx.schema))
+	for name := range idx.schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := make([]*pb.FieldTypes, len(names))
+	for i, name := range names {
+		fields[i] = &pb.FieldTypes{Name: proto.String(name)}
+		for t := pb.FieldValue_TEXT; t <= pb.FieldValue_GEO; t++ {
+			if idx.schema[name][t] {
+				fields[i].Type = append(fields[i].Type, t)
+			}
+		}
+	}
+	return fields
+}
+
+// validSearchName reports whether s can be an index name or document ID:
+// printable ASCII w/o spaces, not starting with "!".
+func validSearchName(s string) bool {
+	if s == "" || len(s) > maxSearchNameLen || s[0] == '!' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateSearchField checks the name and the value of f.
+func validateSearchField(f *pb.Field) error {
+	if !searchFieldName.MatchString(f.GetName()) {
+		return searchErrorf("Invalid field name %q", f.GetName())
+	}
+	v := f.GetValue()
+	var err error
+	switch v.GetType() {
+	case pb.FieldValue_NUMBER:
+		_, err = strconv.ParseFloat(v.GetStringValue(), 64)
+	case pb.FieldValue_DATE:
+		_, err = strconv.ParseInt(v.GetStringValue(), 10, 64)
+	case pb.FieldValue_GEO:
+		if v.GetGeo().Lat == nil || v.GetGeo().Lng == nil {
+			err = fmt.Errorf("no lat or lng")
+		}
+	}
+	if err != nil {
+		return searchErrorf("Invalid %s value %q of field %s", v.GetType(), v.GetStringValue(), f.GetName())
+	}
+	return nil
+}
+
+// encodeSearchCursor creates a cursor to continue a search of query
+// after n results.
+func encodeSearchCursor(n int, query string) string {
+	return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", n, query)))
+}
+
+// decodeSearchCursor returns the number of results skipped by cursor,
+// which must have been created for the same query.
+func decodeSearchCursor(cursor, query string) (int, error) {
+	b, err := base64.URLEncoding.DecodeString(cursor)
+	parts := strings.SplitN(string(b), ":", 2)
+	if err != nil || len(parts) != 2 || parts[1] != query {
+		return 0, searchErrorf("Invalid cursor %q", cursor)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return 0, searchErrorf("Invalid cursor %q", cursor)
+	}
+	return n, nil
+}
+
+// searchError is a failed request. Search service reports errors
+// in RequestStatus of responses rather than as API errors.
+type searchError struct {
+	code   pb.SearchServiceError_ErrorCode
+	detail string
+}
+
+func (e *searchError) Error() string {
+	return e.code.String() + ": " + e.detail
+}
+
+// searchErrorf creates an INVALID_REQUEST error.
+func searchErrorf(format string, args ...interface{}) error {
+	return &searchError{pb.SearchServiceError_INVALID_REQUEST, fmt.Sprintf(format, args...)}
+}
+
+// searchStatus converts err to a request status; nil error is OK.
+func searchStatus(err error) *pb.RequestStatus {
+	if err == nil {
+		return &pb.RequestStatus{Code: pb.SearchServiceError_OK.Enum()}
+	}
+	s := &pb.RequestStatus{
+		Code:        pb.SearchServiceError_INTERNAL_ERROR.Enum(),
+		ErrorDetail: proto.String(err.Error()),
+	}
+	if e, ok := err.(*searchError); ok {
+		s.Code, s.ErrorDetail = e.code.Enum(), proto.String(e.detail)
+	}
+	return s
+}
@@ -0,0 +1,670 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	pb "appengine_internal/search"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// searchDateFormat is the format of dates in queries.
+const searchDateFormat = "2006-01-02"
+
+// htmlTag matches tags stripped from HTML fields before tokenizing.
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// searchQuery is a parsed query, or a part of it.
+type searchQuery interface {
+	// match reports whether d satisfies the query, and how many times
+	// query terms occur in d.
+	match(d *pb.Document) (ok bool, hits int)
+}
+
+type (
+	matchAllQuery struct{}
+	andQuery      []searchQuery
+	orQuery       []searchQuery
+	notQuery      struct{ q searchQuery }
+)
+
+// termQuery matches a word or a phrase in all fields of a document,
+// or compares it with values of one field.
+type termQuery struct {
+	// empty for global terms
+	field string
+	// one of ":", "=", "<", "<=", ">", ">="
+	op     string
+	value  string
+	phrase bool
+	// "~" prefix: match plural forms too
+	stem bool
+}
+
+func (matchAllQuery) match(d *pb.Document) (bool, int) { return true, 0 }
+
+func (q andQuery) match(d *pb.Document) (bool, int) {
+	hits := 0
+	for _, sub := range q {
+		ok, n := sub.match(d)
+		if !ok {
+			return false, 0
+		}
+		hits += n
+	}
+	return true, hits
+}
+
+func (q orQuery) match(d *pb.Document) (bool, int) {
+	matched, hits := false, 0
+	for _, sub := range q {
+		ok, n := sub.match(d)
+		matched = matched || ok
+		hits += n
+	}
+	return matched, hits
+}
+
+func (q notQuery) match(d *pb.Document) (bool, int) {
+	ok, _ := q.q.match(d)
+	return !ok, 0
+}
+
+func (q *termQuery) match(d *pb.Document) (bool, int) {
+	hits := 0
+	for _, f := range d.GetField() {
+		if q.field == "" || q.field == f.GetName() {
+			hits += q.matchValue(f.GetValue())
+		}
+	}
+	return hits > 0, hits
+}
+
+// matchValue returns how many times q matches v.
+func (q *termQuery) matchValue(v *pb.FieldValue) int {
+	eq := q.op == ":" || q.op == "="
+	switch v.GetType() {
+	case pb.FieldValue_TEXT, pb.FieldValue_HTML:
+		if !eq {
+			return 0
+		}
+		s := v.GetStringValue()
+		if v.GetType() == pb.FieldValue_HTML {
+			s = htmlTag.ReplaceAllString(s, " ")
+		}
+		return countTokens(searchTokens(s), searchTokens(q.value), q.stem)
+	case pb.FieldValue_ATOM:
+		if eq && strings.EqualFold(v.GetStringValue(), q.value) {
+			return 1
+		}
+	case pb.FieldValue_NUMBER:
+		x, err1 := strconv.ParseFloat(q.value, 64)
+		y, err2 := strconv.ParseFloat(v.GetStringValue(), 64)
+		if q.phrase || err1 != nil || err2 != nil || (q.field == "" && !eq) {
+			return 0
+		}
+		if compareOp(q.op, compareFloats(y, x)) {
+			return 1
+		}
+	case pb.FieldValue_DATE:
+		// dates are compared by day
+		if _, err := time.Parse(searchDateFormat, q.value); err != nil || q.phrase {
+			return 0
+		}
+		ms, err := strconv.ParseInt(v.GetStringValue(), 10, 64)
+		if err != nil || (q.field == "" && !eq) {
+			return 0
+		}
+		day := time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(searchDateFormat)
+		if compareOp(q.op, compareStrings(day, q.value)) {
+			return 1
+		}
+	}
+	return 0
+}
+
+// countTokens returns how many times phrase occurs in tokens.
+func countTokens(tokens, phrase []string, stem bool) int {
+	if len(phrase) == 0 {
+		return 0
+	}
+	n := 0
+next:
+	for i := 0; i+len(phrase) <= len(tokens); i++ {
+		for j, p := range phrase {
+			t := tokens[i+j]
+			if stem {
+				t, p = strings.TrimSuffix(t, "s"), strings.TrimSuffix(p, "s")
+			}
+			if t != p {
+				continue next
+			}
+		}
+		n++
+	}
+	return n
+}
+
+// searchTokens splits s into lowercase words.
+func searchTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// compareOp reports whether c, a result of comparing a value with
+// a query value, satisfies op.
+func compareOp(op string, c int) bool {
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return c == 0
+}
+
+// queryToken is a lexical token of a query or an expression.
+type queryToken struct {
+	// "word", "phrase", "op", "(" or ")"
+	kind string
+	val  string
+}
+
+// lexSearch splits s into tokens. ops are the operator characters,
+// and "<" or ">" followed by "=" is a single operator.
+func lexSearch(s, ops string) ([]*queryToken, error) {
+	var toks []*queryToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, &queryToken{string(c), string(c)})
+			i++
+		case c == '"':
+			val := []byte{}
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				val = append(val, s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated phrase at %d", len(s))
+			}
+			toks = append(toks, &queryToken{"phrase", string(val)})
+			i++
+		case strings.ContainsRune(ops, rune(c)):
+			op := string(c)
+			if (c == '<' || c == '>') && i+1 < len(s) && s[i+1] == '=' {
+				op += "="
+			}
+			toks = append(toks, &queryToken{"op", op})
+			i += len(op)
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n\r()\""+ops, rune(s[j])) {
+				j++
+			}
+			toks = append(toks, &queryToken{"word", s[i:j]})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// queryParser is a recursive descent parser of search queries:
+//
+// 		query   = or
+// 		or      = and { "OR" and }
+// 		and     = unary { ["AND"] unary }
+// 		unary   = ("NOT" | "-") unary | "(" or ")" | term | field op value
+// 		value   = term | "(" or ")"
+// 		term    = word | phrase
+//
+// Values in parentheses can only have terms, e.g. title:(go OR golang),
+// and they are matched against the restricted field.
+type queryParser struct {
+	toks []*queryToken
+	pos  int
+	// restricted field and operator of the value being parsed
+	field, op string
+}
+
+// parseSearchQuery parses a search query; an empty query matches all
+// documents. Field restrictions are "field:value", or comparisons with
+// "=", "<", "<=", ">" and ">=" for NUMBER and DATE fields, with dates
+// in yyyy-mm-dd format. Words separated by spaces must all match, unless
+// joined with OR.
+func parseSearchQuery(query string) (searchQuery, error) {
+	toks, err := lexSearch(query, ":=<>")
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return matchAllQuery{}, nil
+	}
+	p := &queryParser{toks: toks}
+	q, err := p.parseOr()
+	if err == nil && p.pos < len(p.toks) {
+		err = fmt.Errorf("unexpected %q", p.toks[p.pos].val)
+	}
+	return q, err
+}
+
+// relaxedSearchQuery treats words of a query that can't be parsed
+// as terms, like RELAXED parsing mode does.
+func relaxedSearchQuery(query string) searchQuery {
+	var q andQuery
+	for _, w := range strings.Fields(query) {
+		if w == "AND" || w == "OR" || w == "NOT" {
+			continue
+		}
+		for _, t := range searchTokens(w) {
+			q = append(q, &termQuery{op: ":", value: t})
+		}
+	}
+	if len(q) == 0 {
+		return matchAllQuery{}
+	}
+	return q
+}
+
+func (p *queryParser) peek() *queryToken {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return nil
+}
+
+func (p *queryParser) isKeyword(t *queryToken, kw string) bool {
+	return t != nil && t.kind == "word" && t.val == kw
+}
+
+// isNumber reports whether s is a negative number of a restriction,
+// rather than a negated term.
+func (p *queryParser) isNumber(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return p.field != "" && err == nil
+}
+
+func (p *queryParser) parseOr() (searchQuery, error) {
+	var q orQuery
+	for {
+		sub, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		q = append(q, sub)
+		if !p.isKeyword(p.peek(), "OR") {
+			break
+		}
+		p.pos++
+	}
+	if len(q) == 1 {
+		return q[0], nil
+	}
+	return q, nil
+}
+
+func (p *queryParser) parseAnd() (searchQuery, error) {
+	var q andQuery
+	for {
+		sub, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		q = append(q, sub)
+		t := p.peek()
+		if p.isKeyword(t, "AND") {
+			p.pos++
+		} else if t == nil || t.kind == ")" || p.isKeyword(t, "OR") {
+			break
+		}
+	}
+	if len(q) == 1 {
+		return q[0], nil
+	}
+	return q, nil
+}
+
+func (p *queryParser) parseUnary() (searchQuery, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	p.pos++
+	switch {
+	case p.isKeyword(t, "NOT") || (t.kind == "word" && t.val == "-"):
+		q, err := p.parseUnary()
+		return notQuery{q}, err
+	case t.kind == "word" && strings.HasPrefix(t.val, "-") && !p.isNumber(t.val):
+		// -word, parse the word as if there was a space after "-"
+		p.pos--
+		p.toks[p.pos] = &queryToken{"word", t.val[1:]}
+		q, err := p.parseUnary()
+		return notQuery{q}, err
+	case t.kind == "(":
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t == nil || t.kind != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return q, nil
+	case t.kind == "word" && p.peek() != nil && p.peek().kind == "op":
+		return p.parseRestriction(t.val)
+	case t.kind == "word" || t.kind == "phrase":
+		if t.kind == "word" && (t.val == "AND" || t.val == "OR") {
+			return nil, fmt.Errorf("unexpected %q", t.val)
+		}
+		q := &termQuery{field: p.field, op: ":", value: t.val, phrase: t.kind == "phrase"}
+		if p.op != "" {
+			q.op = p.op
+		}
+		if !q.phrase && strings.HasPrefix(q.value, "~") {
+			q.value, q.stem = q.value[1:], true
+		}
+		return q, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.val)
+}
+
+// parseRestriction parses the operator and the value of a restriction
+// of field.
+func (p *queryParser) parseRestriction(field string) (searchQuery, error) {
+	if p.field != "" {
+		return nil, fmt.Errorf("nested restriction of %s", field)
+	}
+	if !searchFieldName.MatchString(field) {
+		return nil, fmt.Errorf("invalid field name %q", field)
+	}
+	op := p.toks[p.pos].val
+	p.pos++
+	t := p.peek()
+	if t == nil || t.kind == ")" || t.kind == "op" {
+		return nil, fmt.Errorf("missing value of %s%s", field, op)
+	}
+	if t.kind == "(" && op != ":" && op != "=" {
+		return nil, fmt.Errorf("%s%s can't have several values", field, op)
+	}
+	p.field, p.op = field, op
+	defer func() { p.field, p.op = "", "" }()
+	return p.parseUnary()
+}
+
+// searchValue is a value of an expression: a number or a text.
+type searchValue struct {
+	num     float64
+	text    string
+	isText  bool
+	missing bool
+}
+
+// orDefault returns v, or a default value of spec if v is missing.
+func (v searchValue) orDefault(spec *pb.SortSpec) searchValue {
+	switch {
+	case !v.missing:
+		return v
+	case spec.DefaultValueNumeric != nil:
+		return searchValue{num: spec.GetDefaultValueNumeric()}
+	case spec.DefaultValueText != nil:
+		return searchValue{text: spec.GetDefaultValueText(), isText: true}
+	}
+	return v
+}
+
+// compare orders numbers before texts.
+func (v searchValue) compare(o searchValue) int {
+	switch {
+	case v.isText && o.isText:
+		return compareStrings(v.text, o.text)
+	case v.isText != o.isText:
+		if v.isText {
+			return 1
+		}
+		return -1
+	}
+	return compareFloats(v.num, o.num)
+}
+
+// field returns v as a document field, or nil if it's missing.
+func (v searchValue) field(name string) *pb.Field {
+	if v.missing {
+		return nil
+	}
+	fv := &pb.FieldValue{
+		Type:        pb.FieldValue_NUMBER.Enum(),
+		StringValue: proto.String(strconv.FormatFloat(v.num, 'e', -1, 64)),
+	}
+	if v.isText {
+		fv.Type, fv.StringValue = pb.FieldValue_TEXT.Enum(), proto.String(v.text)
+	}
+	return &pb.Field{Name: proto.String(name), Value: fv}
+}
+
+// searchExpr is a parsed sort or field expression: a number, a phrase,
+// a field name, _rank, _score, a function call of abs, max, min or count,
+// or arithmetic of those with +, -, * and /.
+type searchExpr struct {
+	// "num", "text", "field", "call" or an arithmetic operator
+	kind string
+	num  float64
+	// text, field or function name
+	name string
+	args []*searchExpr
+}
+
+// exprParser is a recursive descent parser of expressions.
+type exprParser struct {
+	toks []*queryToken
+	pos  int
+}
+
+func parseSearchExpr(s string) (*searchExpr, error) {
+	toks, err := lexSearch(s, "+-*/,")
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	e, err := p.parseSum()
+	if err == nil && p.pos < len(p.toks) {
+		err = fmt.Errorf("unexpected %q", p.toks[p.pos].val)
+	}
+	return e, err
+}
+
+func (p *exprParser) next() *queryToken {
+	if p.pos < len(p.toks) {
+		p.pos++
+		return p.toks[p.pos-1]
+	}
+	return nil
+}
+
+// parseBinary parses operands joined with ops.
+func (p *exprParser) parseBinary(ops string, operand func() (*searchExpr, error)) (*searchExpr, error) {
+	e, err := operand()
+	for err == nil && p.pos < len(p.toks) {
+		t := p.toks[p.pos]
+		if t.kind != "op" || !strings.Contains(ops, t.val) {
+			break
+		}
+		p.pos++
+		var rhs *searchExpr
+		rhs, err = operand()
+		e = &searchExpr{kind: t.val, args: []*searchExpr{e, rhs}}
+	}
+	return e, err
+}
+
+func (p *exprParser) parseSum() (*searchExpr, error) {
+	return p.parseBinary("+-", p.parseProduct)
+}
+
+func (p *exprParser) parseProduct() (*searchExpr, error) {
+	return p.parseBinary("*/", p.parseOperand)
+}
+
+func (p *exprParser) parseOperand() (*searchExpr, error) {
+	t := p.next()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	switch t.kind {
+	case "phrase":
+		return &searchExpr{kind: "text", name: t.val}, nil
+	case "op":
+		if t.val != "-" {
+			break
+		}
+		e, err := p.parseOperand()
+		return &searchExpr{kind: "-", args: []*searchExpr{{kind: "num"}, e}}, err
+	case "(":
+		e, err := p.parseSum()
+		if err == nil {
+			if t := p.next(); t == nil || t.kind != ")" {
+				err = fmt.Errorf("missing ')'")
+			}
+		}
+		return e, err
+	case "word":
+		if x, err := strconv.ParseFloat(t.val, 64); err == nil {
+			return &searchExpr{kind: "num", num: x}, nil
+		}
+		if t.val != "_rank" && t.val != "_score" && !searchFieldName.MatchString(t.val) {
+			break
+		}
+		if p.pos == len(p.toks) || p.toks[p.pos].kind != "(" {
+			return &searchExpr{kind: "field", name: t.val}, nil
+		}
+		return p.parseCall(t.val)
+	}
+	return nil, fmt.Errorf("unexpected %q", t.val)
+}
+
+// parseCall parses arguments of a function.
+func (p *exprParser) parseCall(name string) (*searchExpr, error) {
+	e := &searchExpr{kind: "call", name: name}
+	p.pos++
+	for {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		e.args = append(e.args, arg)
+		t := p.next()
+		if t != nil && t.kind == ")" {
+			break
+		}
+		if t == nil || t.val != "," {
+			return nil, fmt.Errorf("missing ')' after arguments of %s", name)
+		}
+	}
+	switch {
+	case name == "abs" && len(e.args) == 1, name == "max", name == "min":
+	case name == "count" && len(e.args) == 1 && e.args[0].kind == "field":
+	default:
+		return nil, fmt.Errorf("invalid call of %s", name)
+	}
+	return e, nil
+}
+
+// eval computes e for a search hit. Numeric operations with texts
+// or missing values are missing.
+func (e *searchExpr) eval(h *searchHit) searchValue {
+	switch e.kind {
+	case "num":
+		return searchValue{num: e.num}
+	case "text":
+		return searchValue{text: e.name, isText: true}
+	case "field":
+		return fieldValue(h, e.name)
+	case "call":
+		return e.call(h)
+	}
+	a, b := e.args[0].eval(h), e.args[1].eval(h)
+	if a.missing || b.missing || a.isText || b.isText {
+		return searchValue{missing: true}
+	}
+	switch e.kind {
+	case "+":
+		return searchValue{num: a.num + b.num}
+	case "-":
+		return searchValue{num: a.num - b.num}
+	case "*":
+		return searchValue{num: a.num * b.num}
+	}
+	if b.num == 0 {
+		return searchValue{missing: true}
+	}
+	return searchValue{num: a.num / b.num}
+}
+
+func (e *searchExpr) call(h *searchHit) searchValue {
+	if e.name == "count" {
+		n := 0
+		for _, f := range h.doc.GetField() {
+			if f.GetName() == e.args[0].name {
+				n++
+			}
+		}
+		return searchValue{num: float64(n)}
+	}
+	var v searchValue
+	for i, arg := range e.args {
+		a := arg.eval(h)
+		if a.missing || a.isText {
+			return searchValue{missing: true}
+		}
+		switch {
+		case i == 0 && e.name == "abs":
+			v.num = math.Abs(a.num)
+		case i == 0, e.name == "max" && a.num > v.num, e.name == "min" && a.num < v.num:
+			v.num = a.num
+		}
+	}
+	return v
+}
+
+// fieldValue returns the first value of a field of h: a number for NUMBER
+// and DATE fields, with dates in milliseconds, or a text.
+func fieldValue(h *searchHit, name string) searchValue {
+	switch name {
+	case "_rank":
+		return searchValue{num: float64(h.doc.GetOrderId())}
+	case "_score":
+		return searchValue{num: h.score}
+	}
+	for _, f := range h.doc.GetField() {
+		if f.GetName() != name {
+			continue
+		}
+		v := f.GetValue()
+		switch v.GetType() {
+		case pb.FieldValue_NUMBER, pb.FieldValue_DATE:
+			x, _ := strconv.ParseFloat(v.GetStringValue(), 64)
+			return searchValue{num: x}
+		case pb.FieldValue_GEO:
+			continue
+		}
+		return searchValue{text: v.GetStringValue(), isText: true}
+	}
+	return searchValue{missing: true}
+}
@@ -0,0 +1,288 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "appengine_internal/search"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+func searchField(name string, t pb.FieldValue_ContentType, v string) *pb.Field {
+	return &pb.Field{
+		Name:  proto.String(name),
+		Value: &pb.FieldValue{Type: t.Enum(), StringValue: proto.String(v)},
+	}
+}
+
+// searchDate returns value of a DATE field for t, in ms since the epoch.
+func searchDate(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/1e6, 10)
+}
+
+// testSearchDocs returns documents searched by tests, in rank order.
+func testSearchDocs() []*pb.Document {
+	const (
+		text   = pb.FieldValue_TEXT
+		html   = pb.FieldValue_HTML
+		atom   = pb.FieldValue_ATOM
+		number = pb.FieldValue_NUMBER
+		date   = pb.FieldValue_DATE
+	)
+	doc := func(id string, rank int32, fields ...*pb.Field) *pb.Document {
+		return &pb.Document{Id: proto.String(id), OrderId: proto.Int32(rank), Field: fields}
+	}
+	return []*pb.Document{
+		doc("nodate", 40,
+			searchField("title", text, "Cats and dogs")),
+		doc("verne1", 30,
+			searchField("title", text, "Twenty Thousand Leagues Under the Sea"),
+			searchField("author", atom, "Jules Verne"),
+			searchField("year", number, "1870"),
+			// late in the evening, so that it's the next day in some zones
+			searchField("pub", date, searchDate(time.Date(1870, 3, 20, 23, 30, 0, 0, time.UTC))),
+			searchField("body", html, "<p>The <b>sea</b> and the sea monsters</p>")),
+		doc("verne2", 20,
+			searchField("title", text, "Around the World in Eighty Days"),
+			searchField("author", atom, "Jules Verne"),
+			searchField("year", number, "1873"),
+			searchField("pub", date, searchDate(time.Date(1873, 1, 30, 0, 0, 0, 0, time.UTC)))),
+		doc("melville", 10,
+			searchField("title", text, "Moby Dick"),
+			searchField("author", atom, "Herman Melville"),
+			searchField("year", number, "1851"),
+			searchField("body", text, "whale sea sea sea"),
+			searchField("price", number, "-5")),
+	}
+}
+
+// matchingIds returns IDs of docs q matches.
+func matchingIds(q searchQuery, docs []*pb.Document) []string {
+	ids := []string{}
+	for _, d := range docs {
+		if ok, _ := q.match(d); ok {
+			ids = append(ids, d.GetId())
+		}
+	}
+	return ids
+}
+
+func TestSearchQueryMatch(t *testing.T) {
+	docs := testSearchDocs()
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "nodate verne1 verne2 melville"},
+		{"sea", "verne1 melville"},
+		{"SEA -moby", "verne1"},
+		{"sea NOT title:moby", "verne1"},
+		{"-(sea OR cats)", "verne2"},
+		// a negative number is a value, not a negation
+		{"price < -1", "melville"},
+		{"price > -1", ""},
+		{"price = -5", "melville"},
+		{"price:-5", "melville"},
+		// but it negates a term that is not restricted to a field
+		{"-1851", "nodate verne1 verne2"},
+		{"- sea", "nodate verne2"},
+		// field restrictions
+		{`author:"jules verne"`, "verne1 verne2"},
+		{"author:verne", ""},
+		{`author:"Jules Verne" AND year < 1871`, "verne1"},
+		{"year >= 1870", "verne1 verne2"},
+		{"year=1851", "melville"},
+		{"1851", "melville"},
+		{"title:(moby OR eighty)", "verne2 melville"},
+		{"title:(moby eighty)", ""},
+		{"title:(sea OR dick) body:sea", "verne1 melville"},
+		{"(moby OR eighty) days", "verne2"},
+		// dates are compared by day
+		{"pub:1870-03-20", "verne1"},
+		{"pub = 1870-03-21", ""},
+		{"pub > 1870-03-20", "verne2"},
+		{"pub >= 1870-03-20", "verne1 verne2"},
+		{"pub < 1873-01-30", "verne1"},
+		{"pub <= 1873-01-30", "verne1 verne2"},
+		{"pub < 1900-01-01 OR title:cats", "nodate verne1 verne2"},
+		{"1870-03-20", "verne1"},
+		// phrases, stemming and HTML
+		{`"thousand leagues"`, "verne1"},
+		{`"leagues thousand"`, ""},
+		{"~cat", "nodate"},
+		{"cat", ""},
+		{"monsters", "verne1"},
+		{"b", ""},
+	}
+	for _, tt := range tests {
+		q, err := parseSearchQuery(tt.query)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if got := strings.Join(matchingIds(q, docs), " "); got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.query, tt.want, got)
+		}
+	}
+}
+
+func TestSearchQueryHits(t *testing.T) {
+	docs := testSearchDocs()
+	tests := []struct {
+		query string
+		hits  []int
+	}{
+		{"sea", []int{0, 3, 0, 3}},
+		{"sea OR whale", []int{0, 3, 0, 4}},
+		{"sea -whale", []int{0, 3, 0, 0}},
+		{`"sea monsters"`, []int{0, 1, 0, 0}},
+		{"year > 1860", []int{0, 1, 1, 0}},
+	}
+	for _, tt := range tests {
+		q, err := parseSearchQuery(tt.query)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		hits := make([]int, len(docs))
+		for i, d := range docs {
+			_, hits[i] = q.match(d)
+		}
+		if !reflect.DeepEqual(hits, tt.hits) {
+			t.Errorf("%q: expected hits %v, got %v", tt.query, tt.hits, hits)
+		}
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"foo AND", "unexpected end of query"},
+		{"(foo", "missing ')'"},
+		{"foo)", `unexpected ")"`},
+		{`"foo`, "unterminated phrase at 4"},
+		{"title:", "missing value of title:"},
+		{"OR sea", `unexpected "OR"`},
+		{"year < (1 OR 2)", "year< can't have several values"},
+		{"title:(a b:c)", "nested restriction of b"},
+	}
+	for _, tt := range tests {
+		_, err := parseSearchQuery(tt.query)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: expected error %q, got %v", tt.query, tt.err, err)
+		}
+	}
+}
+
+func TestRelaxedSearchQuery(t *testing.T) {
+	docs := testSearchDocs()
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// operators and punctuation of an invalid query are ignored,
+		// the words must all match
+		{"sea AND (", "verne1 melville"},
+		{"OR sea", "verne1 melville"},
+		{`"moby dick`, "melville"},
+		{"sea )", "verne1 melville"},
+		{"(", "nodate verne1 verne2 melville"},
+	}
+	for _, tt := range tests {
+		if _, err := parseSearchQuery(tt.query); err == nil {
+			t.Errorf("%q: expected a strict parsing error", tt.query)
+		}
+		q := relaxedSearchQuery(tt.query)
+		if got := strings.Join(matchingIds(q, docs), " "); got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.query, tt.want, got)
+		}
+	}
+}
+
+func TestSearchExpr(t *testing.T) {
+	docs := testSearchDocs()
+	tests := []struct {
+		expr string
+		// values for each of docs, "missing" if there's none
+		want []string
+	}{
+		{"year", []string{"missing", "1870", "1873", "1851"}},
+		{"2000 - year", []string{"missing", "130", "127", "149"}},
+		{"year / 10 + price * 2", []string{"missing", "missing", "missing", "175.1"}},
+		{"max(year, 1860)", []string{"missing", "1870", "1873", "1860"}},
+		{"min(price, 0) + abs(-1)", []string{"missing", "missing", "missing", "-4"}},
+		{"count(title)", []string{"1", "1", "1", "1"}},
+		{"author", []string{"missing", "Jules Verne", "Jules Verne", "Herman Melville"}},
+		{"_rank", []string{"40", "30", "20", "10"}},
+		{"_score", []string{"2", "2", "2", "2"}},
+	}
+	for _, tt := range tests {
+		e, err := parseSearchExpr(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		got := make([]string, len(docs))
+		for i, d := range docs {
+			v := e.eval(&searchHit{doc: d, score: 2})
+			switch {
+			case v.missing:
+				got[i] = "missing"
+			case v.isText:
+				got[i] = v.text
+			default:
+				got[i] = strconv.FormatFloat(v.num, 'g', -1, 64)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	for _, expr := range []string{"", "year +", "max(year", "foo(year)", "(1 + 2", "1 2"} {
+		if _, err := parseSearchExpr(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestSearchValueOrder(t *testing.T) {
+	values := []searchValue{
+		{text: "b", isText: true},
+		{num: 2},
+		{text: "a", isText: true},
+		{num: -1},
+	}
+	sort.Sort(searchValues(values))
+	want := []searchValue{{num: -1}, {num: 2}, {text: "a", isText: true}, {text: "b", isText: true}}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Expected %v, got %v", want, values)
+	}
+
+	spec := &pb.SortSpec{DefaultValueNumeric: proto.Float64(7)}
+	if v := (searchValue{missing: true}).orDefault(spec); v.missing || v.num != 7 {
+		t.Errorf("Expected numeric default 7, got %+v", v)
+	}
+	spec = &pb.SortSpec{DefaultValueText: proto.String("zzz")}
+	if v := (searchValue{missing: true}).orDefault(spec); v.missing || v.text != "zzz" {
+		t.Errorf("Expected text default zzz, got %+v", v)
+	}
+	if v := (searchValue{missing: true}).orDefault(&pb.SortSpec{}); !v.missing {
+		t.Errorf("Expected a missing value without defaults, got %+v", v)
+	}
+}
+
+type searchValues []searchValue
+
+func (s searchValues) Len() int           { return len(s) }
+func (s searchValues) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s searchValues) Less(i, j int) bool { return s[i].compare(s[j]) < 0 }
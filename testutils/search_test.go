@@ -0,0 +1,268 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"appengine"
+
+	pb "appengine_internal/search"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// testSearch searches "books" index with query and params changed by mod.
+// Returns the response and results as "id(score)[expr=value]" joined with
+// commas, or the error status.
+func testSearch(t *testing.T, c appengine.Context, query string, mod func(*pb.SearchParams)) (*pb.SearchResponse, string) {
+	params := &pb.SearchParams{
+		IndexSpec:  &pb.IndexSpec{Name: proto.String("books")},
+		Query:      proto.String(query),
+		CursorType: pb.SearchParams_SINGLE.Enum(),
+	}
+	if mod != nil {
+		mod(params)
+	}
+	resp := &pb.SearchResponse{}
+	if err := c.Call("search", "Search", &pb.SearchRequest{Params: params}, resp, nil); err != nil {
+		t.Fatalf("Search %q: %v", query, err)
+	}
+	if code := resp.GetStatus().GetCode(); code != pb.SearchServiceError_OK {
+		return resp, code.String() + ": " + resp.GetStatus().GetErrorDetail()
+	}
+	var res []string
+	for _, r := range resp.Result {
+		s := r.GetDocument().GetId()
+		if len(r.Score) > 0 {
+			s += fmt.Sprintf("(%g)", r.Score[0])
+		}
+		for _, e := range r.Expression {
+			s += "[" + e.GetName() + "=" + e.GetValue().GetStringValue() + "]"
+		}
+		res = append(res, s)
+	}
+	return resp, strings.Join(res, ",")
+}
+
+// newTestSearch creates a search service with testSearchDocs in "books".
+func newTestSearch(t *testing.T) (*FakeSearch, appengine.Context, func()) {
+	fs, unregister := NewFakeSearch()
+	c, deleteContext := newTestContext(t)
+	req := &pb.IndexDocumentRequest{Params: &pb.IndexDocumentParams{
+		IndexSpec: &pb.IndexSpec{Name: proto.String("books")},
+		Document:  testSearchDocs(),
+	}}
+	resp := &pb.IndexDocumentResponse{}
+	if err := c.Call("search", "IndexDocument", req, resp, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range resp.Status {
+		if s.GetCode() != pb.SearchServiceError_OK {
+			t.Fatalf("IndexDocument %s: %v", req.Params.Document[i].GetId(), s)
+		}
+	}
+	return fs, c, func() {
+		deleteContext()
+		unregister()
+	}
+}
+
+func TestSearch(t *testing.T) {
+	fs, c, cleanup := newTestSearch(t)
+	defer cleanup()
+
+	if got, want := fs.DocIds("books"), []string{"melville", "nodate", "verne1", "verne2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected DocIds %v, got %v", want, got)
+	}
+	relaxed := func(p *pb.SearchParams) { p.ParsingMode = pb.SearchParams_RELAXED.Enum() }
+	sortBy := func(specs ...*pb.SortSpec) func(*pb.SearchParams) {
+		return func(p *pb.SearchParams) { p.SortSpec = specs }
+	}
+	asc := func(expr string) *pb.SortSpec {
+		return &pb.SortSpec{SortExpression: proto.String(expr), SortDescending: proto.Bool(false)}
+	}
+	tests := []struct {
+		query string
+		mod   func(*pb.SearchParams)
+		want  string
+	}{
+		// documents are ordered by rank by default
+		{"", nil, "nodate,verne1,verne2,melville"},
+		{"sea -moby", nil, "verne1"},
+		{"title:(moby OR eighty)", nil, "verne2,melville"},
+		{"pub > 1870-03-20", nil, "verne2"},
+		{"sea AND (", nil, `INVALID_REQUEST: Failed to parse search request "sea AND ("; unexpected end of query`},
+		{"sea AND (", relaxed, "verne1,melville"},
+		{"sea", func(p *pb.SearchParams) { p.ScorerSpec = &pb.ScorerSpec{} }, "verne1(3),melville(3)"},
+		{"sea OR whale", func(p *pb.SearchParams) { p.ScorerSpec = &pb.ScorerSpec{} }, "melville(4),verne1(3)"},
+		// documents without a sort value go last, either way
+		{"", sortBy(asc("year")), "melville,verne1,verne2,nodate"},
+		{"", sortBy(&pb.SortSpec{SortExpression: proto.String("year")}), "verne2,verne1,melville,nodate"},
+		{"", sortBy(&pb.SortSpec{SortExpression: proto.String("year"), DefaultValueNumeric: proto.Float64(1860)}),
+			"verne2,verne1,nodate,melville"},
+		{"", sortBy(asc("title")), "verne2,nodate,melville,verne1"},
+		{"", sortBy(asc("author"), &pb.SortSpec{SortExpression: proto.String("year")}), "melville,verne2,verne1,nodate"},
+		{"", sortBy(&pb.SortSpec{SortExpression: proto.String("max(year, 1860) - _rank * 2")}),
+			"melville,verne2,verne1,nodate"},
+		{"", sortBy(asc("year +")), `INVALID_REQUEST: Failed to parse sort expression "year +"; unexpected end of expression`},
+		{`"jules verne"`, func(p *pb.SearchParams) {
+			p.FieldSpec = &pb.FieldSpec{Expression: []*pb.FieldSpec_Expression{
+				{Name: proto.String("age"), Expression: proto.String("2000 - year")},
+				{Name: proto.String("a"), Expression: proto.String("author")},
+				{Name: proto.String("p"), Expression: proto.String("price")},
+			}}
+		}, "verne1[age=1.3e+02][a=Jules Verne],verne2[age=1.27e+02][a=Jules Verne]"},
+		{"", func(p *pb.SearchParams) {
+			p.FieldSpec = &pb.FieldSpec{Expression: []*pb.FieldSpec_Expression{
+				{Name: proto.String("x"), Expression: proto.String("foo(year)")},
+			}}
+		}, `INVALID_REQUEST: Failed to parse field expression "foo(year)"; invalid call of foo`},
+	}
+	for _, tt := range tests {
+		if _, got := testSearch(t, c, tt.query, tt.mod); got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.query, tt.want, got)
+		}
+	}
+
+	resp, _ := testSearch(t, c, "moby", func(p *pb.SearchParams) {
+		p.FieldSpec = &pb.FieldSpec{Name: []string{"title", "year"}}
+	})
+	if fields := resp.Result[0].GetDocument().GetField(); len(fields) != 2 ||
+		fields[0].GetName() != "title" || fields[1].GetName() != "year" {
+		t.Errorf("Expected title and year fields, got %v", fields)
+	}
+	resp, _ = testSearch(t, c, "moby", func(p *pb.SearchParams) { p.KeysOnly = proto.Bool(true) })
+	if d := resp.Result[0].GetDocument(); d.GetId() != "melville" || len(d.Field) != 0 {
+		t.Errorf("Expected only ID of a document, got %v", d)
+	}
+}
+
+func TestSearchCursors(t *testing.T) {
+	_, c, cleanup := newTestSearch(t)
+	defer cleanup()
+
+	var pages []string
+	var cursor *string
+	for i := 0; i < 5; i++ {
+		resp, got := testSearch(t, c, "", func(p *pb.SearchParams) {
+			p.Limit = proto.Int32(3)
+			p.Cursor = cursor
+		})
+		if resp.GetMatchedCount() != 4 {
+			t.Errorf("Expected 4 matches, got %d", resp.GetMatchedCount())
+		}
+		pages = append(pages, got)
+		if cursor = resp.Cursor; cursor == nil {
+			break
+		}
+	}
+	if want := []string{"nodate,verne1,verne2", "melville"}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("Expected pages %v, got %v", want, pages)
+	}
+
+	resp, _ := testSearch(t, c, "", func(p *pb.SearchParams) { p.Limit = proto.Int32(1) })
+	first := resp.GetCursor()
+	perResult, _ := testSearch(t, c, "", func(p *pb.SearchParams) {
+		p.CursorType = pb.SearchParams_PER_RESULT.Enum()
+		p.Limit = proto.Int32(2)
+	})
+	if perResult.Cursor != nil || len(perResult.Result) != 2 {
+		t.Fatalf("Expected 2 results with cursors, got %v", perResult)
+	}
+	tests := []struct {
+		desc   string
+		cursor string
+		query  string
+		offset int32
+		want   string
+	}{
+		{"offset", "", "", 2, "verne2,melville"},
+		{"offset past the end", "", "", 10, ""},
+		{"cursor", first, "", 0, "verne1,verne2,melville"},
+		// an offset is added to the position of the cursor
+		{"cursor and offset", first, "", 2, "melville"},
+		{"result cursor", perResult.Result[0].GetCursor(), "", 0, "verne1,verne2,melville"},
+		{"last result cursor", perResult.Result[1].GetCursor(), "", 0, "verne2,melville"},
+		{"bad cursor", "bogus", "", 0, `INVALID_REQUEST: Invalid cursor "bogus"`},
+		{"cursor of another query", first, "sea", 0, fmt.Sprintf("INVALID_REQUEST: Invalid cursor %q", first)},
+	}
+	for _, tt := range tests {
+		_, got := testSearch(t, c, tt.query, func(p *pb.SearchParams) {
+			if tt.cursor != "" {
+				p.Cursor = proto.String(tt.cursor)
+			}
+			p.Offset = proto.Int32(tt.offset)
+		})
+		if got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.desc, tt.want, got)
+		}
+	}
+}
+
+func TestSearchDocuments(t *testing.T) {
+	fs, c, cleanup := newTestSearch(t)
+	defer cleanup()
+	books := &pb.IndexSpec{Name: proto.String("books")}
+
+	lresp := &pb.ListDocumentsResponse{}
+	err := c.Call("search", "ListDocuments", &pb.ListDocumentsRequest{Params: &pb.ListDocumentsParams{
+		IndexSpec:       books,
+		StartDocId:      proto.String("nodate"),
+		IncludeStartDoc: proto.Bool(false),
+		Limit:           proto.Int32(1),
+		KeysOnly:        proto.Bool(true),
+	}}, lresp, nil)
+	if err != nil || len(lresp.Document) != 1 || lresp.Document[0].GetId() != "verne1" || lresp.Document[0].Field != nil {
+		t.Errorf("Expected only ID of verne1, got %v (%v)", lresp, err)
+	}
+
+	dresp := &pb.DeleteDocumentResponse{}
+	err = c.Call("search", "DeleteDocument", &pb.DeleteDocumentRequest{Params: &pb.DeleteDocumentParams{
+		IndexSpec: books,
+		DocId:     []string{"verne1", "missing"},
+	}}, dresp, nil)
+	if err != nil || len(dresp.Status) != 2 {
+		t.Errorf("Expected 2 statuses, got %v (%v)", dresp, err)
+	}
+	if got, want := fs.DocIds("books"), []string{"melville", "nodate", "verne2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected DocIds %v after delete, got %v", want, got)
+	}
+
+	iresp := &pb.ListIndexesResponse{}
+	err = c.Call("search", "ListIndexes", &pb.ListIndexesRequest{Params: &pb.ListIndexesParams{
+		FetchSchema: proto.Bool(true),
+	}}, iresp, nil)
+	// the schema keeps fields of deleted documents
+	if err != nil || len(iresp.IndexMetadata) != 1 || len(iresp.IndexMetadata[0].Field) != 6 {
+		t.Errorf("Expected books index with 6 fields, got %v (%v)", iresp, err)
+	}
+
+	req := &pb.IndexDocumentRequest{Params: &pb.IndexDocumentParams{IndexSpec: books, Document: []*pb.Document{
+		{Field: []*pb.Field{searchField("n", pb.FieldValue_NUMBER, "x")}},
+		{Id: proto.String("!x")},
+		{Field: []*pb.Field{searchField("ok", pb.FieldValue_TEXT, "x")}},
+	}}}
+	resp := &pb.IndexDocumentResponse{}
+	if err := c.Call("search", "IndexDocument", req, resp, nil); err != nil {
+		t.Fatal(err)
+	}
+	codes := make([]pb.SearchServiceError_ErrorCode, len(resp.Status))
+	for i, s := range resp.Status {
+		codes[i] = s.GetCode()
+	}
+	want := []pb.SearchServiceError_ErrorCode{
+		pb.SearchServiceError_INVALID_REQUEST,
+		pb.SearchServiceError_INVALID_REQUEST,
+		pb.SearchServiceError_OK,
+	}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("Expected statuses %v, got %v", want, codes)
+	}
+	if len(resp.DocId) != 3 || resp.DocId[2] == "" {
+		t.Errorf("Expected an allocated ID of the valid document, got %q", resp.DocId)
+	}
+}
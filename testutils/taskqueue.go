@@ -0,0 +1,436 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	aei "appengine_internal"
+	pb "appengine_internal/taskqueue"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+var taskNameRE = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,500}$`)
+
+// QueuedTask is a task added to FakeTaskQueue.
+type QueuedTask struct {
+	Name  string
+	Queue string
+	// HTTP method of a push task, or "PULL"
+	Method  string
+	URL     string
+	Header  http.Header
+	Payload []byte
+	ETA     time.Time
+	// tag of a pull task
+	Tag string
+	// number of times a push task has been run and failed,
+	// or a pull task has been leased
+	RetryCount int
+	Created    time.Time
+
+	// retry parameters of the task itself, which override the queue's ones
+	retry *pb.TaskQueueRetryParameters
+}
+
+// FakeTaskQueue is an in-memory implementation of "taskqueue" service.
+// Tasks are never run on their own: tests can inspect them with Tasks method
+// or execute push tasks with RunTasks.
+type FakeTaskQueue struct {
+	mu sync.Mutex
+	// queues from queue.yaml
+	queues map[string]*queueConfig
+	// tasks keyed by queue and then task name
+	tasks map[string]map[string]*QueuedTask
+	// names of deleted tasks which can't be reused, keyed by queue
+	tombstones map[string]map[string]bool
+	lastTask   int
+}
+
+// NewFakeTaskQueue creates a task queue service with only the default push
+// queue defined, and registers it as "taskqueue" service implementation.
+// Use LoadQueueYAML to define more queues.
+//
+// Returns the task queue and a function that unregisters it. Here's an example:
+//
+// 		func TestSomething(t *testing.T) {
+// 			tq, unregister := NewFakeTaskQueue()
+// 			defer unregister()
+// 			if err := tq.LoadQueueYAML("queue.yaml"); err != nil {
+// 				t.Fatal(err)
+// 			}
+//
+// 			// test code that calls taskqueue.Add
+//
+// 			if tasks := tq.Tasks("default"); len(tasks) != 1 {
+// 				t.Errorf("Expected 1 task, got %d", len(tasks))
+// 			}
+// 		}
+//
+func NewFakeTaskQueue() (*FakeTaskQueue, func()) {
+	tq := &FakeTaskQueue{
+		queues:     map[string]*queueConfig{defaultQueue: {name: defaultQueue}},
+		tasks:      make(map[string]map[string]*QueuedTask),
+		tombstones: make(map[string]map[string]bool),
+	}
+	unregister := registerServiceOverrides("taskqueue", map[string]RpcStubFunc{
+		"Add":              tq.add,
+		"BulkAdd":          tq.bulkAdd,
+		"Delete":           tq.delete,
+		"PurgeQueue":       tq.purgeQueue,
+		"QueryTasks":       tq.queryTasks,
+		"QueryAndOwnTasks": tq.queryAndOwnTasks,
+		"ModifyTaskLease":  tq.modifyTaskLease,
+	})
+	unsetCurrent := setCurrentTaskQueue(tq)
+	return tq, func() {
+		unregister()
+		unsetCurrent()
+	}
+}
+
+// LoadQueueYAML replaces queue definitions with the ones from queue.yaml file
+// at path. Adding tasks to queues not defined there fails with UNKNOWN_QUEUE
+// error, as in production.
+func (tq *FakeTaskQueue) LoadQueueYAML(path string) error {
+	queues, err := parseQueueYAML(path)
+	if err != nil {
+		return err
+	}
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tq.queues = queues
+	return nil
+}
+
+// Tasks returns tasks currently in queue, ordered by ETA.
+// The returned tasks are copies and can be modified freely.
+func (tq *FakeTaskQueue) Tasks(queue string) []*QueuedTask {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tasks := tq.sortedTasks(queue)
+	for i, t := range tasks {
+		tasks[i] = t.copy()
+	}
+	return tasks
+}
+
+func (t *QueuedTask) copy() *QueuedTask {
+	c := *t
+	c.Header = make(http.Header)
+	for k, v := range t.Header {
+		c.Header[k] = append([]string(nil), v...)
+	}
+	c.Payload = append([]byte(nil), t.Payload...)
+	return &c
+}
+
+func (tq *FakeTaskQueue) add(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.TaskQueueAddRequest), out.(*pb.TaskQueueAddResponse)
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	task, code := tq.newTask(req)
+	if code != pb.TaskQueueServiceError_OK {
+		return taskqueueError(code, string(req.QueueName), string(req.TaskName))
+	}
+	tq.insert(task)
+	if len(req.TaskName) == 0 {
+		resp.ChosenTaskName = []byte(task.Name)
+	}
+	return nil
+}
+
+func (tq *FakeTaskQueue) bulkAdd(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.TaskQueueBulkAddRequest), out.(*pb.TaskQueueBulkAddResponse)
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	tasks := make([]*QueuedTask, len(req.GetAddRequest()))
+	failed := false
+	names := make(map[string]bool)
+	for i, r := range req.GetAddRequest() {
+		var code pb.TaskQueueServiceError_ErrorCode
+		tasks[i], code = tq.newTask(r)
+		if code == pb.TaskQueueServiceError_OK && names[tasks[i].Queue+"/"+tasks[i].Name] {
+			code = pb.TaskQueueServiceError_DUPLICATE_TASK_NAME
+		}
+		if code == pb.TaskQueueServiceError_OK {
+			names[tasks[i].Queue+"/"+tasks[i].Name] = true
+		}
+		result := &pb.TaskQueueBulkAddResponse_TaskResult{Result: code.Enum()}
+		if code == pb.TaskQueueServiceError_OK && len(r.TaskName) == 0 {
+			result.ChosenTaskName = []byte(tasks[i].Name)
+		}
+		failed = failed || code != pb.TaskQueueServiceError_OK
+		resp.Taskresult = append(resp.Taskresult, result)
+	}
+	// Either all tasks are added or none of them.
+	for i, result := range resp.Taskresult {
+		switch {
+		case !failed:
+			tq.insert(tasks[i])
+		case result.GetResult() == pb.TaskQueueServiceError_OK:
+			result.Result = pb.TaskQueueServiceError_SKIPPED.Enum()
+			result.ChosenTaskName = nil
+		}
+	}
+	return nil
+}
+
+// newTask validates req and converts it into a task.
+func (tq *FakeTaskQueue) newTask(req *pb.TaskQueueAddRequest) (*QueuedTask, pb.TaskQueueServiceError_ErrorCode) {
+	queue := string(req.QueueName)
+	q, ok := tq.queues[queue]
+	if !ok {
+		return nil, pb.TaskQueueServiceError_UNKNOWN_QUEUE
+	}
+	pull := req.GetMode() == pb.TaskQueueMode_PULL
+	if q.pull != pull {
+		return nil, pb.TaskQueueServiceError_INVALID_QUEUE_MODE
+	}
+	name := string(req.TaskName)
+	for len(req.TaskName) == 0 && (name == "" || tq.tasks[queue][name] != nil || tq.tombstones[queue][name]) {
+		tq.lastTask++
+		name = "task" + strconv.Itoa(tq.lastTask)
+	}
+	switch {
+	case !taskNameRE.MatchString(name):
+		return nil, pb.TaskQueueServiceError_INVALID_TASK_NAME
+	case tq.tasks[queue][name] != nil:
+		return nil, pb.TaskQueueServiceError_TASK_ALREADY_EXISTS
+	case tq.tombstones[queue][name]:
+		return nil, pb.TaskQueueServiceError_TOMBSTONED_TASK
+	}
+	task := &QueuedTask{
+		Name:    name,
+		Queue:   queue,
+		Header:  make(http.Header),
+		Payload: append([]byte(nil), req.Body...),
+		ETA:     time.Unix(0, req.GetEtaUsec()*1e3),
+		Created: time.Now(),
+		retry:   req.RetryParameters,
+	}
+	if pull {
+		task.Method = "PULL"
+		task.Tag = string(req.Tag)
+		return task, pb.TaskQueueServiceError_OK
+	}
+	task.Method = req.GetMethod().String()
+	task.URL = string(req.Url)
+	if len(task.URL) == 0 || task.URL[0] != '/' {
+		return nil, pb.TaskQueueServiceError_INVALID_URL
+	}
+	for _, h := range req.GetHeader() {
+		task.Header.Add(string(h.Key), string(h.Value))
+	}
+	return task, pb.TaskQueueServiceError_OK
+}
+
+func (tq *FakeTaskQueue) insert(t *QueuedTask) {
+	if tq.tasks[t.Queue] == nil {
+		tq.tasks[t.Queue] = make(map[string]*QueuedTask)
+	}
+	tq.tasks[t.Queue][t.Name] = t
+}
+
+func (tq *FakeTaskQueue) delete(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.TaskQueueDeleteRequest), out.(*pb.TaskQueueDeleteResponse)
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	queue := string(req.QueueName)
+	if _, ok := tq.queues[queue]; !ok {
+		return taskqueueError(pb.TaskQueueServiceError_UNKNOWN_QUEUE, queue, "")
+	}
+	for _, n := range req.GetTaskName() {
+		name := string(n)
+		switch {
+		case tq.tasks[queue][name] != nil:
+			tq.removeTask(queue, name)
+			resp.Result = append(resp.Result, pb.TaskQueueServiceError_OK)
+		case tq.tombstones[queue][name]:
+			resp.Result = append(resp.Result, pb.TaskQueueServiceError_TOMBSTONED_TASK)
+		default:
+			resp.Result = append(resp.Result, pb.TaskQueueServiceError_UNKNOWN_TASK)
+		}
+	}
+	return nil
+}
+
+// removeTask deletes a task, so that its name can't be used again.
+func (tq *FakeTaskQueue) removeTask(queue, name string) {
+	delete(tq.tasks[queue], name)
+	if tq.tombstones[queue] == nil {
+		tq.tombstones[queue] = make(map[string]bool)
+	}
+	tq.tombstones[queue][name] = true
+}
+
+func (tq *FakeTaskQueue) purgeQueue(in, out proto.Message, _ *RpcCallOptions) error {
+	req := in.(*pb.TaskQueuePurgeQueueRequest)
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	queue := string(req.QueueName)
+	if _, ok := tq.queues[queue]; !ok {
+		return taskqueueError(pb.TaskQueueServiceError_UNKNOWN_QUEUE, queue, "")
+	}
+	delete(tq.tasks, queue)
+	return nil
+}
+
+func (tq *FakeTaskQueue) queryTasks(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.TaskQueueQueryTasksRequest), out.(*pb.TaskQueueQueryTasksResponse)
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	queue := string(req.QueueName)
+	if _, ok := tq.queues[queue]; !ok {
+		return taskqueueError(pb.TaskQueueServiceError_UNKNOWN_QUEUE, queue, "")
+	}
+	startEta := time.Unix(0, req.GetStartEtaUsec()*1e3)
+	for _, t := range tq.sortedTasks(queue) {
+		if int32(len(resp.Task)) >= req.GetMaxRows() {
+			break
+		}
+		if req.StartEtaUsec != nil && (t.ETA.Before(startEta) ||
+			t.ETA.Equal(startEta) && t.Name < string(req.StartTaskName)) {
+			continue
+		}
+		rt := &pb.TaskQueueQueryTasksResponse_Task{
+			TaskName:         []byte(t.Name),
+			EtaUsec:          proto.Int64(t.ETA.UnixNano() / 1e3),
+			RetryCount:       proto.Int32(int32(t.RetryCount)),
+			BodySize:         proto.Int32(int32(len(t.Payload))),
+			Body:             t.Payload,
+			CreationTimeUsec: proto.Int64(t.Created.UnixNano() / 1e3),
+			RetryParameters:  t.retry,
+		}
+		if t.Method == "PULL" {
+			rt.Tag = []byte(t.Tag)
+		} else {
+			rt.Url = []byte(t.URL)
+			m := pb.TaskQueueQueryTasksResponse_Task_RequestMethod(
+				pb.TaskQueueAddRequest_RequestMethod_value[t.Method])
+			rt.Method = m.Enum()
+			for k, vs := range t.Header {
+				for _, v := range vs {
+					rt.Header = append(rt.Header, &pb.TaskQueueQueryTasksResponse_Task_Header{
+						Key:   []byte(k),
+						Value: []byte(v),
+					})
+				}
+			}
+		}
+		resp.Task = append(resp.Task, rt)
+	}
+	return nil
+}
+
+func (tq *FakeTaskQueue) queryAndOwnTasks(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.TaskQueueQueryAndOwnTasksRequest), out.(*pb.TaskQueueQueryAndOwnTasksResponse)
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	queue := string(req.QueueName)
+	if code := tq.checkPullQueue(queue); code != pb.TaskQueueServiceError_OK {
+		return taskqueueError(code, queue, "")
+	}
+	now := time.Now()
+	lease := time.Duration(req.GetLeaseSeconds() * float64(time.Second))
+	tag, byTag := string(req.Tag), req.GetGroupByTag()
+	for _, t := range tq.sortedTasks(queue) {
+		if int64(len(resp.Task)) >= req.GetMaxTasks() || t.ETA.After(now) {
+			break
+		}
+		if byTag {
+			if req.Tag == nil && len(resp.Task) == 0 {
+				// group by the tag of the oldest task
+				tag = t.Tag
+			}
+			if t.Tag != tag {
+				continue
+			}
+		}
+		t.ETA = now.Add(lease)
+		t.RetryCount++
+		resp.Task = append(resp.Task, &pb.TaskQueueQueryAndOwnTasksResponse_Task{
+			TaskName:   []byte(t.Name),
+			EtaUsec:    proto.Int64(t.ETA.UnixNano() / 1e3),
+			RetryCount: proto.Int32(int32(t.RetryCount)),
+			Body:       t.Payload,
+			Tag:        []byte(t.Tag),
+		})
+	}
+	return nil
+}
+
+func (tq *FakeTaskQueue) modifyTaskLease(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.TaskQueueModifyTaskLeaseRequest), out.(*pb.TaskQueueModifyTaskLeaseResponse)
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	queue, name := string(req.QueueName), string(req.TaskName)
+	if code := tq.checkPullQueue(queue); code != pb.TaskQueueServiceError_OK {
+		return taskqueueError(code, queue, name)
+	}
+	t := tq.tasks[queue][name]
+	if t == nil {
+		return taskqueueError(pb.TaskQueueServiceError_UNKNOWN_TASK, queue, name)
+	}
+	// The ETA of a leased task is the lease expiration time,
+	// which identifies the current lease owner.
+	now := time.Now()
+	if t.ETA.UnixNano()/1e3 != req.GetEtaUsec() || t.ETA.Before(now) {
+		return taskqueueError(pb.TaskQueueServiceError_TASK_LEASE_EXPIRED, queue, name)
+	}
+	t.ETA = now.Add(time.Duration(req.GetLeaseSeconds() * float64(time.Second)))
+	resp.UpdatedEtaUsec = proto.Int64(t.ETA.UnixNano() / 1e3)
+	return nil
+}
+
+func (tq *FakeTaskQueue) checkPullQueue(queue string) pb.TaskQueueServiceError_ErrorCode {
+	q, ok := tq.queues[queue]
+	switch {
+	case !ok:
+		return pb.TaskQueueServiceError_UNKNOWN_QUEUE
+	case !q.pull:
+		return pb.TaskQueueServiceError_INVALID_QUEUE_MODE
+	}
+	return pb.TaskQueueServiceError_OK
+}
+
+// sortedTasks returns tasks of queue ordered by ETA and name.
+func (tq *FakeTaskQueue) sortedTasks(queue string) []*QueuedTask {
+	tasks := make([]*QueuedTask, 0, len(tq.tasks[queue]))
+	for _, t := range tq.tasks[queue] {
+		tasks = append(tasks, t)
+	}
+	sort.Sort(tasksByETA(tasks))
+	return tasks
+}
+
+type tasksByETA []*QueuedTask
+
+func (s tasksByETA) Len() int      { return len(s) }
+func (s tasksByETA) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s tasksByETA) Less(i, j int) bool {
+	if !s[i].ETA.Equal(s[j].ETA) {
+		return s[i].ETA.Before(s[j].ETA)
+	}
+	return s[i].Name < s[j].Name
+}
+
+// taskqueueError creates an API error with the given code.
+func taskqueueError(code pb.TaskQueueServiceError_ErrorCode, queue, task string) error {
+	detail := fmt.Sprintf("queue %q", queue)
+	if task != "" {
+		detail += fmt.Sprintf(", task %q", task)
+	}
+	return &aei.APIError{
+		Service: "taskqueue",
+		Code:    int32(code),
+		Detail:  detail,
+	}
+}
@@ -0,0 +1,163 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	pb "appengine_internal/taskqueue"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/crhym3/aegot/yaml"
+)
+
+// defaultQueue is the name of the queue which exists even if it is not
+// defined in queue.yaml.
+const defaultQueue = "default"
+
+var (
+	queueNameRE  = regexp.MustCompile(`^[a-zA-Z0-9-]{1,100}$`)
+	queueRateRE  = regexp.MustCompile(`^(\d+(\.\d+)?)/[smhd]$`)
+	ageLimitRE   = regexp.MustCompile(`^(\d+(\.\d+)?)([smhd])$`)
+	ageLimitUnit = map[string]time.Duration{
+		"s": time.Second,
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+	}
+)
+
+// queueConfig is a queue definition from queue.yaml.
+type queueConfig struct {
+	name string
+	pull bool
+	// nil if not specified
+	retry *pb.TaskQueueRetryParameters
+}
+
+// parseQueueYAML reads queue definitions from queue.yaml file at path.
+// The default queue is always defined.
+func parseQueueYAML(path string) (map[string]*queueConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	doc, err := yaml.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	queues := map[string]*queueConfig{defaultQueue: {name: defaultQueue}}
+	if doc == nil {
+		return queues, nil
+	}
+	top, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a map", path)
+	}
+	list, ok := top["queue"].([]interface{})
+	if !ok && top["queue"] != nil {
+		return nil, fmt.Errorf("%s: queue must be a list", path)
+	}
+	for i, item := range list {
+		q, err := parseQueueEntry(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: queue #%d: %v", path, i+1, err)
+		}
+		if queues[q.name] != nil && q.name != defaultQueue {
+			return nil, fmt.Errorf("%s: duplicate queue %q", path, q.name)
+		}
+		queues[q.name] = q
+	}
+	return queues, nil
+}
+
+// parseQueueEntry validates a single queue definition.
+func parseQueueEntry(v interface{}) (*queueConfig, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a map, got %v", v)
+	}
+	name, _ := m["name"].(string)
+	if !queueNameRE.MatchString(name) {
+		return nil, fmt.Errorf("invalid queue name %q", name)
+	}
+	q := &queueConfig{name: name}
+	switch mode := m["mode"]; mode {
+	case nil, "push":
+	case "pull":
+		q.pull = true
+	default:
+		return nil, fmt.Errorf("queue %s: invalid mode %v", name, mode)
+	}
+	if rate, ok := m["rate"]; ok {
+		if s, _ := rate.(string); !queueRateRE.MatchString(s) {
+			return nil, fmt.Errorf("queue %s: invalid rate %v", name, rate)
+		}
+	} else if !q.pull && name != defaultQueue {
+		return nil, fmt.Errorf("queue %s: rate is required for push queues", name)
+	}
+	if rp, ok := m["retry_parameters"]; ok {
+		params, ok := rp.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("queue %s: retry_parameters must be a map", name)
+		}
+		var err error
+		if q.retry, err = parseRetryParameters(params); err != nil {
+			return nil, fmt.Errorf("queue %s: %v", name, err)
+		}
+	}
+	return q, nil
+}
+
+// parseRetryParameters converts retry_parameters section of a queue.
+func parseRetryParameters(m map[string]interface{}) (*pb.TaskQueueRetryParameters, error) {
+	rp := &pb.TaskQueueRetryParameters{}
+	for k, v := range m {
+		n, isInt := v.(int64)
+		f, isFloat := v.(float64)
+		if isInt {
+			f, isFloat = float64(n), true
+		}
+		switch {
+		case k == "task_retry_limit" && isInt && n >= 0:
+			rp.RetryLimit = proto.Int32(int32(n))
+		case k == "task_age_limit":
+			age, err := parseAgeLimit(v)
+			if err != nil {
+				return nil, err
+			}
+			rp.AgeLimitSec = proto.Int64(int64(age / time.Second))
+		case k == "min_backoff_seconds" && isFloat && f >= 0:
+			rp.MinBackoffSec = proto.Float64(f)
+		case k == "max_backoff_seconds" && isFloat && f >= 0:
+			rp.MaxBackoffSec = proto.Float64(f)
+		case k == "max_doublings" && isInt && n >= 0:
+			rp.MaxDoublings = proto.Int32(int32(n))
+		default:
+			return nil, fmt.Errorf("invalid retry parameter %s: %v", k, v)
+		}
+	}
+	// Only values set in queue.yaml are compared: a max_backoff_seconds
+	// below the default min_backoff_seconds is valid.
+	if rp.MinBackoffSec != nil && rp.MaxBackoffSec != nil &&
+		rp.GetMinBackoffSec() > rp.GetMaxBackoffSec() {
+		return nil, fmt.Errorf("min_backoff_seconds is greater than max_backoff_seconds")
+	}
+	return rp, nil
+}
+
+// parseAgeLimit parses task_age_limit value, e.g. "2d" or "10m".
+func parseAgeLimit(v interface{}) (time.Duration, error) {
+	s, _ := v.(string)
+	m := ageLimitRE.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid task_age_limit %v", v)
+	}
+	n, _ := strconv.ParseFloat(m[1], 64)
+	return time.Duration(n * float64(ageLimitUnit[m[3]])), nil
+}
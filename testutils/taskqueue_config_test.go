@@ -0,0 +1,87 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeTempFile writes content to a new temporary file and returns its path.
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "aegot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestParseQueueYAML(t *testing.T) {
+	path := writeTempFile(t, ydoc(
+		"queue:",
+		"- name: mail",
+		"  rate: 5/s",
+		"  retry_parameters:",
+		"    task_retry_limit: 3",
+		"    task_age_limit: 1.5h",
+		"    min_backoff_seconds: 1",
+		"    max_backoff_seconds: 2.5",
+		"    max_doublings: 2",
+		"- name: fast-retries",
+		"  rate: 1/m",
+		"  retry_parameters:",
+		"    max_backoff_seconds: 0.05",
+		"- name: pull-queue",
+		"  mode: pull",
+	))
+	defer os.Remove(path)
+	queues, err := parseQueueYAML(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queues) != 4 || queues[defaultQueue] == nil {
+		t.Fatalf("Expected default and 3 defined queues, got %v", queues)
+	}
+	rp := queues["mail"].retry
+	if rp.GetRetryLimit() != 3 || rp.GetAgeLimitSec() != 5400 || rp.GetMinBackoffSec() != 1 ||
+		rp.GetMaxBackoffSec() != 2.5 || rp.GetMaxDoublings() != 2 {
+		t.Errorf("Unexpected retry parameters of mail queue: %v", rp)
+	}
+	if rp := queues["fast-retries"].retry; rp.MinBackoffSec != nil || rp.GetMaxBackoffSec() != 0.05 {
+		t.Errorf("Unexpected retry parameters of fast-retries queue: %v", rp)
+	}
+	if q := queues["pull-queue"]; !q.pull || q.retry != nil {
+		t.Errorf("Expected a pull queue without retry parameters, got %+v", q)
+	}
+}
+
+func TestParseQueueYAMLErrors(t *testing.T) {
+	tests := []struct {
+		yaml, err string
+	}{
+		{"queue:\n- name: a b\n  rate: 1/s\n", "invalid queue name"},
+		{"queue:\n- name: q\n", "rate is required"},
+		{"queue:\n- name: q\n  rate: 1/w\n", "invalid rate"},
+		{"queue:\n- name: q\n  mode: poll\n", "invalid mode"},
+		{"queue:\n- name: q\n  rate: 1/s\n- name: q\n  rate: 2/s\n", "duplicate queue"},
+		{"queue:\n- name: q\n  rate: 1/s\n  retry_parameters:\n    task_age_limit: 2w\n", "invalid task_age_limit"},
+		{"queue:\n- name: q\n  rate: 1/s\n  retry_parameters:\n    task_retry_limit: -1\n", "invalid retry parameter"},
+		{"queue:\n- name: q\n  rate: 1/s\n  retry_parameters:\n    min_backoff_seconds: 2\n    max_backoff_seconds: 1\n",
+			"min_backoff_seconds is greater"},
+	}
+	for _, tt := range tests {
+		path := writeTempFile(t, tt.yaml)
+		_, err := parseQueueYAML(path)
+		os.Remove(path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.yaml, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	// delayPath is the URL path of tasks created by appengine/delay package.
+	delayPath = "/_ah/queue/go/delay"
+	// delayMissingFunc is the error appengine/delay logs, responding with
+	// 200, for calls of functions not registered with delay.Func.
+	delayMissingFunc = "delay: no func with key %q found"
+)
+
+// delayInvocation mirrors the payload of appengine/delay tasks.
+type delayInvocation struct {
+	Key  string
+	Args []interface{}
+}
+
+// RunDelayedFuncs runs functions called with appengine/delay package,
+// e.g. laterFunc.Call(c, args...), until there are none left, including
+// the calls made by delayed functions themselves. Returns the number of
+// functions run.
+//
+// See RunNextDelayedFunc for details on how failures are reported.
+func RunDelayedFuncs(t *testing.T) int {
+	n := 0
+	for RunNextDelayedFunc(t) {
+		n++
+	}
+	return n
+}
+
+// RunNextDelayedFunc runs the delayed function call with the earliest ETA
+// and removes it from the task queue created by NewFakeTaskQueue. Returns
+// false if there are no delayed calls.
+//
+// Unlike RunTasks, failed calls are not retried. Instead, the test fails
+// if the call can't be decoded, or the function returns an error or panics.
+// It fails immediately if the function isn't registered with delay.Func,
+// e.g. because the package defining it isn't imported by the test:
+//
+// 		func TestSignup(t *testing.T) {
+// 			_, unregister := NewFakeTaskQueue()
+// 			defer unregister()
+//
+// 			// test code that calls sendWelcomeEmail.Call(c, userId)
+//
+// 			if !RunNextDelayedFunc(t) {
+// 				t.Fatal("Expected sendWelcomeEmail call")
+// 			}
+// 			// check what the first call did, then run the rest
+// 			RunDelayedFuncs(t)
+// 		}
+//
+func RunNextDelayedFunc(t *testing.T) bool {
+	tq := mustCurrentTaskQueue(t, "RunNextDelayedFunc")
+	task := tq.nextPushTask("", isDelayTask)
+	if task == nil {
+		return false
+	}
+	tq.mu.Lock()
+	tq.removeTask(task.Queue, task.Name)
+	tq.mu.Unlock()
+
+	var inv delayInvocation
+	if err := gob.NewDecoder(bytes.NewReader(task.Payload)).Decode(&inv); err != nil {
+		t.Errorf("Delayed call in task %q of queue %q can't be decoded: %v",
+			task.Name, task.Queue, err)
+		return true
+	}
+	// appengine/delay responds with 500 if the function returns an error,
+	// and serveTask if the function panics.
+	code, found := serveDelayTask(t, task, inv.Key)
+	if !found {
+		t.Fatalf("Delayed call of %s in task %q of queue %q: no such function, "+
+			"is it registered with delay.Func in a package the test imports?", inv.Key, task.Name, task.Queue)
+	}
+	if code < 200 || code >= 300 {
+		t.Errorf("Delayed call of %s with %d argument(s) failed with %d",
+			inv.Key, len(inv.Args), code)
+	}
+	return true
+}
+
+// serveDelayTask serves task, a delayed call of function key, and returns
+// the response status code. found is false if appengine/delay logged that
+// the function isn't registered, since it responds with 200 in that case.
+func serveDelayTask(t *testing.T, task *QueuedTask, key string) (code int, found bool) {
+	var logs bytes.Buffer
+	log.SetOutput(io.MultiWriter(os.Stderr, &logs))
+	code = serveTask(t, task)
+	log.SetOutput(os.Stderr)
+	return code, !strings.Contains(logs.String(), fmt.Sprintf(delayMissingFunc, key))
+}
+
+// isDelayTask reports whether t was created by appengine/delay.
+func isDelayTask(t *QueuedTask) bool {
+	u, err := url.Parse(t.URL)
+	return err == nil && u.Path == delayPath
+}
@@ -0,0 +1,95 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/delay"
+
+	pb "appengine_internal/taskqueue"
+)
+
+var delayedCalls []string
+
+var laterRecord = delay.Func("record", func(c appengine.Context, s string) {
+	delayedCalls = append(delayedCalls, s)
+})
+
+var laterFanOut = delay.Func("fan-out", func(c appengine.Context, n int) error {
+	delayedCalls = append(delayedCalls, "fan-out")
+	for i := 0; i < n; i++ {
+		laterRecord.Call(c, string(rune('a'+i)))
+	}
+	return nil
+})
+
+func TestRunDelayedFuncs(t *testing.T) {
+	tq, unregister := NewFakeTaskQueue()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	delayedCalls = nil
+
+	if RunNextDelayedFunc(t) {
+		t.Fatal("Expected no delayed calls")
+	}
+	laterFanOut.Call(c, 3)
+	if !RunNextDelayedFunc(t) {
+		t.Fatal("Expected a delayed call")
+	}
+	if want := []string{"fan-out"}; !reflect.DeepEqual(delayedCalls, want) {
+		t.Errorf("Expected %v, got %v", want, delayedCalls)
+	}
+	if n := len(tq.Tasks("default")); n != 3 {
+		t.Errorf("Expected 3 calls made by the delayed function, got %d", n)
+	}
+	if n := RunDelayedFuncs(t); n != 3 {
+		t.Errorf("Expected 3 more calls, got %d", n)
+	}
+	if want := []string{"fan-out", "a", "b", "c"}; !reflect.DeepEqual(delayedCalls, want) {
+		t.Errorf("Expected %v, got %v", want, delayedCalls)
+	}
+	if n := len(tq.Tasks("default")); n != 0 {
+		t.Errorf("Expected delayed calls to be removed, %d left", n)
+	}
+}
+
+func TestDelayedFuncNotFound(t *testing.T) {
+	tq, unregister := NewFakeTaskQueue()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	delayedCalls = nil
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(delayInvocation{Key: "unknown.go:missing"}); err != nil {
+		t.Fatal(err)
+	}
+	req := testTaskRequest("default", "missing", delayPath, time.Now())
+	req.Body = buf.Bytes()
+	if err := c.Call("taskqueue", "Add", req, &pb.TaskQueueAddResponse{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	laterRecord.Call(c, "a")
+	for _, task := range tq.Tasks("default") {
+		var inv delayInvocation
+		if err := gob.NewDecoder(bytes.NewReader(task.Payload)).Decode(&inv); err != nil {
+			t.Fatal(err)
+		}
+		code, found := serveDelayTask(t, task, inv.Key)
+		if want := task.Name != "missing"; found != want || code != http.StatusOK {
+			t.Errorf("Task %q of %s: expected %v %d, got %v %d", task.Name, inv.Key, want, http.StatusOK, found, code)
+		}
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(delayedCalls, want) {
+		t.Errorf("Expected %v, got %v", want, delayedCalls)
+	}
+}
@@ -0,0 +1,240 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	pb "appengine_internal/taskqueue"
+)
+
+const (
+	// maxTaskRetries is the number of retries after which RunTasks gives up
+	// on a failing task whose queue has no retry limits, to keep a test
+	// from looping forever.
+	maxTaskRetries = 20
+	// taskRemoteAddr is the address task requests come from in production.
+	taskRemoteAddr = "0.1.0.2"
+)
+
+// currentTaskQueue is the task queue created by the last NewFakeTaskQueue
+// call and not unregistered yet; guarded by currentMu.
+var currentTaskQueue *FakeTaskQueue
+
+// RunTasks executes tasks of a push queue created by NewFakeTaskQueue,
+// until there are none left, including the tasks added while running.
+// An empty queue name means all push queues. Tasks are run in order of
+// their ETA, no matter how far in the future it is.
+//
+// Every task is sent to http.DefaultServeMux as an HTTP request with
+// X-AppEngine-QueueName, X-AppEngine-TaskName and X-AppEngine-TaskRetryCount
+// headers, and an appengine.Context created with CreateTestContext. A task
+// is done when the handler responds with a 2xx status code. Otherwise it is
+// retried according to the queue retry_parameters, without actually waiting
+// for the backoff time. A task which runs out of retries is deleted and
+// reported as a test error.
+//
+// Returns the number of tasks successfully executed:
+//
+// 		func TestFanOut(t *testing.T) {
+// 			tq, unregister := NewFakeTaskQueue()
+// 			defer unregister()
+//
+// 			// test code that adds a task which adds more tasks
+//
+// 			if n := RunTasks(t, "default"); n != 11 {
+// 				t.Errorf("Expected 11 tasks, ran %d", n)
+// 			}
+// 		}
+//
+func RunTasks(t *testing.T, queue string) int {
+	tq := mustCurrentTaskQueue(t, "RunTasks")
+	tq.mu.Lock()
+	q, ok := tq.queues[queue]
+	tq.mu.Unlock()
+	switch {
+	case queue != "" && !ok:
+		t.Fatalf("RunTasks: unknown queue %q", queue)
+	case ok && q.pull:
+		t.Fatalf("RunTasks: %q is a pull queue", queue)
+	}
+
+	done := 0
+	for {
+		task := tq.nextPushTask(queue, nil)
+		if task == nil {
+			return done
+		}
+		if tq.runTask(t, task) {
+			done++
+		}
+	}
+}
+
+// setCurrentTaskQueue makes tq the task queue RunTasks executes.
+// Returns a function that resets it, unless another task queue has been set
+// since.
+func setCurrentTaskQueue(tq *FakeTaskQueue) func() {
+	currentMu.Lock()
+	currentTaskQueue = tq
+	currentMu.Unlock()
+	return func() {
+		currentMu.Lock()
+		if currentTaskQueue == tq {
+			currentTaskQueue = nil
+		}
+		currentMu.Unlock()
+	}
+}
+
+// mustCurrentTaskQueue returns the task queue created by NewFakeTaskQueue
+// or fails the test with a message prefixed with caller.
+func mustCurrentTaskQueue(t *testing.T, caller string) *FakeTaskQueue {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	if currentTaskQueue == nil {
+		t.Fatalf("%s: no task queue, call NewFakeTaskQueue first", caller)
+	}
+	return currentTaskQueue
+}
+
+// nextPushTask returns a copy of the push task with the earliest ETA
+// in queue, or in all push queues if queue is empty. If match is not nil,
+// only tasks it returns true for are considered.
+func (tq *FakeTaskQueue) nextPushTask(queue string, match func(*QueuedTask) bool) *QueuedTask {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	var next *QueuedTask
+	for name, q := range tq.queues {
+		if q.pull || queue != "" && name != queue {
+			continue
+		}
+		for _, task := range tq.sortedTasks(name) {
+			if match != nil && !match(task) {
+				continue
+			}
+			if next == nil || tasksByETA([]*QueuedTask{task, next}).Less(0, 1) {
+				next = task
+			}
+			break
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	return next.copy()
+}
+
+// runTask sends task to http.DefaultServeMux and then either deletes it
+// or schedules a retry. It returns true if the task succeeded.
+func (tq *FakeTaskQueue) runTask(t *testing.T, task *QueuedTask) bool {
+	code := serveTask(t, task)
+	ok := code >= 200 && code < 300
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	stored := tq.tasks[task.Queue][task.Name]
+	if stored == nil {
+		// the handler deleted the task itself
+		return ok
+	}
+	if ok {
+		tq.removeTask(task.Queue, task.Name)
+		return true
+	}
+
+	rp := stored.retry
+	if rp == nil && tq.queues[task.Queue] != nil {
+		rp = tq.queues[task.Queue].retry
+	}
+	stored.RetryCount++
+	stored.ETA = stored.ETA.Add(taskBackoff(rp, stored.RetryCount))
+	if taskRetriesExhausted(rp, stored) {
+		tq.removeTask(task.Queue, task.Name)
+		t.Errorf("Task %q in queue %q failed after %d retries, last status %d",
+			task.Name, task.Queue, stored.RetryCount-1, code)
+	}
+	return false
+}
+
+// serveTask runs task handler and returns its response status code.
+// A panicking handler results in 500, as in production.
+func serveTask(t *testing.T, task *QueuedTask) (code int) {
+	req, err := http.NewRequest(task.Method, task.URL, bytes.NewReader(task.Payload))
+	if err != nil {
+		t.Errorf("Task %q in queue %q: %v", task.Name, task.Queue, err)
+		return http.StatusBadRequest
+	}
+	for k, v := range task.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-AppEngine-QueueName", task.Queue)
+	req.Header.Set("X-AppEngine-TaskName", task.Name)
+	req.Header.Set("X-AppEngine-TaskRetryCount", strconv.Itoa(task.RetryCount))
+	req.Header.Set("X-AppEngine-TaskETA",
+		strconv.FormatFloat(float64(task.ETA.UnixNano())/1e9, 'f', 6, 64))
+	req.RemoteAddr = taskRemoteAddr
+
+	CreateTestContext(req)
+	defer DeleteTestContext(req)
+	defer func() {
+		if r := recover(); r != nil {
+			t.Logf("Task %q in queue %q panicked: %v", task.Name, task.Queue, r)
+			code = http.StatusInternalServerError
+		}
+	}()
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	if w.Code < 200 || w.Code >= 300 {
+		t.Logf("Task %q in queue %q (%s %s) failed with %d: %s",
+			task.Name, task.Queue, task.Method, task.URL, w.Code, w.Body.String())
+	}
+	return w.Code
+}
+
+// taskBackoff returns the time to wait before a retry of a task which failed
+// retries times. The interval doubles max_doublings times and then grows
+// linearly, up to max_backoff_seconds.
+func taskBackoff(rp *pb.TaskQueueRetryParameters, retries int) time.Duration {
+	min, max, doublings := 0.1, 3600.0, 16
+	if rp != nil {
+		if rp.MinBackoffSec != nil {
+			min = rp.GetMinBackoffSec()
+		}
+		if rp.MaxBackoffSec != nil {
+			max = rp.GetMaxBackoffSec()
+		}
+		if rp.MaxDoublings != nil {
+			doublings = int(rp.GetMaxDoublings())
+		}
+	}
+	n := retries - 1
+	var sec float64
+	if n <= doublings {
+		sec = min * math.Pow(2, float64(n))
+	} else {
+		sec = min * math.Pow(2, float64(doublings)) * float64(n-doublings+1)
+	}
+	sec = math.Min(sec, max)
+	return time.Duration(sec * float64(time.Second))
+}
+
+// taskRetriesExhausted reports whether task can't be retried anymore.
+// If both task_retry_limit and task_age_limit are set, both must be reached.
+// The age of a task is measured up to its next ETA.
+func taskRetriesExhausted(rp *pb.TaskQueueRetryParameters, task *QueuedTask) bool {
+	if rp == nil || rp.RetryLimit == nil && rp.AgeLimitSec == nil {
+		return task.RetryCount > maxTaskRetries
+	}
+	retriesDone := rp.RetryLimit == nil || task.RetryCount > int(rp.GetRetryLimit())
+	age := task.ETA.Sub(task.Created)
+	ageDone := rp.AgeLimitSec == nil || age > time.Duration(rp.GetAgeLimitSec())*time.Second
+	return retriesDone && ageDone
+}
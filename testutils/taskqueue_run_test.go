@@ -0,0 +1,142 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"appengine"
+
+	pb "appengine_internal/taskqueue"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// taskRuns records requests of test task handlers.
+var taskRuns []string
+
+func init() {
+	http.HandleFunc("/_test/tasks/fan-out", func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+		for i := 0; i < 3; i++ {
+			req := testTaskRequest("mail", "", fmt.Sprintf("/_test/tasks/leaf?i=%d", i), time.Now())
+			if err := c.Call("taskqueue", "Add", req, &pb.TaskQueueAddResponse{}, nil); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		taskRuns = append(taskRuns, fmt.Sprintf("fan-out %s %s",
+			r.Header.Get("X-AppEngine-QueueName"), r.RemoteAddr))
+	})
+	http.HandleFunc("/_test/tasks/leaf", func(w http.ResponseWriter, r *http.Request) {
+		i, retries := r.FormValue("i"), r.Header.Get("X-AppEngine-TaskRetryCount")
+		taskRuns = append(taskRuns, fmt.Sprintf("leaf %s %s", i, retries))
+		switch {
+		case i == "1" && retries == "0":
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		case i == "2" && retries == "0":
+			panic("try again")
+		}
+	})
+}
+
+func TestRunTasks(t *testing.T) {
+	tq, c, cleanup := newTestTaskQueue(t)
+	defer cleanup()
+	taskRuns = nil
+
+	// the fan-out task is due later than the leaf but runs first
+	later := testTaskRequest("default", "", "/_test/tasks/fan-out", time.Now().Add(time.Hour))
+	if err := c.Call("taskqueue", "Add", later, &pb.TaskQueueAddResponse{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := RunTasks(t, "mail"); n != 0 {
+		t.Errorf("Expected no tasks in mail queue, ran %d", n)
+	}
+	if n := RunTasks(t, ""); n != 4 {
+		t.Errorf("Expected 4 tasks to succeed, got %d", n)
+	}
+	want := []string{
+		"fan-out default " + taskRemoteAddr,
+		"leaf 0 0",
+		"leaf 1 0",
+		"leaf 2 0",
+		// failed tasks are retried after a backoff, in ETA order
+		"leaf 1 1",
+		"leaf 2 1",
+	}
+	if !reflect.DeepEqual(taskRuns, want) {
+		t.Errorf("Expected runs %q, got %q", want, taskRuns)
+	}
+	for _, q := range []string{"default", "mail"} {
+		if names := taskNames(tq, q); len(names) != 0 {
+			t.Errorf("Expected no tasks left in %s, got %v", q, names)
+		}
+	}
+}
+
+func TestTaskBackoff(t *testing.T) {
+	rp := &pb.TaskQueueRetryParameters{
+		MinBackoffSec: proto.Float64(1),
+		MaxBackoffSec: proto.Float64(10),
+		MaxDoublings:  proto.Int32(2),
+	}
+	tests := []struct {
+		rp      *pb.TaskQueueRetryParameters
+		retries int
+		want    time.Duration
+	}{
+		{nil, 1, 100 * time.Millisecond},
+		{nil, 3, 400 * time.Millisecond},
+		{nil, 100, time.Hour},
+		{rp, 1, time.Second},
+		{rp, 2, 2 * time.Second},
+		{rp, 3, 4 * time.Second},
+		// linear growth after max_doublings
+		{rp, 4, 8 * time.Second},
+		{rp, 5, 10 * time.Second},
+		{&pb.TaskQueueRetryParameters{MaxBackoffSec: proto.Float64(0.15)}, 2, 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := taskBackoff(tt.rp, tt.retries); got != tt.want {
+			t.Errorf("taskBackoff(%v, %d): expected %v, got %v", tt.rp, tt.retries, tt.want, got)
+		}
+	}
+}
+
+func TestTaskRetriesExhausted(t *testing.T) {
+	created := time.Now()
+	task := func(retries int, age time.Duration) *QueuedTask {
+		return &QueuedTask{RetryCount: retries, Created: created, ETA: created.Add(age)}
+	}
+	limit := &pb.TaskQueueRetryParameters{RetryLimit: proto.Int32(2)}
+	age := &pb.TaskQueueRetryParameters{AgeLimitSec: proto.Int64(60)}
+	both := &pb.TaskQueueRetryParameters{RetryLimit: proto.Int32(2), AgeLimitSec: proto.Int64(60)}
+	tests := []struct {
+		rp   *pb.TaskQueueRetryParameters
+		task *QueuedTask
+		want bool
+	}{
+		{nil, task(maxTaskRetries, 0), false},
+		{nil, task(maxTaskRetries+1, 0), true},
+		{&pb.TaskQueueRetryParameters{MinBackoffSec: proto.Float64(1)}, task(maxTaskRetries+1, 0), true},
+		{limit, task(2, time.Hour), false},
+		{limit, task(3, 0), true},
+		{age, task(100, time.Minute), false},
+		{age, task(1, time.Minute+time.Second), true},
+		// both limits must be reached
+		{both, task(3, time.Minute), false},
+		{both, task(2, time.Hour), false},
+		{both, task(3, time.Hour), true},
+	}
+	for _, tt := range tests {
+		if got := taskRetriesExhausted(tt.rp, tt.task); got != tt.want {
+			t.Errorf("taskRetriesExhausted(%v) after %d retries in %v: expected %v, got %v",
+				tt.rp, tt.task.RetryCount, tt.task.ETA.Sub(created), tt.want, got)
+		}
+	}
+}
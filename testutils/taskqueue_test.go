@@ -0,0 +1,327 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"appengine"
+
+	aei "appengine_internal"
+	pb "appengine_internal/taskqueue"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// taskqueueErrorCode returns task queue error code of err, or OK if err is nil.
+func taskqueueErrorCode(t *testing.T, err error) pb.TaskQueueServiceError_ErrorCode {
+	if err == nil {
+		return pb.TaskQueueServiceError_OK
+	}
+	apiErr, ok := err.(*aei.APIError)
+	if !ok || apiErr.Service != "taskqueue" {
+		t.Fatalf("Expected a taskqueue API error, got %#v", err)
+	}
+	return pb.TaskQueueServiceError_ErrorCode(apiErr.Code)
+}
+
+// testTaskRequest creates a request to add a push task, or a pull task
+// if url is empty.
+func testTaskRequest(queue, name, url string, eta time.Time) *pb.TaskQueueAddRequest {
+	req := &pb.TaskQueueAddRequest{
+		QueueName: []byte(queue),
+		TaskName:  []byte(name),
+		EtaUsec:   proto.Int64(eta.UnixNano() / 1e3),
+		Body:      []byte("x=1"),
+	}
+	if url == "" {
+		req.Mode = pb.TaskQueueMode_PULL.Enum()
+		return req
+	}
+	req.Url = []byte(url)
+	req.Method = pb.TaskQueueAddRequest_POST.Enum()
+	req.Header = []*pb.TaskQueueAddRequest_Header{
+		{Key: []byte("Content-Type"), Value: []byte("application/x-www-form-urlencoded")},
+	}
+	return req
+}
+
+// taskNames returns names of tasks in queue.
+func taskNames(tq *FakeTaskQueue, queue string) []string {
+	names := []string{}
+	for _, t := range tq.Tasks(queue) {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+// newTestTaskQueue creates a task queue with "mail" push queue and "pull"
+// pull queue.
+func newTestTaskQueue(t *testing.T) (*FakeTaskQueue, appengine.Context, func()) {
+	tq, unregister := NewFakeTaskQueue()
+	path := writeTempFile(t, ydoc(
+		"queue:",
+		"- name: mail",
+		"  rate: 5/s",
+		"- name: pull",
+		"  mode: pull",
+	))
+	defer os.Remove(path)
+	if err := tq.LoadQueueYAML(path); err != nil {
+		unregister()
+		t.Fatal(err)
+	}
+	c, deleteContext := newTestContext(t)
+	return tq, c, func() {
+		deleteContext()
+		unregister()
+	}
+}
+
+func TestTaskQueueAdd(t *testing.T) {
+	tq, c, cleanup := newTestTaskQueue(t)
+	defer cleanup()
+
+	now := time.Now()
+	tests := []struct {
+		desc string
+		req  *pb.TaskQueueAddRequest
+		code pb.TaskQueueServiceError_ErrorCode
+	}{
+		{"named task", testTaskRequest("mail", "a", "/work", now), pb.TaskQueueServiceError_OK},
+		{"existing name", testTaskRequest("mail", "a", "/work", now), pb.TaskQueueServiceError_TASK_ALREADY_EXISTS},
+		{"same name in another queue", testTaskRequest("default", "a", "/work", now), pb.TaskQueueServiceError_OK},
+		{"invalid name", testTaskRequest("mail", "a b", "/work", now), pb.TaskQueueServiceError_INVALID_TASK_NAME},
+		{"relative URL", testTaskRequest("mail", "", "work", now), pb.TaskQueueServiceError_INVALID_URL},
+		{"undefined queue", testTaskRequest("nope", "", "/work", now), pb.TaskQueueServiceError_UNKNOWN_QUEUE},
+		{"push task in a pull queue", testTaskRequest("pull", "", "/work", now), pb.TaskQueueServiceError_INVALID_QUEUE_MODE},
+		{"pull task in a push queue", testTaskRequest("mail", "", "", now), pb.TaskQueueServiceError_INVALID_QUEUE_MODE},
+		{"pull task", testTaskRequest("pull", "p", "", now), pb.TaskQueueServiceError_OK},
+	}
+	for _, tt := range tests {
+		err := c.Call("taskqueue", "Add", tt.req, &pb.TaskQueueAddResponse{}, nil)
+		if code := taskqueueErrorCode(t, err); code != tt.code {
+			t.Errorf("%s: expected %v, got %v", tt.desc, tt.code, err)
+		}
+	}
+
+	// a name is chosen for unnamed tasks
+	resp := &pb.TaskQueueAddResponse{}
+	if err := c.Call("taskqueue", "Add", testTaskRequest("mail", "", "/later", now.Add(time.Hour)), resp, nil); err != nil {
+		t.Fatal(err)
+	}
+	chosen := string(resp.ChosenTaskName)
+	if want := []string{"a", chosen}; !reflect.DeepEqual(taskNames(tq, "mail"), want) {
+		t.Errorf("Expected tasks %v ordered by ETA, got %v", want, taskNames(tq, "mail"))
+	}
+	task := tq.Tasks("mail")[0]
+	if task.Method != "POST" || task.URL != "/work" || string(task.Payload) != "x=1" ||
+		task.Header.Get("Content-Type") != "application/x-www-form-urlencoded" || task.ETA.Unix() != now.Unix() {
+		t.Errorf("Unexpected task %+v", task)
+	}
+	if task := tq.Tasks("pull")[0]; task.Method != "PULL" || task.URL != "" {
+		t.Errorf("Expected a pull task, got %+v", task)
+	}
+	// tasks are copies
+	task.Payload[0] = 'y'
+	if tq.Tasks("mail")[0].Payload[0] != 'x' {
+		t.Error("Expected Tasks to return copies")
+	}
+
+	dresp := &pb.TaskQueueDeleteResponse{}
+	dreq := &pb.TaskQueueDeleteRequest{QueueName: []byte("mail"), TaskName: [][]byte{[]byte("a"), []byte("zz")}}
+	if err := c.Call("taskqueue", "Delete", dreq, dresp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []pb.TaskQueueServiceError_ErrorCode{pb.TaskQueueServiceError_OK, pb.TaskQueueServiceError_UNKNOWN_TASK}; !reflect.DeepEqual(dresp.Result, want) {
+		t.Errorf("Expected delete results %v, got %v", want, dresp.Result)
+	}
+	// names of deleted tasks can't be reused
+	err := c.Call("taskqueue", "Add", testTaskRequest("mail", "a", "/work", now), &pb.TaskQueueAddResponse{}, nil)
+	if code := taskqueueErrorCode(t, err); code != pb.TaskQueueServiceError_TOMBSTONED_TASK {
+		t.Errorf("Expected TOMBSTONED_TASK, got %v", err)
+	}
+	dresp = &pb.TaskQueueDeleteResponse{}
+	dreq.TaskName = dreq.TaskName[:1]
+	if err := c.Call("taskqueue", "Delete", dreq, dresp, nil); err != nil || dresp.Result[0] != pb.TaskQueueServiceError_TOMBSTONED_TASK {
+		t.Errorf("Expected TOMBSTONED_TASK deleting a task twice, got %v (%v)", dresp.Result, err)
+	}
+
+	if err := c.Call("taskqueue", "PurgeQueue", &pb.TaskQueuePurgeQueueRequest{QueueName: []byte("mail")},
+		&pb.TaskQueuePurgeQueueResponse{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if names := taskNames(tq, "mail"); len(names) != 0 {
+		t.Errorf("Expected no tasks after purge, got %v", names)
+	}
+}
+
+func TestTaskQueueBulkAdd(t *testing.T) {
+	tq, c, cleanup := newTestTaskQueue(t)
+	defer cleanup()
+
+	now := time.Now()
+	bulkAdd := func(reqs ...*pb.TaskQueueAddRequest) []*pb.TaskQueueBulkAddResponse_TaskResult {
+		resp := &pb.TaskQueueBulkAddResponse{}
+		if err := c.Call("taskqueue", "BulkAdd", &pb.TaskQueueBulkAddRequest{AddRequest: reqs}, resp, nil); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Taskresult
+	}
+	codes := func(results []*pb.TaskQueueBulkAddResponse_TaskResult) []pb.TaskQueueServiceError_ErrorCode {
+		var codes []pb.TaskQueueServiceError_ErrorCode
+		for _, r := range results {
+			codes = append(codes, r.GetResult())
+		}
+		return codes
+	}
+
+	// none of the tasks are added if any of them fails
+	results := bulkAdd(
+		testTaskRequest("default", "b1", "/x", now),
+		testTaskRequest("default", "", "/x", now),
+		testTaskRequest("default", "b1", "/x", now),
+	)
+	want := []pb.TaskQueueServiceError_ErrorCode{
+		pb.TaskQueueServiceError_SKIPPED,
+		pb.TaskQueueServiceError_SKIPPED,
+		pb.TaskQueueServiceError_DUPLICATE_TASK_NAME,
+	}
+	if got := codes(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if results[1].ChosenTaskName != nil {
+		t.Errorf("Expected no name chosen for a skipped task, got %q", results[1].ChosenTaskName)
+	}
+	if names := taskNames(tq, "default"); len(names) != 0 {
+		t.Errorf("Expected no tasks added, got %v", names)
+	}
+
+	results = bulkAdd(
+		testTaskRequest("default", "b1", "/x", now),
+		testTaskRequest("default", "", "/x", now.Add(time.Minute)),
+	)
+	want = []pb.TaskQueueServiceError_ErrorCode{pb.TaskQueueServiceError_OK, pb.TaskQueueServiceError_OK}
+	if got := codes(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if names := taskNames(tq, "default"); !reflect.DeepEqual(names, []string{"b1", string(results[1].ChosenTaskName)}) {
+		t.Errorf("Expected b1 and a task named %q, got %v", results[1].ChosenTaskName, names)
+	}
+
+	qresp := &pb.TaskQueueQueryTasksResponse{}
+	qreq := &pb.TaskQueueQueryTasksRequest{
+		QueueName:    []byte("default"),
+		StartEtaUsec: proto.Int64(now.Add(time.Second).UnixNano() / 1e3),
+		MaxRows:      proto.Int32(10),
+	}
+	if err := c.Call("taskqueue", "QueryTasks", qreq, qresp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(qresp.Task) != 1 || string(qresp.Task[0].TaskName) != string(results[1].ChosenTaskName) ||
+		qresp.Task[0].GetMethod() != pb.TaskQueueQueryTasksResponse_Task_POST || string(qresp.Task[0].Url) != "/x" {
+		t.Errorf("Expected only the later task, got %v", qresp.Task)
+	}
+}
+
+func TestTaskQueueLease(t *testing.T) {
+	tq, c, cleanup := newTestTaskQueue(t)
+	defer cleanup()
+
+	now := time.Now()
+	for _, r := range []struct{ name, tag string }{{"p1", "a"}, {"p2", "b"}, {"p3", "a"}} {
+		req := testTaskRequest("pull", r.name, "", now)
+		req.Tag = []byte(r.tag)
+		if err := c.Call("taskqueue", "Add", req, &pb.TaskQueueAddResponse{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	future := testTaskRequest("pull", "p4", "", now.Add(time.Hour))
+	if err := c.Call("taskqueue", "Add", future, &pb.TaskQueueAddResponse{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	lease := func(max int64, byTag bool) []*pb.TaskQueueQueryAndOwnTasksResponse_Task {
+		resp := &pb.TaskQueueQueryAndOwnTasksResponse{}
+		req := &pb.TaskQueueQueryAndOwnTasksRequest{
+			QueueName:    []byte("pull"),
+			LeaseSeconds: proto.Float64(60),
+			MaxTasks:     proto.Int64(max),
+			GroupByTag:   proto.Bool(byTag),
+		}
+		if err := c.Call("taskqueue", "QueryAndOwnTasks", req, resp, nil); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Task
+	}
+	names := func(tasks []*pb.TaskQueueQueryAndOwnTasksResponse_Task) []string {
+		names := []string{}
+		for _, t := range tasks {
+			names = append(names, string(t.TaskName))
+		}
+		return names
+	}
+
+	// tasks are grouped by the tag of the oldest one
+	leased := lease(10, true)
+	if got, want := names(leased), []string{"p1", "p3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected leased tasks %v, got %v", want, got)
+	}
+	if leased[0].GetRetryCount() != 1 {
+		t.Errorf("Expected a leased task to be counted, got %d", leased[0].GetRetryCount())
+	}
+	// leased tasks and the tasks in the future are not available
+	if got, want := names(lease(10, false)), []string{"p2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected leased tasks %v, got %v", want, got)
+	}
+	if got := names(lease(10, false)); len(got) != 0 {
+		t.Errorf("Expected no tasks to lease, got %v", got)
+	}
+
+	modify := func(name string, eta int64) (*pb.TaskQueueModifyTaskLeaseResponse, error) {
+		resp := &pb.TaskQueueModifyTaskLeaseResponse{}
+		err := c.Call("taskqueue", "ModifyTaskLease", &pb.TaskQueueModifyTaskLeaseRequest{
+			QueueName:    []byte("pull"),
+			TaskName:     []byte(name),
+			EtaUsec:      proto.Int64(eta),
+			LeaseSeconds: proto.Float64(0),
+		}, resp, nil)
+		return resp, err
+	}
+	resp, err := modify("p1", leased[0].GetEtaUsec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eta := resp.GetUpdatedEtaUsec(); eta > time.Now().UnixNano()/1e3 {
+		t.Errorf("Expected the lease to end now, got ETA in %v", time.Unix(0, eta*1e3).Sub(time.Now()))
+	}
+	// the old ETA doesn't own the lease anymore
+	_, err = modify("p3", leased[0].GetEtaUsec()-1)
+	if code := taskqueueErrorCode(t, err); code != pb.TaskQueueServiceError_TASK_LEASE_EXPIRED {
+		t.Errorf("Expected TASK_LEASE_EXPIRED, got %v", err)
+	}
+	_, err = modify("nope", 0)
+	if code := taskqueueErrorCode(t, err); code != pb.TaskQueueServiceError_UNKNOWN_TASK {
+		t.Errorf("Expected UNKNOWN_TASK, got %v", err)
+	}
+	if got, want := names(lease(10, false)), []string{"p1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the released task %v, got %v", want, got)
+	}
+	for _, task := range tq.Tasks("pull") {
+		if task.Name == "p1" && task.RetryCount != 2 {
+			t.Errorf("Expected p1 leased twice, got %d", task.RetryCount)
+		}
+	}
+
+	err = c.Call("taskqueue", "QueryAndOwnTasks", &pb.TaskQueueQueryAndOwnTasksRequest{
+		QueueName:    []byte("default"),
+		LeaseSeconds: proto.Float64(60),
+		MaxTasks:     proto.Int64(1),
+	}, &pb.TaskQueueQueryAndOwnTasksResponse{}, nil)
+	if code := taskqueueErrorCode(t, err); code != pb.TaskQueueServiceError_INVALID_QUEUE_MODE {
+		t.Errorf("Expected INVALID_QUEUE_MODE leasing from a push queue, got %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	aei "appengine_internal"
+	pb "appengine_internal/urlfetch"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// defaultFetchDeadline and maxFetchDeadline are the production limits
+	// of a urlfetch request duration.
+	defaultFetchDeadline = 5 * time.Second
+	maxFetchDeadline     = 60 * time.Second
+	// maxFetchResponseSize is the size at which a response is truncated.
+	maxFetchResponseSize = 32 << 20
+	// maxFetchRedirects is the number of redirects urlfetch follows.
+	maxFetchRedirects = 5
+	// fetchRemoteAddr is the address urlfetch requests come from.
+	fetchRemoteAddr = "0.1.0.40"
+)
+
+var (
+	fetchMu sync.Mutex
+	// routes keyed by host, with or without a port
+	fetchRoutes = make(map[string]*urlRoute)
+	// unregisters "urlfetch" service override; nil if there are no routes
+	unregisterFetch func()
+)
+
+// RouteURLFetch makes "urlfetch" service send requests for host to handler,
+// instead of the network. Requests for hosts without a route fail with
+// FETCH_ERROR. If host has no port, it matches requests to any port.
+// To route requests to an httptest.Server, pass its Config.Handler.
+//
+// Redirects are followed if the request asks for it (http.Client follows
+// them itself), up to 5 times. A handler which runs longer than the request
+// deadline (5 seconds by default) results in DEADLINE_EXCEEDED error, and
+// responses larger than 32MB are truncated, as in production.
+//
+// Returns a function that removes the route. Here's an example:
+//
+// 		func TestWeather(t *testing.T) {
+// 			api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// 				fmt.Fprint(w, `{"temp": 20}`)
+// 			})
+// 			unroute := RouteURLFetch("api.weather.example.com", api)
+// 			defer unroute()
+//
+// 			// test code that uses urlfetch.Client(c)
+// 		}
+//
+func RouteURLFetch(host string, handler http.Handler) func() {
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+	if unregisterFetch == nil {
+		unregisterFetch = RegisterAPIOverride("urlfetch", "Fetch", fetch)
+	}
+	route := &urlRoute{handler}
+	fetchRoutes[host] = route
+	return func() {
+		fetchMu.Lock()
+		defer fetchMu.Unlock()
+		// the route may have been replaced since; handlers can't be
+		// compared as some, e.g. http.HandlerFunc, are not comparable
+		if fetchRoutes[host] != route {
+			return
+		}
+		delete(fetchRoutes, host)
+		if len(fetchRoutes) == 0 {
+			unregisterFetch()
+			unregisterFetch = nil
+		}
+	}
+}
+
+// urlRoute is a route added by a RouteURLFetch call.
+type urlRoute struct {
+	handler http.Handler
+}
+
+// fetchRoute returns a handler for the host of u, or nil.
+func fetchRoute(u *url.URL) http.Handler {
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+	route, ok := fetchRoutes[u.Host]
+	if !ok {
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil
+		}
+		if route, ok = fetchRoutes[host]; !ok {
+			return nil
+		}
+	}
+	return route.handler
+}
+
+func fetch(in, out proto.Message, _ *RpcCallOptions) error {
+	return doFetch(in.(*pb.URLFetchRequest), out.(*pb.URLFetchResponse), serveFetch)
+}
+
+// fetchReply is a response to a single HTTP request of a urlfetch call.
+type fetchReply struct {
+	code   int
+	header http.Header
+	body   []byte
+}
+
+// serveFetch sends r to the handler routed for its host.
+func serveFetch(r *http.Request) (*fetchReply, error) {
+	handler := fetchRoute(r.URL)
+	if handler == nil {
+		return nil, errors.New("no route for " + r.URL.Host)
+	}
+	r.RequestURI = r.URL.RequestURI()
+	r.RemoteAddr = fetchRemoteAddr
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return &fetchReply{w.Code, w.HeaderMap, w.Body.Bytes()}, nil
+}
+
+// doFetch makes a urlfetch call, sending HTTP requests with send. It follows
+// redirects, enforces the deadline and truncates the response content
+// as the production service does.
+func doFetch(req *pb.URLFetchRequest, resp *pb.URLFetchResponse,
+	send func(*http.Request) (*fetchReply, error)) error {
+
+	deadline := defaultFetchDeadline
+	if req.Deadline != nil {
+		deadline = time.Duration(req.GetDeadline() * float64(time.Second))
+		if deadline > maxFetchDeadline {
+			deadline = maxFetchDeadline
+		}
+	}
+	timeout := time.After(deadline)
+
+	method := req.GetMethod().String()
+	payload := req.Payload
+	u, err := url.Parse(req.GetUrl())
+	for redirects := 0; ; redirects++ {
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fetchError(pb.URLFetchServiceError_INVALID_URL, req.GetUrl())
+		}
+		r, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+		if err != nil {
+			return fetchError(pb.URLFetchServiceError_INVALID_URL, err.Error())
+		}
+		for _, h := range req.GetHeader() {
+			r.Header.Add(h.GetKey(), h.GetValue())
+		}
+
+		var (
+			reply   *fetchReply
+			sendErr error
+		)
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			reply, sendErr = send(r)
+		}()
+		select {
+		case <-done:
+		case <-timeout:
+			return fetchError(pb.URLFetchServiceError_DEADLINE_EXCEEDED, u.String())
+		}
+		if sendErr != nil {
+			return fetchError(pb.URLFetchServiceError_FETCH_ERROR, sendErr.Error())
+		}
+
+		loc := reply.header.Get("Location")
+		if req.GetFollowRedirects() && isRedirect(reply.code) && loc != "" {
+			if redirects == maxFetchRedirects {
+				return fetchError(pb.URLFetchServiceError_TOO_MANY_REDIRECTS, u.String())
+			}
+			if reply.code != http.StatusTemporaryRedirect {
+				method, payload = "GET", nil
+			}
+			next, err := u.Parse(loc)
+			if err != nil {
+				return fetchError(pb.URLFetchServiceError_MALFORMED_REPLY, "bad Location "+loc)
+			}
+			u = next
+			continue
+		}
+
+		content := reply.body
+		if len(content) > maxFetchResponseSize {
+			content = content[:maxFetchResponseSize]
+			resp.ContentWasTruncated = proto.Bool(true)
+		}
+		resp.Content = content
+		resp.StatusCode = proto.Int32(int32(reply.code))
+		resp.Header = fetchResponseHeader(reply.header)
+		if redirects > 0 {
+			resp.FinalUrl = proto.String(u.String())
+		}
+		return nil
+	}
+}
+
+// isRedirect reports whether code is an HTTP status urlfetch follows.
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect:
+		return true
+	}
+	return false
+}
+
+// fetchResponseHeader converts h into URLFetchResponse headers.
+func fetchResponseHeader(h http.Header) []*pb.URLFetchResponse_Header {
+	var res []*pb.URLFetchResponse_Header
+	for k, vs := range h {
+		for _, v := range vs {
+			res = append(res, &pb.URLFetchResponse_Header{
+				Key:   proto.String(k),
+				Value: proto.String(v),
+			})
+		}
+	}
+	return res
+}
+
+// fetchError creates an API error with the given code.
+func fetchError(code pb.URLFetchServiceError_ErrorCode, detail string) error {
+	return &aei.APIError{
+		Service: "urlfetch",
+		Code:    int32(code),
+		Detail:  detail,
+	}
+}
@@ -0,0 +1,245 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	pb "appengine_internal/urlfetch"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// RecordCassettesEnv is the name of environment variable which makes
+// UseCassette record cassettes instead of replaying them,
+// e.g. AEGOT_RECORD_CASSETTES=1 go test.
+const RecordCassettesEnv = "AEGOT_RECORD_CASSETTES"
+
+// CassetteMatch selects the parts of a request compared when looking for
+// a recorded response.
+type CassetteMatch int
+
+const (
+	MatchMethod CassetteMatch = 1 << iota
+	MatchURL
+	// compares SHA-1 hashes of request bodies
+	MatchBody
+)
+
+// CassetteOptions configures UseCassette.
+type CassetteOptions struct {
+	// Transport sends requests when recording. Defaults to a new
+	// http.Transport: http.DefaultTransport can't be used in tests.
+	Transport http.RoundTripper
+	// Match defaults to MatchMethod | MatchURL | MatchBody.
+	Match CassetteMatch
+}
+
+// cassette is a list of recorded urlfetch requests and responses.
+type cassette struct {
+	t     *testing.T
+	path  string
+	opts  CassetteOptions
+	mu    sync.Mutex
+	Calls []*cassetteCall `json:"calls"`
+	// replayed calls
+	used []bool
+}
+
+type cassetteCall struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+// cassetteRequest identifies a request. Request headers and bodies are
+// not stored, so that credentials don't end up in the cassette.
+type cassetteRequest struct {
+	Method   string `json:"method"`
+	URL      string `json:"url"`
+	BodyHash string `json:"body_sha1,omitempty"`
+}
+
+type cassetteResponse struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	// Body holds UTF-8 bodies, Base64Body all the others.
+	Body       string `json:"body,omitempty"`
+	Base64Body string `json:"body_base64,omitempty"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	// set if redirects were followed
+	FinalURL string `json:"final_url,omitempty"`
+}
+
+// UseCassette makes "urlfetch" service replay responses recorded
+// in a cassette file at path, conventionally testdata/<name>.cassette.
+// A request that matches none of the recorded ones, or matches only those
+// already replayed, fails the test. opts can be nil.
+//
+// When tests are run with RecordCassettesEnv set, or with -record flag if
+// the test package defines one, requests are sent to the network with
+// opts.Transport instead, and the file is rewritten with all the requests
+// and responses once the returned function is called. Redirects and
+// deadlines are handled as RouteURLFetch does:
+//
+// 		func TestPartnerAPI(t *testing.T) {
+// 			stop := UseCassette(t, "testdata/partner.cassette", &CassetteOptions{
+// 				Match: MatchMethod | MatchURL, // request bodies contain timestamps
+// 			})
+// 			defer stop()
+//
+// 			// test code that uses urlfetch.Client(c)
+// 		}
+//
+// UseCassette can't be combined with RouteURLFetch.
+func UseCassette(t *testing.T, path string, opts *CassetteOptions) func() {
+	c := &cassette{t: t, path: path}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Transport == nil {
+		c.opts.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	}
+	if c.opts.Match == 0 {
+		c.opts.Match = MatchMethod | MatchURL | MatchBody
+	}
+
+	if flagOrEnv("record", RecordCassettesEnv) {
+		unregister := RegisterAPIOverride("urlfetch", "Fetch", c.record)
+		return func() {
+			unregister()
+			if err := c.save(); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run tests with %s=1 to create it)", err, RecordCassettesEnv)
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	c.used = make([]bool, len(c.Calls))
+	return RegisterAPIOverride("urlfetch", "Fetch", c.replay)
+}
+
+func (c *cassette) record(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.URLFetchRequest), out.(*pb.URLFetchResponse)
+	if err := doFetch(req, resp, c.send); err != nil {
+		return err
+	}
+	call := &cassetteCall{
+		Request: cassetteRequestOf(req),
+		Response: cassetteResponse{
+			StatusCode: int(resp.GetStatusCode()),
+			Header:     make(http.Header),
+			FinalURL:   resp.GetFinalUrl(),
+			Truncated:  resp.GetContentWasTruncated(),
+		},
+	}
+	for _, h := range resp.Header {
+		call.Response.Header.Add(h.GetKey(), h.GetValue())
+	}
+	if utf8.Valid(resp.Content) {
+		call.Response.Body = string(resp.Content)
+	} else {
+		call.Response.Base64Body = base64.StdEncoding.EncodeToString(resp.Content)
+	}
+	c.mu.Lock()
+	c.Calls = append(c.Calls, call)
+	c.mu.Unlock()
+	return nil
+}
+
+// send sends r to the network with c.opts.Transport.
+func (c *cassette) send(r *http.Request) (*fetchReply, error) {
+	res, err := c.opts.Transport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxFetchResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	return &fetchReply{res.StatusCode, res.Header, body}, nil
+}
+
+func (c *cassette) replay(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.URLFetchRequest), out.(*pb.URLFetchResponse)
+	want := cassetteRequestOf(req)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, call := range c.Calls {
+		if !c.used[i] && c.matches(&call.Request, &want) {
+			c.used[i] = true
+			return call.Response.fill(resp)
+		}
+	}
+	c.t.Errorf("%s: no recorded response for %s %s (body SHA-1 %s)",
+		c.path, want.Method, want.URL, want.BodyHash)
+	return fetchError(pb.URLFetchServiceError_FETCH_ERROR, "not in cassette "+c.path)
+}
+
+// matches compares parts of requests selected by c.opts.Match.
+func (c *cassette) matches(a, b *cassetteRequest) bool {
+	m := c.opts.Match
+	return (m&MatchMethod == 0 || a.Method == b.Method) &&
+		(m&MatchURL == 0 || a.URL == b.URL) &&
+		(m&MatchBody == 0 || a.BodyHash == b.BodyHash)
+}
+
+func (c *cassette) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path, append(b, '\n'), 0644)
+}
+
+func cassetteRequestOf(req *pb.URLFetchRequest) cassetteRequest {
+	r := cassetteRequest{Method: req.GetMethod().String(), URL: req.GetUrl()}
+	if len(req.Payload) > 0 {
+		h := sha1.New()
+		h.Write(req.Payload)
+		r.BodyHash = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return r
+}
+
+// fill copies the recorded response into resp.
+func (r *cassetteResponse) fill(resp *pb.URLFetchResponse) error {
+	body := []byte(r.Body)
+	if r.Base64Body != "" {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(r.Base64Body); err != nil {
+			return fetchError(pb.URLFetchServiceError_MALFORMED_REPLY, err.Error())
+		}
+	}
+	resp.Content = body
+	resp.StatusCode = proto.Int32(int32(r.StatusCode))
+	resp.Header = fetchResponseHeader(r.Header)
+	if r.Truncated {
+		resp.ContentWasTruncated = proto.Bool(true)
+	}
+	if r.FinalURL != "" {
+		resp.FinalUrl = proto.String(r.FinalURL)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "appengine_internal/urlfetch"
+)
+
+func TestUseCassette(t *testing.T) {
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/text", http.StatusFound)
+		case "/binary":
+			w.Write([]byte{0xff, 0})
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			return
+		default:
+			w.Header().Set("X-Path", r.URL.Path)
+			fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+		}
+		requests++
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "aegot-cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testdata", "test.cassette")
+
+	type result struct {
+		status   int32
+		content  string
+		finalURL string
+	}
+	run := func() []result {
+		var res []result
+		for _, u := range []string{"/text", "/redirect", "/binary"} {
+			resp, err := testFetch(c, pb.URLFetchRequest_POST, srv.URL+u, true, 0)
+			if err != nil {
+				t.Fatalf("%s: %v", u, err)
+			}
+			res = append(res, result{resp.GetStatusCode(), string(resp.Content), resp.GetFinalUrl()})
+		}
+		return res
+	}
+	want := []result{
+		{200, "POST /text", ""},
+		{200, "GET /text", srv.URL + "/text"},
+		{200, "\xff\x00", ""},
+	}
+
+	os.Setenv(RecordCassettesEnv, "1")
+	stop := UseCassette(t, path, nil)
+	recorded := run()
+	// redirects and deadlines are handled when recording too
+	_, err = testFetch(c, pb.URLFetchRequest_GET, srv.URL+"/slow", false, 0.05)
+	if code := fetchErrorCode(t, err); code != pb.URLFetchServiceError_DEADLINE_EXCEEDED {
+		t.Errorf("Expected DEADLINE_EXCEEDED while recording, got %v", err)
+	}
+	stop()
+	os.Setenv(RecordCassettesEnv, "")
+	if requests != 4 {
+		t.Errorf("Expected 4 requests sent while recording, got %d", requests)
+	}
+	for i := range want {
+		if recorded[i] != want[i] {
+			t.Errorf("Recorded call %d: expected %+v, got %+v", i, want[i], recorded[i])
+		}
+	}
+
+	stop = UseCassette(t, path, nil)
+	defer stop()
+	replayed := run()
+	if requests != 4 {
+		t.Errorf("Expected no requests sent while replaying, got %d", requests-4)
+	}
+	for i := range want {
+		if replayed[i] != want[i] {
+			t.Errorf("Replayed call %d: expected %+v, got %+v", i, want[i], replayed[i])
+		}
+	}
+}
+
+func TestCassetteMatch(t *testing.T) {
+	a := &cassetteRequest{"POST", "http://example.com/a", "123"}
+	tests := []struct {
+		match CassetteMatch
+		b     *cassetteRequest
+		want  bool
+	}{
+		{MatchMethod | MatchURL | MatchBody, &cassetteRequest{"POST", "http://example.com/a", "123"}, true},
+		{MatchMethod | MatchURL | MatchBody, &cassetteRequest{"POST", "http://example.com/a", "456"}, false},
+		{MatchMethod | MatchURL, &cassetteRequest{"POST", "http://example.com/a", "456"}, true},
+		{MatchMethod | MatchURL, &cassetteRequest{"PUT", "http://example.com/a", "123"}, false},
+		{MatchURL, &cassetteRequest{"PUT", "http://example.com/a", ""}, true},
+		{MatchURL, &cassetteRequest{"POST", "http://example.com/b", "123"}, false},
+	}
+	for _, tt := range tests {
+		c := &cassette{opts: CassetteOptions{Match: tt.match}}
+		if got := c.matches(a, tt.b); got != tt.want {
+			t.Errorf("Match %b of %v and %v: expected %v, got %v", tt.match, a, tt.b, tt.want, got)
+		}
+	}
+}
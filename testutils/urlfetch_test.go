@@ -0,0 +1,191 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+
+	aei "appengine_internal"
+	pb "appengine_internal/urlfetch"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// testFetch calls "urlfetch" service with a request for u.
+func testFetch(c appengine.Context, method pb.URLFetchRequest_RequestMethod, u string,
+	follow bool, deadline float64) (*pb.URLFetchResponse, error) {
+
+	req := &pb.URLFetchRequest{
+		Method:          method.Enum(),
+		Url:             proto.String(u),
+		Payload:         []byte("body"),
+		FollowRedirects: proto.Bool(follow),
+		Header: []*pb.URLFetchRequest_Header{
+			{Key: proto.String("X-Req"), Value: proto.String("v")},
+		},
+	}
+	if deadline > 0 {
+		req.Deadline = proto.Float64(deadline)
+	}
+	resp := &pb.URLFetchResponse{}
+	err := c.Call("urlfetch", "Fetch", req, resp, nil)
+	return resp, err
+}
+
+// fetchErrorCode returns urlfetch error code of err, or 0 if err is nil.
+func fetchErrorCode(t *testing.T, err error) pb.URLFetchServiceError_ErrorCode {
+	if err == nil {
+		return 0
+	}
+	apiErr, ok := err.(*aei.APIError)
+	if !ok || apiErr.Service != "urlfetch" {
+		t.Fatalf("Expected a urlfetch API error, got %#v", err)
+	}
+	return pb.URLFetchServiceError_ErrorCode(apiErr.Code)
+}
+
+func TestRouteURLFetch(t *testing.T) {
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Got", fmt.Sprintf("%s %s %s %s", r.Method, b, r.Header.Get("X-Req"), r.Host))
+		fmt.Fprint(w, "hi")
+	})
+	mux.HandleFunc("/found", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/hello", http.StatusFound)
+	})
+	mux.HandleFunc("/temporary", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/hello", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	unroute := RouteURLFetch("api.example.com", mux)
+	defer unroute()
+
+	const (
+		get  = pb.URLFetchRequest_GET
+		post = pb.URLFetchRequest_POST
+	)
+	tests := []struct {
+		method   pb.URLFetchRequest_RequestMethod
+		url      string
+		follow   bool
+		deadline float64
+		code     pb.URLFetchServiceError_ErrorCode
+		status   int32
+		got      string
+		finalURL string
+	}{
+		{post, "https://api.example.com:443/hello", false, 0,
+			0, 200, "POST body v api.example.com:443", ""},
+		{post, "http://api.example.com/found", false, 0,
+			0, 302, "", ""},
+		// 302 is followed with a GET without a payload
+		{post, "http://api.example.com/found", true, 0,
+			0, 200, "GET  v api.example.com", "http://api.example.com/hello"},
+		// 307 keeps the method and payload
+		{post, "http://api.example.com/temporary", true, 0,
+			0, 200, "POST body v api.example.com", "http://api.example.com/hello"},
+		{get, "http://api.example.com/loop", true, 0,
+			pb.URLFetchServiceError_TOO_MANY_REDIRECTS, 0, "", ""},
+		{get, "http://api.example.com/slow", false, 0.05,
+			pb.URLFetchServiceError_DEADLINE_EXCEEDED, 0, "", ""},
+		{get, "http://api.example.com/slow", false, 1,
+			0, 200, "", ""},
+		{get, "http://other.example.com/", false, 0,
+			pb.URLFetchServiceError_FETCH_ERROR, 0, "", ""},
+		{get, "ftp://api.example.com/", false, 0,
+			pb.URLFetchServiceError_INVALID_URL, 0, "", ""},
+	}
+	for _, tt := range tests {
+		resp, err := testFetch(c, tt.method, tt.url, tt.follow, tt.deadline)
+		if code := fetchErrorCode(t, err); code != tt.code {
+			t.Errorf("%s %s: expected error code %v, got %v", tt.method, tt.url, tt.code, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var got string
+		for _, h := range resp.Header {
+			if h.GetKey() == "X-Got" {
+				got = h.GetValue()
+			}
+		}
+		if resp.GetStatusCode() != tt.status || got != tt.got || resp.GetFinalUrl() != tt.finalURL {
+			t.Errorf("%s %s (follow: %v): expected %d %q %q, got %d %q %q", tt.method, tt.url, tt.follow,
+				tt.status, tt.got, tt.finalURL, resp.GetStatusCode(), got, resp.GetFinalUrl())
+		}
+	}
+}
+
+func TestURLFetchTruncatesContent(t *testing.T) {
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	big := strings.Repeat("x", maxFetchResponseSize+1)
+	unroute := RouteURLFetch("big.example.com", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, big)
+	}))
+	defer unroute()
+
+	resp, err := testFetch(c, pb.URLFetchRequest_GET, "http://big.example.com/", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Content) != maxFetchResponseSize || !resp.GetContentWasTruncated() {
+		t.Errorf("Expected content truncated to %d bytes, got %d bytes, truncated: %v",
+			maxFetchResponseSize, len(resp.Content), resp.GetContentWasTruncated())
+	}
+}
+
+func TestRouteURLFetchUnroute(t *testing.T) {
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+	handler := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		})
+	}
+	fetch := func(host string) string {
+		resp, err := testFetch(c, pb.URLFetchRequest_GET, "http://"+host+"/", false, 0)
+		if err != nil {
+			return err.Error()
+		}
+		return string(resp.Content)
+	}
+
+	unrouteFirst := RouteURLFetch("example.com", handler("first"))
+	unrouteSecond := RouteURLFetch("example.com", handler("second"))
+	unrouteOther := RouteURLFetch("example.org:8080", handler("other"))
+	if got := fetch("example.com:8080"); got != "second" {
+		t.Errorf("Expected the last route of a host to be used for any port, got %q", got)
+	}
+	// the first route has already been replaced: a no-op
+	unrouteFirst()
+	if got := fetch("example.com"); got != "second" {
+		t.Errorf("Expected the second route to stay, got %q", got)
+	}
+	unrouteSecond()
+	_, err := testFetch(c, pb.URLFetchRequest_GET, "http://example.com/", false, 0)
+	if fetchErrorCode(t, err) != pb.URLFetchServiceError_FETCH_ERROR {
+		t.Errorf("Expected FETCH_ERROR for a removed route, got %v", err)
+	}
+	if got := fetch("example.org:8080"); got != "other" {
+		t.Errorf("Expected route of example.org:8080, got %q", got)
+	}
+	unrouteOther()
+}
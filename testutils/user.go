@@ -0,0 +1,223 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	aei "appengine_internal"
+	pb "appengine_internal/user"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+const (
+	// defaultAuthDomain is the auth domain of Google Accounts users.
+	defaultAuthDomain = "gmail.com"
+	// maxRedirectURLLength is the longest destination URL of login
+	// and logout URLs.
+	maxRedirectURLLength = 2000
+	// userLoginPath is the dev_appserver login page.
+	userLoginPath = "/_ah/login"
+)
+
+// LoginAs makes r appear to come from a signed in Google Accounts user,
+// so that user.Current and user.IsAdmin called with a context of r report
+// the user. An empty email signs the user out.
+//
+// It only sets request headers App Engine uses for the purpose and can be
+// used with or without NewFakeUserService:
+//
+// 		r, deleteContext := NewTestRequest("GET", "/admin", nil)
+// 		defer deleteContext()
+// 		LoginAs(r, "admin@example.com", true)
+//
+func LoginAs(r *http.Request, email string, admin bool) {
+	headers := []string{
+		"X-AppEngine-User-Email",
+		"X-AppEngine-Auth-Domain",
+		"X-AppEngine-User-Id",
+		"X-AppEngine-User-Is-Admin",
+	}
+	for _, h := range headers {
+		r.Header.Del(h)
+	}
+	if email == "" {
+		return
+	}
+	r.Header.Set("X-AppEngine-User-Email", email)
+	r.Header.Set("X-AppEngine-Auth-Domain", defaultAuthDomain)
+	r.Header.Set("X-AppEngine-User-Id", userId(email))
+	if admin {
+		r.Header.Set("X-AppEngine-User-Is-Admin", "1")
+	} else {
+		r.Header.Set("X-AppEngine-User-Is-Admin", "0")
+	}
+}
+
+// userId returns a stable numeric user ID for email, the way dev_appserver
+// computes it.
+func userId(email string) string {
+	h := md5.New()
+	h.Write([]byte(email))
+	id := "1"
+	for _, b := range h.Sum(nil) {
+		id += fmt.Sprintf("%02d", b)
+	}
+	return id[:21]
+}
+
+// OAuthUser is a user authorized with an OAuth token, as reported by
+// user.CurrentOAuth and user.OAuthConsumerKey.
+type OAuthUser struct {
+	Email    string
+	Admin    bool
+	ClientID string
+	// Scopes the token grants. If empty, any scope is granted.
+	Scopes []string
+	// ConsumerKey of OAuth 1.0 requests.
+	ConsumerKey string
+}
+
+// FakeUserService is an implementation of "user" service. It creates
+// dev_appserver login and logout URLs and reports the OAuth user set with
+// WithOAuthUser.
+type FakeUserService struct {
+	mu        sync.Mutex
+	oauthUser *OAuthUser
+}
+
+// currentUserService is the user service created by the last
+// NewFakeUserService call and not unregistered yet; guarded by currentMu.
+var currentUserService *FakeUserService
+
+// NewFakeUserService creates a user service with no OAuth user, and
+// registers it as "user" service implementation.
+//
+// Returns the service and a function that unregisters it. Here's an example:
+//
+// 		func TestAPI(t *testing.T) {
+// 			_, unregister := NewFakeUserService()
+// 			defer unregister()
+// 			WithOAuthUser(&OAuthUser{
+// 				Email:  "joe@example.com",
+// 				Scopes: []string{"https://www.googleapis.com/auth/userinfo.email"},
+// 			})
+//
+// 			// test code that calls user.CurrentOAuth
+// 		}
+//
+func NewFakeUserService() (*FakeUserService, func()) {
+	fu := &FakeUserService{}
+	unregister := registerServiceOverrides("user", map[string]RpcStubFunc{
+		"CreateLoginURL":      fu.createLoginURL,
+		"CreateLogoutURL":     fu.createLogoutURL,
+		"GetOAuthUser":        fu.getOAuthUser,
+		"CheckOAuthSignature": fu.checkOAuthSignature,
+	})
+	currentMu.Lock()
+	currentUserService = fu
+	currentMu.Unlock()
+	return fu, func() {
+		unregister()
+		currentMu.Lock()
+		if currentUserService == fu {
+			currentUserService = nil
+		}
+		currentMu.Unlock()
+	}
+}
+
+// WithOAuthUser sets the user subsequent OAuth calls report, in the user
+// service created by NewFakeUserService. A nil u means requests carry no
+// OAuth credentials, so that the calls fail with OAUTH_INVALID_REQUEST.
+// It panics if there's no user service.
+func WithOAuthUser(u *OAuthUser) {
+	currentMu.Lock()
+	fu := currentUserService
+	currentMu.Unlock()
+	if fu == nil {
+		panic("WithOAuthUser: no user service, call NewFakeUserService first")
+	}
+	fu.mu.Lock()
+	defer fu.mu.Unlock()
+	fu.oauthUser = u
+}
+
+func (fu *FakeUserService) createLoginURL(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.CreateLoginURLRequest), out.(*pb.CreateLoginURLResponse)
+	dest := req.GetDestinationUrl()
+	if len(dest) > maxRedirectURLLength {
+		return userError(pb.UserServiceError_REDIRECT_URL_TOO_LONG)
+	}
+	resp.LoginUrl = proto.String(userLoginPath + "?continue=" + url.QueryEscape(dest))
+	return nil
+}
+
+func (fu *FakeUserService) createLogoutURL(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.CreateLogoutURLRequest), out.(*pb.CreateLogoutURLResponse)
+	dest := req.GetDestinationUrl()
+	if len(dest) > maxRedirectURLLength {
+		return userError(pb.UserServiceError_REDIRECT_URL_TOO_LONG)
+	}
+	resp.LogoutUrl = proto.String(userLoginPath + "?continue=" + url.QueryEscape(dest) + "&action=Logout")
+	return nil
+}
+
+func (fu *FakeUserService) getOAuthUser(in, out proto.Message, _ *RpcCallOptions) error {
+	req, resp := in.(*pb.GetOAuthUserRequest), out.(*pb.GetOAuthUserResponse)
+	fu.mu.Lock()
+	defer fu.mu.Unlock()
+	u := fu.oauthUser
+	if u == nil {
+		return userError(pb.UserServiceError_OAUTH_INVALID_REQUEST)
+	}
+	scopes := req.GetScopes()
+	if req.Scope != nil {
+		scopes = append(scopes, req.GetScope())
+	}
+	for _, s := range scopes {
+		if !u.hasScope(s) {
+			return userError(pb.UserServiceError_OAUTH_INVALID_TOKEN)
+		}
+	}
+	resp.Email = proto.String(u.Email)
+	resp.UserId = proto.String(userId(u.Email))
+	resp.AuthDomain = proto.String(defaultAuthDomain)
+	resp.IsAdmin = proto.Bool(u.Admin)
+	resp.ClientId = proto.String(u.ClientID)
+	resp.Scopes = scopes
+	return nil
+}
+
+func (fu *FakeUserService) checkOAuthSignature(in, out proto.Message, _ *RpcCallOptions) error {
+	resp := out.(*pb.CheckOAuthSignatureResponse)
+	fu.mu.Lock()
+	defer fu.mu.Unlock()
+	if fu.oauthUser == nil || fu.oauthUser.ConsumerKey == "" {
+		return userError(pb.UserServiceError_OAUTH_INVALID_REQUEST)
+	}
+	resp.OauthConsumerKey = proto.String(fu.oauthUser.ConsumerKey)
+	return nil
+}
+
+func (u *OAuthUser) hasScope(scope string) bool {
+	if len(u.Scopes) == 0 {
+		return true
+	}
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// userError creates an API error with the given code.
+func userError(code pb.UserServiceError_ErrorCode) error {
+	return &aei.APIError{Service: "user", Code: int32(code)}
+}
@@ -0,0 +1,165 @@
+// Used only for testing:
+// +build !appengine
+
+package testutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"appengine"
+	"appengine/user"
+
+	aei "appengine_internal"
+	pb "appengine_internal/user"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// userErrorCode returns user service error code of err, or OK if err is nil.
+func userErrorCode(t *testing.T, err error) pb.UserServiceError_ErrorCode {
+	if err == nil {
+		return pb.UserServiceError_OK
+	}
+	apiErr, ok := err.(*aei.APIError)
+	if !ok || apiErr.Service != "user" {
+		t.Fatalf("Expected a user API error, got %#v", err)
+	}
+	return pb.UserServiceError_ErrorCode(apiErr.Code)
+}
+
+func TestLoginAs(t *testing.T) {
+	_, unregister := NewFakeUserService()
+	defer unregister()
+	r, deleteContext := NewTestRequest("GET", "/", nil)
+	defer deleteContext()
+	c := appengine.NewContext(r)
+
+	if u := user.Current(c); u != nil || user.IsAdmin(c) {
+		t.Errorf("Expected no user before LoginAs, got %v", u)
+	}
+	LoginAs(r, "joe@example.com", true)
+	u := user.Current(c)
+	if u == nil {
+		t.Fatal("Expected a user after LoginAs")
+	}
+	if u.Email != "joe@example.com" || u.AuthDomain != defaultAuthDomain || !u.Admin || len(u.ID) != 21 ||
+		!user.IsAdmin(c) {
+		t.Errorf("Expected admin joe@example.com, got %+v", u)
+	}
+	id := u.ID
+	LoginAs(r, "joe@example.com", false)
+	if u := user.Current(c); u == nil || u.ID != id || u.Admin || user.IsAdmin(c) {
+		t.Errorf("Expected the same user ID, not an admin, got %+v", u)
+	}
+	if userId("ann@example.com") == id {
+		t.Errorf("Expected different IDs of different users, got %s", id)
+	}
+
+	login, err := user.LoginURL(c, "/after")
+	if want := "/_ah/login?continue=%2Fafter"; login != want || err != nil {
+		t.Errorf("Expected login URL %s, got %s (%v)", want, login, err)
+	}
+	logout, err := user.LogoutURL(c, "/")
+	if want := "/_ah/login?continue=%2F&action=Logout"; logout != want || err != nil {
+		t.Errorf("Expected logout URL %s, got %s (%v)", want, logout, err)
+	}
+
+	LoginAs(r, "", false)
+	if u := user.Current(c); u != nil || user.IsAdmin(c) {
+		t.Errorf("Expected no user after signing out, got %+v", u)
+	}
+}
+
+func TestUserService(t *testing.T) {
+	_, unregister := NewFakeUserService()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	login := &pb.CreateLoginURLResponse{}
+	if err := c.Call("user", "CreateLoginURL", &pb.CreateLoginURLRequest{
+		DestinationUrl: proto.String("/after?x=1"),
+	}, login, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/_ah/login?continue=%2Fafter%3Fx%3D1"; login.GetLoginUrl() != want {
+		t.Errorf("Expected login URL %s, got %s", want, login.GetLoginUrl())
+	}
+	logout := &pb.CreateLogoutURLResponse{}
+	if err := c.Call("user", "CreateLogoutURL", &pb.CreateLogoutURLRequest{
+		DestinationUrl: proto.String("/"),
+	}, logout, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/_ah/login?continue=%2F&action=Logout"; logout.GetLogoutUrl() != want {
+		t.Errorf("Expected logout URL %s, got %s", want, logout.GetLogoutUrl())
+	}
+	err := c.Call("user", "CreateLoginURL", &pb.CreateLoginURLRequest{
+		DestinationUrl: proto.String("/" + strings.Repeat("x", maxRedirectURLLength)),
+	}, &pb.CreateLoginURLResponse{}, nil)
+	if code := userErrorCode(t, err); code != pb.UserServiceError_REDIRECT_URL_TOO_LONG {
+		t.Errorf("Expected REDIRECT_URL_TOO_LONG, got %v", err)
+	}
+}
+
+func TestOAuthUser(t *testing.T) {
+	_, unregister := NewFakeUserService()
+	defer unregister()
+	c, deleteContext := newTestContext(t)
+	defer deleteContext()
+
+	getUser := func(scopes ...string) (*pb.GetOAuthUserResponse, pb.UserServiceError_ErrorCode) {
+		req := &pb.GetOAuthUserRequest{}
+		if len(scopes) > 0 {
+			req.Scope = proto.String(scopes[0])
+			req.Scopes = scopes[1:]
+		}
+		resp := &pb.GetOAuthUserResponse{}
+		return resp, userErrorCode(t, c.Call("user", "GetOAuthUser", req, resp, nil))
+	}
+	consumerKey := func() (string, pb.UserServiceError_ErrorCode) {
+		resp := &pb.CheckOAuthSignatureResponse{}
+		err := c.Call("user", "CheckOAuthSignature", &pb.CheckOAuthSignatureRequest{}, resp, nil)
+		return resp.GetOauthConsumerKey(), userErrorCode(t, err)
+	}
+
+	if _, code := getUser("s1"); code != pb.UserServiceError_OAUTH_INVALID_REQUEST {
+		t.Errorf("Expected OAUTH_INVALID_REQUEST without a user, got %v", code)
+	}
+	WithOAuthUser(&OAuthUser{Email: "a@example.com", Admin: true, ClientID: "cid", Scopes: []string{"s1", "s2"}})
+	resp, code := getUser("s2", "s1")
+	if code != pb.UserServiceError_OK {
+		t.Fatalf("Expected the OAuth user, got %v", code)
+	}
+	want := &pb.GetOAuthUserResponse{
+		Email:      proto.String("a@example.com"),
+		UserId:     proto.String(userId("a@example.com")),
+		AuthDomain: proto.String(defaultAuthDomain),
+		IsAdmin:    proto.Bool(true),
+		ClientId:   proto.String("cid"),
+		Scopes:     []string{"s1", "s2"},
+	}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("Expected %v, got %v", want, resp)
+	}
+	if _, code := getUser("s1", "s3"); code != pb.UserServiceError_OAUTH_INVALID_TOKEN {
+		t.Errorf("Expected OAUTH_INVALID_TOKEN for a scope not granted, got %v", code)
+	}
+	if _, code := consumerKey(); code != pb.UserServiceError_OAUTH_INVALID_REQUEST {
+		t.Errorf("Expected OAUTH_INVALID_REQUEST without a consumer key, got %v", code)
+	}
+
+	// any scope is granted if there are none
+	WithOAuthUser(&OAuthUser{Email: "b@example.com", ConsumerKey: "example.com"})
+	if resp, code := getUser("anything"); code != pb.UserServiceError_OK || resp.GetEmail() != "b@example.com" {
+		t.Errorf("Expected b@example.com, got %v %v", resp, code)
+	}
+	if key, code := consumerKey(); key != "example.com" || code != pb.UserServiceError_OK {
+		t.Errorf("Expected consumer key example.com, got %q %v", key, code)
+	}
+	WithOAuthUser(nil)
+	if _, code := getUser(); code != pb.UserServiceError_OAUTH_INVALID_REQUEST {
+		t.Errorf("Expected OAUTH_INVALID_REQUEST after the user is removed, got %v", code)
+	}
+}
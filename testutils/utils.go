@@ -10,8 +10,10 @@ package testutils
 
 import (
 	"bytes"
+	"flag"
 	"io"
 	"net/http"
+	"os"
 	"time"
 
 	"appengine"
@@ -41,6 +43,42 @@ func DeleteTestContext(r *http.Request) {
 	aei.DeleteContext(r)
 }
 
+// appID returns the application ID, as appengine.AppID reports it to the
+// app, e.g. "test" for the default "s~test".
+func appID() string {
+	c, done := newServiceContext()
+	defer done()
+	return appengine.AppID(c)
+}
+
+// fullAppID returns the application ID with partition, e.g. "s~test".
+func fullAppID() string {
+	c, done := newServiceContext()
+	defer done()
+	return c.FullyQualifiedAppID()
+}
+
+// flagOrEnv reports whether environment variable env is set to a non-empty
+// value, or a boolean flag name, defined by the test package, is set to true.
+// The package doesn't define flags itself so that they don't collide with
+// flags of other packages.
+func flagOrEnv(name, env string) bool {
+	if os.Getenv(env) != "" {
+		return true
+	}
+	f := flag.Lookup(name)
+	return f != nil && f.Value.String() == "true"
+}
+
+// newServiceContext creates a context fakes use to call other services
+// outside of app requests. The returned function deletes the context.
+func newServiceContext() (appengine.Context, func()) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	return CreateTestContext(r), func() {
+		DeleteTestContext(r)
+	}
+}
+
 // NewTestRequest creates http.Request and appengine.Context associated with
 // the request. It panics if the request cannot be created.
 // 
@@ -107,3 +145,16 @@ func RegisterAPIOverride(service, method string, f RpcStubFunc) func() {
 func UnregisterAPIOverride(service, method string) {
 	aei.UnregisterAPIOverride(service, method)
 }
+
+// registerServiceOverrides registers a stub for every method in methods
+// and returns a function that unregisters all of them at once.
+func registerServiceOverrides(service string, methods map[string]RpcStubFunc) func() {
+	for m, f := range methods {
+		RegisterAPIOverride(service, m, f)
+	}
+	return func() {
+		for m := range methods {
+			UnregisterAPIOverride(service, m)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+// Package yaml parses the subset of YAML found in App Engine config files
+// and aegot test fixtures: block mappings and sequences, flow collections on
+// a single line, literal (|) block scalars, quoted and plain scalars.
+// It's shared by testutils and indexyaml packages.
+package yaml
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a non-empty line of YAML document, stripped of comments.
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// parser is the state of a document being parsed.
+type parser struct {
+	lines []*yamlLine
+	pos   int
+	// raw lines, needed by block scalars which keep comment-like text
+	raw []string
+}
+
+// Parse parses a YAML document read from r. Mappings are decoded as
+// map[string]interface{}, sequences as []interface{}, and scalars as nil,
+// bool, int64, float64 or string.
+func Parse(r io.Reader) (interface{}, error) {
+	p := &parser{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		raw := strings.Replace(scanner.Text(), "\t", "    ", -1)
+		p.raw = append(p.raw, raw)
+		text := strings.TrimRight(stripComment(raw), " ")
+		if t := strings.TrimSpace(text); t == "" || t == "---" {
+			continue
+		}
+		trimmed := strings.TrimLeft(text, " ")
+		p.lines = append(p.lines, &yamlLine{
+			num:    n,
+			indent: len(text) - len(trimmed),
+			text:   trimmed,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.parseNode(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return v, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	n := 0
+	if p.pos < len(p.lines) {
+		n = p.lines[p.pos].num
+	} else if len(p.lines) > 0 {
+		n = p.lines[len(p.lines)-1].num
+	}
+	return fmt.Errorf("yaml: line %d: %s", n, fmt.Sprintf(format, args...))
+}
+
+// parseNode parses a block node starting at the current line.
+func (p *parser) parseNode(indent int) (interface{}, error) {
+	line := p.lines[p.pos]
+	switch {
+	case isSeqItem(line.text):
+		return p.parseSeq(line.indent)
+	case keyEnd(line.text) >= 0:
+		return p.parseMap(line.indent)
+	}
+	p.pos++
+	return parseFlow(line.text)
+}
+
+func (p *parser) parseSeq(indent int) (interface{}, error) {
+	var seq []interface{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent || line.indent == indent && !isSeqItem(line.text) {
+			// a sequence nested at the same indentation as its key
+			// ends with the next key
+			break
+		}
+		if line.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		item := strings.TrimLeft(line.text[1:], " ")
+		if item == "" {
+			p.pos++
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				v, err := p.parseNode(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, v)
+			} else {
+				seq = append(seq, nil)
+			}
+			continue
+		}
+		// The item is parsed as if it started on a line of its own,
+		// indented to where its content begins.
+		line.indent += len(line.text) - len(item)
+		line.text = item
+		v, err := p.parseNode(line.indent)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+func (p *parser) parseMap(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		i := keyEnd(line.text)
+		if line.indent > indent || i < 0 || isSeqItem(line.text) {
+			return nil, p.errorf("unexpected indentation")
+		}
+		key, err := parseFlow(line.text[:i])
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		k := fmt.Sprint(key)
+		if _, dup := m[k]; dup {
+			return nil, p.errorf("duplicate key %q", k)
+		}
+		rest := strings.TrimSpace(line.text[i+1:])
+		p.pos++
+
+		switch {
+		case rest == "|" || rest == "|-":
+			m[k] = p.parseBlockScalar(indent, rest == "|-")
+		case rest != "":
+			if m[k], err = parseFlow(rest); err != nil {
+				p.pos--
+				return nil, p.errorf("%v", err)
+			}
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			if m[k], err = p.parseNode(p.lines[p.pos].indent); err != nil {
+				return nil, err
+			}
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent &&
+			isSeqItem(p.lines[p.pos].text):
+			// sequences are allowed at the same indentation as their key
+			if m[k], err = p.parseSeq(indent); err != nil {
+				return nil, err
+			}
+		default:
+			m[k] = nil
+		}
+	}
+	return m, nil
+}
+
+// parseBlockScalar returns literal text of the lines indented deeper than
+// indent, following the current one.
+func (p *parser) parseBlockScalar(indent int, chomp bool) string {
+	start := p.lines[p.pos-1].num // 1-based, so it is the index of the next raw line
+	end := len(p.raw)
+	for p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		p.pos++
+	}
+	if p.pos < len(p.lines) {
+		end = p.lines[p.pos].num - 1
+	}
+	lines := p.raw[start:end]
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	strip := -1
+	for _, l := range lines {
+		if t := strings.TrimLeft(l, " "); t != "" && (strip < 0 || len(l)-len(t) < strip) {
+			strip = len(l) - len(t)
+		}
+	}
+	for i, l := range lines {
+		if len(l) >= strip {
+			lines[i] = l[strip:]
+		} else {
+			lines[i] = ""
+		}
+	}
+	s := strings.Join(lines, "\n")
+	if !chomp {
+		s += "\n"
+	}
+	return s
+}
+
+// isSeqItem reports whether text starts a block sequence item.
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// keyEnd returns index of the colon ending a mapping key in text,
+// or -1 if text isn't a "key: value" pair.
+func keyEnd(text string) int {
+	if text == "" || strings.IndexByte("[{", text[0]) >= 0 {
+		return -1
+	}
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 {
+				quote = c
+			}
+		case c == ':':
+			if i+1 == len(text) || text[i+1] == ' ' {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// stripComment removes a trailing comment from line.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.IndexByte(" [{,:", line[i-1]) >= 0 {
+				quote = c
+			}
+		case c == '#':
+			if i == 0 || line[i-1] == ' ' {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// parseFlow parses a scalar or a flow collection, e.g. [a, {b: c}].
+func parseFlow(s string) (interface{}, error) {
+	f := &flow{s: strings.TrimSpace(s)}
+	v, err := f.value()
+	if err != nil {
+		return nil, err
+	}
+	if f.skipSpace(); f.pos < len(f.s) {
+		return nil, fmt.Errorf("unexpected %q", f.s[f.pos:])
+	}
+	return v, nil
+}
+
+type flow struct {
+	s   string
+	pos int
+	// nesting level of flow collections; plain scalars inside
+	// a collection end at ",", "]" and "}"
+	depth int
+}
+
+func (f *flow) skipSpace() {
+	for f.pos < len(f.s) && f.s[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *flow) value() (interface{}, error) {
+	f.skipSpace()
+	if f.pos == len(f.s) {
+		return nil, nil
+	}
+	switch f.s[f.pos] {
+	case '[':
+		return f.seq()
+	case '{':
+		return f.mapping()
+	case '"', '\'':
+		return f.quoted()
+	}
+	return f.plain(), nil
+}
+
+func (f *flow) seq() (interface{}, error) {
+	f.pos++
+	f.depth++
+	seq := []interface{}{}
+	for {
+		f.skipSpace()
+		if f.pos < len(f.s) && f.s[f.pos] == ']' {
+			f.pos++
+			f.depth--
+			return seq, nil
+		}
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+		if err := f.separator(']'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (f *flow) mapping() (interface{}, error) {
+	f.pos++
+	f.depth++
+	m := make(map[string]interface{})
+	for {
+		f.skipSpace()
+		if f.pos < len(f.s) && f.s[f.pos] == '}' {
+			f.pos++
+			f.depth--
+			return m, nil
+		}
+		key, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		if f.skipSpace(); f.pos == len(f.s) || f.s[f.pos] != ':' {
+			return nil, fmt.Errorf("expected ':' after %v", key)
+		}
+		f.pos++
+		if m[fmt.Sprint(key)], err = f.value(); err != nil {
+			return nil, err
+		}
+		if err := f.separator('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// separator consumes "," between collection items, leaving the closing
+// bracket in place.
+func (f *flow) separator(end byte) error {
+	f.skipSpace()
+	switch {
+	case f.pos == len(f.s):
+		return fmt.Errorf("missing %q", end)
+	case f.s[f.pos] == ',':
+		f.pos++
+	case f.s[f.pos] != end:
+		return fmt.Errorf("unexpected %q", f.s[f.pos:])
+	}
+	return nil
+}
+
+func (f *flow) quoted() (interface{}, error) {
+	q := f.s[f.pos]
+	for i := f.pos + 1; i < len(f.s); i++ {
+		switch {
+		case q == '"' && f.s[i] == '\\':
+			i++
+		case q == '\'' && f.s[i] == '\'' && i+1 < len(f.s) && f.s[i+1] == '\'':
+			i++
+		case f.s[i] == q:
+			lit := f.s[f.pos : i+1]
+			f.pos = i + 1
+			if q == '\'' {
+				return strings.Replace(lit[1:len(lit)-1], "''", "'", -1), nil
+			}
+			return strconv.Unquote(lit)
+		}
+	}
+	return nil, fmt.Errorf("unterminated string %s", f.s[f.pos:])
+}
+
+func (f *flow) plain() interface{} {
+	start := f.pos
+	for ; f.pos < len(f.s); f.pos++ {
+		c := f.s[f.pos]
+		if f.depth > 0 && (c == ',' || c == ']' || c == '}') {
+			break
+		}
+		if c == ':' && f.depth > 0 && (f.pos+1 == len(f.s) || f.s[f.pos+1] == ' ') {
+			break
+		}
+	}
+	return Scalar(strings.TrimSpace(f.s[start:f.pos]))
+}
+
+// Scalar converts a plain scalar to its typed value, e.g. "yes" to true.
+func Scalar(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE", "yes", "Yes", "YES", "on", "On", "ON":
+		return true
+	case "false", "False", "FALSE", "no", "No", "NO", "off", "Off", "OFF":
+		return false
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if strings.IndexAny(s, "0123456789") >= 0 {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
@@ -0,0 +1,202 @@
+package yaml
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type ymap map[string]interface{}
+type yseq []interface{}
+
+// ydoc joins lines of a YAML document.
+func ydoc(lines ...string) string {
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want interface{}
+	}{
+		{"empty", "# nothing here\n\n", nil},
+		{"scalar", "hello world\n", "hello world"},
+		{"block map", ydoc(
+			"application: test",
+			"version: 1",
+			"threadsafe: true",
+		), ymap{"application": "test", "version": int64(1), "threadsafe": true}},
+		{"block seq", ydoc(
+			"- a",
+			"- 2",
+			"-",
+			"- 1.5",
+		), yseq{"a", int64(2), nil, 1.5}},
+		{"seq at key indentation", ydoc(
+			"handlers:",
+			"- url: /.*",
+			"  script: _go_app",
+			"- url: /static",
+			"  static_dir: static",
+			"api_version: go1",
+		), ymap{
+			"handlers": yseq{
+				ymap{"url": "/.*", "script": "_go_app"},
+				ymap{"url": "/static", "static_dir": "static"},
+			},
+			"api_version": "go1",
+		}},
+		{"nested indentation", ydoc(
+			"queue:",
+			"  - name: default",
+			"    retry_parameters:",
+			"      task_retry_limit: 3",
+			"      min_backoff_seconds: 0.5",
+			"  - name: mail",
+			"    rate: 5/s",
+		), ymap{"queue": yseq{
+			ymap{"name": "default", "retry_parameters": ymap{
+				"task_retry_limit": int64(3), "min_backoff_seconds": 0.5}},
+			ymap{"name": "mail", "rate": "5/s"},
+		}}},
+		{"seq of seqs", ydoc(
+			"-",
+			"  - a",
+			"  - b",
+			"- - c",
+		), yseq{yseq{"a", "b"}, yseq{"c"}}},
+		{"flow collections", ydoc(
+			`tags: [a, "b, c", 3, []]`,
+			`point: {x: 1, y: -2.5, name: 'it''s'}`,
+			`nested: [{a: [1, 2]}, {}]`,
+		), ymap{
+			"tags":   yseq{"a", "b, c", int64(3), yseq{}},
+			"point":  ymap{"x": int64(1), "y": -2.5, "name": "it's"},
+			"nested": yseq{ymap{"a": yseq{int64(1), int64(2)}}, ymap{}},
+		}},
+		{"quoted and plain scalars", ydoc(
+			`a: "yes"`,
+			`b: yes`,
+			`c: "tab\there"`,
+			`d: '#not a comment'`,
+			`e: ~`,
+			`f:`,
+			`g: 12abc`,
+			`h: http://example.org/path`,
+			`"quoted key": 1`,
+			`i: 007`,
+		), ymap{
+			"a": "yes", "b": true, "c": "tab\there", "d": "#not a comment",
+			"e": nil, "f": nil, "g": "12abc", "h": "http://example.org/path",
+			"quoted key": int64(1), "i": int64(7),
+		}},
+		{"comments", ydoc(
+			"# header",
+			"---",
+			"a: 1 # trailing",
+			"  # indented comment",
+			"b: c#d",
+			`c: "x # y"`,
+		), ymap{"a": int64(1), "b": "c#d", "c": "x # y"}},
+		{"block scalars", ydoc(
+			"keep: |",
+			"  line one",
+			"    indented # kept",
+			"",
+			"  line three",
+			"strip: |-",
+			"  only",
+			"empty: |",
+			"last: x",
+		), ymap{
+			"keep":  "line one\n  indented # kept\n\nline three\n",
+			"strip": "only",
+			"empty": "",
+			"last":  "x",
+		}},
+		{"block scalar at the end", ydoc(
+			"- text: |",
+			"    a",
+			"    b",
+			"",
+		), yseq{ymap{"text": "a\nb\n"}}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(strings.NewReader(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if want := yamlPlain(tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %#v, got %#v", tt.name, want, got)
+		}
+	}
+}
+
+// yamlPlain converts ymap and yseq values to types Parse returns.
+func yamlPlain(v interface{}) interface{} {
+	switch v := v.(type) {
+	case ymap:
+		m := make(map[string]interface{})
+		for k, e := range v {
+			m[k] = yamlPlain(e)
+		}
+		return m
+	case yseq:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = yamlPlain(e)
+		}
+		return s
+	}
+	return v
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"over-indented key", ydoc(
+			"a: 1",
+			"b: 2",
+			"   c: 3",
+		), "line 3: unexpected indentation"},
+		{"item in a map", ydoc(
+			"a: 1",
+			"# comment",
+			"- b",
+		), "line 3: unexpected indentation"},
+		{"over-indented item", ydoc(
+			"- a",
+			"  - b",
+		), "line 2: unexpected indentation"},
+		{"duplicate key", ydoc(
+			"a: 1",
+			"b: 2",
+			"a: 3",
+		), `line 3: duplicate key "a"`},
+		{"unterminated flow seq", ydoc(
+			"a: 1",
+			"b: [1, 2",
+		), `line 2: missing ']'`},
+		{"unterminated string", ydoc(
+			`a: "abc`,
+		), "line 1: unterminated string"},
+		{"missing colon in flow map", ydoc(
+			"",
+			"a: {b}",
+		), "line 2: expected ':'"},
+		{"trailing text", ydoc(
+			`a: "b" c`,
+		), `line 1: unexpected "c"`},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.in))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}